@@ -0,0 +1,186 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// payloadAdapter reads the documents of one RackHD API version into the
+// driver's own types, so differences between the versions stay out of the
+// create, state and remove logic.
+type payloadAdapter interface {
+	node(payload interface{}) (*nodeInfo, error)
+	nodeStatus(payload interface{}) (*nodeStatus, error)
+	workflow(payload interface{}) (*workflowInstance, error)
+	lookup(record json.RawMessage) (*lookupEntry, error)
+	catalogData(payload interface{}) (interface{}, error)
+	obmCount(payload interface{}) (int, error)
+	obmSettings(payload interface{}) ([]obmSetting, error)
+	pollerIDs(payload interface{}) ([]string, error)
+	pollers(payload interface{}) ([]pollerInfo, error)
+	skuName(payload interface{}) (string, error)
+	skuDefaults(payload interface{}) (*skuDefaults, error)
+	templateContents(payload interface{}) (string, error)
+}
+
+// VersionedClient is implemented by RackHD clients for an API version other
+// than 1.1. APIVersion returns the version, e.g. "2.0".
+type VersionedClient interface {
+	APIVersion() string
+}
+
+// adapter returns the payload adapter for the API version of the client.
+func (d *Driver) adapter() payloadAdapter {
+	if client, ok := d.getClient().(VersionedClient); ok && client.APIVersion() == "2.0" {
+		return adapter20{}
+	}
+	return adapter11{}
+}
+
+// adapter11 reads 1.1 documents.
+type adapter11 struct{}
+
+func (adapter11) node(payload interface{}) (*nodeInfo, error) {
+	node := &nodeInfo{}
+	if err := decodePayload(payload, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (adapter11) nodeStatus(payload interface{}) (*nodeStatus, error) {
+	status := &nodeStatus{}
+	if err := decodePayload(payload, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (adapter11) workflow(payload interface{}) (*workflowInstance, error) {
+	wf := &workflowInstance{}
+	if err := decodePayload(payload, wf); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+func (adapter11) lookup(record json.RawMessage) (*lookupEntry, error) {
+	entry := &lookupEntry{}
+	if err := json.Unmarshal(record, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (adapter11) catalogData(payload interface{}) (interface{}, error) {
+	var catalog struct {
+		Data interface{} `json:"data"`
+	}
+	if err := decodePayload(payload, &catalog); err != nil {
+		return nil, err
+	}
+	return catalog.Data, nil
+}
+
+func (adapter11) obmCount(payload interface{}) (int, error) {
+	var obms []interface{}
+	if err := decodePayload(payload, &obms); err != nil {
+		return 0, err
+	}
+	return len(obms), nil
+}
+
+func (adapter11) obmSettings(payload interface{}) ([]obmSetting, error) {
+	var obms []obmSetting
+	if err := decodePayload(payload, &obms); err != nil {
+		return nil, err
+	}
+	return obms, nil
+}
+
+func (a adapter11) pollerIDs(payload interface{}) ([]string, error) {
+	list, err := a.pollers(payload)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(list))
+	for _, poller := range list {
+		ids = append(ids, poller.ID)
+	}
+	return ids, nil
+}
+
+func (adapter11) pollers(payload interface{}) ([]pollerInfo, error) {
+	var list []pollerInfo
+	if err := decodePayload(payload, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (adapter11) skuName(payload interface{}) (string, error) {
+	var sku struct {
+		Name string `json:"name"`
+	}
+	if err := decodePayload(payload, &sku); err != nil {
+		return "", err
+	}
+	return sku.Name, nil
+}
+
+func (adapter11) skuDefaults(payload interface{}) (*skuDefaults, error) {
+	var sku struct {
+		Config struct {
+			Defaults *skuDefaults `json:"docker-machine"`
+		} `json:"skuConfig"`
+	}
+	if err := decodePayload(payload, &sku); err != nil {
+		return nil, err
+	}
+	return sku.Config.Defaults, nil
+}
+
+// templateContents reads a template of the library, returned as a document
+// with its contents or, by some releases, as the text itself.
+func (adapter11) templateContents(payload interface{}) (string, error) {
+	if text, ok := payload.(string); ok {
+		return text, nil
+	}
+	var template struct {
+		Contents string `json:"contents"`
+	}
+	if err := decodePayload(payload, &template); err != nil {
+		return "", err
+	}
+	return template.Contents, nil
+}
+
+// adapter20 reads 2.0 documents. They differ from 1.1 in that relations,
+// like the SKU of a node, are links such as /api/2.0/skus/<id>, and graph
+// instances carry their state in status rather than _status.
+type adapter20 struct {
+	adapter11
+}
+
+func (a adapter20) node(payload interface{}) (*nodeInfo, error) {
+	node, err := a.adapter11.node(payload)
+	if err != nil {
+		return nil, err
+	}
+	node.SKU = node.SKU[strings.LastIndex(node.SKU, "/")+1:]
+	return node, nil
+}
+
+func (a adapter20) workflow(payload interface{}) (*workflowInstance, error) {
+	var wf struct {
+		workflowInstance
+		State string `json:"status"`
+	}
+	if err := decodePayload(payload, &wf); err != nil {
+		return nil, err
+	}
+	if wf.Status == "" {
+		wf.Status = wf.State
+	}
+	return &wf.workflowInstance, nil
+}
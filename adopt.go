@@ -0,0 +1,29 @@
+package rackhd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkAdoptable refuses to adopt a node that RackHD is still working on or
+// that another machine already uses.
+func (d *Driver) checkAdoptable() error {
+	active, err := d.activeWorkflow()
+	if err != nil {
+		return err
+	}
+	if active != nil {
+		return fmt.Errorf("Node %s is running workflow %s (%s) and cannot be adopted until it finishes", d.NodeID, active.Name, active.InstanceID)
+	}
+
+	node, err := d.getNode()
+	if err != nil {
+		return err
+	}
+	for _, tag := range node.Tags {
+		if strings.HasPrefix(tag, machineTagPrefix) && tag != machineTagPrefix+d.MachineName {
+			return fmt.Errorf("Node %s is already used by machine %s", d.NodeID, strings.TrimPrefix(tag, machineTagPrefix))
+		}
+	}
+	return nil
+}
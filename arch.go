@@ -0,0 +1,58 @@
+package rackhd
+
+import (
+	"strings"
+)
+
+// Placeholders expanded in the workflow name and options, so one command line
+// serves nodes of every architecture, e.g. a repo URL ending in /${arch}/.
+const (
+	archPlaceholder   = "${arch}"
+	goarchPlaceholder = "${goarch}"
+)
+
+// goarchNames maps kernel machine names to the architecture names Docker
+// images and packages use.
+var goarchNames = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armv7l":  "arm",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// detectArch reads the node's CPU architecture from the ohai catalog and
+// expands the architecture placeholders of the workflow settings. Nodes
+// without an ohai catalog are assumed to be x86_64.
+func (d *Driver) detectArch() {
+	var ohai struct {
+		Kernel struct {
+			Machine string `json:"machine"`
+		} `json:"kernel"`
+	}
+	if err := d.getCatalog("ohai", &ohai); err != nil || ohai.Kernel.Machine == "" {
+		log.Debugf("Unable to read the architecture of node %s, assuming x86_64: %v", d.NodeID, err)
+		d.Arch = "x86_64"
+	} else {
+		d.Arch = ohai.Kernel.Machine
+	}
+	if d.Arch != "x86_64" {
+		log.Infof("Node %s is a %s host; make sure the OS workflow and --engine-install-url support it", d.NodeID, d.Arch)
+	}
+
+	d.WorkflowName = d.expandArch(d.WorkflowName)
+	d.WorkflowOptions = d.expandArch(d.WorkflowOptions)
+}
+
+func (d *Driver) expandArch(s string) string {
+	s = strings.Replace(s, archPlaceholder, d.Arch, -1)
+	return strings.Replace(s, goarchPlaceholder, d.goarch(), -1)
+}
+
+// goarch is the Docker name of the node's architecture.
+func (d *Driver) goarch() string {
+	if name, ok := goarchNames[d.Arch]; ok {
+		return name
+	}
+	return d.Arch
+}
@@ -0,0 +1,86 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const auditLogFile = "audit.log"
+
+// auditEntry is one line of the API audit log.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Machine    string    `json:"machine"`
+	User       string    `json:"user"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status,omitempty"`
+	DurationMS int64     `json:"durationMs"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// auditTransport appends a record of every RackHD API request to the
+// machine's audit log, so shared environments can tell who did what to a node.
+type auditTransport struct {
+	next   http.RoundTripper
+	driver *Driver
+	mu     sync.Mutex
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	entry := auditEntry{
+		Time:       start.UTC(),
+		Machine:    t.driver.MachineName,
+		User:       localUser(),
+		Method:     req.Method,
+		Path:       req.URL.RequestURI(),
+		DurationMS: int64(time.Since(start) / time.Millisecond),
+	}
+	if resp != nil {
+		entry.Status = resp.StatusCode
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	t.write(entry)
+
+	return resp, err
+}
+
+// write appends entry to the audit log. Auditing is best effort and never
+// fails the request it describes.
+func (t *auditTransport) write(entry auditEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dir := t.driver.storeDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		apiLog.Debugf("Unable to write audit log: %s", err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(dir, auditLogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		apiLog.Debugf("Unable to write audit log: %s", err)
+		return
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		apiLog.Debugf("Unable to write audit log: %s", err)
+	}
+}
+
+// localUser names the workstation user running docker-machine.
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,83 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+const (
+	defaultBIOSWorkflow = "Graph.Dell.Wsman.ConfigureBios"
+	// biosWorkflowTimeout allows for the reboots applying BIOS changes takes
+	biosWorkflowTimeout = 30 * time.Minute
+)
+
+// biosAttribute is one BIOS setting as the configure BIOS graph takes it.
+type biosAttribute struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// readBIOSSettings reads a JSON object of BIOS attribute names and values,
+// e.g. {"SriovGlobalEnable": "Enabled", "SysProfile": "PerfOptimized"}.
+func readBIOSSettings(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read --rackhd-bios-settings-file %s. Error: %s", path, err)
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return "", fmt.Errorf("--rackhd-bios-settings-file %s is not a JSON object of BIOS attributes. Error: %s", path, err)
+	}
+	if len(settings) == 0 {
+		return "", fmt.Errorf("--rackhd-bios-settings-file %s sets no BIOS attributes", path)
+	}
+	compact, err := json.Marshal(settings)
+	return string(compact), err
+}
+
+// biosOptions builds the options of the configure BIOS graph, with the
+// attributes in name order so the graph applies them the same way every time.
+func (d *Driver) biosOptions() (interface{}, error) {
+	var settings map[string]interface{}
+	if err := json.Unmarshal([]byte(d.BIOSSettings), &settings); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attributes := make([]biosAttribute, 0, len(names))
+	for _, name := range names {
+		attributes = append(attributes, biosAttribute{Name: name, Value: settings[name]})
+	}
+	return map[string]interface{}{
+		"defaults": map[string]interface{}{"attributes": attributes},
+	}, nil
+}
+
+func (d *Driver) biosWorkflow() string {
+	if d.BIOSWorkflow == "" {
+		return defaultBIOSWorkflow
+	}
+	return d.BIOSWorkflow
+}
+
+// configureBIOS runs the vendor BIOS configuration graph with the settings
+// of --rackhd-bios-settings-file before the OS is installed, so nodes that
+// drifted from the fleet's BIOS baseline are corrected on every create.
+func (d *Driver) configureBIOS() error {
+	if d.BIOSSettings == "" {
+		return errPhaseSkipped
+	}
+	options, err := d.biosOptions()
+	if err != nil {
+		return err
+	}
+	log.Infof("Applying BIOS settings to node %s with %s", d.NodeID, d.biosWorkflow())
+	_, err = d.runWorkflow(d.biosWorkflow(), options, biosWorkflowTimeout)
+	return err
+}
@@ -0,0 +1,184 @@
+package rackhd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bootDiskSelector is a parsed --rackhd-boot-disk: a drive matched by WWN or
+// serial number, or the smallest drive whose size satisfies a comparison.
+type bootDiskSelector struct {
+	kind  string // wwn, serial or size
+	value string
+	op    string
+	gb    float64
+}
+
+// parseBootDisk parses wwn:<wwn>, serial:<serial> or size<op><n><G|T>, e.g.
+// size>=400G, with op one of >=, <=, >, < and =.
+func parseBootDisk(value string) (*bootDiskSelector, error) {
+	invalid := fmt.Errorf("Invalid --rackhd-boot-disk %q. Specify wwn:<wwn>, serial:<serial> or a size such as size>=400G", value)
+	switch {
+	case strings.HasPrefix(value, "wwn:") && len(value) > len("wwn:"):
+		return &bootDiskSelector{kind: "wwn", value: strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(value, "wwn:"), "0x"))}, nil
+	case strings.HasPrefix(value, "serial:") && len(value) > len("serial:"):
+		return &bootDiskSelector{kind: "serial", value: strings.TrimPrefix(value, "serial:")}, nil
+	case strings.HasPrefix(value, "size"):
+		expr := strings.TrimPrefix(value, "size")
+		sel := &bootDiskSelector{kind: "size"}
+		for _, op := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(expr, op) {
+				sel.op, expr = op, strings.TrimPrefix(expr, op)
+				break
+			}
+		}
+		unit := 1.0
+		switch {
+		case strings.HasSuffix(strings.ToUpper(expr), "T"):
+			unit, expr = 1000, expr[:len(expr)-1]
+		case strings.HasSuffix(strings.ToUpper(expr), "G"):
+			expr = expr[:len(expr)-1]
+		}
+		n, err := strconv.ParseFloat(expr, 64)
+		if sel.op == "" || err != nil || n <= 0 {
+			return nil, invalid
+		}
+		sel.gb = n * unit
+		return sel, nil
+	}
+	return nil, invalid
+}
+
+// bootDiskCandidate is a drive of the node with what the selector matches on.
+type bootDiskCandidate struct {
+	drive  catalogDrive
+	serial string
+	gb     float64
+}
+
+func (s *bootDiskSelector) matches(c bootDiskCandidate) bool {
+	switch s.kind {
+	case "wwn":
+		return c.drive.LinuxWwid != "" && strings.Contains(strings.ToLower(c.drive.LinuxWwid), s.value)
+	case "serial":
+		return c.serial != "" && c.serial == s.value
+	}
+	if c.gb == 0 {
+		return false
+	}
+	switch s.op {
+	case ">=":
+		return c.gb >= s.gb
+	case "<=":
+		return c.gb <= s.gb
+	case ">":
+		return c.gb > s.gb
+	case "<":
+		return c.gb < s.gb
+	}
+	// sizes are marketed rounded, so = allows for 2% either way
+	return c.gb >= s.gb*0.98 && c.gb <= s.gb*1.02
+}
+
+// bootDisk resolves --rackhd-boot-disk against the node's driveId catalog,
+// with serial numbers from the smart catalog and sizes from ohai, and
+// returns the device the installer should use. Several drives can match a
+// size; the smallest is chosen, leaving the larger ones for data.
+func (d *Driver) bootDisk() (string, error) {
+	sel, err := parseBootDisk(d.BootDisk)
+	if err != nil {
+		return "", err
+	}
+	var drives []catalogDrive
+	if err := d.getCatalog(driveIDCatalog, &drives); err != nil {
+		return "", err
+	}
+	serials := make(map[string]string)
+	if sel.kind == "serial" {
+		var disks []smartDisk
+		if err := d.getCatalog("smart", &disks); err != nil {
+			return "", err
+		}
+		for _, disk := range disks {
+			serials[strings.TrimPrefix(disk.Device, "/dev/")] = disk.SMART.Identity.Serial
+		}
+	}
+	var hw ohaiHardware
+	if sel.kind == "size" {
+		if err := d.getCatalog("ohai", &hw); err != nil {
+			return "", err
+		}
+	}
+
+	var matched []bootDiskCandidate
+	for _, drive := range drives {
+		c := bootDiskCandidate{drive: drive, serial: serials[drive.DevName]}
+		if dev, ok := hw.BlockDevices[drive.DevName]; ok {
+			sectors, _ := strconv.ParseFloat(dev.Size, 64)
+			c.gb = sectors * 512 / 1e9
+		}
+		if sel.matches(c) {
+			matched = append(matched, c)
+		}
+	}
+	if len(matched) == 0 {
+		return "", fmt.Errorf("Node %s has no drive matching --rackhd-boot-disk=%s", d.NodeID, d.BootDisk)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].gb != matched[j].gb {
+			return matched[i].gb < matched[j].gb
+		}
+		return matched[i].drive.DevName < matched[j].drive.DevName
+	})
+	return matched[0].drive.device(), nil
+}
+
+// installOptions are the options of the install workflow: those of
+// --rackhd-workflow-options, with installDisk set to the resolved
+// --rackhd-boot-disk so the OS lands on that drive rather than on whichever
+// the installer enumerates first, the library names of the --rackhd-template
+// files, and with --rackhd-bootstrap-method=graph the machine key and hostname.
+func (d *Driver) installOptions() (interface{}, error) {
+	options, err := d.workflowOptions()
+	if err != nil || (d.BootDisk == "" && len(d.Templates) == 0 && d.BootstrapMethod != bootstrapGraph) {
+		return options, err
+	}
+
+	opts, ok := options.(map[string]interface{})
+	if !ok {
+		opts = make(map[string]interface{})
+	}
+	defaults, ok := opts["defaults"].(map[string]interface{})
+	if !ok {
+		defaults = make(map[string]interface{})
+		opts["defaults"] = defaults
+	}
+	templates, err := d.templateFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, template := range templates {
+		if previous, ok := defaults[template.option]; ok {
+			log.Warnf("--rackhd-template overrides %s %v of --rackhd-workflow-options", template.option, previous)
+		}
+		defaults[template.option] = template.name()
+	}
+	if d.BootstrapMethod == bootstrapGraph {
+		d.addInstallKey(defaults)
+	}
+	if d.BootDisk == "" {
+		return opts, nil
+	}
+	disk, err := d.bootDisk()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Installing the OS of node %s on %s", d.NodeID, disk)
+	if previous, ok := defaults["installDisk"]; ok && previous != disk {
+		log.Warnf("--rackhd-boot-disk overrides installDisk %v of --rackhd-workflow-options", previous)
+	}
+	defaults["installDisk"] = disk
+	return opts, nil
+}
@@ -0,0 +1,99 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultListingCacheTTL is the default of --rackhd-listing-cache-ttl, in
+// seconds.
+const defaultListingCacheTTL = 5
+
+// listingCache holds the node and lookup listings of each endpoint for a few
+// seconds. It is process wide, like the API transport, so a script or
+// library running many creates at once reads the inventory once per TTL
+// rather than once per create and check.
+type listingCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedListing
+}
+
+// cachedListing is one listing. Its lock is held while it is fetched, so
+// creates asking for it meanwhile wait for that fetch instead of making
+// their own.
+type cachedListing struct {
+	mu      sync.Mutex
+	fetched time.Time
+	records []json.RawMessage
+}
+
+var listings = &listingCache{entries: make(map[string]*cachedListing)}
+
+func listingKey(endpoint, kind string, query url.Values) string {
+	return endpoint + " " + kind + "?" + query.Encode()
+}
+
+func (c *listingCache) entry(key string) *cachedListing {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &cachedListing{}
+		c.entries[key] = entry
+	}
+	return entry
+}
+
+// invalidate drops the listings of an endpoint, after the driver changed a
+// node there.
+func (c *listingCache) invalidate(endpoint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, endpoint+" ") {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (d *Driver) listingCacheTTL() time.Duration {
+	return time.Duration(d.ListingCacheTTL) * time.Second
+}
+
+// cachedPages is listPages answered from the listing cache, when the cache is
+// enabled. A listing older than the TTL is fetched again in full.
+func (d *Driver) cachedPages(kind string, list func(query url.Values) (interface{}, error), query url.Values, fn func(json.RawMessage) error) error {
+	if d.ListingCacheTTL <= 0 {
+		return d.listPages(list, query, fn)
+	}
+	entry := listings.entry(listingKey(d.Endpoint, kind, query))
+	entry.mu.Lock()
+	if entry.records == nil || time.Since(entry.fetched) > d.listingCacheTTL() {
+		records := []json.RawMessage{}
+		err := d.listPages(list, query, func(record json.RawMessage) error {
+			records = append(records, record)
+			return nil
+		})
+		if err != nil {
+			entry.mu.Unlock()
+			return err
+		}
+		entry.records, entry.fetched = records, time.Now()
+	} else {
+		apiLog.Debugf("Using the %s listing cached %s ago", kind, time.Since(entry.fetched).Round(time.Millisecond))
+	}
+	records := entry.records
+	entry.mu.Unlock()
+
+	for _, record := range records {
+		if err := fn(record); err == errStopListing {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
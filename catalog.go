@@ -0,0 +1,81 @@
+package rackhd
+
+import (
+	"fmt"
+	"time"
+)
+
+const catalogSnapshotFile = "catalogs.json"
+
+// snapshotCatalogSources are the catalogs saved with every machine.
+var snapshotCatalogSources = []string{"dmi", "ohai", "driveId"}
+
+// catalogSnapshot is a point-in-time copy of a node's hardware catalogs.
+type catalogSnapshot struct {
+	Time     time.Time              `json:"time"`
+	NodeID   string                 `json:"nodeId"`
+	Catalogs map[string]interface{} `json:"catalogs"`
+}
+
+// dmiSystemInfo is the "System Information" section of the dmi catalog.
+type dmiSystemInfo struct {
+	Manufacturer string `json:"Manufacturer"`
+	ProductName  string `json:"Product Name"`
+	SerialNumber string `json:"Serial Number"`
+	UUID         string `json:"UUID"`
+}
+
+// systemInfo returns the node's DMI system identity.
+func (d *Driver) systemInfo() (*dmiSystemInfo, error) {
+	var dmi struct {
+		System dmiSystemInfo `json:"System Information"`
+	}
+	if err := d.getCatalog("dmi", &dmi); err != nil {
+		return nil, err
+	}
+	return &dmi.System, nil
+}
+
+// getCatalog fetches the data of one catalog source of the node into v.
+func (d *Driver) getCatalog(source string, v interface{}) error {
+	return d.getNodeCatalog(d.NodeID, source, v)
+}
+
+// getNodeCatalog is getCatalog for any node, such as a selection candidate.
+func (d *Driver) getNodeCatalog(nodeID, source string, v interface{}) error {
+	payload, err := d.getClient().GetNodeCatalog(d.context(), nodeID, source)
+	if err != nil {
+		return fmt.Errorf("Unable to get the %s catalog of node %s. Error: %s", source, nodeID, apiError(err))
+	}
+	data, err := d.adapter().catalogData(payload)
+	if err != nil {
+		return err
+	}
+	return decodePayload(data, v)
+}
+
+// snapshotCatalogs stores the node's catalogs in the machine store so the
+// hardware inventory of the machine is kept even if RackHD re-catalogs the
+// node later. Missing catalogs are skipped; this never fails a create.
+func (d *Driver) snapshotCatalogs() {
+	snapshot := catalogSnapshot{
+		Time:     time.Now().UTC(),
+		NodeID:   d.NodeID,
+		Catalogs: make(map[string]interface{}),
+	}
+	for _, source := range snapshotCatalogSources {
+		var data interface{}
+		if err := d.getCatalog(source, &data); err != nil {
+			log.Debugf("Not saving catalog: %s", err)
+			continue
+		}
+		snapshot.Catalogs[source] = data
+	}
+
+	path, err := d.writeStoreJSON(catalogSnapshotFile, snapshot)
+	if err != nil {
+		log.Warnf("Unable to save the catalogs of node %s: %s", d.NodeID, err)
+		return
+	}
+	log.Debugf("Saved catalogs of node %s to %s", d.NodeID, path)
+}
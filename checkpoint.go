@@ -0,0 +1,111 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// resumablePhases are the create phases whose result outlives a failed create:
+// the node keeps its power state and installed OS after docker-machine rm, so
+// a retry with --rackhd-resume can skip them. Later phases work with the
+// machine key, which is regenerated by every create.
+var resumablePhases = map[string]bool{
+	"power":          true,
+	"configure BIOS": true,
+	"configure RAID": true,
+	"install OS":     true,
+}
+
+// createCheckpoint records the phases a create completed against a node.
+type createCheckpoint struct {
+	Time            time.Time `json:"time"`
+	Machine         string    `json:"machine"`
+	NodeID          string    `json:"nodeId"`
+	WorkflowName    string    `json:"workflowName"`
+	WorkflowOptions string    `json:"workflowOptions"`
+	BIOSSettings    string    `json:"biosSettings,omitempty"`
+	RAIDConfig      string    `json:"raidConfig,omitempty"`
+	WorkflowID      string    `json:"workflowId"`
+	Completed       []string  `json:"completed"`
+}
+
+// checkpointPath is outside the machine directory, which docker-machine rm
+// deletes before the create can be retried.
+func (d *Driver) checkpointPath() string {
+	return filepath.Join(d.StorePath, "rackhd-checkpoints", d.MachineName+".json")
+}
+
+// loadCheckpoint returns the checkpoint of an earlier create of this machine
+// against the same node and workflow, or nil.
+func (d *Driver) loadCheckpoint() *createCheckpoint {
+	b, err := ioutil.ReadFile(d.checkpointPath())
+	if err != nil {
+		return nil
+	}
+	var cp createCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		log.Warnf("Ignoring unreadable checkpoint %s: %s", d.checkpointPath(), err)
+		return nil
+	}
+	if cp.NodeID != d.NodeID || cp.WorkflowName != d.WorkflowName || cp.WorkflowOptions != d.WorkflowOptions || cp.BIOSSettings != d.BIOSSettings || cp.RAIDConfig != d.RAIDConfig {
+		log.Infof("Not resuming: the checkpoint of %s was made for node %s and workflow %q", d.MachineName, cp.NodeID, cp.WorkflowName)
+		return nil
+	}
+	return &cp
+}
+
+// completePhase adds phase to the machine's checkpoint.
+func (d *Driver) completePhase(phase string) {
+	cp := d.loadCheckpoint()
+	if cp == nil {
+		cp = &createCheckpoint{
+			Machine:         d.MachineName,
+			NodeID:          d.NodeID,
+			WorkflowName:    d.WorkflowName,
+			WorkflowOptions: d.WorkflowOptions,
+			BIOSSettings:    d.BIOSSettings,
+			RAIDConfig:      d.RAIDConfig,
+		}
+	}
+	cp.Time = time.Now().UTC()
+	cp.WorkflowID = d.WorkflowID
+	if !containsString(cp.Completed, phase) {
+		cp.Completed = append(cp.Completed, phase)
+	}
+
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(d.checkpointPath()), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(d.checkpointPath(), b, 0600)
+	}
+	if err != nil {
+		log.Warnf("Unable to save the create checkpoint of %s: %s", d.MachineName, err)
+	}
+}
+
+// resumePhase reports whether phase was completed by an earlier create and
+// restores what it produced.
+func (d *Driver) resumePhase(phase string) bool {
+	if !d.Resume || !resumablePhases[phase] {
+		return false
+	}
+	cp := d.loadCheckpoint()
+	if cp == nil || !containsString(cp.Completed, phase) {
+		return false
+	}
+	if cp.WorkflowID != "" {
+		d.WorkflowID = cp.WorkflowID
+	}
+	return true
+}
+
+func (d *Driver) clearCheckpoint() {
+	if err := os.Remove(d.checkpointPath()); err != nil && !os.IsNotExist(err) {
+		log.Debugf("Unable to remove the create checkpoint of %s: %s", d.MachineName, err)
+	}
+}
@@ -0,0 +1,152 @@
+package rackhd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// claimTagPrefix marks a node selected by a create that is still
+	// running, as docker-machine-claim:<machine>@<expiry in Unix seconds>
+	claimTagPrefix  = "docker-machine-claim:"
+	defaultClaimTTL = 30
+)
+
+func claimTag(machine string, expires time.Time) string {
+	return fmt.Sprintf("%s%s@%d", claimTagPrefix, machine, expires.Unix())
+}
+
+// parseClaim returns the machine and expiry of a claim tag.
+func parseClaim(tag string) (string, time.Time, bool) {
+	if !strings.HasPrefix(tag, claimTagPrefix) {
+		return "", time.Time{}, false
+	}
+	claim := strings.TrimPrefix(tag, claimTagPrefix)
+	i := strings.LastIndex(claim, "@")
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(claim[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return claim[:i], time.Unix(unix, 0), true
+}
+
+// liveClaim returns the machine holding a node with tags: of the unexpired
+// claims, the one of the lowest machine name, so every create racing for the
+// node agrees on the winner. Claims of creates that crashed expire after the
+// TTL, so the node is free again without anyone cleaning up.
+func liveClaim(tags []string, now time.Time) (string, bool) {
+	winner, found := "", false
+	for _, tag := range tags {
+		if machine, expires, ok := parseClaim(tag); ok && now.Before(expires) && (!found || machine < winner) {
+			winner, found = machine, true
+		}
+	}
+	return winner, found
+}
+
+func (d *Driver) claimTTL() time.Duration {
+	if d.ClaimTTL <= 0 {
+		return defaultClaimTTL * time.Minute
+	}
+	return time.Duration(d.ClaimTTL) * time.Minute
+}
+
+// writeClaim replaces the claim of this machine on the node, dropping expired
+// claims, with one expiring after the TTL, or with none when release is set.
+// It refuses to claim a node another machine holds. RackHD has no conditional update,
+// so two creates can both find the node unclaimed and both write; the node is
+// read again to confirm the claim, and the create that lost backs off.
+func (d *Driver) writeClaim(release bool) error {
+	now := time.Now()
+	err := d.updateNodeTags(func(current []string) ([]string, error) {
+		if machine, ok := liveClaim(current, now); ok && machine != d.MachineName && !release {
+			return nil, fmt.Errorf("Node %s is being provisioned by machine %s", d.NodeID, machine)
+		}
+		tags := make([]string, 0, len(current)+1)
+		for _, tag := range current {
+			if machine, expires, ok := parseClaim(tag); ok && (machine == d.MachineName || !now.Before(expires)) {
+				continue
+			}
+			tags = append(tags, tag)
+		}
+		if !release {
+			tags = append(tags, claimTag(d.MachineName, now.Add(d.claimTTL())))
+		}
+		return tags, nil
+	})
+	if err != nil || release {
+		return err
+	}
+	node, err := d.getNode()
+	if err != nil {
+		return err
+	}
+	if machine, ok := liveClaim(node.Tags, now); machine != d.MachineName {
+		if ok {
+			err = fmt.Errorf("Node %s is being provisioned by machine %s", d.NodeID, machine)
+		} else {
+			err = fmt.Errorf("The claim on node %s was overwritten by another create", d.NodeID)
+		}
+		if err := d.writeClaim(true); err != nil {
+			log.Debugf("Unable to release the claim on node %s: %s", d.NodeID, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// claimNode claims the node for the rest of the create and refreshes the
+// claim while the create runs, so a long OS install does not outlive it. The
+// node is also marked reserved where RackHD supports it, for consumers other
+// than docker-machine; that stays while the machine exists. releaseClaim
+// ends the claim.
+func (d *Driver) claimNode() error {
+	if err := d.writeClaim(false); err != nil {
+		return err
+	}
+	if err := d.setReserved(true); err != nil {
+		if err := d.writeClaim(true); err != nil {
+			log.Debugf("Unable to release the claim on node %s: %s", d.NodeID, err)
+		}
+		return err
+	}
+	log.Debugf("Claimed node %s for %s", d.NodeID, d.claimTTL())
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(d.claimTTL() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := d.writeClaim(false); err != nil {
+					log.Warnf("Unable to refresh the claim on node %s: %s", d.NodeID, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	d.claimRelease = func() {
+		close(done)
+		<-stopped
+		if err := d.writeClaim(true); err != nil {
+			log.Warnf("Unable to release the claim on node %s: %s", d.NodeID, err)
+		}
+	}
+	return nil
+}
+
+// releaseClaim removes the claim of claimNode, if the create made one.
+func (d *Driver) releaseClaim() {
+	if d.claimRelease != nil {
+		d.claimRelease()
+		d.claimRelease = nil
+	}
+}
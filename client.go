@@ -0,0 +1,298 @@
+package rackhd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	apiclient "github.com/emccode/gorackhd/client"
+	"github.com/emccode/gorackhd/client/nodes"
+	"github.com/emccode/gorackhd/client/pollers"
+	"github.com/emccode/gorackhd/client/skus"
+	"github.com/emccode/gorackhd/client/templates"
+	"github.com/emccode/gorackhd/client/workflows"
+
+	"github.com/go-swagger/go-swagger/httpkit"
+	httptransport "github.com/go-swagger/go-swagger/httpkit/client"
+	"github.com/go-swagger/go-swagger/strfmt"
+)
+
+// RackHDClient is the part of the RackHD API the driver uses. Payloads are
+// returned as decoded JSON and read with decodePayload, so implementations
+// for other API versions, or fakes for tests, only have to produce the same
+// documents. The listings take the query parameters of the API, including
+// the $skip and $top paging parameters. Errors should be httpkit.APIError values where the API answered
+// with an error status, which is what apiError and isNotFound inspect. A call
+// must give up once its context is done.
+type RackHDClient interface {
+	GetConfig(ctx context.Context) (interface{}, error)
+	Lookup(ctx context.Context, query url.Values) (interface{}, error)
+
+	GetNodes(ctx context.Context, query url.Values) (interface{}, error)
+	GetNode(ctx context.Context, nodeID string) (interface{}, error)
+	SetNodeTags(ctx context.Context, nodeID string, tags []string) error
+	SetNodeReserved(ctx context.Context, nodeID string, reserved bool) error
+	GetNodeCatalog(ctx context.Context, nodeID, source string) (interface{}, error)
+	GetNodeOBM(ctx context.Context, nodeID string) (interface{}, error)
+	AddNodeOBM(ctx context.Context, nodeID string, setting interface{}) error
+	GetNodePollers(ctx context.Context, nodeID string) (interface{}, error)
+	SetPollerPaused(ctx context.Context, pollerID string, paused bool) error
+	GetPollerData(ctx context.Context, pollerID string) (interface{}, error)
+	GetSKU(ctx context.Context, skuID string) (interface{}, error)
+
+	StartWorkflow(ctx context.Context, nodeID, name string, body interface{}) (interface{}, error)
+	GetActiveWorkflow(ctx context.Context, nodeID string) (interface{}, error)
+	CancelActiveWorkflow(ctx context.Context, nodeID string) error
+	GetWorkflow(ctx context.Context, instanceID string) (interface{}, error)
+	GetWorkflowDefinition(ctx context.Context, name string) (interface{}, error)
+	PutWorkflowDefinition(ctx context.Context, definition interface{}) error
+
+	GetTemplate(ctx context.Context, name string) (interface{}, error)
+	PutTemplate(ctx context.Context, name, contents string) error
+}
+
+// SetClient replaces the RackHD API client of the driver, e.g. with a client
+// for another API version. The default talks to the 1.1 API at Endpoint; a
+// client implementing VersionedClient has its payloads read accordingly.
+func (d *Driver) SetClient(client RackHDClient) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.client = client
+}
+
+// swaggerClient is the default RackHDClient, backed by the gorackhd swagger
+// client for the 1.1 API. Auth info is nil throughout; the 1.1 API has none.
+type swaggerClient struct {
+	host      string
+	scheme    string
+	transport http.RoundTripper
+}
+
+// apiTransport is shared by the API clients of all drivers in the process,
+// so polling a workflow for the length of an OS install, or reconciling a
+// store of many machines, reuses a few kept-alive connections instead of
+// dialling and handshaking for every request.
+var apiTransport http.RoundTripper = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	MaxIdleConns:          16,
+	MaxIdleConnsPerHost:   4,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 2 * time.Minute,
+	ExpectContinueTimeout: time.Second,
+}
+
+func newSwaggerClient(d *Driver) *swaggerClient {
+	// create the transport
+	/** Will Need to determine changes for v 2.0 API **/
+	var transport http.RoundTripper = &timedTransport{next: apiTransport, driver: d}
+	if d.AuditLog && !d.DryRun {
+		transport = &auditTransport{next: transport, driver: d}
+	}
+	return &swaggerClient{host: d.Endpoint, scheme: d.Transport, transport: transport}
+}
+
+// api returns an API client whose requests are bound to ctx. The swagger
+// parameters have no context of their own, so it is attached to each request
+// by the transport.
+func (c *swaggerClient) api(ctx context.Context) *apiclient.Monorail {
+	transport := httptransport.New(c.host, "/api/1.1", []string{c.scheme})
+	transport.Transport = &contextTransport{next: c.transport, ctx: ctx}
+	// create the API client, with the transport
+	return apiclient.New(transport, strfmt.Default)
+}
+
+// contextTransport binds the requests it sends to a context.
+type contextTransport struct {
+	next http.RoundTripper
+	ctx  context.Context
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req.WithContext(t.ctx))
+}
+
+func (c *swaggerClient) GetConfig(ctx context.Context) (interface{}, error) {
+	resp, err := c.api(ctx).Config.GetConfig(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+// The swagger listings only know the q parameter of the lookups, so the
+// listings are requested directly.
+func (c *swaggerClient) Lookup(ctx context.Context, query url.Values) (interface{}, error) {
+	return c.list(ctx, "getLookups", "/lookups", query)
+}
+
+func (c *swaggerClient) GetNodes(ctx context.Context, query url.Values) (interface{}, error) {
+	return c.list(ctx, "getNodes", "/nodes", query)
+}
+
+// list GETs an API listing with query parameters, returning API errors the
+// way the swagger client does, with the Monorail error as their Response.
+func (c *swaggerClient) list(ctx context.Context, operation, path string, query url.Values) (interface{}, error) {
+	u := url.URL{Scheme: c.scheme, Host: c.host, Path: "/api/1.1" + path, RawQuery: query.Encode()}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// the connection is only reused once the body has been read to the end
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		// the body is gone once the error is seen, so it is kept decoded
+		var body monorailError
+		json.NewDecoder(resp.Body).Decode(&body)
+		return nil, &httpkit.APIError{OperationName: operation, Response: body, Code: resp.StatusCode}
+	}
+	var payload interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("Unable to decode the response of %s. Error: %s", operation, err)
+	}
+	return payload, nil
+}
+
+func (c *swaggerClient) GetNode(ctx context.Context, nodeID string) (interface{}, error) {
+	resp, err := c.api(ctx).Nodes.GetNodesIdentifier(&nodes.GetNodesIdentifierParams{Identifier: nodeID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) SetNodeTags(ctx context.Context, nodeID string, tags []string) error {
+	body := map[string]interface{}{"tags": tags}
+	_, err := c.api(ctx).Nodes.PatchNodesIdentifier(&nodes.PatchNodesIdentifierParams{Identifier: nodeID, Body: body}, nil)
+	return err
+}
+
+func (c *swaggerClient) SetNodeReserved(ctx context.Context, nodeID string, reserved bool) error {
+	body := map[string]interface{}{"reserved": reserved}
+	_, err := c.api(ctx).Nodes.PatchNodesIdentifier(&nodes.PatchNodesIdentifierParams{Identifier: nodeID, Body: body}, nil)
+	return err
+}
+
+func (c *swaggerClient) GetNodeCatalog(ctx context.Context, nodeID, source string) (interface{}, error) {
+	resp, err := c.api(ctx).Nodes.GetNodesIdentifierCatalogsSource(&nodes.GetNodesIdentifierCatalogsSourceParams{Identifier: nodeID, Source: source}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) GetNodeOBM(ctx context.Context, nodeID string) (interface{}, error) {
+	resp, err := c.api(ctx).Nodes.GetNodesIdentifierObm(&nodes.GetNodesIdentifierObmParams{Identifier: nodeID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) AddNodeOBM(ctx context.Context, nodeID string, setting interface{}) error {
+	_, err := c.api(ctx).Nodes.PostNodesIdentifierObm(&nodes.PostNodesIdentifierObmParams{Identifier: nodeID, Body: setting}, nil)
+	return err
+}
+
+func (c *swaggerClient) GetNodePollers(ctx context.Context, nodeID string) (interface{}, error) {
+	resp, err := c.api(ctx).Nodes.GetNodesIdentifierPollers(&nodes.GetNodesIdentifierPollersParams{Identifier: nodeID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) SetPollerPaused(ctx context.Context, pollerID string, paused bool) error {
+	body := map[string]interface{}{"paused": paused}
+	_, err := c.api(ctx).Pollers.PatchPollersIdentifier(&pollers.PatchPollersIdentifierParams{Identifier: pollerID, Body: body}, nil)
+	return err
+}
+
+func (c *swaggerClient) GetPollerData(ctx context.Context, pollerID string) (interface{}, error) {
+	resp, err := c.api(ctx).Pollers.GetPollersIdentifierDataCurrent(&pollers.GetPollersIdentifierDataCurrentParams{Identifier: pollerID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) GetSKU(ctx context.Context, skuID string) (interface{}, error) {
+	resp, err := c.api(ctx).Skus.GetSkusIdentifier(&skus.GetSkusIdentifierParams{Identifier: skuID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) StartWorkflow(ctx context.Context, nodeID, name string, body interface{}) (interface{}, error) {
+	resp, err := c.api(ctx).Nodes.PostNodesIdentifierWorkflows(&nodes.PostNodesIdentifierWorkflowsParams{Identifier: nodeID, Name: name, Body: body}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) GetActiveWorkflow(ctx context.Context, nodeID string) (interface{}, error) {
+	resp, err := c.api(ctx).Nodes.GetNodesIdentifierWorkflowsActive(&nodes.GetNodesIdentifierWorkflowsActiveParams{Identifier: nodeID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) CancelActiveWorkflow(ctx context.Context, nodeID string) error {
+	_, err := c.api(ctx).Nodes.DeleteNodesIdentifierWorkflowsActive(&nodes.DeleteNodesIdentifierWorkflowsActiveParams{Identifier: nodeID}, nil)
+	return err
+}
+
+func (c *swaggerClient) GetWorkflow(ctx context.Context, instanceID string) (interface{}, error) {
+	resp, err := c.api(ctx).Workflows.GetWorkflowsIdentifier(&workflows.GetWorkflowsIdentifierParams{Identifier: instanceID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) GetWorkflowDefinition(ctx context.Context, name string) (interface{}, error) {
+	resp, err := c.api(ctx).Workflows.GetWorkflowsLibraryIdentifier(&workflows.GetWorkflowsLibraryIdentifierParams{Identifier: name}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) PutWorkflowDefinition(ctx context.Context, definition interface{}) error {
+	_, err := c.api(ctx).Workflows.PutWorkflows(&workflows.PutWorkflowsParams{Body: definition}, nil)
+	return err
+}
+
+func (c *swaggerClient) GetTemplate(ctx context.Context, name string) (interface{}, error) {
+	resp, err := c.api(ctx).Templates.GetTemplatesLibraryIdentifier(&templates.GetTemplatesLibraryIdentifierParams{Identifier: name}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+func (c *swaggerClient) PutTemplate(ctx context.Context, name, contents string) error {
+	_, err := c.api(ctx).Templates.PutTemplatesLibraryIdentifier(&templates.PutTemplatesLibraryIdentifierParams{Identifier: name, Body: contents}, nil)
+	return err
+}
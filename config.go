@@ -0,0 +1,328 @@
+package rackhd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Config holds the options of a machine, as set from the create flags. It is
+// embedded in Driver, so its fields are persisted with the machine like the
+// driver's own, except BMCPassword, which only the create needs.
+type Config struct {
+	Endpoint     string
+	NodeID       string
+	NodeBySerial string
+	Transport    string
+	EndpointWait int
+
+	SelectStrategy    string
+	SelectTags        []string
+	AntiAffinityGroup string
+	WeightsFile       string
+	PoolHealth        bool
+
+	SSHPassword         string
+	BootstrapUser       string
+	DisablePasswordAuth bool
+	NopasswdSudo        bool
+	RestrictedBootstrap bool
+	SSHCAKey            string
+	SSHCAPublicKey      string
+	SSHCAPrincipals     []string
+	MachineKeyPath      string
+	MachineKeyBits      int
+	MachineKeyComment   string
+	ReuseMachineKey     string
+	SSHTunnel           bool
+	SSHTunnelPort       int
+	SSHCommandTimeout   int
+	SOLPasswordFile     string
+	BMCHost             string
+	BMCUser             string
+	BMCPassword         string `json:"-"`
+	BMCPasswordFile     string
+
+	BootstrapMethod string
+	WinRMPort       int
+	WinRMHTTPS      bool
+	WinRMInsecure   bool
+
+	WorkflowName      string
+	WorkflowOptions   string
+	Templates         []string
+	IgnoreSKUDefaults bool
+	WorkflowTimeout   int
+	WorkflowRetries   int
+	ProgressFile      string
+	AMQPURI           string
+	AMQPExchange      string
+	WebsocketURL      string
+	WebhookURL        string
+	DryRun            bool
+	Resume            bool
+	Adopt             bool
+
+	HardwareLabels bool
+	DockerDataDisk string
+	GPULabels      bool
+	GPURuntime     bool
+
+	ConfigureFirewall bool
+	HTTPProxy         string
+	HTTPSProxy        string
+	NoProxy           string
+	Sysctls           []string
+	KernelArgs        string
+	NetworkConfig     string
+	Hugepages         string
+	NUMABalancing     string
+
+	RegistryMirrors    []string
+	InsecureRegistries []string
+	AuditLog           bool
+	ReportFile         string
+	InventoryFile      string
+	BootDisk           string
+	MetricsAddr        string
+	RemoveStrategy     string
+	WipeWorkflow       string
+
+	PreUpgradeWorkflow  string
+	PostUpgradeWorkflow string
+	PostInstallScript   string
+	PreUpgradeScript    string
+	PostUpgradeScript   string
+	AutoRepair          bool
+	Owner               string
+	Project             string
+	Profile             string
+	PoolsFile           string
+	Pool                string
+	ClaimTTL            int
+	ListingCacheTTL     int
+	AutoRebind          bool
+	LeaseHours          int
+
+	MinCPUs                int
+	MinMemoryGB            int
+	MinDiskGB              int
+	RequireVirtualization  bool
+	MinFirmware            []string
+	FirmwareWorkflow       string
+	RequireTPM             bool
+	TPMAttestationWorkflow string
+	IgnoreDiskHealth       bool
+	DiskHealthWorkflow     string
+	IgnoreSensorAlerts     bool
+	HardwarePolicies       []string
+
+	BIOSSettings string
+	BIOSWorkflow string
+	PXEWorkflow  string
+	RAIDConfig   string
+	RAIDWorkflow string
+
+	Simulate string
+}
+
+// ConfigError lists every problem Validate found, so all of them can be fixed
+// before the next attempt.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid rackhd driver options: %s", strings.Join(e.Problems, "; "))
+}
+
+// Validate checks the options on their own and against each other. It
+// returns a *ConfigError, or nil when the options are consistent.
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case c.NodeID == "" && c.NodeBySerial == "" && c.SelectStrategy == "":
+		problem("the --rackhd-node-id, --rackhd-node-serial or --rackhd-select option is required")
+	case c.NodeID != "" && c.NodeBySerial != "":
+		problem("--rackhd-node-id and --rackhd-node-serial cannot be combined")
+	case c.SelectStrategy != "" && (c.NodeID != "" || c.NodeBySerial != ""):
+		problem("--rackhd-select cannot be combined with --rackhd-node-id or --rackhd-node-serial")
+	}
+	if c.SelectStrategy != "" && !validSelectStrategy(c.SelectStrategy) {
+		problem("unsupported --rackhd-select %q. Specify first or random", c.SelectStrategy)
+	}
+	if len(c.SelectTags) > 0 && c.SelectStrategy == "" {
+		problem("--rackhd-select-tag requires --rackhd-select")
+	}
+	if c.WeightsFile != "" && c.SelectStrategy == "" {
+		problem("--rackhd-weights-file requires --rackhd-select")
+	}
+	if c.MachineKeyBits != 0 && (c.MachineKeyBits < defaultMachineKeyBits || c.MachineKeyBits > maxMachineKeyBits) {
+		problem("--rackhd-machine-key-bits must be between %d and %d", defaultMachineKeyBits, maxMachineKeyBits)
+	}
+	if strings.ContainsAny(c.MachineKeyComment, "\r\n") {
+		problem("--rackhd-machine-key-comment must be a single line")
+	}
+	if c.ReuseMachineKey != "" && (c.MachineKeyPath != "" || c.MachineKeyBits != 0 || c.MachineKeyComment != "") {
+		problem("--rackhd-reuse-machine-key cannot be combined with --rackhd-machine-key-path, --rackhd-machine-key-bits or --rackhd-machine-key-comment")
+	}
+	if c.ReuseMachineKey != "" && c.SSHCAKey != "" {
+		problem("--rackhd-reuse-machine-key cannot be combined with --rackhd-ssh-ca-key; each machine's certificate is written next to its key")
+	}
+	if c.SSHCAKey != "" && c.SSHCAPublicKey != "" {
+		problem("--rackhd-ssh-ca-key and --rackhd-ssh-ca-public-key cannot be combined; the public key is derived from the CA key")
+	}
+	if len(c.SSHCAPrincipals) > 0 && c.SSHCAKey == "" && c.SSHCAPublicKey == "" {
+		problem("--rackhd-ssh-ca-principal requires --rackhd-ssh-ca-key or --rackhd-ssh-ca-public-key")
+	}
+	if c.PoolHealth && c.SelectStrategy == "" {
+		problem("--rackhd-pool-health requires --rackhd-select")
+	}
+	if c.RestrictedBootstrap {
+		if conflicts := c.restrictedConflicts(); len(conflicts) > 0 {
+			problem("--rackhd-restricted-bootstrap cannot be combined with %s, which run commands on the node", strings.Join(conflicts, ", "))
+		}
+	}
+	if c.Transport != "http" && c.Transport != "https" {
+		problem("unsupported --rackhd-transport %q. Specify http or https", c.Transport)
+	}
+	if _, _, err := normalizeEndpoint(c.Endpoint, c.Transport); err != nil {
+		problem("%s", err)
+	}
+	if (c.BMCUser == "") != (c.BMCPassword == "") {
+		problem("--rackhd-bmc-user and --rackhd-bmc-password must be given together")
+	}
+	if c.BMCHost != "" && c.BMCUser == "" {
+		problem("--rackhd-bmc-host requires --rackhd-bmc-user and --rackhd-bmc-password")
+	}
+	for _, template := range c.Templates {
+		if parts := strings.SplitN(template, "=", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			problem("invalid --rackhd-template %q. Specify option=file, such as installScript=ks.cfg", template)
+		}
+	}
+	for _, setting := range c.Sysctls {
+		if !strings.Contains(setting, "=") {
+			problem("invalid --rackhd-sysctl %q. Specify key=value", setting)
+		}
+	}
+	if c.Hugepages != "" {
+		if _, _, err := parseHugepages(c.Hugepages); err != nil {
+			problem("%s", err)
+		}
+	}
+	if c.NUMABalancing != "" && c.NUMABalancing != "on" && c.NUMABalancing != "off" {
+		problem("invalid --rackhd-numa-balancing %q. Specify on or off", c.NUMABalancing)
+	}
+	if c.Adopt && c.WorkflowName != "" {
+		problem("--rackhd-adopt cannot be combined with --rackhd-workflow-name")
+	}
+	if c.Adopt && c.BIOSSettings != "" {
+		problem("--rackhd-adopt cannot be combined with --rackhd-bios-settings-file, which reboots the node")
+	}
+	for _, policy := range c.HardwarePolicies {
+		if _, err := parseHardwarePolicy(policy); err != nil {
+			problem("%s", err)
+		}
+	}
+	for _, rule := range c.MinFirmware {
+		if _, err := parseFirmwareRule(rule); err != nil {
+			problem("%s", err)
+		}
+	}
+	if c.Adopt && c.FirmwareWorkflow != "" {
+		problem("--rackhd-adopt cannot be combined with --rackhd-firmware-workflow, which reboots the node")
+	}
+	if c.TPMAttestationWorkflow != "" && !c.RequireTPM {
+		problem("--rackhd-tpm-attestation-workflow requires --rackhd-require-tpm")
+	}
+	if c.BootDisk != "" {
+		if _, err := parseBootDisk(c.BootDisk); err != nil {
+			problem("%s", err)
+		}
+		if c.WorkflowName == "" {
+			problem("--rackhd-boot-disk requires --rackhd-workflow-name")
+		}
+	}
+	if c.PXEWorkflow != "" && c.WorkflowName == "" {
+		problem("--rackhd-pxe-workflow requires --rackhd-workflow-name")
+	}
+	if c.RAIDConfig != "" && c.WorkflowName == "" {
+		problem("--rackhd-raid-config requires --rackhd-workflow-name; it destroys the data on the node's drives")
+	}
+	if !validRemoveStrategy(c.RemoveStrategy) {
+		problem("unsupported --rackhd-remove-strategy %q. Specify none, poweroff, wipe or rediscover", c.RemoveStrategy)
+	}
+	if c.Pool != "" && c.PoolsFile == "" {
+		problem("--rackhd-pool requires --rackhd-pools-file")
+	}
+	if c.SSHTunnelPort != 0 && !c.SSHTunnel {
+		problem("--rackhd-ssh-tunnel-port requires --rackhd-ssh-tunnel")
+	}
+	if c.MinCPUs < 0 || c.MinMemoryGB < 0 || c.MinDiskGB < 0 {
+		problem("--rackhd-min-cpus, --rackhd-min-memory and --rackhd-min-disk cannot be negative")
+	}
+	if c.LeaseHours < 0 {
+		problem("--rackhd-lease-hours cannot be negative")
+	}
+	if c.WorkflowRetries < 0 {
+		problem("--rackhd-workflow-retries cannot be negative")
+	}
+	if c.EndpointWait < 0 {
+		problem("--rackhd-endpoint-wait cannot be negative")
+	}
+	if c.ClaimTTL < 0 {
+		problem("--rackhd-claim-ttl cannot be negative")
+	}
+	if c.WebsocketURL != "" {
+		if u, err := url.Parse(c.WebsocketURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			problem("invalid --rackhd-websocket-url %q. Specify a ws:// or wss:// URL", c.WebsocketURL)
+		}
+	}
+	switch c.Simulate {
+	case "", simulateOn, simulateChaos:
+	default:
+		problem("unsupported --rackhd-simulate %q. Specify on or chaos", c.Simulate)
+	}
+	if c.Simulate != "" && (c.BootstrapMethod == bootstrapWinRM || c.SSHTunnel) {
+		problem("--rackhd-simulate supports neither WinRM nor the SSH tunnel")
+	}
+	switch c.BootstrapMethod {
+	case bootstrapSSH, bootstrapGraph:
+		if c.WinRMHTTPS || c.WinRMInsecure {
+			problem("--rackhd-winrm-https and --rackhd-winrm-insecure require --rackhd-bootstrap-method=winrm")
+		}
+		if c.BootstrapMethod == bootstrapSSH {
+			break
+		}
+		for _, flag := range c.passwordOptions() {
+			problem("%s is not supported with --rackhd-bootstrap-method=graph", flag)
+		}
+		if c.Adopt {
+			problem("--rackhd-adopt is not supported with --rackhd-bootstrap-method=graph, which reboots the node")
+		}
+	case bootstrapWinRM:
+		if c.DisablePasswordAuth {
+			problem("--rackhd-disable-password-auth is not supported with --rackhd-bootstrap-method=winrm")
+		}
+		if c.NopasswdSudo {
+			problem("--rackhd-nopasswd-sudo is not supported with --rackhd-bootstrap-method=winrm")
+		}
+		if c.SSHCAKey != "" || c.SSHCAPublicKey != "" {
+			problem("--rackhd-ssh-ca-key and --rackhd-ssh-ca-public-key are not supported with --rackhd-bootstrap-method=winrm")
+		}
+		if c.WinRMInsecure && !c.WinRMHTTPS {
+			problem("--rackhd-winrm-insecure requires --rackhd-winrm-https")
+		}
+	default:
+		problem("unsupported --rackhd-bootstrap-method %q. Specify ssh, winrm or graph", c.BootstrapMethod)
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
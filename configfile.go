@@ -0,0 +1,263 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"gopkg.in/yaml.v2"
+)
+
+// fileOptions answers for an option left at its default with the value of
+// --rackhd-config-file, so options given as flags or environment variables
+// override the file.
+type fileOptions struct {
+	drivers.DriverOptions
+	flags  map[string]mcnflag.Flag
+	values map[string]interface{}
+}
+
+// configFileOptions reads the --rackhd-config-file document: a JSON object,
+// or YAML, of option names without the rackhd- prefix and their values, e.g.
+// workflow-name: Graph.InstallCentOS. Named sets of options under profiles
+// are applied on top of the others with --rackhd-profile, or the profile the
+// document names.
+func (d *Driver) configFileOptions(path string, flags drivers.DriverOptions) (drivers.DriverOptions, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read --rackhd-config-file %s. Error: %s", path, err)
+	}
+	var document map[string]interface{}
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "{") {
+		err = json.Unmarshal(b, &document)
+	} else {
+		document, err = parseYAML(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("--rackhd-config-file %s is neither a JSON object nor YAML. Error: %s", path, err)
+	}
+
+	profiles, ok := document["profiles"].(map[string]interface{})
+	if _, set := document["profiles"]; set && !ok {
+		return nil, fmt.Errorf("Invalid --rackhd-config-file %s: profiles must be a mapping of profile names to options", path)
+	}
+	profile := flags.String("rackhd-profile")
+	if profile == "" {
+		profile, _ = document["profile"].(string)
+	}
+	delete(document, "profiles")
+	delete(document, "profile")
+	type optionSource struct {
+		prefix  string
+		options interface{}
+	}
+	sources := []optionSource{{"", document}}
+	if profile != "" {
+		options, ok := profiles[profile]
+		if !ok {
+			names := make([]string, 0, len(profiles))
+			for name := range profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("--rackhd-config-file %s has no profile %q. Specify one of: %s", path, profile, strings.Join(names, ", "))
+		}
+		sources = append(sources, optionSource{fmt.Sprintf("profile %q: ", profile), options})
+	}
+
+	options := &fileOptions{DriverOptions: flags, flags: make(map[string]mcnflag.Flag), values: make(map[string]interface{})}
+	for _, flag := range d.GetCreateFlags() {
+		options.flags[flag.String()] = flag
+	}
+	var problems []string
+	for _, source := range sources {
+		values, ok := source.options.(map[string]interface{})
+		if !ok {
+			problems = append(problems, source.prefix+"options must be a mapping")
+			continue
+		}
+		for key, value := range values {
+			name := "rackhd-" + strings.TrimPrefix(key, "rackhd-")
+			flag, ok := options.flags[name]
+			if !ok || name == "rackhd-config-file" || name == "rackhd-profile" {
+				problems = append(problems, fmt.Sprintf("%sunknown option %q", source.prefix, key))
+				continue
+			}
+			converted, err := convertOption(flag, value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%soption %q %s", source.prefix, key, err))
+				continue
+			}
+			options.values[name] = converted
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("Invalid --rackhd-config-file %s: %s", path, strings.Join(problems, "; "))
+	}
+	d.Profile = profile
+	return options, nil
+}
+
+// fromFile returns the value of the file for name when the flag is at its
+// default. DriverOptions does not tell whether a flag was given, so a flag
+// given with its default value, such as --rackhd-ssh-port 22 or a bool flag
+// set to false, is taken as not given and does not override the file.
+func (o *fileOptions) fromFile(name string, flagValue interface{}) (interface{}, bool) {
+	value, ok := o.values[name]
+	if !ok {
+		return nil, false
+	}
+	if flag, ok := o.flags[name]; ok && !isDefault(flag, flagValue) {
+		return nil, false
+	}
+	return value, true
+}
+
+func isDefault(flag mcnflag.Flag, value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return !v
+	case []string:
+		def, _ := flag.Default().([]string)
+		return len(v) == 0 || reflect.DeepEqual(v, def)
+	}
+	return reflect.DeepEqual(flag.Default(), value)
+}
+
+func (o *fileOptions) String(key string) string {
+	value := o.DriverOptions.String(key)
+	if file, ok := o.fromFile(key, value); ok {
+		return file.(string)
+	}
+	return value
+}
+
+func (o *fileOptions) StringSlice(key string) []string {
+	value := o.DriverOptions.StringSlice(key)
+	if file, ok := o.fromFile(key, value); ok {
+		return file.([]string)
+	}
+	return value
+}
+
+func (o *fileOptions) Int(key string) int {
+	value := o.DriverOptions.Int(key)
+	if file, ok := o.fromFile(key, value); ok {
+		return file.(int)
+	}
+	return value
+}
+
+func (o *fileOptions) Bool(key string) bool {
+	value := o.DriverOptions.Bool(key)
+	if file, ok := o.fromFile(key, value); ok {
+		return file.(bool)
+	}
+	return value
+}
+
+// convertOption converts a value of the file to the type of the flag.
+func convertOption(flag mcnflag.Flag, value interface{}) (interface{}, error) {
+	switch flag.(type) {
+	case mcnflag.StringFlag:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case float64, bool:
+			return fmt.Sprint(v), nil
+		case map[string]interface{}, []interface{}:
+			// a structured value such as workflow-options, kept as JSON
+			b, err := json.Marshal(v)
+			return string(b), err
+		}
+	case mcnflag.IntFlag:
+		switch v := value.(type) {
+		case float64:
+			if v == float64(int(v)) {
+				return int(v), nil
+			}
+		case string:
+			if n, err := strconv.Atoi(v); err == nil {
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("is not a whole number")
+	case mcnflag.BoolFlag:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("is not true or false")
+	case mcnflag.StringSliceFlag:
+		switch v := value.(type) {
+		case string:
+			return []string{v}, nil
+		case []string:
+			return v, nil
+		case []interface{}:
+			list := make([]string, 0, len(v))
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("is not a list of strings")
+				}
+				list = append(list, s)
+			}
+			return list, nil
+		}
+		return nil, fmt.Errorf("is not a list of strings")
+	}
+	return nil, fmt.Errorf("has an unsupported value")
+}
+
+// parseYAML reads a YAML document into the types encoding/json gives a JSON
+// one, which convertOption expects.
+func parseYAML(b []byte) (map[string]interface{}, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(b, &document); err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return map[string]interface{}{}, nil
+	}
+	j, err := json.Marshal(jsonValue(document))
+	if err != nil {
+		return nil, err
+	}
+	var mapping map[string]interface{}
+	if err := json.Unmarshal(j, &mapping); err != nil {
+		return nil, fmt.Errorf("the document is not a mapping of options")
+	}
+	return mapping, nil
+}
+
+// jsonValue converts the mappings yaml decodes, whose keys may be of any
+// type, to ones encoding/json can marshal.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		mapping := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			mapping[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return mapping
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = jsonValue(item)
+		}
+		return list
+	}
+	return value
+}
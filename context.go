@@ -0,0 +1,41 @@
+package rackhd
+
+import (
+	"context"
+	"time"
+)
+
+// SetContext sets the context the driver's operations run under. Once it is
+// cancelled or its deadline passes, in-flight RackHD API calls, address
+// probes and remote commands are abandoned and waits for workflows, locks and
+// reboots return. docker-machine itself has no way to pass a context to a
+// plugin, so this is for tooling using the driver as a library; the default
+// is never done.
+func (d *Driver) SetContext(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ctx = ctx
+}
+
+// context returns the context set with SetContext.
+func (d *Driver) context() context.Context {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// sleep waits for the duration, returning the context's error early if it is
+// done first.
+func (d *Driver) sleep(duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-d.context().Done():
+		return d.context().Err()
+	}
+}
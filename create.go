@@ -0,0 +1,281 @@
+package rackhd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	networkTimeout      = 10 * time.Minute
+	networkPollInterval = 10 * time.Second
+	probeTimeout        = 25 * time.Second
+)
+
+// selectNode resolves the node's IP addresses from the RackHD lookup table.
+func (d *Driver) selectNode() error {
+	if d.Adopt {
+		if err := d.checkAdoptable(); err != nil {
+			return err
+		}
+	} else if err := d.checkIdle(); err != nil {
+		return err
+	}
+	if err := d.checkOwner("create a machine on"); err != nil {
+		return err
+	}
+	if err := d.checkReserved(); err != nil {
+		return err
+	}
+	if err := d.checkPools(); err != nil {
+		return err
+	}
+	if err := d.checkFirmware(); err != nil {
+		return err
+	}
+	if err := d.checkTPM(); err != nil {
+		return err
+	}
+	if err := d.checkRedundancy(); err != nil {
+		return err
+	}
+	d.applySKUDefaults()
+	ips, err := d.lookupIPs()
+	if err != nil {
+		return err
+	}
+
+	//if the slice is empty that means there are no IPs. A node that is about to
+	//be installed may legitimately have none until the new OS requests a lease.
+	if len(ips) <= 0 && d.WorkflowName == "" {
+		return classError(ErrNoReachableIP, "No IP addresses are associated with the Node ID specified")
+	}
+	d.candidateIPs = ips
+	d.detectArch()
+
+	if !d.DryRun {
+		if err := d.claimNode(); err != nil {
+			return err
+		}
+		d.snapshotCatalogs()
+		d.pinIdentity()
+		d.recordSOL()
+	}
+	return nil
+}
+
+// powerOn makes sure the node is powered before the install graph runs; install
+// graphs reboot through the OBM, which fails on a node that is switched off.
+func (d *Driver) powerOn() error {
+	if d.WorkflowName == "" {
+		return errPhaseSkipped
+	}
+	log.Infof("Powering on node %s", d.NodeID)
+	_, err := d.runWorkflow(powerOnGraph, nil, powerWorkflowTimeout)
+	return err
+}
+
+// installOS runs the --rackhd-workflow-name graph against the node.
+func (d *Driver) installOS() error {
+	if d.WorkflowName == "" {
+		return errPhaseSkipped
+	}
+	if d.BootstrapMethod == bootstrapGraph {
+		// the installer writes the key, so it must exist before the graph runs
+		if err := d.createMachineKey(); err != nil {
+			return err
+		}
+	}
+	if err := d.uploadTemplates(); err != nil {
+		return err
+	}
+	options, err := d.installOptions()
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		log.Infof("Running workflow %s on node %s, this may take a while...", d.WorkflowName, d.NodeID)
+		d.WorkflowID, err = d.runWorkflow(d.WorkflowName, options, d.workflowTimeout())
+		if err == nil || ErrorClass(err) != ErrWorkflowFailed || attempt >= d.WorkflowRetries {
+			return err
+		}
+		// a graph that timed out is still running and would refuse the next one
+		if cerr := d.cancelActiveWorkflow(); cerr != nil {
+			return fmt.Errorf("%s; not retrying: %s", err, cerr)
+		}
+		log.Warnf("%s; retrying (%d of %d)", err, attempt+1, d.WorkflowRetries)
+	}
+}
+
+// waitForNetwork picks the first of the node's addresses that accepts
+// connections on the bootstrap port. After an OS install the node comes back
+// with a new lease, so the lookup table is polled until an address answers.
+func (d *Driver) waitForNetwork() error {
+	deadline := time.Now().Add(networkTimeout)
+	for {
+		if d.probeIPs(d.candidateIPs) {
+			return nil
+		}
+		if d.WorkflowName == "" || time.Now().After(deadline) {
+			return classError(ErrNoReachableIP, "No IP addresses are accessible on this network to the Node ID specified")
+		}
+
+		log.Debugf("Waiting for node %s to become reachable", d.NodeID)
+		if err := d.awaitEvent(d.pollInterval(networkPollInterval), nodeChanged); err != nil {
+			return err
+		}
+		ips, err := d.lookupIPs()
+		if err != nil {
+			return err
+		}
+		d.candidateIPs = ips
+	}
+}
+
+// installKey generates the machine key pair and installs the public key.
+func (d *Driver) installKey() error {
+	if err := d.createMachineKey(); err != nil {
+		return err
+	}
+	if d.BootstrapMethod == bootstrapGraph {
+		return d.installKeyGraph()
+	}
+
+	log.Infof("Copy public SSH key to %s [%s]", d.MachineName, d.IPAddress)
+	if err := d.installMachineKey(); err != nil {
+		return err
+	}
+	if d.NopasswdSudo && d.BootstrapMethod != bootstrapWinRM {
+		return d.configureSudo()
+	}
+	return nil
+}
+
+// createMachineKey generates the machine key pair, unless it was generated
+// earlier in the create.
+func (d *Driver) createMachineKey() error {
+	if d.SSHKey != "" {
+		return nil
+	}
+	//create public SSH key
+	log.Infof("Creating SSH key...")
+	key, err := d.createSSHKey()
+	if err != nil {
+		return err
+	}
+	d.SSHKey = strings.TrimSpace(key)
+	return nil
+}
+
+// installMachineKey gives the machine key access to the node: through
+// authorized_keys, or through a certificate of --rackhd-ssh-ca-key, which
+// replaces the authorized_keys entry.
+func (d *Driver) installMachineKey() error {
+	if d.BootstrapMethod == bootstrapWinRM {
+		return d.installSSHKeyWinRM()
+	}
+	if d.SSHCAKey != "" {
+		if err := d.signMachineKey(); err != nil {
+			return err
+		}
+		return d.installSSHCA()
+	}
+	if err := d.installSSHKey(); err != nil {
+		return err
+	}
+	if d.SSHCAPublicKey != "" {
+		return d.installSSHCA()
+	}
+	return nil
+}
+
+// verify confirms key authentication works, then applies the optional
+// hardening and tunnel settings that depend on it.
+func (d *Driver) verify() error {
+	log.Infof("Verifying key authentication to %s [%s]", d.MachineName, d.IPAddress)
+	if err := d.verifyKeyAuth(); err != nil {
+		return err
+	}
+
+	if d.DisablePasswordAuth {
+		log.Infof("Disabling SSH password authentication on %s [%s]", d.MachineName, d.IPAddress)
+		if err := d.disablePasswordAuth(); err != nil {
+			return err
+		}
+	}
+
+	if d.SSHTunnel {
+		if err := d.pickTunnelPort(); err != nil {
+			return err
+		}
+		log.Infof("Docker API will be reached through an SSH tunnel on %s", d.tunnelAddr())
+	}
+	return nil
+}
+
+// checkIdle refuses a node RackHD is running a graph on, such as a discovery
+// or another consumer's install, which the create would interfere with.
+func (d *Driver) checkIdle() error {
+	active, err := d.activeWorkflow()
+	if err != nil {
+		return err
+	}
+	if active != nil {
+		return fmt.Errorf("Node %s is running workflow %s (%s). Wait for it to finish, or cancel it in RackHD", d.NodeID, active.Name, active.InstanceID)
+	}
+	return nil
+}
+
+// lookupEntry is one record of the RackHD lookup table.
+type lookupEntry struct {
+	MACAddress string `json:"macAddress"`
+	IPAddress  string `json:"ipAddress"`
+	Node       string `json:"node"`
+}
+
+// lookupIPs returns all IP addresses RackHD's lookup table holds for the node.
+// Entries without an address are skipped rather than failing the lookup.
+func (d *Driver) lookupIPs() ([]string, error) {
+	// new slice for all IP addresses found for the node
+	ipAddSlice := make([]string, 0)
+
+	// do a lookup on the ID to retrieve IP information
+	err := d.eachLookup(d.NodeID, func(entry lookupEntry) error {
+		// the query matches any field, so leave out entries of other nodes
+		if entry.IPAddress == "" || (entry.Node != "" && entry.Node != d.NodeID) {
+			return nil
+		}
+		log.Debugf("Found IP Address for Node ID: %v", entry.IPAddress)
+		ipAddSlice = append(ipAddSlice, entry.IPAddress)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to look up node %s. Error: %w", d.NodeID, describedAPIError{err})
+	}
+	return ipAddSlice, nil
+}
+
+// probeIPs sets d.IPAddress to the first address accepting connections on the
+// bootstrap port and reports whether one was found.
+func (d *Driver) probeIPs(ips []string) bool {
+	defer d.track(timingProbe, time.Now())
+	// loop through slice and see if we can connect to the ip:ssh-port (or winrm port)
+	for _, ipAddy := range ips {
+		if d.context().Err() != nil {
+			return false
+		}
+		ipPort := ipAddy + ":" + strconv.Itoa(d.bootstrapPort())
+		log.Debugf("Testing connection to: %v", ipPort)
+		conn, err := d.dial(ipPort, probeTimeout)
+		if err != nil {
+			log.Debugf("Connection failed on: %v", ipPort)
+		} else {
+			log.Infof("Connection succeeded on: %v", ipPort)
+			d.IPAddress = string(ipAddy)
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
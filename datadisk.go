@@ -0,0 +1,83 @@
+package rackhd
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	dockerDataDir  = "/var/lib/docker"
+	dataDiskAuto   = "auto"
+	driveIDCatalog = "driveId"
+)
+
+// catalogDrive is one entry of the driveId catalog.
+type catalogDrive struct {
+	DevName   string `json:"devName"`
+	LinuxWwid string `json:"linuxWwid"`
+}
+
+// device is the most stable path to the drive on the installed OS.
+func (c catalogDrive) device() string {
+	if c.LinuxWwid != "" {
+		return c.LinuxWwid
+	}
+	return "/dev/" + c.DevName
+}
+
+// dataDiskCandidates returns the drives --rackhd-docker-data-disk may refer
+// to: the one named by device name or WWID, or every drive for auto.
+func (d *Driver) dataDiskCandidates() ([]catalogDrive, error) {
+	var drives []catalogDrive
+	if err := d.getCatalog(driveIDCatalog, &drives); err != nil {
+		return nil, err
+	}
+	if d.DockerDataDisk == dataDiskAuto {
+		return drives, nil
+	}
+	want := strings.TrimPrefix(d.DockerDataDisk, "/dev/")
+	for _, drive := range drives {
+		if drive.DevName == want || drive.LinuxWwid == d.DockerDataDisk {
+			return []catalogDrive{drive}, nil
+		}
+	}
+	return nil, fmt.Errorf("Node %s has no drive %q in its %s catalog", d.NodeID, d.DockerDataDisk, driveIDCatalog)
+}
+
+// prepareDataDisk formats the chosen drive and mounts it at /var/lib/docker
+// so images and containers do not fill the OS disk. Drives with a mounted
+// filesystem, such as the boot disk, are never formatted, so a resumed or
+// repeated create keeps the data disk it mounted before. The storage driver
+// is docker-machine's to set, with --engine-storage-driver.
+func (d *Driver) prepareDataDisk() error {
+	if err := d.runKeyCommands([]string{fmt.Sprintf("mountpoint -q %s", dockerDataDir)}); err == nil {
+		log.Infof("%s is mounted on %s already, leaving it as it is", dockerDataDir, d.MachineName)
+		return nil
+	}
+	drives, err := d.dataDiskCandidates()
+	if err != nil {
+		return err
+	}
+	for _, drive := range drives {
+		dev := drive.device()
+		// fails if the drive or any of its partitions is mounted
+		inUse := fmt.Sprintf("test -b %s && ! lsblk -no MOUNTPOINT %s | grep -q .", dev, dev)
+		if err := d.runKeyCommands([]string{inUse}); err != nil {
+			log.Debugf("Not using %s as the Docker data disk: %s", dev, err)
+			continue
+		}
+
+		log.Infof("Formatting %s and mounting it at %s on %s", dev, dockerDataDir, d.MachineName)
+		// xfs needs ftype=1 for overlay2; ext4 is the fallback where xfsprogs is
+		// missing. nofail keeps a node whose data disk fails booting, and the
+		// fstab entry of an earlier run is replaced rather than repeated.
+		return d.runKeyCommands([]string{
+			fmt.Sprintf("if command -v mkfs.xfs >/dev/null; then mkfs.xfs -f -n ftype=1 %s; else mkfs.ext4 -F %s; fi", dev, dev),
+			fmt.Sprintf("mkdir -p %s", dockerDataDir),
+			fmt.Sprintf("sed -i '\\| %s |d' /etc/fstab", dockerDataDir),
+			fmt.Sprintf("echo \"UUID=$(blkid -s UUID -o value %s) %s $(blkid -s TYPE -o value %s) defaults,nofail 0 2\" >> /etc/fstab", dev, dockerDataDir, dev),
+			fmt.Sprintf("mount %s", dockerDataDir),
+		})
+	}
+	return fmt.Errorf("No unused drive matching --rackhd-docker-data-disk=%s was found on %s", d.DockerDataDisk, d.MachineName)
+}
@@ -0,0 +1,93 @@
+package rackhd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const diskHealthWorkflowTimeout = 20 * time.Minute
+
+// smartDisk is one entry of the smart catalog, smartctl's report on a drive.
+type smartDisk struct {
+	Device string `json:"OS Device Name"`
+	SMART  struct {
+		Identity struct {
+			Model    string `json:"Device Model"`
+			Serial   string `json:"Serial Number"`
+			Capacity string `json:"User Capacity"`
+		} `json:"Identity"`
+		SelfAssessment string `json:"Self-Assessment"`
+		Attributes     struct {
+			Attributes []struct {
+				ID    string `json:"ID#"`
+				Name  string `json:"ATTRIBUTE_NAME"`
+				Value string `json:"RAW_VALUE"`
+			} `json:"Attributes"`
+		} `json:"Attributes"`
+	} `json:"SMART"`
+}
+
+// rawAttribute returns the raw value of a SMART attribute by ID, or 0 when
+// the drive does not report it.
+func (s *smartDisk) rawAttribute(id string) int {
+	for _, attr := range s.SMART.Attributes.Attributes {
+		if attr.ID == id {
+			// raw values may carry details, as in "0 (Average 0)"
+			n, _ := strconv.Atoi(strings.Fields(attr.Value + " ")[0])
+			return n
+		}
+	}
+	return 0
+}
+
+// SMART attributes a failing drive shows first.
+const (
+	smartReallocated = "5"
+	smartPending     = "197"
+	smartUncorrect   = "198"
+)
+
+// checkDiskHealth refuses a node with a drive that fails its SMART
+// self-assessment or has sectors pending reallocation, which is how a drive
+// about to die usually looks. It reads the node's smart catalog, refreshed
+// first by --rackhd-disk-health-workflow when set.
+func (d *Driver) checkDiskHealth() (string, error) {
+	if d.IgnoreDiskHealth {
+		return "--rackhd-ignore-disk-health is set", errCheckSkipped
+	}
+	if d.DiskHealthWorkflow != "" && !d.DryRun {
+		if _, err := d.runWorkflow(d.DiskHealthWorkflow, nil, diskHealthWorkflowTimeout); err != nil {
+			return "", err
+		}
+	}
+	var disks []smartDisk
+	if err := d.getCatalog("smart", &disks); err != nil {
+		return "", checkWarning{fmt.Sprintf("disk health unknown: %s", err)}
+	}
+
+	var failing []string
+	reallocated := 0
+	for _, disk := range disks {
+		var problems []string
+		if status := disk.SMART.SelfAssessment; status != "" && status != "PASSED" {
+			problems = append(problems, "SMART status "+status)
+		}
+		if n := disk.rawAttribute(smartPending); n > 0 {
+			problems = append(problems, fmt.Sprintf("%d sectors pending reallocation", n))
+		}
+		if n := disk.rawAttribute(smartUncorrect); n > 0 {
+			problems = append(problems, fmt.Sprintf("%d uncorrectable sectors", n))
+		}
+		if len(problems) > 0 {
+			failing = append(failing, fmt.Sprintf("%s: %s", disk.Device, strings.Join(problems, ", ")))
+		}
+		reallocated += disk.rawAttribute(smartReallocated)
+	}
+	if len(failing) > 0 {
+		return "", fmt.Errorf("Node %s has failing drives (%s). Replace them, or set --rackhd-ignore-disk-health to provision anyway",
+			d.NodeID, strings.Join(failing, "; "))
+	}
+	return fmt.Sprintf("%d drive(s) healthy, %d sector(s) reallocated", len(disks), reallocated), nil
+}
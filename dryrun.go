@@ -0,0 +1,107 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// dryRun resolves the node, its addresses and the planned workflow using read
+// only API calls and TCP probes, prints the plan and then fails on purpose so
+// docker-machine stops before anything is created or changed.
+func (d *Driver) dryRun() error {
+	log.Infof("Dry run: nothing will be changed on RackHD or the node")
+
+	node, err := d.getNode()
+	if err != nil {
+		return err
+	}
+	log.Infof("Dry run: node %s (name %q, type %s)", node.ID, node.Name, node.Type)
+
+	if err := d.selectNode(); err != nil {
+		return err
+	}
+	log.Infof("Dry run: addresses known to RackHD: %v", d.candidateIPs)
+
+	if d.BMCUser != "" {
+		log.Infof("Dry run: would create IPMI OBM settings as %s if the node has none, and verify power control with %s", d.BMCUser, powerOnGraph)
+	}
+
+	if d.BIOSSettings != "" {
+		if _, err := d.getClient().GetWorkflowDefinition(d.context(), d.biosWorkflow()); err != nil {
+			return fmt.Errorf("Workflow %s is not defined on %s. Error: %s", d.biosWorkflow(), d.Endpoint, apiError(err))
+		}
+		options, err := d.biosOptions()
+		if err != nil {
+			return err
+		}
+		encoded, _ := json.Marshal(options)
+		log.Infof("Dry run: would run %s with options %s to apply the BIOS settings", d.biosWorkflow(), encoded)
+	}
+	if d.RAIDConfig != "" {
+		if _, err := d.getClient().GetWorkflowDefinition(d.context(), d.raidWorkflow()); err != nil {
+			return fmt.Errorf("Workflow %s is not defined on %s. Error: %s", d.raidWorkflow(), d.Endpoint, apiError(err))
+		}
+		_, options, err := d.raidPlan()
+		if err != nil {
+			return err
+		}
+		encoded, _ := json.Marshal(options)
+		log.Infof("Dry run: would run %s with options %s to configure RAID", d.raidWorkflow(), encoded)
+	}
+	if d.WorkflowName != "" {
+		options, err := d.installOptions()
+		if err != nil {
+			return err
+		}
+		if _, err := d.getClient().GetWorkflowDefinition(d.context(), d.WorkflowName); err != nil {
+			return fmt.Errorf("Workflow %s is not defined on %s. Error: %s", d.WorkflowName, d.Endpoint, apiError(err))
+		}
+		templates, err := d.templateFiles()
+		if err != nil {
+			return err
+		}
+		for _, template := range templates {
+			log.Infof("Dry run: would upload %s as template %s unless RackHD has it", template.path, template.name())
+		}
+		encoded, _ := json.Marshal(options)
+		log.Infof("Dry run: would run %s to power on the node", powerOnGraph)
+		log.Infof("Dry run: would run workflow %s with options %s (timeout %s)", d.WorkflowName, encoded, d.workflowTimeout())
+		log.Infof("Dry run: would then wait up to %s for the installed OS to answer on port %d", networkTimeout, d.bootstrapPort())
+	} else {
+		if !d.probeIPs(d.candidateIPs) {
+			return classError(ErrNoReachableIP, "No IP addresses are accessible on this network to the Node ID specified")
+		}
+		log.Infof("Dry run: target IP %s", d.IPAddress)
+	}
+
+	switch {
+	case d.BootstrapMethod == bootstrapGraph && d.WorkflowName != "":
+		log.Infof("Dry run: would generate machine key %s and have %s install it for %s", d.GetSSHKeyPath(), d.WorkflowName, d.SSHUser)
+	case d.BootstrapMethod == bootstrapGraph:
+		log.Infof("Dry run: would generate machine key %s, register workflow %s and run it to install the key for %s", d.GetSSHKeyPath(), keyGraph, d.SSHUser)
+	default:
+		log.Infof("Dry run: would generate machine key %s and install it for %s via %s as %s",
+			d.GetSSHKeyPath(), d.SSHUser, d.BootstrapMethod, d.bootstrapUser())
+	}
+	if d.RestrictedBootstrap {
+		log.Infof("Dry run: restricted bootstrap, would run only:\n%s", strings.Join(d.keyInstallCommands(), "\n"))
+	}
+	if d.SSHCAKey != "" || d.SSHCAPublicKey != "" {
+		log.Infof("Dry run: would make sshd trust the SSH CA for principals %s", strings.Join(d.sshPrincipals(), ", "))
+	}
+	if d.NopasswdSudo && d.SSHUser != "root" {
+		log.Infof("Dry run: would give %s passwordless sudo", d.SSHUser)
+	}
+	if d.DisablePasswordAuth {
+		log.Infof("Dry run: would disable sshd password authentication")
+	}
+	if d.SSHTunnel {
+		log.Infof("Dry run: would reach the Docker API through an SSH tunnel")
+	}
+	if d.PostInstallScript != "" {
+		log.Infof("Dry run: would run post-install script %s", d.PostInstallScript)
+	}
+
+	return fmt.Errorf("Dry run complete for node %s, no changes were made", d.NodeID)
+}
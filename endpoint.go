@@ -0,0 +1,46 @@
+package rackhd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// normalizeEndpoint accepts --rackhd-endpoint as host:port or as an http or
+// https URL without a path, and returns the host:port the API client expects
+// with the transport to use. The scheme of a URL is the transport, unless it
+// contradicts a --rackhd-transport other than the default.
+func normalizeEndpoint(endpoint, transport string) (string, string, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid --rackhd-endpoint %q. Error: %s", endpoint, err)
+		}
+		scheme := strings.ToLower(u.Scheme)
+		if scheme != "http" && scheme != "https" {
+			return "", "", fmt.Errorf("unsupported scheme %q of --rackhd-endpoint %q. Specify http or https", u.Scheme, endpoint)
+		}
+		if transport != defaultTransport && transport != scheme {
+			return "", "", fmt.Errorf("--rackhd-endpoint %q is %s but --rackhd-transport is %s", endpoint, scheme, transport)
+		}
+		if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+			return "", "", fmt.Errorf("--rackhd-endpoint %q cannot have a path, query or user info. Specify host:port", endpoint)
+		}
+		endpoint, transport = u.Host, scheme
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+	if strings.Contains(endpoint, "/") {
+		return "", "", fmt.Errorf("--rackhd-endpoint %q cannot have a path. Specify host:port", endpoint)
+	}
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil || host == "" {
+		return "", "", fmt.Errorf("invalid --rackhd-endpoint %q. Specify host:port, such as %s", endpoint, defaultEndpoint)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port %q of --rackhd-endpoint %q", port, endpoint)
+	}
+	return endpoint, transport, nil
+}
@@ -0,0 +1,165 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	daemonConfigPath = "/etc/docker/daemon.json"
+	rackTagPrefix    = "rack:"
+)
+
+// configureEngine prepares the node for the Docker engine docker-machine
+// installs after the driver returns. Settings that have no engine flag of
+// their own for docker-machine to pass go into daemon.json, apart from the
+// labels, see applyEngineLabels.
+func (d *Driver) configureEngine() error {
+	skipped := true
+	if d.DockerDataDisk != "" {
+		if err := d.prepareDataDisk(); err != nil {
+			return err
+		}
+		skipped = false
+	}
+	if len(d.proxyEnv()) > 0 {
+		if err := d.configureProxy(); err != nil {
+			return err
+		}
+		skipped = false
+	}
+	if d.ConfigureFirewall {
+		if err := d.configureFirewall(); err != nil {
+			return err
+		}
+		skipped = false
+	}
+
+	config := make(map[string]interface{})
+	var labels []string
+	if d.HardwareLabels {
+		hardware, err := d.hardwareLabels()
+		if err != nil {
+			return err
+		}
+		labels = append(labels, hardware...)
+	}
+	if d.GPULabels || d.GPURuntime {
+		gpu, err := d.configureGPUs(config)
+		if err != nil {
+			return err
+		}
+		if d.GPULabels {
+			labels = append(labels, gpu...)
+		}
+	}
+	if len(labels) > 0 {
+		if err := d.applyEngineLabels(labels); err != nil {
+			return err
+		}
+		skipped = false
+	}
+	d.registryConfig(config)
+
+	if len(config) == 0 {
+		if skipped {
+			return errPhaseSkipped
+		}
+		return nil
+	}
+	return d.writeDaemonConfig(config)
+}
+
+// hardwareLabels derives engine labels from the node's SKU, DMI catalog,
+// topology and rack:<name> tag, so Swarm constraints can target hardware
+// classes.
+func (d *Driver) hardwareLabels() ([]string, error) {
+	node, err := d.getNode()
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	if node.SKU != "" {
+		labels["rackhd.sku"] = d.skuName(node.SKU)
+	}
+	for _, tag := range node.Tags {
+		if strings.HasPrefix(tag, rackTagPrefix) {
+			labels["rackhd.rack"] = strings.TrimPrefix(tag, rackTagPrefix)
+		}
+	}
+	if info, err := d.systemInfo(); err != nil {
+		log.Warnf("Not adding serial and vendor labels: %s", err)
+	} else {
+		labels["rackhd.serial"] = info.SerialNumber
+		labels["rackhd.vendor"] = info.Manufacturer
+		labels["rackhd.product"] = info.ProductName
+	}
+	if topo, err := d.topology(); err != nil {
+		log.Warnf("Not adding topology labels: %s", err)
+	} else {
+		for key, value := range topo.labels() {
+			labels[key] = value
+		}
+	}
+	labels["rackhd.node"] = d.NodeID
+	labels["rackhd.arch"] = d.goarch()
+
+	var list []string
+	for key, value := range labels {
+		if value != "" {
+			list = append(list, key+"="+value)
+		}
+	}
+	sort.Strings(list)
+	log.Debugf("Hardware labels for %s: %v", d.MachineName, list)
+	return list, nil
+}
+
+// skuName resolves a SKU ID to its name, falling back to the ID.
+func (d *Driver) skuName(id string) string {
+	payload, err := d.getClient().GetSKU(d.context(), id)
+	if err != nil {
+		log.Debugf("Unable to get SKU %s: %s", id, apiError(err))
+		return id
+	}
+	name, err := d.adapter().skuName(payload)
+	if err != nil || name == "" {
+		return id
+	}
+	return name
+}
+
+// writeDaemonConfig writes the engine's daemon.json, keeping any file already
+// on the node as daemon.json.rackhd-backup.
+func (d *Driver) writeDaemonConfig(config map[string]interface{}) error {
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Infof("Writing %s on %s [%s]", daemonConfigPath, d.MachineName, d.IPAddress)
+	return d.runKeyCommands([]string{
+		fmt.Sprintf("mkdir -p %s", daemonConfigPath[:strings.LastIndex(daemonConfigPath, "/")]),
+		fmt.Sprintf("if [ -f %s ]; then cp %s %s.rackhd-backup; fi", daemonConfigPath, daemonConfigPath, daemonConfigPath),
+		fmt.Sprintf("echo %s > %s", shellQuote(string(b)), daemonConfigPath),
+	})
+}
+
+// runKeyCommands runs commands as root over the machine key session.
+func (d *Driver) runKeyCommands(commands []string) error {
+	for _, command := range commands {
+		if err := executeSSHKeyCommand(d.asRootKey(command), d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// asRootKey is asRoot for commands run as SSHUser with the machine key.
+func (d *Driver) asRootKey(command string) string {
+	if d.SSHUser == "root" {
+		return command
+	}
+	return fmt.Sprintf("sudo -n sh -c %s", shellQuote(command))
+}
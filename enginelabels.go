@@ -0,0 +1,67 @@
+package rackhd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	labelsDropIn  = "/etc/systemd/system/docker.service.d/20-rackhd-labels.conf"
+	labelsWrapper = "/usr/local/bin/docker-machine-rackhd-dockerd"
+	machineDropIn = "/etc/systemd/system/docker.service.d/10-machine.conf"
+)
+
+// labelsScript runs the dockerd command line of the docker unit with
+// the labels added. docker-machine writes its command line, with its own
+// --label provider=rackhd, to 10-machine.conf once the driver has returned;
+// the engine of a node that is not provisioned yet runs the packaged unit.
+const labelsScript = `#!/bin/sh
+# written by docker-machine-rackhd, see %s
+for unit in %s /etc/systemd/system/docker.service /lib/systemd/system/docker.service /usr/lib/systemd/system/docker.service; do
+	cmd=$(sed -n 's/^ExecStart=//p' "$unit" 2>/dev/null | grep . | tail -n 1)
+	[ -n "$cmd" ] && break
+done
+if [ -z "$cmd" ]; then
+	echo "No dockerd command line found in the docker unit" >&2
+	exit 1
+fi
+eval "set -- $cmd"
+exec "$@"%s
+`
+
+// applyEngineLabels gives the engine the labels. dockerd refuses labels both
+// as flags and in daemon.json, and docker-machine always passes --label, so
+// they are added to its command line: a systemd drop-in, ordered after the
+// 10-machine.conf of docker-machine, starts dockerd through a wrapper that
+// appends them. The drop-in survives docker-machine provision, which rewrites
+// only 10-machine.conf.
+func (d *Driver) applyEngineLabels(labels []string) error {
+	d.EngineLabels = labels
+	script := labelsWrapperScript(machineDropIn, labels)
+	unit := strings.Join([]string{"[Service]", "ExecStart=", "ExecStart=" + labelsWrapper}, "\n")
+
+	log.Infof("Labelling the engine of %s with %s", d.MachineName, strings.Join(labels, " "))
+	commands := []string{
+		"command -v systemctl >/dev/null",
+		fmt.Sprintf("mkdir -p %s %s", path.Dir(labelsWrapper), path.Dir(labelsDropIn)),
+		fmt.Sprintf("echo %s > %s", shellQuote(script), labelsWrapper),
+		fmt.Sprintf("chmod 755 %s", labelsWrapper),
+		fmt.Sprintf("echo %s > %s", shellQuote(unit), labelsDropIn),
+		"systemctl daemon-reload",
+	}
+	if err := d.runKeyCommands(commands); err != nil {
+		return fmt.Errorf("Unable to label the engine; the labels need a systemd node. Error: %w", err)
+	}
+	return nil
+}
+
+// labelsWrapperScript is labelsScript for the labels, taking the dockerd
+// command line from dropIn first.
+func labelsWrapperScript(dropIn string, labels []string) string {
+	var flags string
+	for _, label := range labels {
+		flags += " --label " + shellQuote(label)
+	}
+	return fmt.Sprintf(labelsScript, labelsDropIn, shellQuote(dropIn), flags)
+}
@@ -0,0 +1,70 @@
+package rackhd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const engineDialTimeout = 10 * time.Second
+
+// engineDiagnostics are run on the node when the Docker API cannot be reached,
+// each one allowed to fail.
+var engineDiagnostics = []string{
+	"systemctl is-active docker",
+	"systemctl status docker --no-pager -l 2>&1 | tail -n 20",
+	"journalctl -u docker --no-pager -n 20 2>&1",
+	fmt.Sprintf("ss -ltn 2>/dev/null | grep ':%d ' || netstat -ltn 2>/dev/null | grep ':%d '", dockerPort, dockerPort),
+	"firewall-cmd --list-ports 2>/dev/null || ufw status 2>/dev/null || iptables -S INPUT 2>/dev/null | head -n 30",
+}
+
+// VerifyEngine checks from the client side that the Docker API port accepts
+// connections, through the tunnel in tunnel mode. It is not part of GetURL:
+// docker-machine reads the URL before it configures the engine to listen on
+// the port, and on every ls. Start runs it, as can tooling once a create has
+// finished; once it passed it is not repeated. On failure the node's engine
+// and firewall state is put into the error instead of leaving the user with a
+// bare TLS timeout.
+func (d *Driver) VerifyEngine() error {
+	if d.EngineVerified {
+		return nil
+	}
+	ip, err := d.GetIP()
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(dockerPort))
+	if d.SSHTunnel {
+		if err := d.ensureTunnel(); err != nil {
+			return err
+		}
+		addr = d.tunnelAddr()
+	}
+	conn, err := d.dial(addr, engineDialTimeout)
+	if err == nil {
+		conn.Close()
+		d.EngineVerified = true
+		log.Debugf("Docker API of %s is reachable on %s", d.MachineName, addr)
+		return nil
+	}
+	log.Warnf("Docker API of %s is not reachable on %s, gathering diagnostics", d.MachineName, addr)
+	return fmt.Errorf("The Docker API of %s is not reachable on %s. Error: %s\n%s", d.MachineName, addr, err, d.engineDiagnostics())
+}
+
+func (d *Driver) engineDiagnostics() string {
+	if d.RestrictedBootstrap {
+		return "Diagnostics are not gathered on the node with --rackhd-restricted-bootstrap"
+	}
+	var report []string
+	for _, command := range engineDiagnostics {
+		// keep the output of commands that report a problem through their exit status
+		out, err := executeSSHKeyCommandOutput(d.asRootKey("("+command+") 2>&1; true"), d)
+		if err != nil && out == "" {
+			out = err.Error()
+		}
+		report = append(report, fmt.Sprintf("$ %s\n%s", command, strings.TrimSpace(out)))
+	}
+	return strings.Join(report, "\n")
+}
@@ -0,0 +1,186 @@
+package rackhd
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-swagger/go-swagger/httpkit"
+)
+
+// Failure classes of driver errors. Errors returned by the driver for these
+// failures are *Error values whose Class is one of these, so tooling can
+// branch on the class with ErrorClass.
+var (
+	ErrNodeNotFound   = errors.New("node-not-found")
+	ErrNoReachableIP  = errors.New("no-reachable-ip")
+	ErrWorkflowFailed = errors.New("workflow-failed")
+	ErrAuth           = errors.New("auth")
+
+	ErrIdentityMismatch = errors.New("identity-mismatch")
+	ErrOwnerMismatch    = errors.New("owner-mismatch")
+)
+
+// Error is a driver error of a known failure class. docker-machine passes
+// plugin errors on as plain text, so the class is also part of the message,
+// e.g. "No IP addresses are accessible ... [rackhd:no-reachable-ip]".
+type Error struct {
+	Class error
+	msg   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s [rackhd:%s]", e.msg, e.Class)
+}
+
+// Unwrap returns the failure class.
+func (e *Error) Unwrap() error {
+	return e.Class
+}
+
+func classError(class error, format string, args ...interface{}) error {
+	return &Error{Class: class, msg: fmt.Sprintf(format, args...)}
+}
+
+// ErrorClass returns the failure class of err, or nil if it is not a classified error.
+func ErrorClass(err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Class
+	}
+	return nil
+}
+
+// describedAPIError renders an API error with apiError, for wrapping with %w
+// without losing the error itself.
+type describedAPIError struct {
+	err error
+}
+
+func (e describedAPIError) Error() string {
+	return apiError(e.err)
+}
+
+func (e describedAPIError) Unwrap() error {
+	return e.err
+}
+
+// monorailError is the error document RackHD returns with failed requests.
+type monorailError struct {
+	Message string      `json:"message"`
+	Code    interface{} `json:"code"`
+	Status  interface{} `json:"status"`
+	Fields  interface{} `json:"fields"`
+	Context interface{} `json:"context"`
+	Errors  interface{} `json:"errors"`
+}
+
+// parts renders the message and the details the error carries.
+func (e monorailError) parts() []string {
+	var parts []string
+	if e.Message != "" {
+		parts = append(parts, e.Message)
+	}
+	for _, extra := range []struct {
+		name  string
+		value interface{}
+	}{{"code", e.Code}, {"fields", e.Fields}, {"context", e.Context}, {"errors", e.Errors}} {
+		if s := fmt.Sprint(extra.value); extra.value != nil && s != "" && s != "0" {
+			parts = append(parts, fmt.Sprintf("%s: %v", extra.name, extra.value))
+		}
+	}
+	return parts
+}
+
+// apiError describes a failed RackHD API call including the status code and
+// the Monorail error payload. Swagger generated errors only render the
+// operation and a pointer address, hiding what the server actually said.
+func apiError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if e, ok := err.(*httpkit.APIError); ok {
+		parts := []string{fmt.Sprintf("%s returned unexpected status %d", e.OperationName, e.Code)}
+		if body, ok := e.Response.(monorailError); ok {
+			parts = append(parts, body.parts()...)
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	v := reflect.ValueOf(err)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return err.Error()
+	}
+
+	var parts []string
+	operation, _ := parseSwaggerMessage(err.Error())
+	status := apiStatus(err)
+	if operation != "" {
+		parts = append(parts, operation)
+	}
+	if status != "" {
+		parts = append(parts, "status "+status)
+	}
+
+	payload := v.FieldByName("Payload")
+	if payload.IsValid() && payload.CanInterface() {
+		var body monorailError
+		if decodePayload(payload.Interface(), &body) == nil {
+			parts = append(parts, body.parts()...)
+		}
+	}
+
+	if len(parts) == 0 {
+		return err.Error()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseSwaggerMessage extracts the operation and status code from swagger
+// messages of the form "[GET /nodes/{identifier}][404] getNodesIdentifierNotFound ...".
+func parseSwaggerMessage(msg string) (operation, status string) {
+	if !strings.HasPrefix(msg, "[") {
+		return "", ""
+	}
+	fields := strings.SplitN(msg[1:], "]", 3)
+	if len(fields) < 3 || !strings.HasPrefix(fields[1], "[") {
+		return "", ""
+	}
+	return fields[0], fields[1][1:]
+}
+
+// apiStatus returns the HTTP status of a failed swagger call, if known.
+func apiStatus(err error) string {
+	if err == nil {
+		return ""
+	}
+	if e, ok := err.(*httpkit.APIError); ok {
+		return fmt.Sprint(e.Code)
+	}
+	if coder, ok := err.(interface {
+		Code() int
+	}); ok {
+		return fmt.Sprint(coder.Code())
+	}
+	_, status := parseSwaggerMessage(err.Error())
+	return status
+}
+
+// isAuthError reports whether a swagger error carries a 401 or 403 status.
+func isAuthError(err error) bool {
+	status := apiStatus(err)
+	return status == "401" || status == "403"
+}
+
+func isNotFound(err error) bool {
+	return apiStatus(err) == "404"
+}
+
+// isSSHAuthError reports whether an SSH dial failed because the credentials were refused.
+func isSSHAuthError(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
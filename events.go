@@ -0,0 +1,224 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultAMQPExchange = "on.events"
+
+	// eventFallbackInterval is how often waits poll RackHD while events are
+	// subscribed, in case one is missed.
+	eventFallbackInterval = time.Minute
+	eventBuffer           = 64
+)
+
+// rackhdEvent is a notification RackHD publishes about a node: discovery,
+// graph (workflow) progress, poller alerts and so on.
+type rackhdEvent struct {
+	RoutingKey string          `json:"-"`
+	Type       string          `json:"type"`
+	Action     string          `json:"action"`
+	Severity   string          `json:"severity"`
+	TypeID     string          `json:"typeId"`
+	NodeID     string          `json:"nodeId"`
+	Data       json.RawMessage `json:"data"`
+}
+
+func (e rackhdEvent) String() string {
+	if e.Type == "" {
+		return e.RoutingKey
+	}
+	s := fmt.Sprintf("%s %s", e.Type, e.Action)
+	if e.Severity != "" && e.Severity != "information" {
+		s += " (" + e.Severity + ")"
+	}
+	if e.TypeID != "" {
+		s += " " + e.TypeID
+	}
+	return s
+}
+
+// eventSubscription is a running subscription to the node's events.
+type eventSubscription interface {
+	Close() error
+}
+
+// amqpSubscription consumes the node's events from RackHD's event exchange.
+type amqpSubscription struct {
+	conn *amqp.Connection
+}
+
+func (s *amqpSubscription) Close() error {
+	return s.conn.Close()
+}
+
+// subscribeAMQP binds an exclusive, auto-deleted queue to the event exchange
+// for everything routed to nodeID and hands each event to handler.
+func subscribeAMQP(uri, exchange, nodeID string, handler func(rackhdEvent)) (*amqpSubscription, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to AMQP at %s. Error: %s", redactURI(uri), err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// RackHD routing keys end in the node ID, e.g. graph.finished.information.<graphId>.<nodeId>
+	if err := ch.QueueBind(q.Name, "#."+nodeID, exchange, false, nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to bind to AMQP exchange %s. Error: %s", exchange, err)
+	}
+	deliveries, err := ch.Consume(q.Name, "docker-machine-rackhd", true, true, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go func() {
+		for delivery := range deliveries {
+			event := rackhdEvent{}
+			if err := json.Unmarshal(delivery.Body, &event); err != nil {
+				log.Debugf("Ignoring undecodable RackHD event %s: %s", delivery.RoutingKey, err)
+			}
+			event.RoutingKey = delivery.RoutingKey
+			handler(event)
+		}
+	}()
+
+	return &amqpSubscription{conn: conn}, nil
+}
+
+// watchEvents logs the node's RackHD events while an operation runs, when
+// --rackhd-amqp-uri or, where AMQP is not exposed, --rackhd-websocket-url is
+// set, and wakes the waits of the operation with them, see awaitEvent. Call
+// the returned function to stop watching. The waits fall back to polling, so
+// subscription failures are just warnings.
+func (d *Driver) watchEvents() func() {
+	handler := func(event rackhdEvent) {
+		log.Infof("RackHD event on node %s: %s", d.NodeID, event)
+		if events := d.nodeEvents(); events != nil {
+			select {
+			case events <- event:
+			default:
+				// a waiter missing an event polls at the fallback interval
+			}
+		}
+	}
+	var sub eventSubscription
+	var err error
+	switch {
+	case d.AMQPURI != "":
+		sub, err = subscribeAMQP(d.AMQPURI, d.amqpExchange(), d.NodeID, handler)
+	case d.WebsocketURL != "":
+		sub, err = subscribeWebsocket(d, d.WebsocketURL, d.NodeID, handler)
+	default:
+		return func() {}
+	}
+	if err != nil {
+		log.Warnf("Not watching RackHD events: %s", err)
+		return func() {}
+	}
+	d.mu.Lock()
+	d.events = make(chan rackhdEvent, eventBuffer)
+	d.mu.Unlock()
+	return func() {
+		sub.Close()
+		d.mu.Lock()
+		d.events = nil
+		d.mu.Unlock()
+	}
+}
+
+// nodeEvents is the channel of the node's events while watchEvents runs.
+func (d *Driver) nodeEvents() chan rackhdEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.events
+}
+
+// pollInterval is how long a wait polling RackHD pauses between polls: the
+// interval given, or eventFallbackInterval while events wake it instead.
+func (d *Driver) pollInterval(interval time.Duration) time.Duration {
+	if d.nodeEvents() != nil && interval < eventFallbackInterval {
+		return eventFallbackInterval
+	}
+	return interval
+}
+
+// awaitEvent pauses a wait for up to timeout, like sleep, but returns as soon
+// as an event of the node that match accepts arrives.
+func (d *Driver) awaitEvent(timeout time.Duration, match func(rackhdEvent) bool) error {
+	events := d.nodeEvents()
+	if events == nil {
+		return d.sleep(timeout)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case event := <-events:
+			if match(event) {
+				log.Debugf("Woken by RackHD event %s", event)
+				return nil
+			}
+		case <-timer.C:
+			return nil
+		case <-d.context().Done():
+			return d.context().Err()
+		}
+	}
+}
+
+// graphFinished matches the event of the graph instance ending: AMQP
+// publishes graph.finished with the instance ID, the websocket the new status
+// with the graph name.
+func graphFinished(name, instanceID string) func(rackhdEvent) bool {
+	return func(event rackhdEvent) bool {
+		if event.Type != "graph" || (event.TypeID != instanceID && event.TypeID != name && !strings.Contains(event.RoutingKey, instanceID)) {
+			return false
+		}
+		switch event.Action {
+		case "finished", "succeeded", "failed", "cancelled", "timeout":
+			return true
+		}
+		return false
+	}
+}
+
+// nodeChanged matches the events that come with a node booting or getting an
+// address, i.e. those that are not about graphs or pollers.
+func nodeChanged(event rackhdEvent) bool {
+	return event.Type != "graph" && !strings.HasPrefix(event.RoutingKey, "graph.") && !strings.HasPrefix(event.RoutingKey, "poller.")
+}
+
+func (d *Driver) amqpExchange() string {
+	if d.AMQPExchange == "" {
+		return defaultAMQPExchange
+	}
+	return d.AMQPExchange
+}
+
+// redactURI hides the password of a URI with embedded credentials.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
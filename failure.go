@@ -0,0 +1,187 @@
+package rackhd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	failureReportFile = "failure.json"
+	// selTail is how many of the latest SEL entries the report keeps.
+	selTail = 50
+	// diagnosticsDialTimeout bounds each SSH probe of the report.
+	diagnosticsDialTimeout = 5 * time.Second
+)
+
+// failureReport is the diagnostics bundle stored in the machine store when a
+// create or start fails: the node document, its active workflow and lookup
+// entries, and a probe of the bootstrap port of its addresses. Once the node
+// was powered on it includes the latest entries of the node's System Event
+// Log, as hardware faults are a leading cause of failed bare-metal installs.
+type failureReport struct {
+	Machine        string        `json:"machine"`
+	Operation      string        `json:"operation"`
+	NodeID         string        `json:"nodeId"`
+	Phase          string        `json:"phase"`
+	Error          string        `json:"error"`
+	Class          string        `json:"class,omitempty"`
+	Workflows      []workflowRun `json:"workflows,omitempty"`
+	Failed         time.Time     `json:"failed"`
+	Node           interface{}   `json:"node,omitempty"`
+	NodeError      string        `json:"nodeError,omitempty"`
+	ActiveWorkflow interface{}   `json:"activeWorkflow,omitempty"`
+	WorkflowError  string        `json:"activeWorkflowError,omitempty"`
+	Lookups        []lookupEntry `json:"lookups,omitempty"`
+	LookupError    string        `json:"lookupError,omitempty"`
+	SSHProbes      []sshProbe    `json:"sshProbes,omitempty"`
+	SEL            []selEntry    `json:"sel,omitempty"`
+	SELError       string        `json:"selError,omitempty"`
+}
+
+// sshProbe is the result of connecting to the bootstrap port of an address.
+type sshProbe struct {
+	Address   string `json:"address"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// systemEventLog returns the SEL records from the data of the node's sel
+// pollers.
+func (d *Driver) systemEventLog() ([]selEntry, error) {
+	samples, found, err := d.pollerSamples("sel")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("Node %s has no IPMI sel poller data", d.NodeID)
+	}
+	var data []struct {
+		SEL []selEntry `json:"sel"`
+	}
+	if err := decodePayload(samples, &data); err != nil {
+		return nil, err
+	}
+	var entries []selEntry
+	for _, sample := range data {
+		entries = append(entries, sample.SEL...)
+	}
+	return entries, nil
+}
+
+// writeFailureReport stores the diagnostics bundle of a create or start that
+// failed with err and returns its path, or "" if it could not be written. The
+// SEL is only collected when a create got past node selection, since before
+// that nothing was done to the node.
+func (d *Driver) writeFailureReport(operation string, err error) string {
+	report := failureReport{
+		Machine:   d.MachineName,
+		Operation: operation,
+		NodeID:    d.NodeID,
+		Error:     err.Error(),
+		Workflows: d.workflowRuns,
+		Failed:    time.Now().UTC(),
+	}
+	if class := ErrorClass(err); class != nil {
+		report.Class = class.Error()
+	}
+	t := d.timings()
+	t.mu.Lock()
+	if len(t.phases) > 0 {
+		report.Phase = t.phases[len(t.phases)-1]
+	}
+	t.mu.Unlock()
+
+	if d.NodeID != "" {
+		d.collectNodeDiagnostics(&report)
+	}
+	if operation != "create" || (report.Phase != "" && report.Phase != "select node") {
+		sel, selErr := d.systemEventLog()
+		if selErr != nil {
+			log.Debugf("Not collecting the SEL: %s", selErr)
+			report.SELError = selErr.Error()
+		}
+		if len(sel) > selTail {
+			sel = sel[len(sel)-selTail:]
+		}
+		report.SEL = sel
+	}
+
+	path, werr := d.writeStoreJSON(failureReportFile, report)
+	if werr != nil {
+		log.Warnf("Unable to save the failure report of %s: %s", d.MachineName, werr)
+		return ""
+	}
+	if len(report.SEL) > 0 {
+		log.Infof("Saved the failure report with %d SEL entries of node %s to %s", len(report.SEL), d.NodeID, path)
+	} else {
+		log.Infof("Saved the failure report to %s", path)
+	}
+	return path
+}
+
+// collectNodeDiagnostics adds what RackHD knows of the node, and whether its
+// addresses accept connections, to the report. Each part that cannot be
+// collected records its error instead.
+func (d *Driver) collectNodeDiagnostics(report *failureReport) {
+	client := d.getClient()
+	if node, err := client.GetNode(d.context(), d.NodeID); err != nil {
+		report.NodeError = apiError(err)
+	} else {
+		report.Node = node
+	}
+	if active, err := client.GetActiveWorkflow(d.context(), d.NodeID); err != nil {
+		if !isNotFound(err) {
+			report.WorkflowError = apiError(err)
+		}
+	} else {
+		report.ActiveWorkflow = active
+	}
+	err := d.eachLookup(d.NodeID, func(entry lookupEntry) error {
+		if entry.Node == "" || entry.Node == d.NodeID {
+			report.Lookups = append(report.Lookups, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		report.LookupError = apiError(err)
+	}
+
+	addresses := d.candidateIPs
+	if d.IPAddress != "" && !containsString(addresses, d.IPAddress) {
+		addresses = append([]string{d.IPAddress}, addresses...)
+	}
+	for _, ip := range addresses {
+		probe := sshProbe{Address: ip + ":" + strconv.Itoa(d.bootstrapPort())}
+		conn, err := d.dial(probe.Address, diagnosticsDialTimeout)
+		if err != nil {
+			probe.Error = err.Error()
+		} else {
+			conn.Close()
+			probe.Reachable = true
+		}
+		report.SSHProbes = append(report.SSHProbes, probe)
+	}
+}
+
+// withDiagnostics points the error of a failed operation at its diagnostics
+// bundle, keeping its failure class.
+func withDiagnostics(err error, path string) error {
+	if path == "" {
+		return err
+	}
+	if e, ok := err.(*Error); ok {
+		return &Error{Class: e.Class, msg: fmt.Sprintf("%s (diagnostics in %s)", e.msg, path)}
+	}
+	return fmt.Errorf("%w (diagnostics in %s)", err, path)
+}
+
+// clearFailureReport removes the report of an earlier failed create once
+// the machine is created.
+func (d *Driver) clearFailureReport() {
+	if err := os.Remove(filepath.Join(d.storeDir(), failureReportFile)); err != nil && !os.IsNotExist(err) {
+		log.Debugf("Unable to remove the failure report: %s", err)
+	}
+}
@@ -0,0 +1,38 @@
+package rackhd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// firewallPorts are the Docker API and Swarm ports opened by
+// --rackhd-configure-firewall.
+var firewallPorts = []string{"2376/tcp", "2377/tcp", "7946/tcp", "7946/udp", "4789/udp"}
+
+// configureFirewall opens firewallPorts with whichever of firewalld, ufw or
+// plain iptables the OS image uses. iptables rules are saved where the
+// distribution's persistence package expects them, if it is installed.
+func (d *Driver) configureFirewall() error {
+	var firewalld, ufw, iptables []string
+	for _, port := range firewallPorts {
+		parts := strings.Split(port, "/")
+		firewalld = append(firewalld, "--add-port="+port)
+		ufw = append(ufw, "ufw allow "+port)
+		iptables = append(iptables, fmt.Sprintf("{ iptables -C INPUT -p %s --dport %s -j ACCEPT 2>/dev/null || iptables -I INPUT -p %s --dport %s -j ACCEPT; }",
+			parts[1], parts[0], parts[1], parts[0]))
+	}
+	script := fmt.Sprintf(`if command -v firewall-cmd >/dev/null && firewall-cmd --state >/dev/null 2>&1; then
+	firewall-cmd --permanent %s && firewall-cmd --reload
+elif command -v ufw >/dev/null && ufw status | grep -q 'Status: active'; then
+	%s
+elif command -v iptables >/dev/null; then
+	%s
+	if command -v netfilter-persistent >/dev/null; then netfilter-persistent save; elif [ -d /etc/sysconfig ]; then iptables-save > /etc/sysconfig/iptables; fi
+fi`, strings.Join(firewalld, " "), strings.Join(ufw, " && "), strings.Join(iptables, " && "))
+
+	log.Infof("Opening Docker and Swarm ports %s on %s", strings.Join(firewallPorts, ", "), d.MachineName)
+	if err := d.runKeyCommands([]string{script}); err != nil {
+		return fmt.Errorf("Unable to configure the firewall. Error: %w", err)
+	}
+	return nil
+}
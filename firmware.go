@@ -0,0 +1,198 @@
+package rackhd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const firmwareWorkflowTimeout = 60 * time.Minute
+
+// firmwareComponents maps the components --rackhd-min-firmware knows to the
+// catalog holding their version.
+var firmwareComponents = map[string]string{
+	"bios": "dmi",
+	"bmc":  "bmc",
+}
+
+// firmwareRule is one --rackhd-min-firmware entry: the lowest version of a
+// component, on nodes of one SKU or on every node when SKU is empty.
+type firmwareRule struct {
+	SKU       string
+	Component string
+	Version   string
+}
+
+// parseFirmwareRule parses [<sku>:]<bios|bmc>=<version>, e.g.
+// "PowerEdge R630:bios=2.4.3" or "bmc=2.41".
+func parseFirmwareRule(value string) (*firmwareRule, error) {
+	i := strings.Index(value, "=")
+	if i < 0 || i == len(value)-1 {
+		return nil, fmt.Errorf("Invalid --rackhd-min-firmware %q. Specify [<sku>:]<bios|bmc>=<version>", value)
+	}
+	rule := &firmwareRule{Component: value[:i], Version: value[i+1:]}
+	if j := strings.LastIndex(rule.Component, ":"); j >= 0 {
+		rule.SKU, rule.Component = rule.Component[:j], rule.Component[j+1:]
+	}
+	rule.Component = strings.ToLower(rule.Component)
+	if _, ok := firmwareComponents[rule.Component]; !ok {
+		return nil, fmt.Errorf("Unsupported firmware component %q in --rackhd-min-firmware. Specify bios or bmc", rule.Component)
+	}
+	return rule, nil
+}
+
+// compareVersions compares firmware versions such as 2.4.3 and 2.10.0 by
+// their numeric parts, returning -1, 0 or 1. Parts that are not numbers,
+// like the "A" in 1.2.A07, are compared as strings.
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		return strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '-' || r == '_' || r == ' ' })
+	}
+	pa, pb := split(a), split(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y string
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		nx, errx := strconv.Atoi(x)
+		ny, erry := strconv.Atoi(y)
+		switch {
+		case errx == nil && erry == nil && nx != ny:
+			if nx < ny {
+				return -1
+			}
+			return 1
+		case (errx != nil || erry != nil) && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// firmwareVersion reads the installed version of a component from the
+// node's catalogs.
+func (d *Driver) firmwareVersion(component string) (string, error) {
+	switch component {
+	case "bios":
+		var dmi struct {
+			BIOS struct {
+				Version string `json:"Version"`
+			} `json:"BIOS Information"`
+		}
+		if err := d.getCatalog("dmi", &dmi); err != nil {
+			return "", err
+		}
+		return dmi.BIOS.Version, nil
+	default:
+		var bmc struct {
+			Version string `json:"Firmware Revision"`
+		}
+		if err := d.getCatalog("bmc", &bmc); err != nil {
+			return "", err
+		}
+		return bmc.Version, nil
+	}
+}
+
+// firmwareBelowBaseline lists the components of the node older than the
+// --rackhd-min-firmware rules for its SKU, as "bios 2.1.0 < 2.4.3". Rules
+// name the SKU by name or ID; a rule for the node's SKU takes precedence
+// over one for every SKU.
+func (d *Driver) firmwareBelowBaseline() ([]string, error) {
+	if len(d.MinFirmware) == 0 {
+		return nil, nil
+	}
+	node, err := d.getNode()
+	if err != nil {
+		return nil, err
+	}
+	sku := ""
+	if node.SKU != "" {
+		sku = d.skuName(node.SKU)
+	}
+
+	baseline := make(map[string]string)
+	for _, value := range d.MinFirmware {
+		rule, err := parseFirmwareRule(value)
+		if err != nil {
+			return nil, err
+		}
+		if rule.SKU == "" {
+			if _, ok := baseline[rule.Component]; !ok {
+				baseline[rule.Component] = rule.Version
+			}
+		} else if strings.EqualFold(rule.SKU, sku) || rule.SKU == node.SKU {
+			baseline[rule.Component] = rule.Version
+		}
+	}
+
+	var below []string
+	for _, component := range []string{"bios", "bmc"} {
+		min, ok := baseline[component]
+		if !ok {
+			continue
+		}
+		version, err := d.firmwareVersion(component)
+		if err != nil {
+			return nil, err
+		}
+		if version == "" || compareVersions(version, min) < 0 {
+			if version == "" {
+				version = "unknown"
+			}
+			below = append(below, fmt.Sprintf("%s %s < %s", component, version, min))
+		}
+	}
+	return below, nil
+}
+
+// checkFirmware refuses a node below the firmware baseline during
+// selection, unless --rackhd-firmware-workflow is set to bring it up to date.
+func (d *Driver) checkFirmware() error {
+	below, err := d.firmwareBelowBaseline()
+	if err != nil {
+		return err
+	}
+	if len(below) == 0 {
+		return nil
+	}
+	if d.FirmwareWorkflow == "" {
+		return fmt.Errorf("Node %s is below the firmware baseline (%s). Choose another node or set --rackhd-firmware-workflow to update it",
+			d.NodeID, strings.Join(below, ", "))
+	}
+	log.Infof("Node %s is below the firmware baseline (%s); it will be updated with %s", d.NodeID, strings.Join(below, ", "), d.FirmwareWorkflow)
+	return nil
+}
+
+// updateFirmware runs --rackhd-firmware-workflow on a node below the
+// baseline and checks the versions in the catalogs it refreshed.
+func (d *Driver) updateFirmware() error {
+	if d.FirmwareWorkflow == "" {
+		return errPhaseSkipped
+	}
+	below, err := d.firmwareBelowBaseline()
+	if err != nil {
+		return err
+	}
+	if len(below) == 0 {
+		return errPhaseSkipped
+	}
+	log.Infof("Updating the firmware of node %s with %s", d.NodeID, d.FirmwareWorkflow)
+	if _, err := d.runWorkflow(d.FirmwareWorkflow, nil, firmwareWorkflowTimeout); err != nil {
+		return err
+	}
+	if below, err = d.firmwareBelowBaseline(); err != nil {
+		return err
+	}
+	if len(below) > 0 {
+		return fmt.Errorf("Node %s is still below the firmware baseline after %s: %s", d.NodeID, d.FirmwareWorkflow, strings.Join(below, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package rackhd
+
+import (
+	"fmt"
+	"strings"
+)
+
+const lspciCatalog = "lspci"
+
+// installNVIDIAToolkit installs the NVIDIA container toolkit from NVIDIA's
+// package repository on apt and yum based images. The GPU kernel driver is
+// expected to be part of the OS image.
+const installNVIDIAToolkit = `set -e
+if command -v apt-get >/dev/null; then
+	curl -fsSL https://nvidia.github.io/libnvidia-container/gpgkey | gpg --batch --yes --dearmor -o /usr/share/keyrings/nvidia-container-toolkit-keyring.gpg
+	curl -fsSL https://nvidia.github.io/libnvidia-container/stable/deb/nvidia-container-toolkit.list | sed 's#deb https://#deb [signed-by=/usr/share/keyrings/nvidia-container-toolkit-keyring.gpg] https://#g' > /etc/apt/sources.list.d/nvidia-container-toolkit.list
+	apt-get update
+	DEBIAN_FRONTEND=noninteractive apt-get install -y nvidia-container-toolkit
+elif command -v yum >/dev/null; then
+	curl -fsSL https://nvidia.github.io/libnvidia-container/stable/rpm/nvidia-container-toolkit.repo > /etc/yum.repos.d/nvidia-container-toolkit.repo
+	yum install -y nvidia-container-toolkit
+else
+	echo 'no supported package manager' >&2
+	exit 1
+fi`
+
+// gpuInfo summarizes the GPUs found in the node's PCI catalog.
+type gpuInfo struct {
+	Vendor string
+	Count  int
+}
+
+// detectGPUs looks for display and 3D controllers in the lspci catalog.
+// Catalog field names differ between RackHD releases, so entries are matched
+// on their values rather than a fixed schema.
+func (d *Driver) detectGPUs() (*gpuInfo, error) {
+	var devices []map[string]interface{}
+	if err := d.getCatalog(lspciCatalog, &devices); err != nil {
+		return nil, err
+	}
+	gpus := &gpuInfo{}
+	for _, device := range devices {
+		var class, vendor string
+		for key, value := range device {
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			switch strings.ToLower(key) {
+			case "class":
+				class = strings.ToLower(s)
+			case "vendor":
+				vendor = strings.ToLower(s)
+			}
+		}
+		if !strings.Contains(class, "vga") && !strings.Contains(class, "3d controller") && !strings.Contains(class, "display") {
+			continue
+		}
+		switch {
+		case strings.Contains(vendor, "nvidia"):
+			gpus.Vendor = "nvidia"
+		case strings.Contains(vendor, "advanced micro devices") || strings.Contains(vendor, "amd") || strings.Contains(vendor, "ati technologies"):
+			gpus.Vendor = "amd"
+		default:
+			// onboard BMC and server VGA chips are not compute GPUs
+			continue
+		}
+		gpus.Count++
+	}
+	log.Debugf("Node %s has %d GPUs (%s)", d.NodeID, gpus.Count, gpus.Vendor)
+	return gpus, nil
+}
+
+// configureGPUs returns the GPU engine labels and, with --rackhd-gpu-runtime,
+// installs the NVIDIA container toolkit and registers its runtime in config.
+func (d *Driver) configureGPUs(config map[string]interface{}) ([]string, error) {
+	gpus, err := d.detectGPUs()
+	if err != nil {
+		return nil, err
+	}
+	if gpus.Count == 0 {
+		return []string{"gpu=false"}, nil
+	}
+	labels := []string{"gpu=true", "gpu.vendor=" + gpus.Vendor, fmt.Sprintf("gpu.count=%d", gpus.Count)}
+
+	if d.GPURuntime {
+		if gpus.Vendor != "nvidia" || (d.Arch != "x86_64" && d.Arch != "aarch64") {
+			log.Warnf("Not installing a GPU runtime on %s: only NVIDIA GPUs on x86_64 and aarch64 are supported", d.MachineName)
+			return labels, nil
+		}
+		log.Infof("Installing the NVIDIA container toolkit on %s", d.MachineName)
+		if err := d.runKeyCommands([]string{installNVIDIAToolkit}); err != nil {
+			return nil, fmt.Errorf("Unable to install the NVIDIA container toolkit. Error: %w", err)
+		}
+		config["runtimes"] = map[string]interface{}{
+			"nvidia": map[string]interface{}{"path": "nvidia-container-runtime"},
+		}
+	}
+	return labels, nil
+}
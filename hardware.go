@@ -0,0 +1,119 @@
+package rackhd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ohaiHardware is the part of the ohai catalog the hardware requirements
+// are checked against. cpu holds one entry per logical CPU, keyed by its
+// number, next to the totals; memory and block device sizes are strings.
+type ohaiHardware struct {
+	CPU    map[string]interface{} `json:"cpu"`
+	Memory struct {
+		Total string `json:"total"`
+	} `json:"memory"`
+	BlockDevices map[string]ohaiBlockDevice `json:"block_device"`
+}
+
+type ohaiBlockDevice struct {
+	// Size is in 512 byte sectors
+	Size      string `json:"size"`
+	Removable string `json:"removable"`
+}
+
+// cpus is the number of logical CPUs.
+func (h *ohaiHardware) cpus() int {
+	if total, ok := h.CPU["total"].(float64); ok {
+		return int(total)
+	}
+	return 0
+}
+
+// cpuFlags are the flags of the first CPU.
+func (h *ohaiHardware) cpuFlags() []string {
+	cpu, _ := h.CPU["0"].(map[string]interface{})
+	list, _ := cpu["flags"].([]interface{})
+	flags := make([]string, 0, len(list))
+	for _, flag := range list {
+		if s, ok := flag.(string); ok {
+			flags = append(flags, s)
+		}
+	}
+	return flags
+}
+
+// memoryGB is the installed memory, from a total like "32832428kB".
+func (h *ohaiHardware) memoryGB() float64 {
+	kb, _ := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(h.Memory.Total), "kb"), 64)
+	return kb / (1024 * 1024)
+}
+
+// largestDiskGB is the size of the largest fixed block device.
+func (h *ohaiHardware) largestDiskGB() float64 {
+	var largest float64
+	for _, dev := range h.BlockDevices {
+		if dev.Removable == "1" {
+			continue
+		}
+		sectors, _ := strconv.ParseFloat(dev.Size, 64)
+		if gb := sectors * 512 / 1e9; gb > largest {
+			largest = gb
+		}
+	}
+	return largest
+}
+
+func (d *Driver) hardwareRequired() bool {
+	return d.MinCPUs > 0 || d.MinMemoryGB > 0 || d.MinDiskGB > 0 || d.RequireVirtualization
+}
+
+// checkHardware compares the node's ohai catalog with the --rackhd-min-*
+// requirements and reports every one the node falls short of.
+func (d *Driver) checkHardware() (string, error) {
+	if !d.hardwareRequired() {
+		return "no requirements set", errCheckSkipped
+	}
+	var hw ohaiHardware
+	if err := d.getCatalog("ohai", &hw); err != nil {
+		return "", err
+	}
+
+	var found, missing []string
+	compare := func(what string, have, want float64, unit string) {
+		if want <= 0 {
+			return
+		}
+		found = append(found, fmt.Sprintf("%s%s %s", strconv.FormatFloat(have, 'f', -1, 64), unit, what))
+		if have < want {
+			missing = append(missing, fmt.Sprintf("%s: has %s%s, requires %s%s", what,
+				strconv.FormatFloat(have, 'f', -1, 64), unit, strconv.FormatFloat(want, 'f', -1, 64), unit))
+		}
+	}
+	compare("CPUs", float64(hw.cpus()), float64(d.MinCPUs), "")
+	compare("memory", roundGB(hw.memoryGB()), float64(d.MinMemoryGB), "GB")
+	compare("disk", roundGB(hw.largestDiskGB()), float64(d.MinDiskGB), "GB")
+	if d.RequireVirtualization {
+		flags := hw.cpuFlags()
+		switch {
+		case containsString(flags, "vmx"):
+			found = append(found, "VT-x")
+		case containsString(flags, "svm"):
+			found = append(found, "AMD-V")
+		case len(flags) == 0:
+			missing = append(missing, "virtualization: the catalog lists no CPU flags")
+		default:
+			missing = append(missing, "virtualization: the CPU has neither VT-x (vmx) nor AMD-V (svm), or it is disabled in the BIOS")
+		}
+	}
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Node %s does not meet the hardware requirements: %s", d.NodeID, strings.Join(missing, "; "))
+	}
+	return strings.Join(found, ", "), nil
+}
+
+func roundGB(gb float64) float64 {
+	return float64(int(gb*10+0.5)) / 10
+}
@@ -0,0 +1,97 @@
+package rackhd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// hugepageSizes are the page sizes --rackhd-hugepages accepts, in kB.
+var hugepageSizes = map[string]int64{
+	"2M": 2 * 1024,
+	"1G": 1024 * 1024,
+}
+
+// maxHugepageShare is the share of memory hugepages may take, leaving the
+// rest for the OS and the engine.
+const maxHugepageShare = 0.75
+
+// memoryTopology is the part of the ohai catalog describing memory and CPUs.
+type memoryTopology struct {
+	Memory struct {
+		Total string `json:"total"`
+	} `json:"memory"`
+	CPU struct {
+		Real  int `json:"real"`
+		Cores int `json:"cores"`
+	} `json:"cpu"`
+}
+
+// parseHugepages parses a --rackhd-hugepages value such as 1G:8, the page
+// size and the number of pages per NUMA node.
+func parseHugepages(value string) (string, int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) == 2 {
+		if _, ok := hugepageSizes[strings.ToUpper(parts[0])]; ok {
+			if count, err := strconv.Atoi(parts[1]); err == nil && count > 0 {
+				return strings.ToUpper(parts[0]), count, nil
+			}
+		}
+	}
+	return "", 0, fmt.Errorf("Invalid --rackhd-hugepages %q. Specify <2M|1G>:<pages per NUMA node>", value)
+}
+
+// memoryTuning returns the sysctls and kernel arguments for --rackhd-hugepages
+// and --rackhd-numa-balancing. The hugepage count is multiplied by the node's
+// NUMA node count from the ohai catalog, one per CPU socket, so every NUMA
+// node gets the same allocation. 2M pages are allocated at runtime; 1G pages
+// through kernel arguments, as they rarely can be once memory is fragmented.
+func (d *Driver) memoryTuning() ([]string, string, error) {
+	var sysctls []string
+	var kernelArgs string
+	switch d.NUMABalancing {
+	case "":
+	case "on":
+		sysctls = append(sysctls, "kernel.numa_balancing=1")
+	case "off":
+		sysctls = append(sysctls, "kernel.numa_balancing=0")
+	default:
+		return nil, "", fmt.Errorf("Invalid --rackhd-numa-balancing %q. Specify on or off", d.NUMABalancing)
+	}
+	if d.Hugepages == "" {
+		return sysctls, kernelArgs, nil
+	}
+
+	size, perNode, err := parseHugepages(d.Hugepages)
+	if err != nil {
+		return nil, "", err
+	}
+	var ohai memoryTopology
+	if err := d.getCatalog("ohai", &ohai); err != nil {
+		return nil, "", fmt.Errorf("Unable to size hugepages without the node's topology. Error: %w", err)
+	}
+	// sockets may be split into several NUMA nodes, e.g. AMD EPYC in NPS4 mode
+	numaNodes := ohai.CPU.Real
+	if topo, err := d.topology(); err == nil {
+		numaNodes = topo.NUMANodes
+	}
+	if numaNodes < 1 {
+		numaNodes = 1
+	}
+	pages := perNode * numaNodes
+	totalKB, err := strconv.ParseInt(strings.TrimSuffix(ohai.Memory.Total, "kB"), 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to read the memory size of node %s from %q", d.NodeID, ohai.Memory.Total)
+	}
+	if float64(int64(pages)*hugepageSizes[size]) > maxHugepageShare*float64(totalKB) {
+		return nil, "", fmt.Errorf("%d %s hugepages would take more than %d%% of the %s of memory of node %s", pages, size, int(maxHugepageShare*100), ohai.Memory.Total, d.NodeID)
+	}
+
+	log.Infof("Allocating %d %s hugepages (%d on each of %d NUMA nodes) on %s", pages, size, perNode, numaNodes, d.MachineName)
+	if size == "1G" {
+		kernelArgs = fmt.Sprintf("default_hugepagesz=1G hugepagesz=1G hugepages=%d", pages)
+	} else {
+		sysctls = append(sysctls, fmt.Sprintf("vm.nr_hugepages=%d", pages))
+	}
+	return sysctls, kernelArgs, nil
+}
@@ -0,0 +1,41 @@
+package rackhd
+
+import (
+	"strings"
+)
+
+// pinIdentity records the node's DMI serial number and UUID, so later
+// destructive operations can tell whether the node ID still refers to the same
+// hardware. RackHD hands out node IDs again after a rediscovery.
+func (d *Driver) pinIdentity() {
+	info, err := d.systemInfo()
+	if err != nil {
+		log.Warnf("Unable to record the identity of node %s, it will not be verified later: %s", d.NodeID, err)
+		return
+	}
+	d.NodeSerial = info.SerialNumber
+	d.NodeUUID = info.UUID
+	log.Debugf("Node %s has serial number %q and UUID %q", d.NodeID, d.NodeSerial, d.NodeUUID)
+
+	if node, err := d.getNode(); err == nil {
+		d.NodeMACs = node.Identifiers
+	}
+}
+
+// verifyIdentity checks that the node still has the serial number and UUID
+// recorded at create, rebinding the machine first if --rackhd-auto-rebind is
+// set. Machines created without a recorded identity pass.
+func (d *Driver) verifyIdentity() error {
+	if d.NodeSerial == "" && d.NodeUUID == "" {
+		return nil
+	}
+	info, err := d.systemInfo()
+	if err != nil {
+		return classError(ErrIdentityMismatch, "Unable to verify that node %s is still the hardware machine %s was created on. Error: %s", d.NodeID, d.MachineName, err)
+	}
+	if (!strings.EqualFold(info.SerialNumber, d.NodeSerial) || !strings.EqualFold(info.UUID, d.NodeUUID)) && !d.rebindIfEnabled() {
+		return classError(ErrIdentityMismatch, "Node %s now has serial number %q and UUID %q, but machine %s was created on serial number %q and UUID %q; refusing to modify it",
+			d.NodeID, info.SerialNumber, info.UUID, d.MachineName, d.NodeSerial, d.NodeUUID)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const inventoryFile = "inventory.json"
+
+// hardwareInventory is the normalized hardware inventory of a machine, built
+// from the node's catalogs for capacity planning and asset tracking. Unlike
+// the raw catalog snapshot it has the same shape for every vendor. Missing
+// lists the catalogs the node did not have, whose sections are left empty.
+type hardwareInventory struct {
+	Machine   string          `json:"machine"`
+	NodeID    string          `json:"nodeId"`
+	Collected time.Time       `json:"collected"`
+	System    dmiSystemInfo   `json:"system"`
+	BIOS      string          `json:"biosVersion,omitempty"`
+	BMC       inventoryBMC    `json:"bmc"`
+	CPUs      []inventoryCPU  `json:"cpus"`
+	MemoryGB  float64         `json:"memoryGB"`
+	DIMMs     []inventoryDIMM `json:"dimms"`
+	Disks     []inventoryDisk `json:"disks"`
+	NICs      []inventoryNIC  `json:"nics"`
+	Topology  *nodeTopology   `json:"topology,omitempty"`
+	Missing   []string        `json:"missingCatalogs,omitempty"`
+}
+
+type inventoryBMC struct {
+	Firmware   string `json:"firmware,omitempty"`
+	IPAddress  string `json:"ipAddress,omitempty"`
+	MACAddress string `json:"macAddress,omitempty"`
+}
+
+type inventoryCPU struct {
+	Socket  string `json:"socket"`
+	Model   string `json:"model"`
+	Cores   string `json:"cores,omitempty"`
+	Threads string `json:"threads,omitempty"`
+}
+
+type inventoryDIMM struct {
+	Locator      string `json:"locator"`
+	Size         string `json:"size"`
+	Type         string `json:"type,omitempty"`
+	Speed        string `json:"speed,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+}
+
+type inventoryDisk struct {
+	Device   string `json:"device"`
+	Model    string `json:"model,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Capacity string `json:"capacity,omitempty"`
+}
+
+type inventoryNIC struct {
+	Name     string `json:"name"`
+	MAC      string `json:"mac"`
+	Driver   string `json:"driver,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// dmiList is a dmi catalog section that is an object when the node has one
+// such device and a list of objects when it has several.
+type dmiList []map[string]string
+
+func (l *dmiList) UnmarshalJSON(b []byte) error {
+	var one map[string]string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*l = dmiList{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]map[string]string)(l))
+}
+
+// lshwNode is a node of the lshw catalog's device tree.
+type lshwNode struct {
+	Class         string            `json:"class"`
+	LogicalName   interface{}       `json:"logicalname"`
+	Serial        string            `json:"serial"`
+	Configuration map[string]string `json:"configuration"`
+	Children      []lshwNode        `json:"children"`
+}
+
+// networkDevices returns the network devices of the tree in depth-first order.
+func (n *lshwNode) networkDevices() []lshwNode {
+	var found []lshwNode
+	if n.Class == "network" && n.Serial != "" {
+		found = append(found, *n)
+	}
+	for i := range n.Children {
+		found = append(found, n.Children[i].networkDevices()...)
+	}
+	return found
+}
+
+// inventory builds the machine's hardware inventory from the dmi, ohai,
+// smart, lshw and bmc catalogs.
+func (d *Driver) inventory() *hardwareInventory {
+	inv := &hardwareInventory{
+		Machine:   d.MachineName,
+		NodeID:    d.NodeID,
+		Collected: time.Now().UTC(),
+		CPUs:      []inventoryCPU{},
+		DIMMs:     []inventoryDIMM{},
+		Disks:     []inventoryDisk{},
+		NICs:      []inventoryNIC{},
+	}
+	catalog := func(source string, v interface{}) bool {
+		if err := d.getCatalog(source, v); err != nil {
+			log.Debugf("Inventory without the %s catalog: %s", source, err)
+			inv.Missing = append(inv.Missing, source)
+			return false
+		}
+		return true
+	}
+
+	var dmi struct {
+		System     dmiSystemInfo     `json:"System Information"`
+		BIOS       map[string]string `json:"BIOS Information"`
+		Processors dmiList           `json:"Processor Information"`
+		Memory     dmiList           `json:"Memory Device"`
+	}
+	if catalog("dmi", &dmi) {
+		inv.System = dmi.System
+		inv.BIOS = dmi.BIOS["Version"]
+		for _, cpu := range dmi.Processors {
+			inv.CPUs = append(inv.CPUs, inventoryCPU{
+				Socket:  cpu["Socket Designation"],
+				Model:   strings.TrimSpace(cpu["Version"]),
+				Cores:   cpu["Core Count"],
+				Threads: cpu["Thread Count"],
+			})
+		}
+		for _, dimm := range dmi.Memory {
+			// empty slots are listed too
+			if size := dimm["Size"]; size == "" || strings.HasPrefix(size, "No Module") {
+				continue
+			}
+			inv.DIMMs = append(inv.DIMMs, inventoryDIMM{
+				Locator:      dimm["Locator"],
+				Size:         dimm["Size"],
+				Type:         dimm["Type"],
+				Speed:        dimm["Speed"],
+				Manufacturer: dimm["Manufacturer"],
+				Serial:       dimm["Serial Number"],
+			})
+		}
+	}
+
+	var hw ohaiHardware
+	if catalog("ohai", &hw) {
+		inv.MemoryGB = roundGB(hw.memoryGB())
+		if topo, err := d.topology(); err == nil {
+			inv.Topology = topo
+		}
+	}
+
+	var disks []smartDisk
+	if catalog("smart", &disks) {
+		for _, disk := range disks {
+			inv.Disks = append(inv.Disks, inventoryDisk{
+				Device:   disk.Device,
+				Model:    disk.SMART.Identity.Model,
+				Serial:   disk.SMART.Identity.Serial,
+				Capacity: disk.SMART.Identity.Capacity,
+			})
+		}
+	}
+
+	var lshw lshwNode
+	if catalog("lshw", &lshw) {
+		for _, dev := range lshw.networkDevices() {
+			nic := inventoryNIC{
+				MAC:      strings.ToLower(dev.Serial),
+				Driver:   dev.Configuration["driver"],
+				Firmware: dev.Configuration["firmware"],
+			}
+			switch name := dev.LogicalName.(type) {
+			case string:
+				nic.Name = name
+			case []interface{}:
+				if len(name) > 0 {
+					nic.Name, _ = name[0].(string)
+				}
+			}
+			inv.NICs = append(inv.NICs, nic)
+		}
+		sort.SliceStable(inv.NICs, func(i, j int) bool { return inv.NICs[i].Name < inv.NICs[j].Name })
+	}
+
+	var bmc struct {
+		Firmware string `json:"Firmware Revision"`
+		IP       string `json:"IP Address"`
+		MAC      string `json:"MAC Address"`
+	}
+	if catalog("bmc", &bmc) {
+		inv.BMC = inventoryBMC{Firmware: bmc.Firmware, IPAddress: bmc.IP, MACAddress: strings.ToLower(bmc.MAC)}
+	}
+	return inv
+}
+
+// writeInventory stores the hardware inventory with the machine once it is
+// created, after any firmware, BIOS and RAID changes, and exports a copy to
+// --rackhd-inventory-file when set. Neither fails the create.
+func (d *Driver) writeInventory() {
+	inv := d.inventory()
+	path, err := d.writeStoreJSON(inventoryFile, inv)
+	if err != nil {
+		log.Warnf("Unable to save the hardware inventory of node %s: %s", d.NodeID, err)
+	} else {
+		log.Debugf("Saved the hardware inventory of node %s to %s", d.NodeID, path)
+	}
+	if d.InventoryFile == "" {
+		return
+	}
+	b, err := json.MarshalIndent(inv, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(d.InventoryFile, b, 0644)
+	}
+	if err != nil {
+		log.Warnf("Unable to write hardware inventory %s: %s", d.InventoryFile, err)
+	}
+}
@@ -0,0 +1,163 @@
+package rackhd
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	keyGraph        = "Graph.DockerMachine.InstallKey"
+	keyGraphTimeout = 30 * time.Minute
+)
+
+// keyGraphDefinition is the graph registered for
+// --rackhd-bootstrap-method=graph. It PXE boots the node into the microkernel,
+// runs the commands given as options of its install-key task against the
+// node's disks, and reboots the node into its own OS.
+var keyGraphDefinition = map[string]interface{}{
+	"friendlyName":   "Docker Machine Install Key",
+	"injectableName": keyGraph,
+	"options": map[string]interface{}{
+		"install-key": map[string]interface{}{"commands": nil},
+	},
+	"tasks": []interface{}{
+		map[string]interface{}{"label": "set-boot-pxe", "taskName": "Task.Obm.Node.PxeBoot", "ignoreFailure": true},
+		map[string]interface{}{"label": "reboot", "taskName": "Task.Obm.Node.Reboot",
+			"waitOn": map[string]interface{}{"set-boot-pxe": "finished"}},
+		map[string]interface{}{"label": "bootstrap-ubuntu", "taskName": "Task.Linux.Bootstrap.Ubuntu",
+			"waitOn": map[string]interface{}{"reboot": "succeeded"}},
+		map[string]interface{}{"label": "install-key", "taskName": "Task.Linux.Commands",
+			"waitOn": map[string]interface{}{"bootstrap-ubuntu": "succeeded"}},
+		map[string]interface{}{"label": "reboot-to-disk", "taskName": "Task.Obm.Node.Reboot",
+			"waitOn": map[string]interface{}{"install-key": "succeeded"}},
+	},
+}
+
+// installKeyGraphScript runs in the microkernel. It mounts the first
+// filesystem of the node with an /etc/passwd, adds the machine key to the
+// authorized_keys of the user, keeping the keys of the image, and sets the
+// hostname. SELinux systems are relabeled on the next boot, so sshd accepts
+// the new file.
+const installKeyGraphScript = `set -e
+user=%s
+key=%s
+name=%s
+root=/mnt/docker-machine
+mkdir -p $root
+for dev in $(lsblk -lnpo NAME,TYPE | awk '$2 == "part" || $2 == "lvm" {print $1}'); do
+	if mount "$dev" $root 2>/dev/null; then
+		[ -f $root/etc/passwd ] && break
+		umount $root
+	fi
+done
+if [ ! -f $root/etc/passwd ]; then
+	echo "No root filesystem found on the disks of the node" >&2
+	exit 1
+fi
+entry=$(grep "^$user:" $root/etc/passwd) || { echo "No user $user in the OS of the node" >&2; umount $root; exit 1; }
+home=$(echo "$entry" | cut -d: -f6)
+mkdir -p "$root$home/.ssh"
+grep -qxF "$key" "$root$home/.ssh/authorized_keys" 2>/dev/null || echo "$key" >> "$root$home/.ssh/authorized_keys"
+chmod 700 "$root$home/.ssh"
+chmod 600 "$root$home/.ssh/authorized_keys"
+chown -R "$(echo "$entry" | cut -d: -f3,4)" "$root$home/.ssh"
+echo "$name" > $root/etc/hostname
+if [ -f $root/etc/selinux/config ]; then touch $root/.autorelabel; fi
+umount $root
+`
+
+// keyGraphOptions are the options keyGraph is run with.
+func (d *Driver) keyGraphOptions() map[string]interface{} {
+	script := fmt.Sprintf(installKeyGraphScript, shellQuote(d.SSHUser), shellQuote(d.SSHKey), shellQuote(d.MachineName))
+	return map[string]interface{}{
+		"install-key": map[string]interface{}{"commands": []string{script}},
+	}
+}
+
+// installKeyGraph installs the machine key without logging in to the node,
+// for golden images whose credentials are unknown. A node installed by
+// --rackhd-workflow-name got the key from the installer already; any other
+// node is booted into the microkernel by keyGraph, which writes the key to its
+// disk. The node is then back in its own OS once the key is accepted.
+func (d *Driver) installKeyGraph() error {
+	if d.WorkflowName != "" {
+		log.Infof("The machine key of %s was installed by %s", d.MachineName, d.WorkflowName)
+		return nil
+	}
+	log.Infof("Registering workflow %s on %s", keyGraph, d.Endpoint)
+	if err := d.getClient().PutWorkflowDefinition(d.context(), keyGraphDefinition); err != nil {
+		return fmt.Errorf("Unable to register workflow %s. Error: %s", keyGraph, apiError(err))
+	}
+	log.Infof("Running workflow %s on node %s to install the machine key", keyGraph, d.NodeID)
+	if _, err := d.runWorkflow(keyGraph, d.keyGraphOptions(), keyGraphTimeout); err != nil {
+		return err
+	}
+
+	// the microkernel may still answer on the SSH port, but not to the key
+	deadline := time.Now().Add(networkTimeout)
+	for {
+		if d.probeIPs(d.candidateIPs) && executeSSHKeyCommand("exit 0", d) == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return classError(ErrNoReachableIP, "Node %s did not come back into its OS with the machine key within %s of workflow %s", d.NodeID, networkTimeout, keyGraph)
+		}
+		log.Debugf("Waiting for node %s to reboot into its OS", d.NodeID)
+		if err := d.awaitEvent(d.pollInterval(networkPollInterval), nodeChanged); err != nil {
+			return err
+		}
+		ips, err := d.lookupIPs()
+		if err != nil {
+			return err
+		}
+		d.candidateIPs = ips
+	}
+}
+
+// addInstallKey passes the machine key and hostname to an install graph in
+// the options of the RackHD OS installers: rootSshKey for root, otherwise the
+// sshKey of the user's entry under users, which is added when there is none.
+func (d *Driver) addInstallKey(defaults map[string]interface{}) {
+	key := d.SSHKey
+	if key == "" {
+		// a dry run generates no key
+		key = "<machine key>"
+	}
+	if _, ok := defaults["hostname"]; !ok {
+		defaults["hostname"] = d.MachineName
+	}
+	if d.SSHUser == "root" {
+		defaults["rootSshKey"] = key
+		return
+	}
+	users, _ := defaults["users"].([]interface{})
+	for _, user := range users {
+		if entry, ok := user.(map[string]interface{}); ok && entry["name"] == d.SSHUser {
+			entry["sshKey"] = key
+			return
+		}
+	}
+	defaults["users"] = append(users, map[string]interface{}{"name": d.SSHUser, "sshKey": key})
+}
+
+// passwordOptions returns the options that log in with the bootstrap
+// password, which --rackhd-bootstrap-method=graph does without.
+func (c *Config) passwordOptions() []string {
+	options := []struct {
+		set  bool
+		flag string
+	}{
+		{c.DisablePasswordAuth, "--rackhd-disable-password-auth"},
+		{c.NopasswdSudo, "--rackhd-nopasswd-sudo"},
+		{c.AutoRepair, "--rackhd-auto-repair"},
+		{c.SSHCAKey != "", "--rackhd-ssh-ca-key"},
+		{c.SSHCAPublicKey != "", "--rackhd-ssh-ca-public-key"},
+	}
+	var set []string
+	for _, option := range options {
+		if option.set {
+			set = append(set, option.flag)
+		}
+	}
+	return set
+}
@@ -0,0 +1,42 @@
+package rackhd
+
+import (
+	"time"
+)
+
+// reclaimTag marks the node of a machine whose lease has expired, so a reaper
+// can find the nodes to return to the pool without reading machine stores.
+const reclaimTag = "docker-machine-reclaim"
+
+// startLease sets the lease expiry of a machine created with --rackhd-lease-hours.
+func (d *Driver) startLease() {
+	if d.LeaseHours <= 0 {
+		return
+	}
+	d.LeaseExpires = time.Now().UTC().Add(time.Duration(d.LeaseHours) * time.Hour)
+	log.Infof("Machine %s is leased until %s", d.MachineName, d.LeaseExpires.Format(time.RFC3339))
+}
+
+// LeaseExpired reports whether the machine's lease has run out. Machines
+// created without a lease never expire.
+func (d *Driver) LeaseExpired() bool {
+	return !d.LeaseExpires.IsZero() && time.Now().After(d.LeaseExpires)
+}
+
+// checkLease tags the node for reclamation once the lease has expired.
+func (d *Driver) checkLease() {
+	if !d.LeaseExpired() || !d.firstTime(&d.leaseChecked) {
+		return
+	}
+	log.Warnf("The lease of %s expired at %s; its node %s is marked for reclamation", d.MachineName, d.LeaseExpires.Format(time.RFC3339), d.NodeID)
+
+	err := d.updateNodeTags(func(tags []string) ([]string, error) {
+		if containsString(tags, reclaimTag) {
+			return nil, nil
+		}
+		return append(tags, reclaimTag), nil
+	})
+	if err != nil {
+		log.Warnf("Unable to tag node %s for reclamation: %s", d.NodeID, err)
+	}
+}
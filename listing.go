@@ -0,0 +1,96 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// listPageSize is the number of records requested per page of a listing.
+const listPageSize = 100
+
+// errStopListing ends a listing early when returned by its callback.
+var errStopListing = errors.New("stop listing")
+
+// listPages walks a RackHD listing page by page with $skip and $top, handing
+// each record to fn, so only one page is held in memory. RackHD releases that
+// ignore the paging parameters return the whole listing at once, which is
+// detected by a page larger than requested or a page repeating the last one.
+func (d *Driver) listPages(list func(query url.Values) (interface{}, error), query url.Values, fn func(json.RawMessage) error) error {
+	var last string
+	for skip := 0; ; skip += listPageSize {
+		pageQuery := url.Values{}
+		for key, values := range query {
+			pageQuery[key] = values
+		}
+		pageQuery.Set("$skip", strconv.Itoa(skip))
+		pageQuery.Set("$top", strconv.Itoa(listPageSize))
+
+		payload, err := list(pageQuery)
+		if err != nil {
+			return err
+		}
+		var page []json.RawMessage
+		if err := decodePayload(payload, &page); err != nil {
+			return err
+		}
+		if len(page) > 0 && string(page[0]) == last {
+			apiLog.Debugf("RackHD ignored the paging parameters; the listing is complete")
+			return nil
+		}
+		for _, record := range page {
+			if err := fn(record); err == errStopListing {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(page) != listPageSize {
+			return nil
+		}
+		last = string(page[0])
+	}
+}
+
+// eachNode calls fn for every node matching the filter, e.g. type=compute.
+// The filter is passed to RackHD, which applies it where it supports the
+// field; fn should still check what it relies on. The listing may come from
+// the listing cache, so it can be up to --rackhd-listing-cache-ttl old.
+func (d *Driver) eachNode(filter url.Values, fn func(*nodeInfo) error) error {
+	client, adapter := d.getClient(), d.adapter()
+	list := func(query url.Values) (interface{}, error) {
+		return client.GetNodes(d.context(), query)
+	}
+	err := d.cachedPages("nodes", list, filter, func(record json.RawMessage) error {
+		node, err := adapter.node(record)
+		if err != nil {
+			apiLog.Debugf("Skipping malformed node %s: %s", record, err)
+			return nil
+		}
+		return fn(node)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to list the nodes of %s. Error: %s", d.Endpoint, apiError(err))
+	}
+	return nil
+}
+
+// eachLookup calls fn for every lookup table entry matching q, which RackHD
+// matches against the node ID, MAC address and IP address. Malformed entries
+// are skipped.
+func (d *Driver) eachLookup(q string, fn func(lookupEntry) error) error {
+	client, adapter := d.getClient(), d.adapter()
+	list := func(query url.Values) (interface{}, error) {
+		return client.Lookup(d.context(), query)
+	}
+	return d.cachedPages("lookups", list, url.Values{"q": {q}}, func(record json.RawMessage) error {
+		entry, err := adapter.lookup(record)
+		if err != nil {
+			apiLog.Debugf("Skipping malformed lookup entry %s: %s", record, err)
+			return nil
+		}
+		return fn(*entry)
+	})
+}
@@ -0,0 +1,113 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockTimeout      = 10 * time.Minute
+	lockPollInterval = 2 * time.Second
+	// a held lock is touched every lockRefresh; one that has not been touched
+	// for lockStaleAfter belongs to a process that died
+	lockRefresh    = 30 * time.Second
+	lockStaleAfter = 3 * time.Minute
+)
+
+// nodeLock is the content of a node lock file.
+type nodeLock struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	Machine   string    `json:"machine"`
+	Operation string    `json:"operation"`
+	Time      time.Time `json:"time"`
+}
+
+// lockPath is shared by every machine in the store, so two machines pointed at
+// the same node are serialized too.
+func (d *Driver) lockPath() string {
+	return filepath.Join(d.StorePath, "rackhd-locks", d.NodeID+".lock")
+}
+
+// lockNode takes the store-wide lock of the node for operation, waiting for
+// other docker-machine processes to release it, and returns the function that
+// releases it. Taking a lock the driver already holds is a no-op.
+func (d *Driver) lockNode(operation string) (func(), error) {
+	if d.NodeID == "" || d.StorePath == "" || d.heldLock != "" {
+		return func() {}, nil
+	}
+	path := d.lockPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create the lock directory. Error: %s", err)
+	}
+	host, _ := os.Hostname()
+	b, _ := json.Marshal(nodeLock{PID: os.Getpid(), Host: host, Machine: d.MachineName, Operation: operation, Time: time.Now().UTC()})
+
+	deadline := time.Now().Add(lockTimeout)
+	logged := false
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Write(b)
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("Unable to create lock %s. Error: %s", path, err)
+		}
+		holder := readNodeLock(path)
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > lockStaleAfter {
+			log.Warnf("Removing stale lock of node %s held by %s", d.NodeID, holder)
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Node %s is locked by %s; giving up after %s", d.NodeID, holder, lockTimeout)
+		}
+		if !logged {
+			log.Infof("Waiting for %s to finish with node %s", holder, d.NodeID)
+			logged = true
+		}
+		if err := d.sleep(lockPollInterval); err != nil {
+			return nil, fmt.Errorf("Stopped waiting for the lock of node %s held by %s. Error: %s", d.NodeID, holder, err)
+		}
+	}
+
+	d.heldLock = path
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := time.Now()
+				os.Chtimes(path, now, now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		os.Remove(path)
+		d.heldLock = ""
+	}, nil
+}
+
+// readNodeLock describes the holder of a lock file for messages.
+func readNodeLock(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "another process"
+	}
+	var l nodeLock
+	if err := json.Unmarshal(b, &l); err != nil {
+		return "another process"
+	}
+	return fmt.Sprintf("%s of machine %s (pid %d on %s, since %s)", l.Operation, l.Machine, l.PID, l.Host, l.Time.Format(time.RFC3339))
+}
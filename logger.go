@@ -0,0 +1,122 @@
+package rackhd
+
+import (
+	"sync"
+
+	machinelog "github.com/docker/machine/libmachine/log"
+)
+
+// Logger is a logging backend for the driver. The default writes to
+// libmachine's log, which is what docker-machine shows.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// LogLevel is the least severe level a component logs at.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+	// LogOff silences a component
+	LogOff
+)
+
+// The components whose log level can be set on its own. ComponentAPI covers
+// RackHD API calls and listings, ComponentSSH the SSH and WinRM sessions and
+// the tunnel, ComponentWorkflow running and waiting for workflows, and
+// ComponentDriver everything else.
+const (
+	ComponentDriver   = "driver"
+	ComponentAPI      = "api"
+	ComponentSSH      = "ssh"
+	ComponentWorkflow = "workflow"
+)
+
+// logging is process wide, like the metrics: an application embedding the
+// driver sets it up once for all the machines it drives.
+var logging = struct {
+	sync.Mutex
+	backend Logger
+	levels  map[string]LogLevel
+}{
+	backend: machineLogger{},
+	levels:  make(map[string]LogLevel),
+}
+
+// SetLogger replaces the backend all driver logging goes to. A nil logger
+// restores libmachine's log.
+func SetLogger(logger Logger) {
+	logging.Lock()
+	defer logging.Unlock()
+	if logger == nil {
+		logger = machineLogger{}
+	}
+	logging.backend = logger
+}
+
+// SetLogLevel sets the level of one component, e.g.
+// SetLogLevel(ComponentAPI, LogWarn). All components log at LogDebug by
+// default, leaving the filtering to the backend.
+func SetLogLevel(component string, level LogLevel) {
+	logging.Lock()
+	defer logging.Unlock()
+	logging.levels[component] = level
+}
+
+// componentLogger logs for one component through the current backend.
+type componentLogger string
+
+var (
+	log         = componentLogger(ComponentDriver)
+	apiLog      = componentLogger(ComponentAPI)
+	sshLog      = componentLogger(ComponentSSH)
+	workflowLog = componentLogger(ComponentWorkflow)
+)
+
+// backend returns the backend when the component logs at level.
+func (c componentLogger) backend(level LogLevel) Logger {
+	logging.Lock()
+	defer logging.Unlock()
+	if level < logging.levels[string(c)] {
+		return nil
+	}
+	return logging.backend
+}
+
+func (c componentLogger) Debugf(format string, args ...interface{}) {
+	if backend := c.backend(LogDebug); backend != nil {
+		backend.Debugf(format, args...)
+	}
+}
+
+func (c componentLogger) Infof(format string, args ...interface{}) {
+	if backend := c.backend(LogInfo); backend != nil {
+		backend.Infof(format, args...)
+	}
+}
+
+func (c componentLogger) Warnf(format string, args ...interface{}) {
+	if backend := c.backend(LogWarn); backend != nil {
+		backend.Warnf(format, args...)
+	}
+}
+
+func (c componentLogger) Errorf(format string, args ...interface{}) {
+	if backend := c.backend(LogError); backend != nil {
+		backend.Errorf(format, args...)
+	}
+}
+
+// machineLogger is the default Logger.
+type machineLogger struct{}
+
+func (machineLogger) Debugf(format string, args ...interface{}) { machinelog.Debugf(format, args...) }
+func (machineLogger) Infof(format string, args ...interface{})  { machinelog.Infof(format, args...) }
+func (machineLogger) Warnf(format string, args ...interface{})  { machinelog.Warnf(format, args...) }
+func (machineLogger) Errorf(format string, args ...interface{}) { machinelog.Errorf(format, args...) }
@@ -0,0 +1,82 @@
+package rackhd
+
+import (
+	"fmt"
+)
+
+// maintenanceTag marks a node under maintenance. It can be set through
+// SetMaintenance or directly in RackHD; the driver only looks at the tag.
+const maintenanceTag = "docker-machine-maintenance"
+
+// Maintainer is implemented by drivers that can put a machine under
+// maintenance.
+type Maintainer interface {
+	SetMaintenance(on bool) error
+}
+
+var _ Maintainer = (*Driver)(nil)
+
+// SetMaintenance tags or untags the node as under maintenance and pauses or
+// resumes its RackHD pollers. While the tag is set GetState reports Paused and
+// the driver refuses power operations.
+func (d *Driver) SetMaintenance(on bool) error {
+	unlock, err := d.lockNode("maintenance")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if on {
+		log.Infof("Putting %s (node %s) under maintenance", d.MachineName, d.NodeID)
+	} else {
+		log.Infof("Clearing maintenance of %s (node %s)", d.MachineName, d.NodeID)
+	}
+	err = d.updateNodeTags(func(current []string) ([]string, error) {
+		tags := make([]string, 0, len(current)+1)
+		for _, tag := range current {
+			if tag != maintenanceTag {
+				tags = append(tags, tag)
+			}
+		}
+		if on {
+			tags = append(tags, maintenanceTag)
+		}
+		return tags, nil
+	})
+	if err != nil {
+		return err
+	}
+	return d.pausePollers(on)
+}
+
+// pausePollers pauses or resumes every poller RackHD runs against the node.
+func (d *Driver) pausePollers(paused bool) error {
+	client := d.getClient()
+	payload, err := client.GetNodePollers(d.context(), d.NodeID)
+	if err != nil {
+		return fmt.Errorf("Unable to get the pollers of node %s. Error: %s", d.NodeID, apiError(err))
+	}
+	ids, err := d.adapter().pollerIDs(payload)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := client.SetPollerPaused(d.context(), id, paused); err != nil {
+			return fmt.Errorf("Unable to update poller %s of node %s. Error: %s", id, d.NodeID, apiError(err))
+		}
+	}
+	log.Debugf("Set paused=%t on %d pollers of node %s", paused, len(ids), d.NodeID)
+	return nil
+}
+
+// checkMaintenance refuses operation while the node is under maintenance.
+func (d *Driver) checkMaintenance(operation string) error {
+	node, err := d.getNode()
+	if err != nil {
+		return err
+	}
+	if containsString(node.Tags, maintenanceTag) {
+		return fmt.Errorf("Machine %s (node %s) is under maintenance; %s is blocked until maintenance is cleared", d.MachineName, d.NodeID, operation)
+	}
+	return nil
+}
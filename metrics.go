@@ -0,0 +1,120 @@
+package rackhd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// apiLatencyBuckets are the upper bounds, in seconds, of the API latency histogram.
+var apiLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// driverMetrics are process wide, so a single process driving many machines
+// (a provisioning service embedding the driver) reports them all together.
+type driverMetrics struct {
+	mu                sync.Mutex
+	createsInProgress int
+	creates           map[string]int // by result
+	apiCount          map[string]int // by method
+	apiSum            map[string]float64
+	apiBuckets        map[string][]int
+}
+
+var metrics = &driverMetrics{
+	creates:    make(map[string]int),
+	apiCount:   make(map[string]int),
+	apiSum:     make(map[string]float64),
+	apiBuckets: make(map[string][]int),
+}
+
+var metricsServer sync.Once
+
+func (m *driverMetrics) createStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createsInProgress++
+}
+
+func (m *driverMetrics) createFinished(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createsInProgress--
+	if err != nil {
+		m.creates["failed"]++
+	} else {
+		m.creates["succeeded"]++
+	}
+}
+
+func (m *driverMetrics) observeAPI(method string, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := elapsed.Seconds()
+	if m.apiBuckets[method] == nil {
+		m.apiBuckets[method] = make([]int, len(apiLatencyBuckets))
+	}
+	for i, le := range apiLatencyBuckets {
+		if seconds <= le {
+			m.apiBuckets[method][i]++
+		}
+	}
+	m.apiCount[method]++
+	m.apiSum[method] += seconds
+}
+
+// MetricsHandler serves the driver metrics in the Prometheus text format, for
+// applications that embed the driver and have their own HTTP server.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+}
+
+func (m *driverMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP rackhd_creates_in_progress Machine creates currently running.")
+	fmt.Fprintln(w, "# TYPE rackhd_creates_in_progress gauge")
+	fmt.Fprintf(w, "rackhd_creates_in_progress %d\n", m.createsInProgress)
+
+	fmt.Fprintln(w, "# HELP rackhd_creates_total Machine creates finished, by result.")
+	fmt.Fprintln(w, "# TYPE rackhd_creates_total counter")
+	for _, result := range []string{"succeeded", "failed"} {
+		fmt.Fprintf(w, "rackhd_creates_total{result=%q} %d\n", result, m.creates[result])
+	}
+
+	fmt.Fprintln(w, "# HELP rackhd_api_request_duration_seconds Latency of RackHD API requests.")
+	fmt.Fprintln(w, "# TYPE rackhd_api_request_duration_seconds histogram")
+	methods := make([]string, 0, len(m.apiCount))
+	for method := range m.apiCount {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		for i, le := range apiLatencyBuckets {
+			fmt.Fprintf(w, "rackhd_api_request_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", method, le, m.apiBuckets[method][i])
+		}
+		fmt.Fprintf(w, "rackhd_api_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, m.apiCount[method])
+		fmt.Fprintf(w, "rackhd_api_request_duration_seconds_sum{method=%q} %g\n", method, m.apiSum[method])
+		fmt.Fprintf(w, "rackhd_api_request_duration_seconds_count{method=%q} %d\n", method, m.apiCount[method])
+	}
+}
+
+// serveMetrics starts the metrics endpoint on addr once per process.
+func serveMetrics(addr string) {
+	metricsServer.Do(func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", MetricsHandler())
+		go func() {
+			log.Debugf("Serving driver metrics on %s/metrics", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Warnf("Unable to serve driver metrics on %s: %s", addr, err)
+			}
+		}()
+	})
+}
@@ -0,0 +1,104 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// configVersion is the version of the machine config this release persists.
+// Bump it, and add a migration, whenever a persisted field is renamed,
+// changes type or gets a default that older configs lack.
+const configVersion = 2
+
+// configMigrations[v] upgrades a config of version v to version v+1. They
+// work on the persisted JSON object, so a renamed or retyped field can still
+// be read in its old form.
+var configMigrations = []func(fields map[string]json.RawMessage){
+	migrateConfigV0,
+	migrateConfigV1,
+}
+
+// migrateConfigV0 upgrades configs of releases before configs were
+// versioned. Those did not persist the options added since, so the driver
+// read them as zero values; fill in the defaults they stood for.
+func migrateConfigV0(fields map[string]json.RawMessage) {
+	setConfigDefault(fields, "Endpoint", defaultEndpoint)
+	setConfigDefault(fields, "Transport", defaultTransport)
+	setConfigDefault(fields, "BootstrapMethod", bootstrapSSH)
+	setConfigDefault(fields, "RemoveStrategy", removeNone)
+	setConfigDefault(fields, "WorkflowTimeout", defaultWorkflowTimeout)
+	setConfigDefault(fields, "SSHCommandTimeout", defaultSSHCommandTimeout)
+	winrmPort := defaultWinRMPort
+	if string(fields["WinRMHTTPS"]) == "true" {
+		winrmPort = defaultWinRMHTTPSPort
+	}
+	setConfigDefault(fields, "WinRMPort", winrmPort)
+}
+
+// migrateConfigV1 drops the BMC passwords version 1 stored in plaintext. The
+// serial console reads its password from a file or IPMI_PASSWORD instead.
+func migrateConfigV1(fields map[string]json.RawMessage) {
+	for _, name := range []string{"SOLPassword", "BMCPassword"} {
+		switch strings.TrimSpace(string(fields[name])) {
+		case "", "null", `""`:
+		default:
+			log.Warnf("The machine config holds a BMC password, which is no longer stored; give the serial console its password with IPMI_PASSWORD")
+		}
+		delete(fields, name)
+	}
+}
+
+// setConfigDefault sets a field that is missing, null or zero.
+func setConfigDefault(fields map[string]json.RawMessage, name string, value interface{}) {
+	switch strings.TrimSpace(string(fields[name])) {
+	case "", "null", `""`, "0":
+		b, _ := json.Marshal(value)
+		fields[name] = b
+	}
+}
+
+// persistedDriver has the fields of Driver but not its UnmarshalJSON.
+type persistedDriver Driver
+
+// UnmarshalJSON loads a machine config written by this or an older release,
+// migrating it to the current version first. A field that still does not
+// decode, e.g. one an unknown release wrote with another type, is dropped
+// with a warning rather than making the machine unusable.
+func (d *Driver) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	var version int
+	json.Unmarshal(fields["ConfigVersion"], &version)
+	if version > configVersion {
+		log.Warnf("The machine config was written by a newer driver release (config version %d, this release reads %d); fields it does not know are ignored", version, configVersion)
+	}
+	for v := version; v < configVersion; v++ {
+		configMigrations[v](fields)
+	}
+	if version < configVersion {
+		log.Debugf("Migrated machine config from version %d to %d", version, configVersion)
+	}
+
+	for {
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(b, (*persistedDriver)(d))
+		typeErr, ok := err.(*json.UnmarshalTypeError)
+		if !ok || typeErr.Field == "" {
+			if err == nil && version < configVersion {
+				d.ConfigVersion = configVersion
+			}
+			return err
+		}
+		field := strings.SplitN(typeErr.Field, ".", 2)[0]
+		if _, known := fields[field]; !known {
+			return err
+		}
+		log.Warnf("Ignoring field %s of the machine config, which cannot be read as %s", field, typeErr.Type)
+		delete(fields, field)
+	}
+}
@@ -0,0 +1,348 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeMonorail is an in-memory RackHD serving the parts of the 1.1 API the
+// driver uses. Graphs finish as soon as they are started, with the status set
+// in graphStatus (succeeded by default); a graph left "running" becomes the
+// node's active workflow. Listings are paged with $skip and $top unless
+// noPaging is set, as on RackHD releases without paging.
+type fakeMonorail struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	nodes       map[string]map[string]interface{}
+	lookups     []map[string]interface{}
+	catalogs    map[string]map[string]interface{}
+	pollers     map[string][]map[string]interface{}
+	obms        map[string][]interface{}
+	skus        map[string]map[string]interface{}
+	pollerData  map[string]interface{}
+	graphStatus map[string]string
+	graphs      map[string]map[string]interface{}
+	definitions map[string]map[string]interface{}
+	templates   map[string]string
+	active      map[string]string
+	noPaging    bool
+	pages       int
+	conns       int
+
+	// started and cancelled record the graphs run and cancelled, in order,
+	// and options the options of the last run of each graph.
+	started   []string
+	cancelled []string
+	options   map[string]interface{}
+	// uploads records the templates put into the library, in order.
+	uploads []string
+}
+
+func newFakeMonorail() *fakeMonorail {
+	f := &fakeMonorail{
+		nodes:       make(map[string]map[string]interface{}),
+		catalogs:    make(map[string]map[string]interface{}),
+		pollers:     make(map[string][]map[string]interface{}),
+		obms:        make(map[string][]interface{}),
+		skus:        make(map[string]map[string]interface{}),
+		pollerData:  make(map[string]interface{}),
+		graphStatus: make(map[string]string),
+		graphs:      make(map[string]map[string]interface{}),
+		definitions: make(map[string]map[string]interface{}),
+		templates:   make(map[string]string),
+		active:      make(map[string]string),
+		options:     make(map[string]interface{}),
+	}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(f.serveHTTP))
+	f.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+		}
+	}
+	f.Start()
+	return f
+}
+
+// endpoint is the value of --rackhd-endpoint for the fake.
+func (f *fakeMonorail) endpoint() string {
+	return strings.TrimPrefix(f.URL, "http://")
+}
+
+// addNode adds a node document and a lookup entry for each of its addresses.
+func (f *fakeMonorail) addNode(id string, tags []string, ips ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if tags == nil {
+		tags = []string{}
+	}
+	f.nodes[id] = map[string]interface{}{
+		"id":          id,
+		"name":        "node-" + id,
+		"type":        "compute",
+		"tags":        tags,
+		"identifiers": []string{"52:54:00:00:00:01"},
+	}
+	for _, ip := range ips {
+		f.lookups = append(f.lookups, map[string]interface{}{
+			"node":       id,
+			"ipAddress":  ip,
+			"macAddress": "52:54:00:00:00:01",
+		})
+	}
+}
+
+// setNode sets a field of a node document.
+func (f *fakeMonorail) setNode(id, field string, value interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes[id][field] = value
+}
+
+func (f *fakeMonorail) nodeTags(id string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var tags []string
+	b, _ := json.Marshal(f.nodes[id]["tags"])
+	json.Unmarshal(b, &tags)
+	return tags
+}
+
+// startGraph creates a graph instance for the node, as POST
+// /nodes/{id}/workflows does.
+func (f *fakeMonorail) startGraph(nodeID, name string) map[string]interface{} {
+	status := f.graphStatus[name]
+	if status == "" {
+		status = "succeeded"
+	}
+	id := fmt.Sprintf("graph-%d", len(f.graphs)+1)
+	graph := map[string]interface{}{
+		"instanceId":     id,
+		"injectableName": name,
+		"node":           nodeID,
+		"_status":        status,
+	}
+	f.graphs[id] = graph
+	f.started = append(f.started, name)
+	if status == "running" {
+		f.active[nodeID] = id
+	}
+	return graph
+}
+
+func (f *fakeMonorail) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/1.1"), "/"), "/")
+	reply := func(code int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+	notFound := func() {
+		reply(http.StatusNotFound, map[string]interface{}{"message": "Not Found"})
+	}
+	var raw []byte
+	if r.Body != nil {
+		raw, _ = ioutil.ReadAll(r.Body)
+	}
+	var body map[string]interface{}
+	json.Unmarshal(raw, &body)
+
+	switch {
+	case r.Method == "GET" && path[0] == "config":
+		reply(http.StatusOK, map[string]interface{}{})
+
+	case r.Method == "GET" && path[0] == "lookups":
+		q := r.URL.Query().Get("q")
+		records := []map[string]interface{}{}
+		for _, record := range f.lookups {
+			if q == "" || record["node"] == q || record["ipAddress"] == q || record["macAddress"] == q {
+				records = append(records, record)
+			}
+		}
+		reply(http.StatusOK, f.page(r, records))
+
+	case r.Method == "GET" && len(path) == 1 && path[0] == "nodes":
+		ids := make([]string, 0, len(f.nodes))
+		for id := range f.nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		list := []map[string]interface{}{}
+	nodes:
+		for _, id := range ids {
+			for field, values := range r.URL.Query() {
+				if !strings.HasPrefix(field, "$") && fmt.Sprint(f.nodes[id][field]) != values[0] {
+					continue nodes
+				}
+			}
+			list = append(list, f.nodes[id])
+		}
+		reply(http.StatusOK, f.page(r, list))
+
+	case path[0] == "nodes" && len(path) >= 2:
+		node, ok := f.nodes[path[1]]
+		if !ok {
+			notFound()
+			return
+		}
+		f.serveNode(r.Method, path[1], node, path[2:], body, r, reply, notFound)
+
+	case r.Method == "PUT" && len(path) == 1 && path[0] == "workflows":
+		name, _ := body["injectableName"].(string)
+		f.definitions[name] = body
+		reply(http.StatusOK, body)
+
+	case r.Method == "GET" && path[0] == "templates" && len(path) == 3 && path[1] == "library":
+		contents, ok := f.templates[path[2]]
+		if !ok {
+			notFound()
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"name": path[2], "contents": contents})
+
+	case r.Method == "PUT" && path[0] == "templates" && len(path) == 3 && path[1] == "library":
+		var contents string
+		json.Unmarshal(raw, &contents)
+		f.templates[path[2]] = contents
+		f.uploads = append(f.uploads, path[2])
+		reply(http.StatusOK, map[string]interface{}{"name": path[2]})
+
+	case r.Method == "GET" && path[0] == "workflows" && len(path) == 3 && path[1] == "library":
+		reply(http.StatusOK, map[string]interface{}{"injectableName": path[2]})
+
+	case r.Method == "GET" && path[0] == "workflows" && len(path) == 2:
+		graph, ok := f.graphs[path[1]]
+		if !ok {
+			notFound()
+			return
+		}
+		reply(http.StatusOK, graph)
+
+	case r.Method == "GET" && path[0] == "skus" && len(path) == 2:
+		sku, ok := f.skus[path[1]]
+		if !ok {
+			notFound()
+			return
+		}
+		reply(http.StatusOK, sku)
+
+	case r.Method == "GET" && path[0] == "pollers" && len(path) == 4 && path[2] == "data" && path[3] == "current":
+		data, ok := f.pollerData[path[1]]
+		if !ok {
+			notFound()
+			return
+		}
+		reply(http.StatusOK, data)
+
+	case r.Method == "PATCH" && path[0] == "pollers":
+		reply(http.StatusOK, map[string]interface{}{"id": path[1]})
+
+	default:
+		notFound()
+	}
+}
+
+// page applies the $skip and $top parameters of a listing request, unless
+// paging is disabled, and counts the pages served.
+func (f *fakeMonorail) page(r *http.Request, records []map[string]interface{}) []map[string]interface{} {
+	f.pages++
+	if f.noPaging {
+		return records
+	}
+	skip, _ := strconv.Atoi(r.URL.Query().Get("$skip"))
+	top, err := strconv.Atoi(r.URL.Query().Get("$top"))
+	if skip > len(records) {
+		skip = len(records)
+	}
+	records = records[skip:]
+	if err == nil && top < len(records) {
+		records = records[:top]
+	}
+	return records
+}
+
+func (f *fakeMonorail) serveNode(method, id string, node map[string]interface{}, path []string, body map[string]interface{},
+	r *http.Request, reply func(int, interface{}), notFound func()) {
+	switch {
+	case len(path) == 0 && method == "GET":
+		reply(http.StatusOK, node)
+
+	case len(path) == 0 && method == "PATCH":
+		for key, value := range body {
+			node[key] = value
+		}
+		reply(http.StatusOK, node)
+
+	case len(path) == 2 && path[0] == "catalogs" && method == "GET":
+		data, ok := f.catalogs[id][path[1]]
+		if !ok {
+			notFound()
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"node": id, "source": path[1], "data": data})
+
+	case len(path) == 1 && path[0] == "obm" && method == "GET":
+		obms := f.obms[id]
+		if obms == nil {
+			obms = []interface{}{}
+		}
+		reply(http.StatusOK, obms)
+
+	case len(path) == 1 && path[0] == "obm" && method == "POST":
+		f.obms[id] = append(f.obms[id], body)
+		reply(http.StatusCreated, body)
+
+	case len(path) == 1 && path[0] == "pollers" && method == "GET":
+		pollers := f.pollers[id]
+		if pollers == nil {
+			pollers = []map[string]interface{}{}
+		}
+		reply(http.StatusOK, pollers)
+
+	case len(path) == 1 && path[0] == "workflows" && method == "POST":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name, _ = body["name"].(string)
+		}
+		if _, busy := f.active[id]; busy {
+			reply(http.StatusBadRequest, map[string]interface{}{"message": "Unable to run multiple task graphs against a single target."})
+			return
+		}
+		f.options[name] = body["options"]
+		graph := f.startGraph(id, name)
+		if body["options"] != nil {
+			graph["options"] = body["options"]
+		}
+		reply(http.StatusCreated, graph)
+
+	case len(path) == 2 && path[0] == "workflows" && path[1] == "active":
+		instanceID, ok := f.active[id]
+		if !ok {
+			notFound()
+			return
+		}
+		graph := f.graphs[instanceID]
+		if method == "DELETE" {
+			graph["_status"] = "cancelled"
+			delete(f.active, id)
+			f.cancelled = append(f.cancelled, graph["injectableName"].(string))
+		}
+		reply(http.StatusOK, graph)
+
+	default:
+		notFound()
+	}
+}
@@ -0,0 +1,164 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const netplanConfigPath = "/etc/netplan/60-docker-machine.yaml"
+
+// networkConfig is the --rackhd-network-config document.
+type networkConfig struct {
+	Interfaces []networkInterface `json:"interfaces"`
+	Bonds      []networkBond      `json:"bonds"`
+}
+
+type networkInterface struct {
+	Name string `json:"name"`
+	MTU  int    `json:"mtu"`
+}
+
+type networkBond struct {
+	Name       string   `json:"name"`
+	Mode       string   `json:"mode"`
+	Interfaces []string `json:"interfaces"`
+	MTU        int      `json:"mtu"`
+	// Address is a CIDR address; the bond uses DHCP without one.
+	Address string `json:"address"`
+}
+
+// readNetworkConfig reads and validates the file given with
+// --rackhd-network-config and returns it compacted for the machine config.
+func readNetworkConfig(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read --rackhd-network-config %s. Error: %s", path, err)
+	}
+	var config networkConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return "", fmt.Errorf("--rackhd-network-config %s is not valid JSON. Error: %s", path, err)
+	}
+	for _, bond := range config.Bonds {
+		if bond.Name == "" || len(bond.Interfaces) == 0 {
+			return "", fmt.Errorf("Every bond in --rackhd-network-config needs a name and interfaces")
+		}
+	}
+	compact, err := json.Marshal(config)
+	return string(compact), err
+}
+
+// configureNetwork applies the declared MTUs and bonds after the OS install,
+// through NetworkManager or netplan, whichever the image uses. Interfaces that
+// carry the bootstrap address are never enslaved, as that would cut the
+// driver off from the node.
+func (d *Driver) configureNetwork() error {
+	if d.NetworkConfig == "" {
+		return errPhaseSkipped
+	}
+	var config networkConfig
+	if err := json.Unmarshal([]byte(d.NetworkConfig), &config); err != nil {
+		return err
+	}
+
+	out, err := executeSSHKeyCommandOutput(fmt.Sprintf("ip -o addr show | awk '$4 ~ /^%s\\// {print $2}'", strings.Replace(d.IPAddress, ".", "\\.", -1)), d)
+	if err != nil {
+		return err
+	}
+	bootstrapIface := strings.TrimSpace(out)
+	for _, bond := range config.Bonds {
+		if containsString(bond.Interfaces, bootstrapIface) {
+			return fmt.Errorf("Bond %s would enslave %s, which carries the bootstrap address %s", bond.Name, bootstrapIface, d.IPAddress)
+		}
+	}
+
+	log.Infof("Configuring %d interfaces and %d bonds on %s", len(config.Interfaces), len(config.Bonds), d.MachineName)
+	script := fmt.Sprintf(`if command -v nmcli >/dev/null && nmcli -t general status >/dev/null 2>&1; then
+%s
+elif command -v netplan >/dev/null; then
+	echo %s > %s && netplan apply
+else
+	echo 'neither NetworkManager nor netplan is available' >&2
+	exit 1
+fi`, nmcliScript(config), shellQuote(netplanConfig(config)), netplanConfigPath)
+	if err := d.runKeyCommands([]string{script}); err != nil {
+		return fmt.Errorf("Unable to configure the network. Error: %w", err)
+	}
+	return nil
+}
+
+func nmcliScript(config networkConfig) string {
+	var lines []string
+	for _, iface := range config.Interfaces {
+		if iface.MTU == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(`con=$(nmcli -g GENERAL.CONNECTION device show %s)
+	if [ -z "$con" ]; then nmcli connection add type ethernet ifname %s con-name %s; con=%s; fi
+	nmcli connection modify "$con" 802-3-ethernet.mtu %d && nmcli connection up "$con"`, iface.Name, iface.Name, iface.Name, iface.Name, iface.MTU))
+	}
+	for _, bond := range config.Bonds {
+		mode := bond.Mode
+		if mode == "" {
+			mode = "active-backup"
+		}
+		add := fmt.Sprintf("nmcli connection add type bond ifname %s con-name %s bond.options mode=%s,miimon=100", bond.Name, bond.Name, mode)
+		if bond.Address != "" {
+			add += " ipv4.method manual ipv4.addresses " + bond.Address
+		}
+		if bond.MTU != 0 {
+			add += fmt.Sprintf(" 802-3-ethernet.mtu %d", bond.MTU)
+		}
+		lines = append(lines, add)
+		for _, slave := range bond.Interfaces {
+			lines = append(lines, fmt.Sprintf("nmcli connection add type ethernet ifname %s con-name %s-%s master %s slave-type bond", slave, bond.Name, slave, bond.Name))
+		}
+		lines = append(lines, fmt.Sprintf("nmcli connection up %s", bond.Name))
+	}
+	return "\t" + strings.Join(lines, "\n\t")
+}
+
+// netplanConfig renders the configuration for netplan. JSON is valid YAML,
+// so no YAML encoder is needed.
+func netplanConfig(config networkConfig) string {
+	ethernets := make(map[string]interface{})
+	bonds := make(map[string]interface{})
+	for _, iface := range config.Interfaces {
+		settings := map[string]interface{}{}
+		if iface.MTU != 0 {
+			settings["mtu"] = iface.MTU
+		}
+		ethernets[iface.Name] = settings
+	}
+	for _, bond := range config.Bonds {
+		mode := bond.Mode
+		if mode == "" {
+			mode = "active-backup"
+		}
+		settings := map[string]interface{}{
+			"interfaces": bond.Interfaces,
+			"parameters": map[string]interface{}{"mode": mode, "mii-monitor-interval": 100},
+		}
+		if bond.MTU != 0 {
+			settings["mtu"] = bond.MTU
+		}
+		if bond.Address != "" {
+			settings["addresses"] = []string{bond.Address}
+		} else {
+			settings["dhcp4"] = true
+		}
+		bonds[bond.Name] = settings
+		for _, slave := range bond.Interfaces {
+			if _, ok := ethernets[slave]; !ok {
+				ethernets[slave] = map[string]interface{}{}
+			}
+		}
+	}
+	network := map[string]interface{}{"version": 2, "ethernets": ethernets}
+	if len(bonds) > 0 {
+		network["bonds"] = bonds
+	}
+	b, _ := json.MarshalIndent(map[string]interface{}{"network": network}, "", "  ")
+	return string(b)
+}
@@ -0,0 +1,70 @@
+package rackhd
+
+import (
+	"fmt"
+)
+
+// nodeInfo is the subset of a RackHD node document the driver reads.
+type nodeInfo struct {
+	ID   string   `json:"id"`
+	Name string   `json:"name"`
+	Type string   `json:"type"`
+	SKU  string   `json:"sku"`
+	Tags []string `json:"tags"`
+	// Reserved is the reserved marker of RackHD versions with one, and nil
+	// on others.
+	Reserved *bool `json:"reserved"`
+
+	// Identifiers holds the MAC addresses RackHD discovered the node by.
+	Identifiers []string `json:"identifiers"`
+}
+
+// getNode fetches the node document for d.NodeID.
+func (d *Driver) getNode() (*nodeInfo, error) {
+	payload, err := d.getClient().GetNode(d.context(), d.NodeID)
+	if err != nil && isNotFound(err) {
+		return nil, classError(ErrNodeNotFound, "Node %s does not exist on %s", d.NodeID, d.Endpoint)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get node %s. Error: %s", d.NodeID, apiError(err))
+	}
+	return d.adapter().node(payload)
+}
+
+// nodeGoneError reports that the machine's node was removed from RackHD after
+// the machine was created, e.g. deleted or re-discovered under a new ID.
+func (d *Driver) nodeGoneError() error {
+	return classError(ErrNodeNotFound, "Node %s of machine %s no longer exists on %s; it was deleted or re-discovered under a new ID. Run docker-machine rm %s to remove the machine", d.NodeID, d.MachineName, d.Endpoint, d.MachineName)
+}
+
+// checkNodeExists returns nodeGoneError if the node has been removed from
+// RackHD. Any other failure to reach RackHD is not treated as the node being
+// gone. The result is remembered for the rest of the process.
+func (d *Driver) checkNodeExists() error {
+	if checked, err := d.nodeCheck(); checked {
+		return err
+	}
+	_, err := d.getNode()
+	if err != nil && ErrorClass(err) != ErrNodeNotFound {
+		return nil
+	}
+	var nodeErr error
+	if err != nil && !d.rebindIfEnabled() {
+		nodeErr = d.nodeGoneError()
+	}
+	d.setNodeCheck(nodeErr)
+	return nodeErr
+}
+
+// nodeCheck returns whether checkNodeExists already ran, and its result.
+func (d *Driver) nodeCheck() (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nodeChecked, d.nodeErr
+}
+
+func (d *Driver) setNodeCheck(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nodeChecked, d.nodeErr = true, err
+}
@@ -0,0 +1,58 @@
+package rackhd
+
+import (
+	"net/url"
+	"strings"
+)
+
+// resolveNodeSerial sets the node ID from --rackhd-node-serial, matching the
+// system serial number, chassis serial number and system UUID in the dmi
+// catalog of every compute node. Data-center teams identify boxes by the
+// serial on the chassis label, not by RackHD's node ID.
+func (d *Driver) resolveNodeSerial() error {
+	if d.NodeBySerial == "" || d.NodeID != "" {
+		return nil
+	}
+	var ids []string
+	err := d.eachNode(url.Values{"type": {"compute"}}, func(node *nodeInfo) error {
+		if node.Type == "compute" {
+			ids = append(ids, node.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var matches []string
+	for _, id := range ids {
+		var dmi struct {
+			System  dmiSystemInfo `json:"System Information"`
+			Chassis struct {
+				SerialNumber string `json:"Serial Number"`
+			} `json:"Chassis Information"`
+		}
+		d.NodeID = id
+		if err := d.getCatalog("dmi", &dmi); err != nil {
+			log.Debugf("Not matching node %s: %s", id, err)
+			continue
+		}
+		for _, value := range []string{dmi.System.SerialNumber, dmi.Chassis.SerialNumber, dmi.System.UUID} {
+			if value != "" && strings.EqualFold(strings.TrimSpace(value), strings.TrimSpace(d.NodeBySerial)) {
+				matches = append(matches, id)
+				break
+			}
+		}
+	}
+	d.NodeID = ""
+
+	switch len(matches) {
+	case 0:
+		return classError(ErrNodeNotFound, "No compute node on %s has the serial number or UUID %q", d.Endpoint, d.NodeBySerial)
+	case 1:
+		d.NodeID = matches[0]
+		log.Infof("Serial number %s is node %s", d.NodeBySerial, d.NodeID)
+		return nil
+	}
+	return classError(ErrNodeNotFound, "Nodes %s all have the serial number or UUID %q; specify one with --rackhd-node-id", strings.Join(matches, ", "), d.NodeBySerial)
+}
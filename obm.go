@@ -0,0 +1,56 @@
+package rackhd
+
+import "fmt"
+
+const (
+	obmSetupGraph = "Graph.Obm.Ipmi.CreateSettings"
+	ipmiService   = "ipmi-obm-service"
+)
+
+// setupOBM gives a node without OBM settings an IPMI OBM setting from
+// --rackhd-bmc-user and --rackhd-bmc-password: for the BMC at --rackhd-bmc-host,
+// or else the one of the node's bmc catalog, with RackHD's OBM setup graph.
+// Power control is then proven with powerOnGraph, so wrong credentials fail
+// the create here rather than at the first reboot into the installer.
+func (d *Driver) setupOBM() error {
+	if d.BMCUser == "" {
+		return errPhaseSkipped
+	}
+	payload, err := d.getClient().GetNodeOBM(d.context(), d.NodeID)
+	if err != nil {
+		return fmt.Errorf("Unable to get OBM settings of node %s. Error: %s", d.NodeID, apiError(err))
+	}
+	obms, err := d.adapter().obmCount(payload)
+	if err != nil {
+		return err
+	}
+	if obms > 0 {
+		log.Debugf("Node %s has OBM settings, --rackhd-bmc-user is not used", d.NodeID)
+		return errPhaseSkipped
+	}
+
+	if d.BMCHost != "" {
+		log.Infof("Adding IPMI OBM settings for BMC %s to node %s", d.BMCHost, d.NodeID)
+		setting := map[string]interface{}{
+			"service": ipmiService,
+			"config":  map[string]interface{}{"host": d.BMCHost, "user": d.BMCUser, "password": d.BMCPassword},
+		}
+		if err := d.getClient().AddNodeOBM(d.context(), d.NodeID, setting); err != nil {
+			return fmt.Errorf("Unable to add OBM settings to node %s. Error: %s", d.NodeID, apiError(err))
+		}
+	} else {
+		log.Infof("Running workflow %s to create the OBM settings of node %s from its BMC catalog", obmSetupGraph, d.NodeID)
+		options := map[string]interface{}{"defaults": map[string]interface{}{"user": d.BMCUser, "password": d.BMCPassword}}
+		if _, err := d.runWorkflow(obmSetupGraph, options, powerWorkflowTimeout); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Verifying power control of node %s", d.NodeID)
+	if _, err := d.runWorkflow(powerOnGraph, nil, powerWorkflowTimeout); err != nil {
+		return fmt.Errorf("OBM settings were created for node %s, but power control through its BMC does not work. "+
+			"Check --rackhd-bmc-user and --rackhd-bmc-password, and fix or delete the OBM settings in RackHD. Error: %w", d.NodeID, err)
+	}
+	d.recordSOL()
+	return nil
+}
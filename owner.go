@@ -0,0 +1,51 @@
+package rackhd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// forceOwnerEnv lets operations proceed on a node claimed by another owner.
+// It is read from the environment of each operation, as docker-machine rm,
+// stop and the like take no driver flags.
+const forceOwnerEnv = "RACKHD_FORCE_OWNER"
+
+// nodeOwners returns the owners recorded in the docker-machine-owner tags of
+// the node.
+func (d *Driver) nodeOwners() ([]string, error) {
+	node, err := d.getNode()
+	if err != nil {
+		return nil, err
+	}
+	var owners []string
+	for _, tag := range node.Tags {
+		if strings.HasPrefix(tag, ownerTagPrefix) {
+			owners = append(owners, strings.TrimPrefix(tag, ownerTagPrefix))
+		}
+	}
+	return owners, nil
+}
+
+// checkOwner refuses operation on a node claimed by an owner other than
+// --rackhd-owner, so one tenant cannot power off or wipe another tenant's
+// node. Nodes without an owner tag can be operated on by anyone.
+func (d *Driver) checkOwner(operation string) error {
+	owners, err := d.nodeOwners()
+	if err != nil {
+		return err
+	}
+	if len(owners) == 0 || containsString(owners, d.Owner) {
+		return nil
+	}
+	if force, _ := strconv.ParseBool(os.Getenv(forceOwnerEnv)); force {
+		log.Warnf("Node %s is claimed by %s; %s proceeds because %s is set", d.NodeID, strings.Join(owners, ", "), operation, forceOwnerEnv)
+		return nil
+	}
+	owner := d.Owner
+	if owner == "" {
+		owner = "no owner"
+	}
+	return classError(ErrOwnerMismatch, "Node %s is claimed by %s, not %s; refusing to %s it. Set %s=1 to override",
+		d.NodeID, strings.Join(owners, ", "), owner, operation, forceOwnerEnv)
+}
@@ -0,0 +1,79 @@
+package rackhd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// nodeProblems returns what would make a create on the node fail: no OBM
+// settings, IPMI pollers failing to reach the BMC, a workflow already
+// running or a node whose workflow is unknown, or critical sensor alerts.
+func (d *Driver) nodeProblems(node *nodeInfo) []string {
+	var problems []string
+	payload, err := d.getClient().GetNodeOBM(d.context(), node.ID)
+	if err == nil {
+		if obms, err := d.adapter().obmCount(payload); err == nil && obms == 0 {
+			problems = append(problems, "no OBM")
+		}
+	}
+	pollers, err := d.nodePollers(node.ID)
+	if err == nil {
+		for _, poller := range pollers {
+			if poller.Type == "ipmi" && poller.FailureCount > 0 {
+				problems = append(problems, "OBM unreachable")
+				break
+			}
+		}
+	}
+	// the selection takes the healthy nodes without checking them again
+	if active, err := d.nodeActiveWorkflow(node.ID); err != nil || active != nil {
+		problems = append(problems, "workflow running")
+	}
+	if !d.IgnoreSensorAlerts && err == nil {
+		if sensors, _, err := d.pollerSensors(pollers); err == nil {
+			for _, s := range sensors {
+				if s.alerting() {
+					problems = append(problems, "sensor alerts")
+					break
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// checkPoolHealth evaluates every candidate of the selection, logs a summary
+// and returns the healthy ones. With no healthy candidate it fails before
+// selecting a node that would fail the create later.
+func (d *Driver) checkPoolHealth(candidates []*nodeInfo) ([]*nodeInfo, error) {
+	counts := make(map[string]int)
+	var healthy []*nodeInfo
+	for _, candidate := range candidates {
+		problems := d.nodeProblems(candidate)
+		if len(problems) == 0 {
+			healthy = append(healthy, candidate)
+			continue
+		}
+		log.Debugf("Node %s is not healthy: %s", candidate.ID, strings.Join(problems, ", "))
+		for _, problem := range problems {
+			counts[problem]++
+		}
+	}
+	var summary []string
+	for problem, count := range counts {
+		summary = append(summary, fmt.Sprintf("%d %s", count, problem))
+	}
+	sort.Strings(summary)
+
+	if len(summary) == 0 {
+		log.Infof("Pool health: all %d free node(s) are healthy", len(candidates))
+		return healthy, nil
+	}
+	log.Infof("Pool health: %d of %d free node(s) are healthy (%s)", len(healthy), len(candidates), strings.Join(summary, ", "))
+	if len(healthy) == 0 {
+		return nil, classError(ErrNodeNotFound, "None of the %d free compute node(s) on %s is healthy (%s)",
+			len(candidates), d.Endpoint, strings.Join(summary, ", "))
+	}
+	return healthy, nil
+}
@@ -0,0 +1,137 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// poolDefinition is a pool of the site-level --rackhd-pools-file: the nodes
+// carrying all of Tags, of which at most MaxMachines may be in use by
+// docker-machine at once. A MaxMachines of 0 sets no quota.
+type poolDefinition struct {
+	Name        string   `json:"name"`
+	Tags        []string `json:"tags"`
+	MaxMachines int      `json:"maxMachines"`
+}
+
+type poolsFile struct {
+	Pools []poolDefinition `json:"pools"`
+}
+
+// contains reports whether a node with tags is in the pool.
+func (p *poolDefinition) contains(tags []string) bool {
+	if len(p.Tags) == 0 {
+		return false
+	}
+	for _, tag := range p.Tags {
+		if !containsString(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// readPools reads --rackhd-pools-file. It is read on every create rather
+// than when the machine is configured, so quota changes apply at once.
+func (d *Driver) readPools() ([]poolDefinition, error) {
+	b, err := ioutil.ReadFile(d.PoolsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read --rackhd-pools-file %s. Error: %s", d.PoolsFile, err)
+	}
+	var file poolsFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("--rackhd-pools-file %s is not valid JSON. Error: %s", d.PoolsFile, err)
+	}
+	for _, pool := range file.Pools {
+		if pool.Name == "" || len(pool.Tags) == 0 || pool.MaxMachines < 0 {
+			return nil, fmt.Errorf("Pool %q of --rackhd-pools-file %s needs a name, at least one tag and a quota that is not negative", pool.Name, d.PoolsFile)
+		}
+	}
+	return file.Pools, nil
+}
+
+// inUse reports whether a node is consumed by a docker-machine machine, or
+// claimed by a create that is still running.
+func inUse(tags []string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, machineTagPrefix) {
+			return true
+		}
+	}
+	_, claimed := liveClaim(tags, time.Now())
+	return claimed
+}
+
+// checkPools enforces the pools of --rackhd-pools-file during selection: the
+// node must be in --rackhd-pool when that is set, and no pool the node is in
+// may be at its quota already.
+func (d *Driver) checkPools() error {
+	if d.PoolsFile == "" {
+		return nil
+	}
+	pools, err := d.readPools()
+	if err != nil {
+		return err
+	}
+	node, err := d.getNode()
+	if err != nil {
+		return err
+	}
+
+	var member []poolDefinition
+	found := d.Pool == ""
+	for _, pool := range pools {
+		if pool.Name == d.Pool {
+			found = true
+		}
+		if pool.contains(node.Tags) {
+			member = append(member, pool)
+		}
+	}
+	if !found {
+		return fmt.Errorf("--rackhd-pool %s is not defined in %s", d.Pool, d.PoolsFile)
+	}
+	if d.Pool != "" && !poolNamed(member, d.Pool) {
+		return fmt.Errorf("Node %s is not in pool %s", d.NodeID, d.Pool)
+	}
+	if len(member) == 0 {
+		return nil
+	}
+
+	used := make(map[string]int)
+	err = d.eachNode(url.Values{"type": {"compute"}}, func(other *nodeInfo) error {
+		if other.ID == d.NodeID || !inUse(other.Tags) {
+			return nil
+		}
+		for _, pool := range member {
+			if pool.contains(other.Tags) {
+				used[pool.Name]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, pool := range member {
+		log.Debugf("Pool %s has %d of %d machines in use", pool.Name, used[pool.Name], pool.MaxMachines)
+		if pool.MaxMachines > 0 && used[pool.Name] >= pool.MaxMachines {
+			return fmt.Errorf("Pool %s already has %d machines, its quota. Remove a machine of the pool or ask the site administrators to raise the quota",
+				pool.Name, used[pool.Name])
+		}
+	}
+	return nil
+}
+
+func poolNamed(pools []poolDefinition, name string) bool {
+	for _, pool := range pools {
+		if pool.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package rackhd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	endpointDialTimeout = 10 * time.Second
+	// the first and the longest pause between attempts of --rackhd-endpoint-wait
+	endpointRetryInitial = time.Second
+	endpointRetryMax     = 30 * time.Second
+)
+
+// errCheckSkipped is returned by a pre-create check that does not apply to
+// this machine's configuration.
+var errCheckSkipped = errors.New("skipped")
+
+// checkWarning is a finding that is reported but does not fail the create.
+type checkWarning struct{ msg string }
+
+func (w checkWarning) Error() string { return w.msg }
+
+type preCreateCheck struct {
+	name string
+	run  func() (string, error)
+	// fatal checks stop the remaining ones, which would fail the same way
+	fatal bool
+}
+
+// runChecks runs every pre-create check, logging each result, and returns an
+// error listing all checks that failed rather than stopping at the first.
+func (d *Driver) runChecks() error {
+	checks := []preCreateCheck{
+		{"endpoint reachable", d.checkEndpoint, true},
+		{"API version", d.checkAPI, true},
+		{"authentication", d.checkAuth, true},
+		{"AMQP", d.checkAMQP, false},
+		{"node exists", d.checkNode, true},
+		{"OBM configured", d.checkOBM, false},
+		{"hardware requirements", d.checkHardware, false},
+		{"disk health", d.checkDiskHealth, false},
+		{"sensor alerts", d.checkSensors, false},
+		{"SSH credentials", d.checkCredentials, false},
+	}
+
+	var failed []string
+	for _, check := range checks {
+		detail, err := check.run()
+		switch err.(type) {
+		case nil:
+			log.Infof("[PASS] %s: %s", check.name, detail)
+		case checkWarning:
+			log.Warnf("[WARN] %s: %s", check.name, err)
+		default:
+			if err == errCheckSkipped {
+				log.Infof("[SKIP] %s: %s", check.name, detail)
+				continue
+			}
+			log.Errorf("[FAIL] %s: %s", check.name, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", check.name, err))
+			if check.fatal {
+				return fmt.Errorf("Pre-create checks failed: %s", strings.Join(failed, "; "))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Pre-create checks failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (d *Driver) checkEndpoint() (string, error) {
+	addr := d.Endpoint
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if d.Transport == "https" {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+	conn, err := d.dial(addr, endpointDialTimeout)
+	if err != nil {
+		return "", fmt.Errorf("The Endpoint is not accessible. Error: %s", err)
+	}
+	conn.Close()
+	return d.Endpoint, nil
+}
+
+// waitForEndpoint retries the endpoint and API checks with an exponential
+// backoff for up to --rackhd-endpoint-wait seconds, for automation that
+// brings up RackHD and its machines in the same run.
+func (d *Driver) waitForEndpoint() error {
+	if d.EndpointWait <= 0 {
+		return nil
+	}
+	wait := time.Duration(d.EndpointWait) * time.Second
+	deadline := time.Now().Add(wait)
+	delay := endpointRetryInitial
+	for attempt := 1; ; attempt++ {
+		_, err := d.checkEndpoint()
+		if err == nil {
+			_, err = d.checkAPI()
+		}
+		if err == nil {
+			if attempt > 1 {
+				log.Infof("Endpoint %s is up after %d attempts", d.Endpoint, attempt)
+			}
+			return nil
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return fmt.Errorf("The Endpoint %s did not come up within %s. Error: %w", d.Endpoint, wait, err)
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		log.Infof("Endpoint %s is not up yet, retrying in %s: %s", d.Endpoint, delay, err)
+		if err := d.sleep(delay); err != nil {
+			return err
+		}
+		if delay *= 2; delay > endpointRetryMax {
+			delay = endpointRetryMax
+		}
+	}
+}
+
+func (d *Driver) checkAPI() (string, error) {
+	//do a test to see if the server is available. 2nd Nil is authentication params
+	// that need to be determined in v2.0 of API
+	_, err := d.getClient().GetConfig(d.context())
+	if err != nil && !isAuthError(err) {
+		return "", fmt.Errorf("The Endpoint does not serve the 1.1 API. Error: %s", apiError(err))
+	}
+	return "1.1", nil
+}
+
+func (d *Driver) checkAuth() (string, error) {
+	_, err := d.getClient().GetConfig(d.context())
+	if isAuthError(err) {
+		return "", classError(ErrAuth, "RackHD rejected the request. Error: %s", apiError(err))
+	}
+	if err != nil {
+		return "", fmt.Errorf("RackHD rejected the request. Error: %s", apiError(err))
+	}
+	return "accepted", nil
+}
+
+func (d *Driver) checkAMQP() (string, error) {
+	if d.AMQPURI == "" {
+		return "--rackhd-amqp-uri not set", errCheckSkipped
+	}
+	conn, err := amqp.Dial(d.AMQPURI)
+	if err != nil {
+		// events are informational only, see watchEvents
+		return "", checkWarning{fmt.Sprintf("node events will not be logged: unable to connect to %s: %s", redactURI(d.AMQPURI), err)}
+	}
+	conn.Close()
+	return redactURI(d.AMQPURI), nil
+}
+
+func (d *Driver) checkNode() (string, error) {
+	node, err := d.getNode()
+	if err != nil {
+		return "", err
+	}
+	if node.Type != "" && node.Type != "compute" {
+		return "", fmt.Errorf("Node %s is of type %s. Specify a compute node", node.ID, node.Type)
+	}
+	return fmt.Sprintf("%s (%s)", node.ID, node.Name), nil
+}
+
+func (d *Driver) checkOBM() (string, error) {
+	payload, err := d.getClient().GetNodeOBM(d.context(), d.NodeID)
+	var obms int
+	if err == nil {
+		obms, err = d.adapter().obmCount(payload)
+	}
+	switch {
+	case err != nil && d.WorkflowName != "":
+		return "", fmt.Errorf("Unable to get OBM settings of node %s. Error: %s", d.NodeID, apiError(err))
+	case obms == 0 && d.BMCUser != "":
+		return "none yet, created from --rackhd-bmc-user at create", nil
+	case obms == 0 && d.WorkflowName != "":
+		return "", fmt.Errorf("Node %s has no OBM settings, so it cannot be powered on or rebooted into the installer", d.NodeID)
+	case obms == 0:
+		return "", checkWarning{fmt.Sprintf("node %s has no OBM settings; power operations will not work", d.NodeID)}
+	}
+	return fmt.Sprintf("%d OBM setting(s)", obms), nil
+}
+
+// checkCredentials logs in with the bootstrap credentials, which is only
+// possible when the node already runs its final OS.
+func (d *Driver) checkCredentials() (string, error) {
+	if d.WorkflowName != "" {
+		return "the OS is installed by " + d.WorkflowName, errCheckSkipped
+	}
+	if d.BootstrapMethod == bootstrapGraph {
+		return "the machine key is installed by " + keyGraph, errCheckSkipped
+	}
+	ips, err := d.lookupIPs()
+	if err != nil {
+		return "", err
+	}
+	if !d.probeIPs(ips) {
+		return "", classError(ErrNoReachableIP, "No IP addresses are accessible on this network to the Node ID specified")
+	}
+	if d.BootstrapMethod == bootstrapWinRM {
+		err = executeWinRMCommand("exit 0", d)
+	} else {
+		err = executeSSHCommand("exit 0", d)
+	}
+	if err != nil && isSSHAuthError(err) {
+		return "", classError(ErrAuth, "Unable to log in to %s as %s. Error: %s", d.IPAddress, d.bootstrapUser(), err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to log in to %s as %s. Error: %s", d.IPAddress, d.bootstrapUser(), err)
+	}
+	return fmt.Sprintf("%s@%s", d.bootstrapUser(), d.IPAddress), nil
+}
@@ -0,0 +1,94 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// errPhaseSkipped is returned by a create phase that has nothing to do for
+// this machine's configuration.
+var errPhaseSkipped = errors.New("skipped")
+
+type createPhase struct {
+	name string
+	run  func() error
+}
+
+// progressEvent is one line of the machine-readable progress file.
+type progressEvent struct {
+	Time    time.Time `json:"time"`
+	Machine string    `json:"machine"`
+	Phase   string    `json:"phase"`
+	Index   int       `json:"index"`
+	Total   int       `json:"total"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// runPhases runs the create phases in order, reporting each one as it starts
+// and finishes, and stops at the first failure.
+func (d *Driver) runPhases(phases []createPhase) error {
+	for i, phase := range phases {
+		step := fmt.Sprintf("[%d/%d] %s", i+1, len(phases), phase.name)
+		log.Infof("%s...", step)
+		if d.resumePhase(phase.name) {
+			log.Infof("%s: already done, resuming", step)
+			d.reportProgress(phase.name, i+1, len(phases), "resumed", nil)
+			continue
+		}
+		d.reportProgress(phase.name, i+1, len(phases), "started", nil)
+
+		start := time.Now()
+		err := phase.run()
+		elapsed := time.Since(start)
+		d.timings().addPhase(phase.name, elapsed)
+		switch err {
+		case nil:
+			log.Infof("%s: done (%s)", step, roundSeconds(elapsed))
+			d.reportProgress(phase.name, i+1, len(phases), "succeeded", nil)
+			if resumablePhases[phase.name] {
+				d.completePhase(phase.name)
+			}
+		case errPhaseSkipped:
+			log.Debugf("%s: skipped", step)
+			d.reportProgress(phase.name, i+1, len(phases), "skipped", nil)
+		default:
+			log.Debugf("%s: failed: %s", step, err)
+			d.reportProgress(phase.name, i+1, len(phases), "failed", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// reportProgress appends an event to --rackhd-progress-file, if set.
+// Failing to write progress never fails the create itself.
+func (d *Driver) reportProgress(phase string, index, total int, status string, phaseErr error) {
+	if d.ProgressFile == "" {
+		return
+	}
+	event := progressEvent{
+		Time:    time.Now().UTC(),
+		Machine: d.MachineName,
+		Phase:   phase,
+		Index:   index,
+		Total:   total,
+		Status:  status,
+	}
+	if phaseErr != nil {
+		event.Error = phaseErr.Error()
+	}
+
+	f, err := os.OpenFile(d.ProgressFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Debugf("Unable to open progress file %s: %s", d.ProgressFile, err)
+		return
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(event); err != nil {
+		log.Debugf("Unable to write progress file %s: %s", d.ProgressFile, err)
+	}
+}
@@ -0,0 +1,55 @@
+package rackhd
+
+import (
+	"fmt"
+	"strings"
+)
+
+const proxyDropIn = "/etc/systemd/system/docker.service.d/http-proxy.conf"
+
+// proxyEnv returns the proxy variables set with the --rackhd-*-proxy flags.
+func (d *Driver) proxyEnv() []string {
+	var env []string
+	for _, v := range []struct{ name, value string }{
+		{"HTTP_PROXY", d.HTTPProxy},
+		{"HTTPS_PROXY", d.HTTPSProxy},
+		{"NO_PROXY", d.NoProxy},
+	} {
+		if v.value != "" {
+			env = append(env, v.name+"="+v.value)
+		}
+	}
+	return env
+}
+
+// configureProxy writes a systemd drop-in that gives the Docker daemon the
+// proxy settings, so it can pull images. They are also added to
+// /etc/environment for the docker-machine provisioner, which downloads the
+// engine over SSH sessions that read that file.
+func (d *Driver) configureProxy() error {
+	env := d.proxyEnv()
+	var unit []string
+	unit = append(unit, "[Service]")
+	for _, v := range env {
+		unit = append(unit, fmt.Sprintf("Environment=%q", v))
+	}
+
+	commands := []string{
+		fmt.Sprintf("mkdir -p %s", proxyDropIn[:strings.LastIndex(proxyDropIn, "/")]),
+		fmt.Sprintf("echo %s > %s", shellQuote(strings.Join(unit, "\n")), proxyDropIn),
+	}
+	for _, v := range env {
+		name := v[:strings.Index(v, "=")]
+		for _, n := range []string{name, strings.ToLower(name)} {
+			line := n + v[len(name):]
+			commands = append(commands, fmt.Sprintf("sed -i '/^%s=/d' /etc/environment; echo %s >> /etc/environment", n, shellQuote(line)))
+		}
+	}
+	commands = append(commands, "if command -v systemctl >/dev/null; then systemctl daemon-reload; fi")
+
+	log.Infof("Configuring the Docker daemon proxy on %s", d.MachineName)
+	if err := d.runKeyCommands(commands); err != nil {
+		return fmt.Errorf("Unable to configure the proxy. Error: %w", err)
+	}
+	return nil
+}
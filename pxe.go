@@ -0,0 +1,126 @@
+package rackhd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	biosCatalog        = "bios"
+	pxeWorkflowTimeout = 30 * time.Minute
+)
+
+// pxeDeviceAttribute matches the BIOS attributes enabling a PXE device, as
+// PxeDev1EnDis, whose interface is in the matching PxeDev1Interface.
+var pxeDeviceAttribute = regexp.MustCompile(`(?i)^pxedev(\d+)endis$`)
+
+// biosAttributes reads the current BIOS attributes from the node's bios
+// catalog, which vendors store either as an object of names and values or
+// as a list of attribute objects.
+func (d *Driver) biosAttributes() (map[string]string, error) {
+	var data interface{}
+	if err := d.getCatalog(biosCatalog, &data); err != nil {
+		return nil, err
+	}
+	if m, ok := data.(map[string]interface{}); ok {
+		if list, ok := m["attributes"]; ok {
+			data = list
+		}
+	}
+	attributes := make(map[string]string)
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for name, value := range v {
+			attributes[name] = fmt.Sprint(value)
+		}
+	case []interface{}:
+		for _, item := range v {
+			attr, _ := item.(map[string]interface{})
+			name := firstString(attr, "name", "attributeName", "AttributeName")
+			if name != "" {
+				attributes[name] = firstString(attr, "currentValue", "CurrentValue", "value")
+			}
+		}
+	}
+	return attributes, nil
+}
+
+// firstString returns the first of the keys of m holding a string.
+func firstString(m map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if s, ok := m[key].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// pxeDevices returns the PXE devices of the BIOS attributes and whether any
+// of them is enabled, e.g. "1 (NIC.Integrated.1-1-1): Disabled".
+func pxeDevices(attributes map[string]string) ([]string, bool) {
+	var devices []string
+	enabled := false
+	for name, value := range attributes {
+		m := pxeDeviceAttribute.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		device := m[1]
+		if iface := attributes["PxeDev"+m[1]+"Interface"]; iface != "" {
+			device = fmt.Sprintf("%s (%s)", m[1], iface)
+		}
+		devices = append(devices, fmt.Sprintf("%s: %s", device, value))
+		if strings.EqualFold(value, "Enabled") {
+			enabled = true
+		}
+	}
+	sort.Strings(devices)
+	return devices, enabled
+}
+
+// pxeEnabled reports whether the node's BIOS has a PXE device enabled. ok is
+// false when the bios catalog does not tell, because the node has none or
+// its vendor names the setting differently.
+func (d *Driver) pxeEnabled() (enabled bool, devices []string, ok bool) {
+	attributes, err := d.biosAttributes()
+	if err != nil {
+		log.Debugf("Unable to verify PXE on node %s: %s", d.NodeID, err)
+		return false, nil, false
+	}
+	devices, enabled = pxeDevices(attributes)
+	return enabled, devices, len(devices) > 0
+}
+
+// verifyPXE checks that the node will actually network boot into the
+// install workflow, which otherwise only times out. With
+// --rackhd-pxe-workflow a node without PXE is fixed by running that graph.
+func (d *Driver) verifyPXE() error {
+	if d.WorkflowName == "" {
+		return errPhaseSkipped
+	}
+	enabled, devices, ok := d.pxeEnabled()
+	if !ok {
+		log.Warnf("The bios catalog of node %s does not show whether PXE is enabled; if %s times out, check the boot settings of the provisioning NIC",
+			d.NodeID, d.WorkflowName)
+		return errPhaseSkipped
+	}
+	if enabled {
+		log.Infof("Node %s has PXE enabled: %s", d.NodeID, strings.Join(devices, ", "))
+		return nil
+	}
+	if d.PXEWorkflow == "" {
+		return fmt.Errorf("Node %s has no PXE device enabled (%s), so %s would time out waiting for it to network boot. Enable PXE on the provisioning NIC, or set --rackhd-pxe-workflow to a graph that does",
+			d.NodeID, strings.Join(devices, ", "), d.WorkflowName)
+	}
+	log.Infof("Node %s has no PXE device enabled; running %s", d.NodeID, d.PXEWorkflow)
+	if _, err := d.runWorkflow(d.PXEWorkflow, nil, pxeWorkflowTimeout); err != nil {
+		return err
+	}
+	if enabled, devices, _ = d.pxeEnabled(); !enabled {
+		return fmt.Errorf("Node %s still has no PXE device enabled after %s (%s)", d.NodeID, d.PXEWorkflow, strings.Join(devices, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,2799 @@
+package rackhd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	testNodeID  = "5668b6ad8bee16a10989e8f5"
+	testMachine = "test"
+)
+
+// testEnv is a driver wired to a fake RackHD and a fake sshd on 127.0.0.1.
+type testEnv struct {
+	driver *Driver
+	rackhd *fakeMonorail
+	sshd   *fakeSSHD
+	store  string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	store, err := ioutil.TempDir("", "rackhd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// docker-machine creates the machine directory before calling the driver
+	if err := os.MkdirAll(filepath.Join(store, "machines", testMachine), 0700); err != nil {
+		t.Fatal(err)
+	}
+	sshd, err := newFakeSSHD(defaultSSHPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &testEnv{rackhd: newFakeMonorail(), sshd: sshd, store: store}
+	env.driver = NewDriver(testMachine, store)
+	env.driver.Endpoint = env.rackhd.endpoint()
+	env.driver.Transport = "http"
+	env.driver.NodeID = testNodeID
+	env.driver.SSHPort = sshd.port()
+	return env
+}
+
+func (env *testEnv) close() {
+	env.rackhd.Close()
+	env.sshd.Close()
+	os.RemoveAll(env.store)
+}
+
+// created is a driver as it is persisted after a successful create.
+func (env *testEnv) created(tags ...string) *Driver {
+	env.rackhd.addNode(testNodeID, append([]string{machineTagPrefix + testMachine}, tags...), "127.0.0.1")
+	d := env.driver
+	d.IPAddress = "127.0.0.1"
+	return d
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name        string
+		workflow    string
+		graphStatus map[string]string
+		ips         []string
+		wantClass   error
+		wantGraphs  []string
+		wantTagged  bool
+	}{
+		{
+			name:       "existing OS",
+			ips:        []string{"127.0.0.1"},
+			wantTagged: true,
+		},
+		{
+			name:       "install OS",
+			workflow:   "Graph.InstallCentOS",
+			ips:        []string{"127.0.0.1"},
+			wantGraphs: []string{powerOnGraph, "Graph.InstallCentOS"},
+			wantTagged: true,
+		},
+		{
+			name:        "install OS fails",
+			workflow:    "Graph.InstallCentOS",
+			graphStatus: map[string]string{"Graph.InstallCentOS": "failed"},
+			ips:         []string{"127.0.0.1"},
+			wantClass:   ErrWorkflowFailed,
+			wantGraphs:  []string{powerOnGraph, "Graph.InstallCentOS"},
+		},
+		{
+			name:        "power on fails",
+			workflow:    "Graph.InstallCentOS",
+			graphStatus: map[string]string{powerOnGraph: "failed"},
+			ips:         []string{"127.0.0.1"},
+			wantClass:   ErrWorkflowFailed,
+			wantGraphs:  []string{powerOnGraph},
+		},
+		{
+			name:      "no addresses",
+			wantClass: ErrNoReachableIP,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			defer env.close()
+			env.rackhd.addNode(testNodeID, nil, tt.ips...)
+			for name, status := range tt.graphStatus {
+				env.rackhd.graphStatus[name] = status
+			}
+			d := env.driver
+			d.WorkflowName = tt.workflow
+
+			err := d.Create()
+			if tt.wantClass == nil && err != nil {
+				t.Fatalf("Create() = %v, want nil", err)
+			}
+			if tt.wantClass != nil && ErrorClass(err) != tt.wantClass {
+				t.Fatalf("Create() = %v, want class %v", err, tt.wantClass)
+			}
+			if !reflect.DeepEqual(env.rackhd.started, tt.wantGraphs) {
+				t.Errorf("started graphs %v, want %v", env.rackhd.started, tt.wantGraphs)
+			}
+			tagged := containsString(env.rackhd.nodeTags(testNodeID), machineTagPrefix+testMachine)
+			if tagged != tt.wantTagged {
+				t.Errorf("node tagged = %v, want %v", tagged, tt.wantTagged)
+			}
+			if err != nil {
+				return
+			}
+
+			if d.IPAddress != "127.0.0.1" {
+				t.Errorf("IPAddress = %q, want 127.0.0.1", d.IPAddress)
+			}
+			if _, err := os.Stat(d.GetSSHKeyPath()); err != nil {
+				t.Errorf("machine key not created: %v", err)
+			}
+			installed := false
+			for _, command := range env.sshd.ran() {
+				if strings.Contains(command, d.SSHKey) && strings.Contains(command, "authorized_keys") {
+					installed = true
+				}
+			}
+			if !installed {
+				t.Errorf("machine key was not installed, commands run: %v", env.sshd.ran())
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tests := []struct {
+		name          string
+		strategy      string
+		tags          []string
+		active        string
+		nodeGone      bool
+		wantErr       bool
+		wantGraphs    []string
+		wantCancelled []string
+		wantUntagged  bool
+	}{
+		{
+			name:         "none",
+			strategy:     removeNone,
+			wantUntagged: true,
+		},
+		{
+			name:         "poweroff",
+			strategy:     removePowerOff,
+			wantGraphs:   []string{powerOffGraph},
+			wantUntagged: true,
+		},
+		{
+			name:          "poweroff cancels active workflow",
+			strategy:      removePowerOff,
+			active:        "Graph.InstallCentOS",
+			wantGraphs:    []string{"Graph.InstallCentOS", powerOffGraph},
+			wantCancelled: []string{"Graph.InstallCentOS"},
+			wantUntagged:  true,
+		},
+		{
+			name:         "wipe",
+			strategy:     removeWipe,
+			wantGraphs:   []string{defaultWipeWorkflow},
+			wantUntagged: true,
+		},
+		{
+			name:         "rediscover",
+			strategy:     removeRediscover,
+			wantGraphs:   []string{rediscoverGraph},
+			wantUntagged: true,
+		},
+		{
+			name:     "under maintenance",
+			strategy: removePowerOff,
+			tags:     []string{maintenanceTag},
+			wantErr:  true,
+		},
+		{
+			name:     "node gone",
+			strategy: removePowerOff,
+			nodeGone: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			defer env.close()
+			d := env.driver
+			if !tt.nodeGone {
+				d = env.created(tt.tags...)
+			}
+			d.RemoveStrategy = tt.strategy
+			if tt.active != "" {
+				env.rackhd.graphStatus[tt.active] = "running"
+				env.rackhd.startGraph(testNodeID, tt.active)
+			}
+
+			err := d.Remove()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Remove() = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(env.rackhd.started, tt.wantGraphs) {
+				t.Errorf("started graphs %v, want %v", env.rackhd.started, tt.wantGraphs)
+			}
+			if !reflect.DeepEqual(env.rackhd.cancelled, tt.wantCancelled) {
+				t.Errorf("cancelled graphs %v, want %v", env.rackhd.cancelled, tt.wantCancelled)
+			}
+			if tt.nodeGone {
+				return
+			}
+			untagged := !containsString(env.rackhd.nodeTags(testNodeID), machineTagPrefix+testMachine)
+			if untagged != tt.wantUntagged {
+				t.Errorf("node untagged = %v, want %v", untagged, tt.wantUntagged)
+			}
+		})
+	}
+}
+
+func TestPowerOperations(t *testing.T) {
+	operations := []struct {
+		name string
+		run  func(*Driver) error
+	}{
+		{"start", (*Driver).Start},
+		{"stop", (*Driver).Stop},
+		{"restart", (*Driver).Restart},
+		{"kill", (*Driver).Kill},
+	}
+	tests := []struct {
+		name    string
+		tags    []string
+		wantErr bool
+	}{
+		{name: "available"},
+		{name: "under maintenance", tags: []string{maintenanceTag}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		for _, op := range operations {
+			t.Run(tt.name+"/"+op.name, func(t *testing.T) {
+				env := newTestEnv(t)
+				defer env.close()
+				d := env.created(tt.tags...)
+				d.EngineVerified = true
+
+				err := op.run(d)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("%s() = %v, want error %v", op.name, err, tt.wantErr)
+				}
+				if len(env.rackhd.started) > 0 {
+					t.Errorf("%s() started graphs %v", op.name, env.rackhd.started)
+				}
+			})
+		}
+	}
+}
+
+func TestGetState(t *testing.T) {
+	tests := []struct {
+		name      string
+		fields    map[string]interface{}
+		tags      []string
+		active    string
+		unnamed   bool
+		nodeGone  bool
+		want      state.State
+		wantClass error
+	}{
+		{name: "healthy", want: state.Running},
+		{name: "under maintenance", tags: []string{maintenanceTag}, want: state.Paused},
+		{name: "unmanageable", fields: map[string]interface{}{"unmanageable": true}, want: state.Error},
+		{name: "inaccessible", fields: map[string]interface{}{"accessible": false}, want: state.Error},
+		{name: "discovering", fields: map[string]interface{}{"discovered": false}, want: state.Starting},
+		{name: "powering on", active: powerOnGraph, want: state.Starting},
+		{name: "powering off", active: powerOffGraph, want: state.Stopping},
+		{name: "other workflow", active: "Graph.Catalog", want: state.Running},
+		{name: "unnamed workflow", unnamed: true, want: state.Running},
+		{name: "node gone", nodeGone: true, want: state.Error, wantClass: ErrNodeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			defer env.close()
+			d := env.driver
+			if !tt.nodeGone {
+				d = env.created(tt.tags...)
+			}
+			for field, value := range tt.fields {
+				env.rackhd.setNode(testNodeID, field, value)
+			}
+			if tt.active != "" || tt.unnamed {
+				env.rackhd.graphStatus[tt.active] = "running"
+				env.rackhd.startGraph(testNodeID, tt.active)
+			}
+
+			got, err := d.GetState()
+			if got != tt.want {
+				t.Errorf("GetState() = %v, want %v", got, tt.want)
+			}
+			if ErrorClass(err) != tt.wantClass {
+				t.Errorf("GetState() error = %v, want class %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestListingError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"message": "Invalid query", "code": "E_QUERY", "context": "sku"}`)
+	}))
+	defer server.Close()
+	d := NewDriver(testMachine, "")
+	d.Endpoint, d.Transport = strings.TrimPrefix(server.URL, "http://"), "http"
+
+	_, err := newSwaggerClient(d).GetNodes(context.Background(), url.Values{"sku": {"none"}})
+	if want := "getNodes returned unexpected status 400, Invalid query, code: E_QUERY, context: sku"; apiError(err) != want {
+		t.Errorf("apiError() = %q, want %q", apiError(err), want)
+	}
+}
+
+func TestLookupIPs(t *testing.T) {
+	tests := []struct {
+		name    string
+		lookups []map[string]interface{}
+		want    []string
+	}{
+		{
+			name: "addresses",
+			lookups: []map[string]interface{}{
+				{"node": testNodeID, "ipAddress": "10.1.0.5", "macAddress": "52:54:00:00:00:01"},
+				{"node": testNodeID, "ipAddress": "10.2.0.5", "macAddress": "52:54:00:00:00:02"},
+			},
+			want: []string{"10.1.0.5", "10.2.0.5"},
+		},
+		{
+			name: "entry without address",
+			lookups: []map[string]interface{}{
+				{"node": testNodeID, "macAddress": "52:54:00:00:00:01"},
+				{"node": testNodeID, "ipAddress": "10.2.0.5", "macAddress": "52:54:00:00:00:02"},
+			},
+			want: []string{"10.2.0.5"},
+		},
+		{
+			name: "malformed entry",
+			lookups: []map[string]interface{}{
+				{"node": testNodeID, "ipAddress": 42, "macAddress": "52:54:00:00:00:01"},
+				{"node": testNodeID, "ipAddress": "10.2.0.5", "macAddress": []string{"52:54:00:00:00:02"}},
+				{"node": testNodeID, "ipAddress": "10.3.0.5"},
+			},
+			want: []string{"10.3.0.5"},
+		},
+		{
+			name: "no entries",
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			defer env.close()
+			env.rackhd.addNode(testNodeID, nil)
+			env.rackhd.lookups = tt.lookups
+
+			got, err := env.driver.lookupIPs()
+			if err != nil {
+				t.Fatalf("lookupIPs() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookupIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateCancelled(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.graphStatus[powerOnGraph] = "running"
+	d := env.driver
+	d.WorkflowName = "Graph.InstallCentOS"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	d.SetContext(ctx)
+
+	start := time.Now()
+	err := d.Create()
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("Create() = %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > workflowPollInterval {
+		t.Errorf("Create() returned after %s, want it to stop waiting for the workflow", elapsed)
+	}
+	if want := []string{powerOnGraph}; !reflect.DeepEqual(env.rackhd.started, want) {
+		t.Errorf("started graphs %v, want %v", env.rackhd.started, want)
+	}
+}
+
+func TestGetStateConcurrent(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	d := env.created()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.GetState(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("GetState() = %v", err)
+	}
+}
+
+func TestEachNode(t *testing.T) {
+	tests := []struct {
+		name      string
+		nodes     int
+		noPaging  bool
+		wantPages int
+	}{
+		{name: "one page", nodes: 3, wantPages: 1},
+		{name: "full pages", nodes: 2 * listPageSize, wantPages: 3},
+		{name: "partial last page", nodes: listPageSize + 1, wantPages: 2},
+		{name: "paging ignored", nodes: listPageSize + 1, noPaging: true, wantPages: 1},
+		{name: "paging ignored, one full page", nodes: listPageSize, noPaging: true, wantPages: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			defer env.close()
+			env.rackhd.noPaging = tt.noPaging
+			for i := 0; i < tt.nodes; i++ {
+				env.rackhd.addNode(fmt.Sprintf("node-%04d", i), nil)
+			}
+			env.rackhd.addNode("switch", nil)
+			env.rackhd.setNode("switch", "type", "switch")
+
+			seen := make(map[string]bool)
+			err := env.driver.eachNode(url.Values{"type": {"compute"}}, func(node *nodeInfo) error {
+				if seen[node.ID] {
+					t.Errorf("node %s listed twice", node.ID)
+				}
+				seen[node.ID] = true
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("eachNode() = %v", err)
+			}
+			if len(seen) != tt.nodes {
+				t.Errorf("eachNode() listed %d nodes, want %d", len(seen), tt.nodes)
+			}
+			if env.rackhd.pages != tt.wantPages {
+				t.Errorf("eachNode() requested %d pages, want %d", env.rackhd.pages, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestAPIConnectionReuse(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	d := env.created()
+
+	for i := 0; i < 10; i++ {
+		if _, err := d.GetState(); err != nil {
+			t.Fatalf("GetState() = %v", err)
+		}
+		if _, err := d.lookupIPs(); err != nil {
+			t.Fatalf("lookupIPs() = %v", err)
+		}
+	}
+	env.rackhd.mu.Lock()
+	defer env.rackhd.mu.Unlock()
+	if env.rackhd.conns != 1 {
+		t.Errorf("sequential API calls opened %d connections, want 1", env.rackhd.conns)
+	}
+}
+
+func TestAdapters(t *testing.T) {
+	node := map[string]interface{}{"id": "n1", "sku": "/api/2.0/skus/s1"}
+	graph := map[string]interface{}{"instanceId": "g1", "status": "failed"}
+
+	tests := []struct {
+		name     string
+		adapter  payloadAdapter
+		wantSKU  string
+		wantStat string
+	}{
+		{"1.1", adapter11{}, "/api/2.0/skus/s1", ""},
+		{"2.0", adapter20{}, "s1", "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := tt.adapter.node(node)
+			if err != nil {
+				t.Fatalf("node() = %v", err)
+			}
+			if n.SKU != tt.wantSKU {
+				t.Errorf("node().SKU = %q, want %q", n.SKU, tt.wantSKU)
+			}
+			wf, err := tt.adapter.workflow(graph)
+			if err != nil {
+				t.Fatalf("workflow() = %v", err)
+			}
+			if wf.InstanceID != "g1" || wf.Status != tt.wantStat {
+				t.Errorf("workflow() = %+v, want instance g1 with status %q", wf, tt.wantStat)
+			}
+		})
+	}
+}
+
+func TestWebsocketEvent(t *testing.T) {
+	tests := []struct {
+		message websocketMessage
+		want    string
+	}{
+		{websocketMessage{Handler: "updated", Resource: "graphobjects", Data: []byte(`{"injectableName":"Graph.InstallCentOS","_status":"succeeded"}`)},
+			"graph succeeded Graph.InstallCentOS"},
+		{websocketMessage{Handler: "updated", Resource: "nodes", Data: []byte(`{"id":"n1"}`)}, "node updated n1"},
+		{websocketMessage{Handler: "removed", Resource: "pollers"}, "pollers removed"},
+	}
+	for _, tt := range tests {
+		if got := websocketEvent(tt.message, "n1").String(); got != tt.want {
+			t.Errorf("websocketEvent(%s %s) = %q, want %q", tt.message.Resource, tt.message.Handler, got, tt.want)
+		}
+	}
+}
+
+func TestInstallSSHKey(t *testing.T) {
+	const key = "ssh-rsa AAAA test"
+	tests := []struct {
+		name          string
+		user, boot    string
+		fail          string
+		wantCommands  []string
+		wantErrSubstr string
+	}{
+		{
+			name: "root",
+			user: "root",
+			wantCommands: []string{
+				"root (password): mkdir -p ~root/.ssh",
+				"root (password): echo 'ssh-rsa AAAA test' > ~root/.ssh/authorized_keys",
+				"root (password): chmod 700 ~root/.ssh",
+				"root (password): chmod 600 ~root/.ssh/authorized_keys",
+				"root (password): chown -R root:$(id -gn root) ~root/.ssh",
+			},
+		},
+		{
+			name: "bootstrap user",
+			user: "docker", boot: "admin",
+			wantCommands: []string{
+				"admin (password): sudo -n sh -c 'mkdir -p ~docker/.ssh'",
+				"admin (password): sudo -n sh -c 'echo '\\''ssh-rsa AAAA test'\\'' > ~docker/.ssh/authorized_keys'",
+				"admin (password): sudo -n sh -c 'chmod 700 ~docker/.ssh'",
+				"admin (password): sudo -n sh -c 'chmod 600 ~docker/.ssh/authorized_keys'",
+				"admin (password): sudo -n sh -c 'chown -R docker:$(id -gn docker) ~docker/.ssh'",
+			},
+		},
+		{
+			name:          "stops at the first failure",
+			user:          "root",
+			fail:          "chmod 700",
+			wantCommands:  []string{"root (password): mkdir -p ~root/.ssh", "root (password): echo 'ssh-rsa AAAA test' > ~root/.ssh/authorized_keys", "root (password): chmod 700 ~root/.ssh"},
+			wantErrSubstr: "exit status 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{fail: tt.fail}
+			d := NewDriver(testMachine, "")
+			d.SSHUser, d.BootstrapUser, d.SSHKey = tt.user, tt.boot, key
+			d.SetSSHRunner(runner)
+
+			err := d.installSSHKey()
+			if tt.wantErrSubstr == "" && err != nil {
+				t.Fatalf("installSSHKey() = %v", err)
+			}
+			if tt.wantErrSubstr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErrSubstr)) {
+				t.Fatalf("installSSHKey() = %v, want an error containing %q", err, tt.wantErrSubstr)
+			}
+			if !reflect.DeepEqual(runner.commands, tt.wantCommands) {
+				t.Errorf("installSSHKey() ran\n%s\nwant\n%s", strings.Join(runner.commands, "\n"), strings.Join(tt.wantCommands, "\n"))
+			}
+		})
+	}
+}
+
+// recordingLogger is a Logger keeping the messages it is given.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", format, args...)
+}
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("info", format, args...)
+}
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("warn", format, args...)
+}
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", format, args...)
+}
+
+func TestLogLevels(t *testing.T) {
+	logger := &recordingLogger{}
+	SetLogger(logger)
+	SetLogLevel(ComponentAPI, LogOff)
+	SetLogLevel(ComponentWorkflow, LogWarn)
+	defer func() {
+		SetLogger(nil)
+		SetLogLevel(ComponentAPI, LogDebug)
+		SetLogLevel(ComponentWorkflow, LogDebug)
+	}()
+
+	apiLog.Errorf("api")
+	workflowLog.Infof("workflow info")
+	workflowLog.Warnf("workflow warn")
+	log.Debugf("driver")
+
+	want := []string{"warn workflow warn", "debug driver"}
+	if !reflect.DeepEqual(logger.messages, want) {
+		t.Errorf("logged %q, want %q", logger.messages, want)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := NewDriver(testMachine, "").Config
+	valid.NodeID = testNodeID
+
+	tests := []struct {
+		name     string
+		change   func(c *Config)
+		problems []string
+	}{
+		{"defaults", func(c *Config) {}, nil},
+		{"winrm over https", func(c *Config) { c.BootstrapMethod, c.WinRMHTTPS, c.WinRMInsecure = bootstrapWinRM, true, true }, nil},
+		{"no node", func(c *Config) { c.NodeID = "" }, []string{"the --rackhd-node-id, --rackhd-node-serial or --rackhd-select option is required"}},
+		{"all problems at once", func(c *Config) {
+			c.Adopt, c.WorkflowName = true, "Graph.InstallCentOS"
+			c.Sysctls = []string{"vm.swappiness"}
+			c.SSHTunnelPort = 2376
+		}, []string{
+			`invalid --rackhd-sysctl "vm.swappiness". Specify key=value`,
+			"--rackhd-adopt cannot be combined with --rackhd-workflow-name",
+			"--rackhd-ssh-tunnel-port requires --rackhd-ssh-tunnel",
+		}},
+		{"insecure winrm over http", func(c *Config) { c.BootstrapMethod, c.WinRMInsecure = bootstrapWinRM, true },
+			[]string{"--rackhd-winrm-insecure requires --rackhd-winrm-https"}},
+		{"websocket scheme", func(c *Config) { c.WebsocketURL = "http://rackhd:9100" },
+			[]string{`invalid --rackhd-websocket-url "http://rackhd:9100". Specify a ws:// or wss:// URL`}},
+		{"graph bootstrap", func(c *Config) { c.BootstrapMethod = bootstrapGraph }, nil},
+		{"graph bootstrap with password options", func(c *Config) { c.BootstrapMethod, c.NopasswdSudo, c.AutoRepair = bootstrapGraph, true, true },
+			[]string{"--rackhd-nopasswd-sudo is not supported with --rackhd-bootstrap-method=graph", "--rackhd-auto-repair is not supported with --rackhd-bootstrap-method=graph"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.change(&c)
+			err := c.Validate()
+			if tt.problems == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			configErr, ok := err.(*ConfigError)
+			if !ok {
+				t.Fatalf("Validate() = %v, want a *ConfigError", err)
+			}
+			if !reflect.DeepEqual(configErr.Problems, tt.problems) {
+				t.Errorf("Validate() problems = %q, want %q", configErr.Problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestConfigPersistedFlat(t *testing.T) {
+	d := NewDriver(testMachine, "")
+	d.NodeID = testNodeID
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["NodeID"] != testNodeID || fields["Endpoint"] != defaultEndpoint {
+		t.Errorf("persisted driver = %s, want NodeID and Endpoint at the top level", b)
+	}
+	if _, nested := fields["Config"]; nested {
+		t.Errorf("persisted driver = %s, want the options inline", b)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	store, err := ioutil.TempDir("", "rackhd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+	if err := os.MkdirAll(filepath.Join(store, "machines", testMachine), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDriver(testMachine, store)
+	d.NodeID = "sim-1"
+	d.Simulate = simulateOn
+	d.WorkflowName = "Graph.InstallCentOS"
+	d.RemoveStrategy = removePowerOff
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatalf("PreCreateCheck() = %v", err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if d.IPAddress != simulatedIP {
+		t.Errorf("IPAddress = %q, want %s", d.IPAddress, simulatedIP)
+	}
+
+	// later commands run in a new process, with a new simulator
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := NewDriver(testMachine, store)
+	if err := json.Unmarshal(b, later); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := later.GetState(); err != nil || st != state.Running {
+		t.Errorf("GetState() = %v, %v, want Running", st, err)
+	}
+	payload, err := later.getClient().GetNode(later.context(), "sim-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, _ := later.adapter().node(payload)
+	if !containsString(node.Tags, machineTagPrefix+testMachine) {
+		t.Errorf("simulated node tags = %v, want the machine tag", node.Tags)
+	}
+	if err := later.Remove(); err != nil {
+		t.Errorf("Remove() = %v", err)
+	}
+}
+
+func TestConfigMigration(t *testing.T) {
+	// as written by the first releases, plus a field another release wrote as a string
+	old := `{"IPAddress":"10.1.1.5","MachineName":"test","SSHUser":"root","SSHPort":22,
+		"Endpoint":"rackhd:8080","NodeID":"` + testNodeID + `","SSHPassword":"root","SSHKey":"ssh-rsa AAAA",
+		"Transport":"","NodeMACs":"52:54:00:00:00:01"}`
+
+	d := NewDriver("", "")
+	if err := json.Unmarshal([]byte(old), d); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+	if d.ConfigVersion != configVersion {
+		t.Errorf("ConfigVersion = %d, want %d", d.ConfigVersion, configVersion)
+	}
+	if d.NodeID != testNodeID || d.Endpoint != "rackhd:8080" || d.IPAddress != "10.1.1.5" || d.MachineName != "test" {
+		t.Errorf("Unmarshal() lost fields: %+v", d)
+	}
+	if d.Transport != defaultTransport || d.BootstrapMethod != bootstrapSSH || d.RemoveStrategy != removeNone || d.WinRMPort != defaultWinRMPort {
+		t.Errorf("Unmarshal() defaults = transport %q, bootstrap %q, remove %q, winrm port %d", d.Transport, d.BootstrapMethod, d.RemoveStrategy, d.WinRMPort)
+	}
+	if d.NodeMACs != nil {
+		t.Errorf("NodeMACs = %v, want the unreadable value dropped", d.NodeMACs)
+	}
+
+	// version 1 stored the BMC passwords
+	v1 := NewDriver("", "")
+	if err := json.Unmarshal([]byte(`{"ConfigVersion":1,"BMCUser":"admin","BMCPassword":"secret","SOLPassword":"calvin"}`), v1); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+	if b, _ := json.Marshal(v1); v1.BMCUser != "admin" || bytes.Contains(b, []byte("secret")) || bytes.Contains(b, []byte("calvin")) {
+		t.Errorf("version 1 config migrated to %s", b)
+	}
+
+	// a current config round-trips unchanged
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := NewDriver("", "")
+	if err := json.Unmarshal(b, again); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+	if !reflect.DeepEqual(again, d) {
+		t.Errorf("round trip = %+v, want %+v", again, d)
+	}
+}
+
+func TestCheckHardware(t *testing.T) {
+	ohai := map[string]interface{}{
+		"cpu": map[string]interface{}{
+			"total": 8,
+			"0":     map[string]interface{}{"flags": []string{"fpu", "sse2", "vmx"}},
+		},
+		"memory": map[string]interface{}{"total": "16777216kB"},
+		"block_device": map[string]interface{}{
+			"sda": map[string]interface{}{"size": "976773168", "removable": "0"},
+			"sr0": map[string]interface{}{"size": "4000000000", "removable": "1"},
+		},
+	}
+	tests := []struct {
+		name       string
+		cpus, mem  int
+		disk       int
+		virt       bool
+		wantDetail string
+		wantErr    string
+	}{
+		{name: "met", cpus: 8, mem: 16, disk: 500, virt: true, wantDetail: "8 CPUs, 16GB memory, 500.1GB disk, VT-x"},
+		{name: "short", cpus: 16, mem: 32, disk: 400,
+			wantErr: "CPUs: has 8, requires 16; memory: has 16GB, requires 32GB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			defer env.close()
+			env.rackhd.addNode(testNodeID, nil)
+			env.rackhd.catalogs[testNodeID] = map[string]interface{}{"ohai": ohai}
+			d := env.driver
+			d.MinCPUs, d.MinMemoryGB, d.MinDiskGB, d.RequireVirtualization = tt.cpus, tt.mem, tt.disk, tt.virt
+
+			detail, err := d.checkHardware()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("checkHardware() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || detail != tt.wantDetail {
+				t.Errorf("checkHardware() = %q, %v, want %q", detail, err, tt.wantDetail)
+			}
+		})
+	}
+}
+
+func TestConfigureBIOS(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	d := env.driver
+	d.WorkflowName = "Graph.InstallCentOS"
+	d.BIOSSettings = `{"SysProfile":"PerfOptimized","SriovGlobalEnable":"Enabled"}`
+
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	want := []string{powerOnGraph, defaultBIOSWorkflow, "Graph.InstallCentOS"}
+	if !reflect.DeepEqual(env.rackhd.started, want) {
+		t.Errorf("started graphs %v, want %v", env.rackhd.started, want)
+	}
+	options, err := d.biosOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(options)
+	if wantOptions := `{"defaults":{"attributes":[{"name":"SriovGlobalEnable","value":"Enabled"},{"name":"SysProfile","value":"PerfOptimized"}]}}`; string(b) != wantOptions {
+		t.Errorf("biosOptions() = %s, want %s", b, wantOptions)
+	}
+}
+
+func TestConfigureRAID(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	drives := []interface{}{}
+	for _, slot := range []string{"252:3", "252:0", "252:2", "252:1"} {
+		drives = append(drives, map[string]interface{}{"EID:Slt": slot, "State": "UGood"})
+	}
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		raidDrivesCatalog: map[string]interface{}{"Controllers": []interface{}{
+			map[string]interface{}{"Response Data": map[string]interface{}{"Drive Information": drives}},
+		}},
+	}
+	path := filepath.Join(t.TempDir(), "raid.json")
+	if err := ioutil.WriteFile(path, []byte(`{"virtualDisks": [{"name": "os", "level": "RAID1", "drives": 2}], "jbodRest": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := readRAIDConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := env.driver
+	d.WorkflowName = "Graph.InstallCentOS"
+	d.RAIDConfig = config
+
+	_, options, err := d.raidPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(options)
+	want := `{"create-raid":{"createDefault":false,"jbodList":[{"drive":2,"enclosure":252},{"drive":3,"enclosure":252}],"raidList":[{"drives":[0,1],"enclosure":252,"name":"os","type":"raid1"}]}}`
+	if string(b) != want {
+		t.Errorf("raidPlan() options = %s, want %s", b, want)
+	}
+
+	// Without the virtual disk in the refreshed catalog the create fails.
+	env.rackhd.catalogs[testNodeID][raidVirtualDisksCatalog] = map[string]interface{}{"Controllers": []interface{}{}}
+	if err := d.Create(); err == nil || !strings.Contains(err.Error(), "os is missing") {
+		t.Errorf("Create() with no virtual disks = %v, want a verification error", err)
+	}
+
+	env.rackhd.catalogs[testNodeID][raidVirtualDisksCatalog] = map[string]interface{}{"Controllers": []interface{}{
+		map[string]interface{}{"Response Data": map[string]interface{}{"Virtual Drives": []interface{}{
+			map[string]interface{}{"DG/VD": "0/0", "TYPE": "RAID1", "State": "Optl", "Name": "os"},
+		}}},
+	}}
+	if err := d.configureRAID(); err != nil {
+		t.Errorf("configureRAID() = %v", err)
+	}
+
+	for _, layout := range []string{`{"virtualDisks": []}`, `{"virtualDisks": [{"name": "os", "level": "raid5", "drives": 2}]}`} {
+		ioutil.WriteFile(path, []byte(layout), 0644)
+		if _, err := readRAIDConfig(path); err == nil {
+			t.Errorf("readRAIDConfig(%s) succeeded, want an error", layout)
+		}
+	}
+}
+
+func TestFirmwareBaseline(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"2.4.3", "2.4.3", 0},
+		{"2.4.3", "2.10.0", -1},
+		{"2.41", "2.5", 1},
+		{"1.2.A07", "1.2.A10", -1},
+		{"2.4", "2.4.1", -1},
+	} {
+		if got := compareVersions(c.a, c.b); got != c.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.setNode(testNodeID, "sku", "sku-r630")
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		"dmi": map[string]interface{}{"BIOS Information": map[string]interface{}{"Version": "2.1.0"}},
+		"bmc": map[string]interface{}{"Firmware Revision": "2.41"},
+	}
+	d := env.driver
+	d.MinFirmware = []string{"bios=1.0", "sku-r630:bios=2.4.3", "other-sku:bmc=9.0", "bmc=2.40"}
+
+	err := d.Create()
+	if err == nil || !strings.Contains(err.Error(), "bios 2.1.0 < 2.4.3") || strings.Contains(err.Error(), "bmc") {
+		t.Errorf("Create() below the baseline = %v, want the BIOS reported", err)
+	}
+	if len(env.rackhd.started) != 0 {
+		t.Errorf("started graphs %v on a refused node", env.rackhd.started)
+	}
+
+	d.FirmwareWorkflow = "Graph.Update.Firmware"
+	if err := d.checkFirmware(); err != nil {
+		t.Errorf("checkFirmware() with a firmware workflow = %v", err)
+	}
+	if err := d.updateFirmware(); err == nil || !strings.Contains(err.Error(), "still below") {
+		t.Errorf("updateFirmware() without a newer catalog = %v, want an error", err)
+	}
+	env.rackhd.catalogs[testNodeID]["dmi"] = map[string]interface{}{"BIOS Information": map[string]interface{}{"Version": "2.10.0"}}
+	if err := d.updateFirmware(); err != errPhaseSkipped {
+		t.Errorf("updateFirmware() at the baseline = %v, want it skipped", err)
+	}
+
+	if _, err := parseFirmwareRule("nic=1.0"); err == nil {
+		t.Error("parseFirmwareRule(nic=1.0) succeeded, want an error")
+	}
+}
+
+func TestRequireTPM(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{"dmi": map[string]interface{}{}}
+	d := env.driver
+	d.RequireTPM = true
+
+	if err := d.Create(); err == nil || !strings.Contains(err.Error(), "has no TPM") {
+		t.Errorf("Create() without a TPM = %v, want an error", err)
+	}
+
+	env.rackhd.catalogs[testNodeID]["dmi"] = map[string]interface{}{
+		"TPM Device": map[string]interface{}{"Vendor ID": "IFX", "Specification Version": "2.0"},
+	}
+	if err := d.checkTPM(); err != nil {
+		t.Errorf("checkTPM() with a TPM = %v", err)
+	}
+	d.TPMAttestationWorkflow = "Graph.Tpm.Attest"
+	env.rackhd.graphStatus["Graph.Tpm.Attest"] = "failed"
+	if err := d.attestTPM(); err == nil || !strings.Contains(err.Error(), "TPM attestation") || ErrorClass(err) != ErrWorkflowFailed {
+		t.Errorf("attestTPM() with a failing graph = %v, want a failed workflow", err)
+	}
+}
+
+func TestCheckDiskHealth(t *testing.T) {
+	disk := func(device, status, pending string) map[string]interface{} {
+		return map[string]interface{}{
+			"OS Device Name": device,
+			"SMART": map[string]interface{}{
+				"Self-Assessment": status,
+				"Attributes": map[string]interface{}{"Attributes": []interface{}{
+					map[string]interface{}{"ID#": "5", "ATTRIBUTE_NAME": "Reallocated_Sector_Ct", "RAW_VALUE": "3"},
+					map[string]interface{}{"ID#": "197", "ATTRIBUTE_NAME": "Current_Pending_Sector", "RAW_VALUE": pending},
+				}},
+			},
+		}
+	}
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil)
+	d := env.driver
+
+	if _, err := d.checkDiskHealth(); err == nil {
+		t.Error("checkDiskHealth() without a smart catalog succeeded, want a warning")
+	} else if _, ok := err.(checkWarning); !ok {
+		t.Errorf("checkDiskHealth() without a smart catalog = %v, want a warning", err)
+	}
+
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		"smart": []interface{}{disk("/dev/sda", "PASSED", "0"), disk("/dev/sdb", "PASSED", "0")},
+	}
+	if detail, err := d.checkDiskHealth(); err != nil || detail != "2 drive(s) healthy, 6 sector(s) reallocated" {
+		t.Errorf("checkDiskHealth() = %q, %v", detail, err)
+	}
+
+	env.rackhd.catalogs[testNodeID]["smart"] = []interface{}{disk("/dev/sda", "PASSED", "0"), disk("/dev/sdb", "FAILED!", "12 (Average 4)")}
+	_, err := d.checkDiskHealth()
+	if want := "/dev/sdb: SMART status FAILED!, 12 sectors pending reallocation"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("checkDiskHealth() with a failing drive = %v, want %q", err, want)
+	}
+	if err := d.PreCreateCheck(); err == nil {
+		t.Error("PreCreateCheck() with a failing drive succeeded")
+	}
+
+	d.IgnoreDiskHealth = true
+	if _, err := d.checkDiskHealth(); err != errCheckSkipped {
+		t.Errorf("checkDiskHealth() with --rackhd-ignore-disk-health = %v, want it skipped", err)
+	}
+}
+
+func TestCheckSensors(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil)
+	d := env.driver
+
+	if _, err := d.checkSensors(); err == nil {
+		t.Error("checkSensors() without pollers succeeded, want a warning")
+	} else if _, ok := err.(checkWarning); !ok {
+		t.Errorf("checkSensors() without pollers = %v, want a warning", err)
+	}
+
+	env.rackhd.pollers[testNodeID] = []map[string]interface{}{
+		{"id": "poller-sel", "type": "ipmi", "config": map[string]interface{}{"command": "sel"}},
+		{"id": "poller-sdr", "type": "ipmi", "config": map[string]interface{}{"command": "sdr"}},
+	}
+	sensor := func(id, kind, reading, status string) map[string]interface{} {
+		return map[string]interface{}{"sensorId": id, "sensorType": kind, "sensorReading": reading, "sensorReadingUnits": "", "status": status}
+	}
+	env.rackhd.pollerData["poller-sdr"] = map[string]interface{}{"sdr": []interface{}{
+		sensor("CPU1 Temp", "Temperature", "45", "ok"),
+		sensor("Fan 1", "Fan", "3600", "Upper Non-critical"),
+		sensor("Voltage 1", "Voltage", "0", "cr"),
+	}}
+	if detail, err := d.checkSensors(); err != nil || detail != "3 sensor(s), no critical alerts" {
+		t.Errorf("checkSensors() = %q, %v", detail, err)
+	}
+
+	env.rackhd.pollerData["poller-sdr"] = []interface{}{map[string]interface{}{"sdr": []interface{}{
+		sensor("CPU1 Temp", "Temperature", "98", "Upper Critical"),
+		sensor("PS2 Status", "Power Supply", "0", "nr"),
+	}}}
+	_, err := d.checkSensors()
+	if err == nil || !strings.Contains(err.Error(), "CPU1 Temp Upper Critical 98") || !strings.Contains(err.Error(), "PS2 Status nr") {
+		t.Errorf("checkSensors() with alerts = %v, want both sensors reported", err)
+	}
+
+	d.IgnoreSensorAlerts = true
+	if _, err := d.checkSensors(); err != errCheckSkipped {
+		t.Errorf("checkSensors() with --rackhd-ignore-sensor-alerts = %v, want it skipped", err)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		"dmi": map[string]interface{}{
+			"System Information":    map[string]interface{}{"Manufacturer": "Dell Inc.", "Serial Number": "ABC1234"},
+			"BIOS Information":      map[string]interface{}{"Version": "2.4.3"},
+			"Processor Information": map[string]interface{}{"Socket Designation": "CPU1", "Version": "Intel(R) Xeon(R) CPU E5-2650 v3 ", "Core Count": "10"},
+			"Memory Device": []interface{}{
+				map[string]interface{}{"Locator": "A1", "Size": "16384 MB", "Serial Number": "1234ABCD"},
+				map[string]interface{}{"Locator": "A2", "Size": "No Module Installed"},
+			},
+		},
+		"lshw": map[string]interface{}{"class": "system", "children": []interface{}{
+			map[string]interface{}{"class": "bridge", "children": []interface{}{
+				map[string]interface{}{"class": "network", "logicalname": "eth1", "serial": "52:54:00:00:00:02",
+					"configuration": map[string]interface{}{"driver": "ixgbe", "firmware": "0x800003e7"}},
+				map[string]interface{}{"class": "network", "logicalname": []interface{}{"eth0", "eth0.100"}, "serial": "52:54:00:00:00:01"},
+			}},
+		}},
+		"bmc": map[string]interface{}{"Firmware Revision": "2.41", "MAC Address": "52:54:00:00:00:FF"},
+	}
+	d := env.driver
+	d.InventoryFile = filepath.Join(t.TempDir(), "inventory.json")
+
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	for _, path := range []string{filepath.Join(d.storeDir(), inventoryFile), d.InventoryFile} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var inv hardwareInventory
+		if err := json.Unmarshal(b, &inv); err != nil {
+			t.Fatal(err)
+		}
+		if inv.System.SerialNumber != "ABC1234" || inv.BIOS != "2.4.3" || inv.BMC.Firmware != "2.41" || inv.BMC.MACAddress != "52:54:00:00:00:ff" {
+			t.Errorf("%s: system %+v, BIOS %q, BMC %+v", path, inv.System, inv.BIOS, inv.BMC)
+		}
+		if len(inv.CPUs) != 1 || inv.CPUs[0].Model != "Intel(R) Xeon(R) CPU E5-2650 v3" {
+			t.Errorf("%s: CPUs %+v", path, inv.CPUs)
+		}
+		if len(inv.DIMMs) != 1 || inv.DIMMs[0].Serial != "1234ABCD" {
+			t.Errorf("%s: DIMMs %+v, want the populated slot", path, inv.DIMMs)
+		}
+		wantNICs := []inventoryNIC{{Name: "eth0", MAC: "52:54:00:00:00:01"}, {Name: "eth1", MAC: "52:54:00:00:00:02", Driver: "ixgbe", Firmware: "0x800003e7"}}
+		if !reflect.DeepEqual(inv.NICs, wantNICs) {
+			t.Errorf("%s: NICs %+v, want %+v", path, inv.NICs, wantNICs)
+		}
+		if want := []string{"ohai", "smart"}; !reflect.DeepEqual(inv.Missing, want) {
+			t.Errorf("%s: missing catalogs %v, want %v", path, inv.Missing, want)
+		}
+	}
+}
+
+func TestBootDisk(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		"driveId": []interface{}{
+			map[string]interface{}{"devName": "sda", "linuxWwid": "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4"},
+			map[string]interface{}{"devName": "sdb", "linuxWwid": "/dev/disk/by-id/wwn-0x5000c500e5f6a7b8"},
+			map[string]interface{}{"devName": "sdc"},
+		},
+		"smart": []interface{}{
+			map[string]interface{}{"OS Device Name": "/dev/sdc", "SMART": map[string]interface{}{"Identity": map[string]interface{}{"Serial Number": "S3EVNX0K"}}},
+		},
+		"ohai": map[string]interface{}{"block_device": map[string]interface{}{
+			"sda": map[string]interface{}{"size": "7814037168"}, // 4TB
+			"sdb": map[string]interface{}{"size": "937703088"},  // 480GB
+			"sdc": map[string]interface{}{"size": "1875385008"}, // 960GB
+		}},
+	}
+	d := env.driver
+	d.WorkflowName = "Graph.InstallCentOS"
+	d.WorkflowOptions = `{"defaults":{"version":"7"}}`
+
+	tests := []struct{ spec, want string }{
+		{"wwn:0x5000C500E5F6A7B8", "/dev/disk/by-id/wwn-0x5000c500e5f6a7b8"},
+		{"serial:S3EVNX0K", "/dev/sdc"},
+		{"size>=400G", "/dev/disk/by-id/wwn-0x5000c500e5f6a7b8"},
+		{"size>1T", "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4"},
+		{"size=960G", "/dev/sdc"},
+	}
+	for _, tt := range tests {
+		d.BootDisk = tt.spec
+		if got, err := d.bootDisk(); err != nil || got != tt.want {
+			t.Errorf("bootDisk() for %s = %q, %v, want %q", tt.spec, got, err, tt.want)
+		}
+	}
+
+	d.BootDisk = "size<100G"
+	if _, err := d.bootDisk(); err == nil {
+		t.Error("bootDisk() for size<100G succeeded, want no match")
+	}
+	d.BootDisk = "serial:S3EVNX0K"
+	options, err := d.installOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := json.Marshal(options); string(b) != `{"defaults":{"installDisk":"/dev/sdc","version":"7"}}` {
+		t.Errorf("installOptions() = %s", b)
+	}
+
+	for _, spec := range []string{"sda", "size400G", "size>=G", "wwn:"} {
+		if _, err := parseBootDisk(spec); err == nil {
+			t.Errorf("parseBootDisk(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestHardwarePolicies(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		"dmi": map[string]interface{}{"System Power Supply": []interface{}{
+			map[string]interface{}{"Location": "PSU1", "Status": "Present, OK"},
+			map[string]interface{}{"Location": "PSU2", "Status": "Not Present"},
+		}},
+	}
+	env.rackhd.pollers[testNodeID] = []map[string]interface{}{
+		{"id": "poller-sel", "type": "ipmi", "config": map[string]interface{}{"command": "sel"}},
+	}
+	env.rackhd.pollerData["poller-sel"] = map[string]interface{}{"sel": []interface{}{
+		map[string]interface{}{"sensorType": "Memory", "event": "Correctable ECC"},
+		map[string]interface{}{"sensorType": "Memory", "event": "Correctable ECC logging limit reached"},
+		map[string]interface{}{"sensorType": "Power Supply", "event": "Power Supply AC lost"},
+	}}
+	d := env.driver
+	d.HardwarePolicies = []string{"dual-psu", "max-ecc-errors=1"}
+
+	err := d.Create()
+	if err == nil || !strings.Contains(err.Error(), "dual-psu: 1 of 2 power supplies present") || !strings.Contains(err.Error(), "2 ECC events") {
+		t.Errorf("Create() = %v, want both policies violated", err)
+	}
+
+	d.HardwarePolicies = []string{"max-ecc-errors=2"}
+	if err := d.checkRedundancy(); err != nil {
+		t.Errorf("checkRedundancy() = %v", err)
+	}
+
+	if _, err := parseHardwarePolicy("max-ecc-errors=-1"); err == nil {
+		t.Error("parseHardwarePolicy(max-ecc-errors=-1) succeeded, want an error")
+	}
+}
+
+func TestFailureReport(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.pollers[testNodeID] = []map[string]interface{}{
+		{"id": "poller-sel", "type": "ipmi", "config": map[string]interface{}{"command": "sel"}},
+	}
+	env.rackhd.pollerData["poller-sel"] = []interface{}{map[string]interface{}{"sel": []interface{}{
+		map[string]interface{}{"logId": "1", "sensorType": "Memory", "sensorNumber": "#0x01", "event": "Uncorrectable ECC", "value": "Asserted"},
+	}}}
+	env.rackhd.graphStatus["Graph.InstallCentOS"] = "failed"
+	d := env.driver
+	d.WorkflowName = "Graph.InstallCentOS"
+
+	path := filepath.Join(d.storeDir(), failureReportFile)
+	createErr := d.Create()
+	if createErr == nil {
+		t.Fatal("Create() succeeded with a failing install workflow")
+	}
+	if !strings.Contains(createErr.Error(), "(diagnostics in "+path+")") || ErrorClass(createErr) != ErrWorkflowFailed {
+		t.Errorf("Create() = %v, want it to name the diagnostics bundle", createErr)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report failureReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Phase != "install OS" || report.Class != ErrWorkflowFailed.Error() {
+		t.Errorf("failure report phase %q class %q, want install OS and %s", report.Phase, report.Class, ErrWorkflowFailed)
+	}
+	if len(report.SEL) != 1 || report.SEL[0].Event != "Uncorrectable ECC" {
+		t.Errorf("failure report SEL = %+v", report.SEL)
+	}
+	if report.Operation != "create" || report.Node == nil || len(report.Lookups) != 1 || report.Lookups[0].IPAddress != "127.0.0.1" {
+		t.Errorf("failure report operation %q node %v lookups %+v", report.Operation, report.Node, report.Lookups)
+	}
+	if len(report.SSHProbes) != 1 || report.SSHProbes[0].Address != "127.0.0.1:"+strconv.Itoa(d.SSHPort) {
+		t.Errorf("failure report SSH probes = %+v", report.SSHProbes)
+	}
+
+	env.rackhd.graphStatus["Graph.InstallCentOS"] = "succeeded"
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.storeDir(), failureReportFile)); !os.IsNotExist(err) {
+		t.Errorf("failure report left after a successful create: %v", err)
+	}
+}
+
+func TestVerifyPXE(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	d := env.driver
+	d.WorkflowName = "Graph.InstallCentOS"
+
+	if err := d.verifyPXE(); err != errPhaseSkipped {
+		t.Errorf("verifyPXE() without a bios catalog = %v, want it skipped", err)
+	}
+
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		biosCatalog: map[string]interface{}{"attributes": []interface{}{
+			map[string]interface{}{"name": "PxeDev1EnDis", "currentValue": "Disabled"},
+			map[string]interface{}{"name": "PxeDev1Interface", "currentValue": "NIC.Integrated.1-1-1"},
+			map[string]interface{}{"name": "PxeDev2EnDis", "currentValue": "Disabled"},
+		}},
+	}
+	err := d.Create()
+	if want := "no PXE device enabled (1 (NIC.Integrated.1-1-1): Disabled, 2: Disabled)"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Create() with PXE disabled = %v, want %q", err, want)
+	}
+	for _, graph := range env.rackhd.started {
+		if graph == d.WorkflowName {
+			t.Errorf("the install workflow ran on a node with PXE disabled")
+		}
+	}
+
+	d.PXEWorkflow = "Graph.Enable.PXE"
+	if err := d.verifyPXE(); err == nil || !strings.Contains(err.Error(), "still has no PXE device enabled after Graph.Enable.PXE") {
+		t.Errorf("verifyPXE() with an unchanged catalog = %v", err)
+	}
+
+	env.rackhd.catalogs[testNodeID][biosCatalog] = map[string]interface{}{"PxeDev1EnDis": "Enabled", "PxeDev1Interface": "NIC.Integrated.1-1-1"}
+	if err := d.verifyPXE(); err != nil {
+		t.Errorf("verifyPXE() with PXE enabled = %v", err)
+	}
+}
+
+func TestNodeBySerial(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode("node-a", nil, "127.0.0.1")
+	env.rackhd.addNode("node-b", nil, "127.0.0.2")
+	env.rackhd.addNode("node-c", nil)
+	env.rackhd.catalogs["node-a"] = map[string]interface{}{"dmi": map[string]interface{}{
+		"System Information":  map[string]interface{}{"Serial Number": "ABC1234", "UUID": "4C4C4544-0042-3510-8034-B7C04F333231"},
+		"Chassis Information": map[string]interface{}{"Serial Number": "CHS0001"},
+	}}
+	env.rackhd.catalogs["node-b"] = map[string]interface{}{"dmi": map[string]interface{}{
+		"System Information": map[string]interface{}{"Serial Number": "XYZ9876", "UUID": "4C4C4544-0042-3510-8034-B7C04F333232"},
+	}}
+	d := env.driver
+
+	for _, tt := range []struct{ serial, want string }{
+		{"abc1234", "node-a"},
+		{"CHS0001", "node-a"},
+		{"4c4c4544-0042-3510-8034-b7c04f333232", "node-b"},
+	} {
+		d.NodeID, d.NodeBySerial = "", tt.serial
+		if err := d.resolveNodeSerial(); err != nil || d.NodeID != tt.want {
+			t.Errorf("resolveNodeSerial() for %s = %v, node %q, want %q", tt.serial, err, d.NodeID, tt.want)
+		}
+	}
+
+	d.NodeID, d.NodeBySerial = "", "NOPE"
+	if err := d.resolveNodeSerial(); ErrorClass(err) != ErrNodeNotFound || d.NodeID != "" {
+		t.Errorf("resolveNodeSerial() for an unknown serial = %v, node %q", err, d.NodeID)
+	}
+
+	if err := (&Config{Endpoint: defaultEndpoint, NodeBySerial: "ABC1234", Transport: "http", BootstrapMethod: bootstrapSSH, RemoveStrategy: "none"}).Validate(); err != nil {
+		t.Errorf("Validate() with only --rackhd-node-serial = %v", err)
+	}
+}
+
+func TestTopologyLabels(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil)
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		"ohai": map[string]interface{}{"cpu": map[string]interface{}{"real": 2, "cores": 20, "total": 40}},
+		"lspci": []interface{}{
+			map[string]interface{}{"Slot": "00:1f.2", "Class": "SATA controller", "NUMANode": "0"},
+			map[string]interface{}{"Slot": "81:00.0", "Class": "Non-Volatile memory controller", "NUMANode": "1"},
+			map[string]interface{}{"Slot": "82:00.0", "Class": "Non-Volatile memory controller", "NUMANode": "1"},
+			map[string]interface{}{"Slot": "03:00.0", "Class": "Non-Volatile memory controller", "NUMANode": "0"},
+		},
+	}
+	labels, err := env.driver.hardwareLabels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"rackhd.numa-nodes=2", "rackhd.sockets=2", "rackhd.cores-per-socket=10", "rackhd.nvme=3", "rackhd.nvme.numa0=1", "rackhd.nvme.numa1=2"} {
+		if !containsString(labels, want) {
+			t.Errorf("hardwareLabels() = %v, want %s", labels, want)
+		}
+	}
+	runner := &fakeRunner{}
+	env.driver.SetSSHRunner(runner)
+	env.driver.HardwareLabels = true
+	if err := env.driver.configureEngine(); err != nil {
+		t.Fatalf("configureEngine() = %v", err)
+	}
+	if commands := strings.Join(runner.commands, "\n"); !strings.Contains(commands, labelsWrapper) || !strings.Contains(commands, "rackhd.nvme.numa1=2") {
+		t.Errorf("configureEngine() ran %v, want the topology labels given to the engine", runner.commands)
+	}
+	env.driver.HardwareLabels = false
+
+	// without lspci the NUMA node count falls back to the sockets
+	delete(env.rackhd.catalogs[testNodeID], "lspci")
+	topo, err := env.driver.topology()
+	if err != nil || topo.NUMANodes != 2 || len(topo.NVMe) != 0 {
+		t.Errorf("topology() without lspci = %+v, %v", topo, err)
+	}
+
+	// hugepages are per NUMA node, of which a socket may have several
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		"ohai": map[string]interface{}{"cpu": map[string]interface{}{"real": 1}, "memory": map[string]interface{}{"total": "263921932kB"}},
+		"lspci": []interface{}{
+			map[string]interface{}{"Slot": "00:1f.2", "NUMANode": "0"},
+			map[string]interface{}{"Slot": "c1:00.0", "NUMANode": "3"},
+		},
+	}
+	env.driver.Hugepages = "2M:512"
+	if sysctls, _, err := env.driver.memoryTuning(); err != nil || !containsString(sysctls, "vm.nr_hugepages=2048") {
+		t.Errorf("memoryTuning() = %v, %v, want 512 pages on each of 4 NUMA nodes", sysctls, err)
+	}
+}
+
+func TestPoolQuota(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, []string{"pool:team-a"}, "127.0.0.1")
+	env.rackhd.addNode("used-1", []string{"pool:team-a", machineTagPrefix + "a1"})
+	env.rackhd.addNode("used-2", []string{"pool:team-b", machineTagPrefix + "b1"})
+	env.rackhd.addNode("free-1", []string{"pool:team-a"})
+	path := filepath.Join(t.TempDir(), "pools.json")
+	writePools := func(quota int) {
+		pools := fmt.Sprintf(`{"pools": [{"name": "team-a", "tags": ["pool:team-a"], "maxMachines": %d}, {"name": "team-b", "tags": ["pool:team-b"], "maxMachines": 1}]}`, quota)
+		if err := ioutil.WriteFile(path, []byte(pools), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := env.driver
+	d.PoolsFile = path
+	d.Pool = "team-a"
+
+	writePools(1)
+	if err := d.Create(); err == nil || !strings.Contains(err.Error(), "Pool team-a already has 1 machines") {
+		t.Errorf("Create() over the quota = %v, want a quota error", err)
+	}
+
+	writePools(2)
+	if err := d.checkPools(); err != nil {
+		t.Errorf("checkPools() under the quota = %v", err)
+	}
+	d.Pool = "team-b"
+	if err := d.checkPools(); err == nil || !strings.Contains(err.Error(), "not in pool team-b") {
+		t.Errorf("checkPools() for another pool = %v", err)
+	}
+	d.Pool = "team-c"
+	if err := d.checkPools(); err == nil || !strings.Contains(err.Error(), "not defined") {
+		t.Errorf("checkPools() for an unknown pool = %v", err)
+	}
+}
+
+func TestOwnerEnforcement(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, []string{ownerTagPrefix + "team-a"}, "127.0.0.1")
+	d := env.driver
+	d.Owner = "team-b"
+
+	if err := d.Create(); ErrorClass(err) != ErrOwnerMismatch {
+		t.Errorf("Create() on another owner's node = %v, want %s", err, ErrOwnerMismatch)
+	}
+	for name, op := range map[string]func() error{"Remove": d.Remove, "Stop": d.Stop, "Kill": d.Kill} {
+		if err := op(); ErrorClass(err) != ErrOwnerMismatch {
+			t.Errorf("%s() on another owner's node = %v, want %s", name, err, ErrOwnerMismatch)
+		}
+	}
+
+	os.Setenv(forceOwnerEnv, "1")
+	defer os.Unsetenv(forceOwnerEnv)
+	if err := d.Stop(); err != nil {
+		t.Errorf("Stop() with %s = %v", forceOwnerEnv, err)
+	}
+	os.Unsetenv(forceOwnerEnv)
+
+	d.Owner = "team-a"
+	if err := d.checkOwner("remove"); err != nil {
+		t.Errorf("checkOwner() for the owner = %v", err)
+	}
+}
+
+func TestClaimTTL(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	live := claimTag("other", time.Now().Add(time.Hour))
+	env.rackhd.addNode(testNodeID, []string{live}, "127.0.0.1")
+	d := env.driver
+
+	if err := d.Create(); err == nil || !strings.Contains(err.Error(), "being provisioned by machine other") {
+		t.Errorf("Create() on a claimed node = %v, want a claim error", err)
+	}
+
+	if !inUse([]string{live}) {
+		t.Errorf("inUse() of a node with a live claim = false, want true")
+	}
+
+	expired := claimTag("other", time.Now().Add(-time.Minute))
+	env.rackhd.setNode(testNodeID, "tags", []string{expired})
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create() on a node with an expired claim = %v", err)
+	}
+	for _, tag := range env.rackhd.nodeTags(testNodeID) {
+		if strings.HasPrefix(tag, claimTagPrefix) {
+			t.Errorf("claim tag %s left on the node after Create()", tag)
+		}
+	}
+}
+
+// racingClient lets another create write its tags right after the next write
+// of the driver, as RackHD applies whichever write comes last.
+type racingClient struct {
+	RackHDClient
+	rival func([]string) []string
+}
+
+func (c *racingClient) SetNodeTags(ctx context.Context, nodeID string, tags []string) error {
+	if err := c.RackHDClient.SetNodeTags(ctx, nodeID, tags); err != nil {
+		return err
+	}
+	rival := c.rival
+	if rival == nil {
+		return nil
+	}
+	c.rival = nil
+	return c.RackHDClient.SetNodeTags(ctx, nodeID, rival(tags))
+}
+
+func TestClaimRace(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	d := env.driver
+	d.NodeID = testNodeID
+	client := &racingClient{RackHDClient: d.getClient()}
+	d.SetClient(client)
+	rival := func(machine string) func([]string) []string {
+		return func(tags []string) []string {
+			return append(append([]string{}, tags...), claimTag(machine, time.Now().Add(time.Hour)))
+		}
+	}
+
+	// both claims reach the node: the lower machine name wins
+	client.rival = rival("a-machine")
+	if err := d.writeClaim(false); err == nil || !strings.Contains(err.Error(), "being provisioned by machine a-machine") {
+		t.Errorf("writeClaim() losing the tie-break = %v", err)
+	}
+	if tags := env.rackhd.nodeTags(testNodeID); len(tags) != 1 || !strings.HasPrefix(tags[0], claimTagPrefix+"a-machine@") {
+		t.Errorf("tags after backing off = %v, want only the claim of a-machine", tags)
+	}
+
+	env.rackhd.setNode(testNodeID, "tags", []string{})
+	client.rival = rival("z-machine")
+	if err := d.writeClaim(false); err != nil {
+		t.Errorf("writeClaim() winning the tie-break = %v", err)
+	}
+
+	// the rival overwrites the claim
+	env.rackhd.setNode(testNodeID, "tags", []string{})
+	client.rival = func([]string) []string { return []string{claimTag("z-machine", time.Now().Add(time.Hour))} }
+	if err := d.writeClaim(false); err == nil || !strings.Contains(err.Error(), "being provisioned by machine z-machine") {
+		t.Errorf("writeClaim() overwritten = %v", err)
+	}
+}
+
+func TestTagFailureFailsCreate(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	d := env.driver
+	d.SelectStrategy = "first"
+	client := &failingTagClient{RackHDClient: d.getClient()}
+	d.SetClient(client)
+
+	if err := d.Create(); err == nil {
+		t.Fatalf("Create() with the machine tag refused = nil, want an error")
+	}
+	if tags := env.rackhd.nodeTags(testNodeID); len(tags) != 0 {
+		t.Errorf("tags after the failed create = %v", tags)
+	}
+}
+
+// failingTagClient refuses to write the machine tag, but not the claim.
+type failingTagClient struct {
+	RackHDClient
+}
+
+func (c *failingTagClient) SetNodeTags(ctx context.Context, nodeID string, tags []string) error {
+	if containsString(tags, machineTagPrefix+testMachine) {
+		return fmt.Errorf("refused")
+	}
+	return c.RackHDClient.SetNodeTags(ctx, nodeID, tags)
+}
+
+func TestListingCache(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.addNode("other", nil)
+
+	drivers := make([]*Driver, 4)
+	for i := range drivers {
+		drivers[i] = NewDriver(fmt.Sprintf("batch-%d", i), env.store)
+		drivers[i].Endpoint = env.rackhd.endpoint()
+		drivers[i].Transport = "http"
+		drivers[i].NodeID = testNodeID
+		drivers[i].ListingCacheTTL = 60
+	}
+	count := func(d *Driver) int {
+		n := 0
+		if err := d.eachNode(nil, func(*nodeInfo) error { n++; return nil }); err != nil {
+			t.Fatalf("eachNode() = %v", err)
+		}
+		return n
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range drivers {
+		wg.Add(1)
+		go func(d *Driver) {
+			defer wg.Done()
+			count(d)
+		}(d)
+	}
+	wg.Wait()
+	if env.rackhd.pages != 1 {
+		t.Errorf("parallel listings fetched %d pages, want 1", env.rackhd.pages)
+	}
+
+	env.rackhd.addNode("added", nil)
+	if got := count(drivers[0]); got != 2 {
+		t.Errorf("eachNode() within the TTL listed %d nodes, want the cached 2", got)
+	}
+	if err := drivers[0].setNodeTags([]string{"changed"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(drivers[1]); got != 3 {
+		t.Errorf("eachNode() after a tag change listed %d nodes, want 3", got)
+	}
+}
+
+func TestProjectTag(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, []string{"rack:r1"}, "127.0.0.1")
+	d := env.driver
+	d.Project = "ci"
+
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if tags := env.rackhd.nodeTags(testNodeID); !containsString(tags, projectTagPrefix+"ci") {
+		t.Errorf("node tags after Create() = %v, want %sci", tags, projectTagPrefix)
+	}
+	if err := d.Remove(); err != nil {
+		t.Fatalf("Remove() = %v", err)
+	}
+	if tags, want := env.rackhd.nodeTags(testNodeID), []string{"rack:r1"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("node tags after Remove() = %v, want %v", tags, want)
+	}
+}
+
+func TestSelectAntiAffinity(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	group := groupTagPrefix + "managers"
+	env.rackhd.addNode("a-used", []string{"rack:r1", machineTagPrefix + "manager-1", group})
+	env.rackhd.addNode("b-free-r1", []string{"rack:r1"})
+	env.rackhd.addNode("c-maintenance", []string{"rack:r2", maintenanceTag})
+	env.rackhd.addNode("d-blade", nil, "127.0.0.1")
+	env.rackhd.addNode("e-blade", nil)
+	for _, id := range []string{"d-blade", "e-blade"} {
+		env.rackhd.catalogs[id] = map[string]interface{}{
+			"dmi": map[string]interface{}{"Chassis Information": map[string]interface{}{"Serial Number": "ENC-1"}},
+		}
+	}
+	d := env.driver
+	d.NodeID = ""
+	d.SelectStrategy = selectFirst
+	d.AntiAffinityGroup = "managers"
+
+	if err := d.resolveSelection(); err != nil {
+		t.Fatalf("resolveSelection() = %v", err)
+	}
+	if d.NodeID != "d-blade" {
+		t.Errorf("selected node %s, want d-blade outside the group's rack", d.NodeID)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if tags := env.rackhd.nodeTags("d-blade"); !containsString(tags, group) {
+		t.Errorf("node tags after Create() = %v, want %s", tags, group)
+	}
+
+	// both r1 and the enclosure now hold a manager, so the order decides
+	second := NewDriver("manager-3", env.store)
+	second.Endpoint, second.Transport = d.Endpoint, d.Transport
+	second.SelectStrategy, second.AntiAffinityGroup = selectFirst, "managers"
+	if err := second.resolveSelection(); err != nil || second.NodeID != "b-free-r1" {
+		t.Errorf("second resolveSelection() = %v, %s, want b-free-r1", err, second.NodeID)
+	}
+
+	// a blade of another enclosure wins, its domain looked up once
+	env.rackhd.addNode("f-blade", nil)
+	env.rackhd.catalogs["f-blade"] = map[string]interface{}{
+		"dmi": map[string]interface{}{"Chassis Information": map[string]interface{}{"Serial Number": "ENC-2"}},
+	}
+	second.NodeID = ""
+	counter := &catalogCounter{RackHDClient: second.getClient(), fetched: make(map[string]int)}
+	second.SetClient(counter)
+	if err := second.resolveSelection(); err != nil || second.NodeID != "f-blade" {
+		t.Errorf("resolveSelection() with a new enclosure = %v, %s, want f-blade", err, second.NodeID)
+	}
+	for id, n := range counter.fetched {
+		if n > 1 {
+			t.Errorf("resolveSelection() fetched the catalog of %s %d times, want once", id, n)
+		}
+	}
+	second.SetClient(counter.RackHDClient)
+	env.rackhd.setNode("f-blade", "tags", []string{maintenanceTag})
+
+	second.NodeID = ""
+	second.SelectTags = []string{"gpu"}
+	if err := second.resolveSelection(); ErrorClass(err) != ErrNodeNotFound {
+		t.Errorf("resolveSelection() without a matching node = %v, want %s", err, ErrNodeNotFound)
+	}
+}
+
+// catalogCounter counts the catalog requests per node.
+type catalogCounter struct {
+	RackHDClient
+	fetched map[string]int
+}
+
+func (c *catalogCounter) GetNodeCatalog(ctx context.Context, nodeID, source string) (interface{}, error) {
+	c.fetched[nodeID]++
+	return c.RackHDClient.GetNodeCatalog(ctx, nodeID, source)
+}
+
+func TestSelectPriority(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode("a-default", nil)
+	env.rackhd.addNode("b-tagged", []string{priorityTagPrefix + "5", "gen:g8"})
+	env.rackhd.addNode("c-old", []string{"gen:g8"})
+	env.rackhd.addNode("d-premium", nil)
+	env.rackhd.setNode("d-premium", "sku", "premium-sku")
+	path := filepath.Join(t.TempDir(), "weights.json")
+	weights := `{"weights": [{"tags": ["gen:g8"], "priority": 10}, {"sku": "premium-sku", "priority": -1}]}`
+	if err := ioutil.WriteFile(path, []byte(weights), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := env.driver
+	d.NodeID = ""
+	d.SelectStrategy = selectFirst
+	d.WeightsFile = path
+
+	candidates, _, err := d.selectCandidates()
+	if err != nil {
+		t.Fatalf("selectCandidates() = %v", err)
+	}
+	var ids []string
+	for _, candidate := range candidates {
+		ids = append(ids, candidate.ID)
+	}
+	if want := []string{"c-old", "b-tagged", "a-default"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("selectCandidates() = %v, want %v", ids, want)
+	}
+}
+
+func TestPoolHealth(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	obm := map[string]interface{}{"service": "ipmi-obm-service"}
+	for _, id := range []string{"a-no-obm", "b-busy", "c-unreachable", "d-healthy"} {
+		env.rackhd.addNode(id, nil)
+		if id != "a-no-obm" {
+			env.rackhd.obms[id] = []interface{}{obm}
+		}
+	}
+	env.rackhd.active["b-busy"] = env.rackhd.startGraph("b-busy", "Graph.Discovery")["instanceId"].(string)
+	env.rackhd.pollers["c-unreachable"] = []map[string]interface{}{
+		{"id": "poller-c", "type": "ipmi", "failureCount": 12, "config": map[string]interface{}{"command": "sdr"}},
+	}
+	d := env.driver
+	d.NodeID = ""
+	d.SelectStrategy = selectFirst
+	d.PoolHealth = true
+	counter := &workflowCounter{RackHDClient: d.getClient(), fetched: make(map[string]int)}
+	d.SetClient(counter)
+
+	if err := d.resolveSelection(); err != nil || d.NodeID != "d-healthy" {
+		t.Errorf("resolveSelection() = %v, %s, want d-healthy", err, d.NodeID)
+	}
+	if n := counter.fetched["d-healthy"]; n != 1 {
+		t.Errorf("resolveSelection() fetched the active workflow of d-healthy %d times, want once", n)
+	}
+
+	d.NodeID = ""
+	env.rackhd.setNode("d-healthy", "tags", []string{machineTagPrefix + "other"})
+	err := d.resolveSelection()
+	if ErrorClass(err) != ErrNodeNotFound || !strings.Contains(err.Error(), "1 OBM unreachable, 1 no OBM, 1 workflow running") {
+		t.Errorf("resolveSelection() without healthy nodes = %v", err)
+	}
+}
+
+// workflowCounter counts the active workflow requests per node.
+type workflowCounter struct {
+	RackHDClient
+	fetched map[string]int
+}
+
+func (c *workflowCounter) GetActiveWorkflow(ctx context.Context, nodeID string) (interface{}, error) {
+	c.fetched[nodeID]++
+	return c.RackHDClient.GetActiveWorkflow(ctx, nodeID)
+}
+
+func TestSelectSkipsActiveWorkflows(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode("a-discovering", nil, "127.0.0.1")
+	env.rackhd.addNode("b-idle", nil, "127.0.0.1")
+	env.rackhd.active["a-discovering"] = env.rackhd.startGraph("a-discovering", "Graph.Discovery")["instanceId"].(string)
+	d := env.driver
+	d.NodeID = ""
+	d.SelectStrategy = selectFirst
+
+	if err := d.resolveSelection(); err != nil || d.NodeID != "b-idle" {
+		t.Errorf("resolveSelection() = %v, %s, want b-idle", err, d.NodeID)
+	}
+
+	d.NodeID = "a-discovering"
+	if err := d.Create(); err == nil || !strings.Contains(err.Error(), "running workflow Graph.Discovery") {
+		t.Errorf("Create() on a node running a workflow = %v", err)
+	}
+
+	env.rackhd.setNode("b-idle", "tags", []string{machineTagPrefix + "other"})
+	d.NodeID = ""
+	if err := d.resolveSelection(); ErrorClass(err) != ErrNodeNotFound {
+		t.Errorf("resolveSelection() with only busy nodes = %v, want %s", err, ErrNodeNotFound)
+	}
+}
+
+func TestReservedField(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.setNode(testNodeID, "reserved", false)
+	env.rackhd.addNode("taken", nil)
+	env.rackhd.setNode("taken", "reserved", true)
+	reserved := func(id string) interface{} {
+		env.rackhd.mu.Lock()
+		defer env.rackhd.mu.Unlock()
+		return env.rackhd.nodes[id]["reserved"]
+	}
+	d := env.driver
+
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if reserved(testNodeID) != true || !d.Reserved {
+		t.Errorf("reserved after Create() = %v (driver %v), want true", reserved(testNodeID), d.Reserved)
+	}
+	if err := d.Remove(); err != nil {
+		t.Fatalf("Remove() = %v", err)
+	}
+	if reserved(testNodeID) != false || d.Reserved {
+		t.Errorf("reserved after Remove() = %v (driver %v), want false", reserved(testNodeID), d.Reserved)
+	}
+
+	other := NewDriver("other", env.store)
+	other.Endpoint, other.Transport, other.NodeID = d.Endpoint, d.Transport, "taken"
+	if err := other.Create(); err == nil || !strings.Contains(err.Error(), "reserved in RackHD by another consumer") {
+		t.Errorf("Create() on a reserved node = %v", err)
+	}
+	other.NodeID, other.SelectStrategy = "", selectFirst
+	env.rackhd.setNode(testNodeID, "tags", []string{machineTagPrefix + "other-machine"})
+	if err := other.resolveSelection(); ErrorClass(err) != ErrNodeNotFound {
+		t.Errorf("resolveSelection() with only a reserved node free = %v, %s", err, other.NodeID)
+	}
+}
+
+func TestEngineLabels(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	d := env.created()
+	runner := &fakeRunner{}
+	d.SetSSHRunner(runner)
+	d.GPULabels = true
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{"lspci": []interface{}{}}
+
+	// labels stay out of daemon.json, dockerd would refuse docker-machine's --label
+	if err := d.configureEngine(); err != nil {
+		t.Fatalf("configureEngine() = %v", err)
+	}
+	commands := strings.Join(runner.commands, "\n")
+	if !strings.Contains(commands, labelsWrapper) || !strings.Contains(commands, labelsDropIn) || !strings.Contains(commands, "daemon-reload") || strings.Contains(commands, "daemon.json") {
+		t.Errorf("configureEngine() ran %v", runner.commands)
+	}
+	if want := []string{"gpu=false"}; !reflect.DeepEqual(d.EngineLabels, want) {
+		t.Errorf("EngineLabels = %v, want %v", d.EngineLabels, want)
+	}
+
+	// the wrapper runs the command line of docker-machine's drop-in with the labels
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dropIn := filepath.Join(dir, "10-machine.conf")
+	unit := "[Service]\nExecStart=\nExecStart=printf '<%s>' dockerd -H tcp://0.0.0.0:2376 --label provider=rackhd\n"
+	if err := ioutil.WriteFile(dropIn, []byte(unit), 0644); err != nil {
+		t.Fatal(err)
+	}
+	labels := []string{"rackhd.product=PowerEdge R630", "gpu=false"}
+	out, err := exec.Command("sh", "-c", labelsWrapperScript(dropIn, labels)).CombinedOutput()
+	if err != nil {
+		t.Fatalf("wrapper = %v: %s", err, out)
+	}
+	if want := "<dockerd><-H><tcp://0.0.0.0:2376><--label><provider=rackhd><--label><rackhd.product=PowerEdge R630><--label><gpu=false>"; string(out) != want {
+		t.Errorf("wrapper ran %q, want %q", out, want)
+	}
+
+	// GPU labels reach the wrapper; the runtime alone labels nothing
+	env.rackhd.catalogs[testNodeID]["lspci"] = []interface{}{
+		map[string]interface{}{"Class": "3D controller", "Vendor": "NVIDIA Corporation"},
+		map[string]interface{}{"Class": "3D controller", "Vendor": "NVIDIA Corporation"},
+	}
+	runner.commands = nil
+	if err := d.configureEngine(); err != nil {
+		t.Fatalf("configureEngine() with GPUs = %v", err)
+	}
+	if commands := strings.Join(runner.commands, "\n"); !strings.Contains(commands, "gpu.vendor=nvidia") || !strings.Contains(commands, "gpu.count=2") {
+		t.Errorf("configureEngine() with GPUs ran %v", runner.commands)
+	}
+	d.GPULabels, d.GPURuntime, d.Arch = false, true, "x86_64"
+	runner.commands = nil
+	if err := d.configureEngine(); err != nil {
+		t.Fatalf("configureEngine() with the GPU runtime = %v", err)
+	}
+	if commands := strings.Join(runner.commands, "\n"); strings.Contains(commands, labelsDropIn) || !strings.Contains(commands, "nvidia-container-toolkit") {
+		t.Errorf("configureEngine() with the GPU runtime ran %v", runner.commands)
+	}
+	d.GPULabels, d.GPURuntime = true, false
+
+	runner.commands = nil
+	runner.fail = "systemctl"
+	if err := d.configureEngine(); err == nil {
+		t.Error("configureEngine() without systemd succeeded")
+	}
+
+	runner.commands = nil
+	runner.fail = ""
+	d.GPULabels = false
+	d.RegistryMirrors = []string{"https://mirror.lab:5000"}
+	if err := d.configureEngine(); err != nil {
+		t.Fatalf("configureEngine() with a registry mirror = %v", err)
+	}
+	if commands := strings.Join(runner.commands, "\n"); !strings.Contains(commands, "registry-mirrors") || strings.Contains(commands, labelsDropIn) {
+		t.Errorf("configureEngine() with a registry mirror ran %v", runner.commands)
+	}
+}
+
+func TestDataDisk(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	d := env.created()
+	runner := &fakeRunner{fail: "mountpoint -q"}
+	d.SetSSHRunner(runner)
+	d.DockerDataDisk = "sdb"
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		driveIDCatalog: []interface{}{map[string]interface{}{"devName": "sdb"}},
+	}
+
+	if err := d.prepareDataDisk(); err != nil {
+		t.Fatalf("prepareDataDisk() = %v", err)
+	}
+	ran := strings.Join(runner.commands, "\n")
+	if !strings.Contains(ran, "\\| /var/lib/docker |d") || !strings.Contains(ran, "/var/lib/docker $(blkid -s TYPE -o value /dev/sdb) defaults,nofail 0 2") {
+		t.Errorf("prepareDataDisk() ran\n%s", ran)
+	}
+
+	// a repeated create keeps the mounted data disk
+	runner.fail, runner.commands = "", nil
+	if err := d.prepareDataDisk(); err != nil || len(runner.commands) != 1 {
+		t.Errorf("prepareDataDisk() on a mounted data disk = %v, ran %v", err, runner.commands)
+	}
+}
+
+func TestConfigureSudo(t *testing.T) {
+	runner := &fakeRunner{}
+	d := NewDriver(testMachine, "")
+	d.SSHUser, d.BootstrapUser = "docker", "root"
+	d.SetSSHRunner(runner)
+
+	if err := d.configureSudo(); err != nil {
+		t.Fatalf("configureSudo() = %v", err)
+	}
+	want := []string{
+		"root (password): echo 'docker ALL=(ALL) NOPASSWD:ALL' > /etc/sudoers.d/docker-machine-docker",
+		"root (password): chmod 0440 /etc/sudoers.d/docker-machine-docker",
+		"root (password): visudo -cf /etc/sudoers.d/docker-machine-docker || { rm -f /etc/sudoers.d/docker-machine-docker; exit 1; }",
+	}
+	if !reflect.DeepEqual(runner.commands, want) {
+		t.Errorf("configureSudo() ran\n%s\nwant\n%s", strings.Join(runner.commands, "\n"), strings.Join(want, "\n"))
+	}
+
+	runner.commands = nil
+	d.SSHUser = "root"
+	if err := d.configureSudo(); err != nil || len(runner.commands) != 0 {
+		t.Errorf("configureSudo() for root = %v, ran %v", err, runner.commands)
+	}
+}
+
+func TestSSHCA(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	privateKey := func() ([]byte, cryptossh.PublicKey) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := cryptossh.MarshalPrivateKey(priv, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sshPub, _ := cryptossh.NewPublicKey(pub)
+		return pem.EncodeToMemory(block), sshPub
+	}
+	caKey, caPub := privateKey()
+	path := filepath.Join(env.store, "ca")
+	if err := ioutil.WriteFile(path, caKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, machinePub := privateKey()
+	runner := &fakeRunner{}
+	d := env.driver
+	d.SSHUser, d.BootstrapUser = "docker", "root"
+	d.SSHCAKey, d.SSHCAPrincipals = path, []string{"ops", "docker"}
+	d.SSHKey = strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(machinePub)))
+	d.SetSSHRunner(runner)
+
+	if err := d.installMachineKey(); err != nil {
+		t.Fatalf("installMachineKey() = %v", err)
+	}
+	b, err := ioutil.ReadFile(d.sshCertPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, _, _, err := cryptossh.ParseAuthorizedKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := parsed.(*cryptossh.Certificate)
+	if !ok || !reflect.DeepEqual(cert.ValidPrincipals, d.SSHCAPrincipals) || !bytes.Equal(cert.SignatureKey.Marshal(), caPub.Marshal()) {
+		t.Errorf("machine certificate = %+v, want one of the CA for %v", parsed, d.SSHCAPrincipals)
+	}
+	commands := strings.Join(runner.commands, "\n")
+	if strings.Contains(commands, "authorized_keys") {
+		t.Errorf("installMachineKey() with a CA key wrote authorized_keys:\n%s", commands)
+	}
+	for _, want := range []string{
+		"echo '" + strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(caPub))) + "' > " + sshCAPath,
+		"printf '%s\\n' 'ops' 'docker' > /etc/ssh/auth_principals/docker",
+		"AuthorizedPrincipalsFile /etc/ssh/auth_principals/%u",
+	} {
+		if !strings.Contains(commands, want) {
+			t.Errorf("installMachineKey() ran\n%s\nwant a command containing %q", commands, want)
+		}
+	}
+}
+
+func TestMachineKeyOptions(t *testing.T) {
+	dir := t.TempDir()
+	d := NewDriver(testMachine, dir)
+	if err := d.setMachineKeyPath(filepath.Join(dir, "keys", "fleet")); err != nil {
+		t.Fatal(err)
+	}
+	d.MachineKeyBits, d.MachineKeyComment = 3072, "docker-machine@ci"
+
+	public, err := d.createSSHKey()
+	if err != nil {
+		t.Fatalf("createSSHKey() = %v", err)
+	}
+	parsed, comment, _, _, err := cryptossh.ParseAuthorizedKey([]byte(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment != "docker-machine@ci" {
+		t.Errorf("public key comment = %q, want docker-machine@ci", comment)
+	}
+	if key, ok := parsed.(cryptossh.CryptoPublicKey); !ok || key.CryptoPublicKey().(*rsa.PublicKey).N.BitLen() != 3072 {
+		t.Errorf("public key %s is not a 3072 bit RSA key", public)
+	}
+
+	os.Remove(d.GetSSHKeyPath() + ".pub")
+	reuse := NewDriver("other", dir)
+	reuse.ReuseMachineKey = d.GetSSHKeyPath()
+	if err := reuse.setMachineKeyPath(reuse.ReuseMachineKey); err != nil {
+		t.Fatal(err)
+	}
+	derived, err := reuse.createSSHKey()
+	if err != nil {
+		t.Fatalf("createSSHKey() reusing a key = %v", err)
+	}
+	if !strings.HasPrefix(public, strings.TrimSpace(derived)) {
+		t.Errorf("reused public key = %q, want the one of %s", derived, reuse.ReuseMachineKey)
+	}
+	if _, err := os.Stat(reuse.GetSSHKeyPath() + ".pub"); !os.IsNotExist(err) {
+		t.Errorf("reusing a key wrote %s.pub", reuse.GetSSHKeyPath())
+	}
+
+	// the comment is data to the remote shell
+	d.SSHUser, d.SSHKey = "docker", "ssh-rsa AAAA it's; touch "+filepath.Join(dir, "injected")
+	sshDir := filepath.Join(dir, "ssh")
+	os.Mkdir(sshDir, 0700)
+	for _, adopt := range []bool{false, true} {
+		d.Adopt = adopt
+		command := strings.Replace(d.keyInstallCommands()[1], "~docker/.ssh", sshDir, -1)
+		if out, err := exec.Command("sh", "-c", command).CombinedOutput(); err != nil {
+			t.Fatalf("%s = %v: %s", command, err, out)
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(sshDir, "authorized_keys")); string(b) != d.SSHKey+"\n" {
+			t.Errorf("adopt %v: authorized_keys = %q, want the key", adopt, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "injected")); !os.IsNotExist(err) {
+		t.Errorf("the key comment ran as a command")
+	}
+	config := Config{NodeID: "node", MachineKeyComment: "ci\nreboot"}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "--rackhd-machine-key-comment must be a single line") {
+		t.Errorf("Validate() with a multi-line comment = %v", err)
+	}
+}
+
+func TestRestrictedBootstrap(t *testing.T) {
+	runner := &fakeRunner{}
+	d := NewDriver(testMachine, "")
+	d.SSHUser, d.BootstrapUser = "docker", "docker"
+	d.SSHKey = "ssh-rsa AAAA test"
+	d.RestrictedBootstrap = true
+	d.SetSSHRunner(runner)
+
+	if err := d.installSSHKey(); err != nil {
+		t.Fatalf("installSSHKey() = %v", err)
+	}
+	if err := d.verifyKeyAuth(); err != nil {
+		t.Fatalf("verifyKeyAuth() = %v", err)
+	}
+	if len(runner.commands) != 6 {
+		t.Errorf("ran %d commands, want 6: %v", len(runner.commands), runner.commands)
+	}
+
+	runner.commands = nil
+	if err := d.runKeyCommands([]string{"reboot"}); err == nil || !strings.Contains(err.Error(), "restricted-bootstrap") {
+		t.Errorf("runKeyCommands(reboot) = %v, want it refused", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Errorf("a refused command was sent to the node: %v", runner.commands)
+	}
+
+	config := d.Config
+	config.NodeID = "node"
+	config.NopasswdSudo = true
+	config.Sysctls = []string{"vm.swappiness=1"}
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "--rackhd-nopasswd-sudo, --rackhd-sysctl") {
+		t.Errorf("Validate() = %v, want the conflicting options listed", err)
+	}
+}
+
+func TestNormalizeEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint, transport string
+		want, wantTransport string
+	}{
+		{"localhost:8080", "http", "localhost:8080", "http"},
+		{"rackhd:8443/", "https", "rackhd:8443", "https"},
+		{"https://rackhd:8443/", "http", "rackhd:8443", "https"},
+		{"HTTP://[::1]:8080", "http", "[::1]:8080", "http"},
+	}
+	for _, tt := range tests {
+		endpoint, transport, err := normalizeEndpoint(tt.endpoint, tt.transport)
+		if err != nil || endpoint != tt.want || transport != tt.wantTransport {
+			t.Errorf("normalizeEndpoint(%q, %q) = %q, %q, %v, want %q, %q", tt.endpoint, tt.transport, endpoint, transport, err, tt.want, tt.wantTransport)
+		}
+	}
+	for _, endpoint := range []string{"rackhd", "rackhd:http", ":8080", "rackhd:8080/api", "ftp://rackhd:21", "https://rackhd:8443/api/2.0"} {
+		if _, _, err := normalizeEndpoint(endpoint, "http"); err == nil {
+			t.Errorf("normalizeEndpoint(%q) was accepted", endpoint)
+		}
+	}
+	if _, _, err := normalizeEndpoint("http://rackhd:8080", "https"); err == nil {
+		t.Errorf("normalizeEndpoint() accepted an http URL with --rackhd-transport https")
+	}
+}
+
+// testFlags is a drivers.DriverOptions of the flag values given, falling
+// back to the defaults of the create flags.
+type testFlags map[string]interface{}
+
+func (f testFlags) value(key string) interface{} {
+	if v, ok := f[key]; ok {
+		return v
+	}
+	for _, flag := range NewDriver(testMachine, "").GetCreateFlags() {
+		if flag.String() == key {
+			return flag.Default()
+		}
+	}
+	return nil
+}
+
+func (f testFlags) String(key string) string {
+	s, _ := f.value(key).(string)
+	return s
+}
+
+func (f testFlags) StringSlice(key string) []string {
+	s, _ := f.value(key).([]string)
+	return s
+}
+
+func (f testFlags) Int(key string) int {
+	n, _ := f.value(key).(int)
+	return n
+}
+
+func (f testFlags) Bool(key string) bool {
+	b, _ := f.value(key).(bool)
+	return b
+}
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rackhd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rackhd.yml")
+	yaml := `# site defaults
+endpoint: rackhd.lab:8080
+select: random
+select-tag: [gen:g9, "rack:r12"]
+claim-ttl: 10
+pool-health: true
+workflow-options: '{"options": {"defaults": {"version": "7"}}}'
+sysctl:
+  - vm.swappiness=1
+`
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDriver(testMachine, "")
+	if err := d.SetConfigFromFlags(testFlags{"rackhd-config-file": path, "rackhd-claim-ttl": 5}); err != nil {
+		t.Fatalf("SetConfigFromFlags() = %v", err)
+	}
+	if d.Endpoint != "rackhd.lab:8080" || d.SelectStrategy != selectRandom || !d.PoolHealth ||
+		!reflect.DeepEqual(d.SelectTags, []string{"gen:g9", "rack:r12"}) || !reflect.DeepEqual(d.Sysctls, []string{"vm.swappiness=1"}) ||
+		d.WorkflowOptions != `{"options": {"defaults": {"version": "7"}}}` {
+		t.Errorf("options from the config file = %+v", d.Config)
+	}
+	if d.ClaimTTL != 5 {
+		t.Errorf("ClaimTTL = %d, want the flag to override the file", d.ClaimTTL)
+	}
+
+	// a mapping is kept as JSON, as an object of a JSON file is
+	mapping := "workflow-options:\n  options:\n    defaults: {version: 7}\nssh-port: \"2222\"\n"
+	if err := ioutil.WriteFile(path, []byte(mapping), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d = NewDriver(testMachine, "")
+	if err := d.SetConfigFromFlags(testFlags{"rackhd-config-file": path, "rackhd-node-id": testNodeID}); err != nil {
+		t.Fatalf("SetConfigFromFlags() with a mapping = %v", err)
+	}
+	if d.WorkflowOptions != `{"options":{"defaults":{"version":7}}}` || d.SSHPort != 2222 {
+		t.Errorf("options from a mapping = %q, ssh port %d", d.WorkflowOptions, d.SSHPort)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"select": "first", "claim-ttl": "soon", "no-such-option": 1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = NewDriver(testMachine, "").SetConfigFromFlags(testFlags{"rackhd-config-file": path})
+	if err == nil || !strings.Contains(err.Error(), `option "claim-ttl" is not a whole number`) || !strings.Contains(err.Error(), `unknown option "no-such-option"`) {
+		t.Errorf("SetConfigFromFlags() with a bad config file = %v", err)
+	}
+}
+
+func TestEndpointWait(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	env.driver.Endpoint = addr
+
+	env.driver.EndpointWait = 1
+	if err := env.driver.waitForEndpoint(); err == nil || !strings.Contains(err.Error(), "did not come up within 1s") {
+		t.Fatalf("waitForEndpoint() with nothing listening = %v", err)
+	}
+
+	server := &http.Server{Handler: env.rackhd.Config.Handler}
+	defer server.Close()
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		if listener, err := net.Listen("tcp", addr); err == nil {
+			server.Serve(listener)
+		}
+	}()
+	env.driver.EndpointWait = 10
+	if err := env.driver.waitForEndpoint(); err != nil {
+		t.Errorf("waitForEndpoint() for an endpoint coming up = %v", err)
+	}
+}
+
+func TestConsole(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil)
+	env.rackhd.obms[testNodeID] = []interface{}{map[string]interface{}{
+		"service": "ipmi-obm-service",
+		"config":  map[string]interface{}{"host": "10.1.0.7", "user": "admin"},
+	}}
+
+	dir, err := ioutil.TempDir("", "rackhd-sol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\necho \"$@ password=$IPMI_PASSWORD\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ipmitool"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	d := env.driver
+	d.recordSOL()
+	if d.SOLHost != "10.1.0.7" || d.SOLUser != "admin" {
+		t.Fatalf("recordSOL() recorded %q as %q", d.SOLHost, d.SOLUser)
+	}
+	if err := d.Console(nil, ioutil.Discard, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "No BMC password") {
+		t.Errorf("Console() without a password = %v", err)
+	}
+	d.SOLPasswordFile = filepath.Join(dir, "sol-password")
+	if err := ioutil.WriteFile(d.SOLPasswordFile, []byte("calvin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := d.Console(nil, &out, ioutil.Discard); err != nil {
+		t.Fatalf("Console() = %v", err)
+	}
+	if want := "-I lanplus -H 10.1.0.7 -U admin -E sol activate password=calvin\n"; out.String() != want {
+		t.Errorf("Console() ran ipmitool %q, want %q", out.String(), want)
+	}
+}
+
+func TestSKUDefaults(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.nodes[testNodeID]["sku"] = "sku-r630"
+	env.rackhd.skus["sku-r630"] = map[string]interface{}{
+		"id": "sku-r630", "name": "PowerEdge R630",
+		"skuConfig": map[string]interface{}{"docker-machine": map[string]interface{}{
+			"workflow-name":    "Graph.InstallCentOS",
+			"workflow-options": map[string]interface{}{"defaults": map[string]interface{}{"version": "7"}},
+		}},
+	}
+	d := env.driver
+
+	d.applySKUDefaults()
+	if d.WorkflowName != "Graph.InstallCentOS" || d.WorkflowOptions != `{"defaults":{"version":"7"}}` {
+		t.Errorf("applySKUDefaults() set workflow %q options %q", d.WorkflowName, d.WorkflowOptions)
+	}
+
+	// the options given on the command line are kept when the selection moves
+	// to a node of another SKU
+	d.WorkflowName, d.WorkflowOptions, d.skuWorkflow, d.skuWorkflowOptions = "", `{"defaults":{"version":"8"}}`, false, false
+	d.applySKUDefaults()
+	delete(env.rackhd.nodes[testNodeID], "sku")
+	d.applySKUDefaults()
+	if d.WorkflowName != "" || d.WorkflowOptions != `{"defaults":{"version":"8"}}` {
+		t.Errorf("applySKUDefaults() on a node without an SKU left workflow %q options %q", d.WorkflowName, d.WorkflowOptions)
+	}
+
+	env.rackhd.nodes[testNodeID]["sku"] = "sku-r630"
+	d.WorkflowName = "Graph.InstallUbuntu"
+	d.applySKUDefaults()
+	if d.WorkflowName != "Graph.InstallUbuntu" {
+		t.Errorf("applySKUDefaults() replaced --rackhd-workflow-name with %q", d.WorkflowName)
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rackhd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rackhd.yml")
+	yaml := `select: random
+workflow-name: Graph.InstallCentOS
+profile: edge-supermicro
+profiles:
+  edge-supermicro:
+    select-tag: [vendor:supermicro]
+    workflow-name: Graph.InstallUbuntu
+  storage-dell:
+    select-tag:
+      - vendor:dell
+      - role:storage
+    post-install-script: /etc/storage.sh
+`
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDriver(testMachine, "")
+	if err := d.SetConfigFromFlags(testFlags{"rackhd-config-file": path}); err != nil {
+		t.Fatalf("SetConfigFromFlags() = %v", err)
+	}
+	if d.Profile != "edge-supermicro" || d.WorkflowName != "Graph.InstallUbuntu" || !reflect.DeepEqual(d.SelectTags, []string{"vendor:supermicro"}) {
+		t.Errorf("default profile gave profile %q workflow %q tags %v", d.Profile, d.WorkflowName, d.SelectTags)
+	}
+
+	d = NewDriver(testMachine, "")
+	if err := d.SetConfigFromFlags(testFlags{"rackhd-config-file": path, "rackhd-profile": "storage-dell"}); err != nil {
+		t.Fatalf("SetConfigFromFlags() = %v", err)
+	}
+	if d.WorkflowName != "Graph.InstallCentOS" || d.PostInstallScript != "/etc/storage.sh" || !reflect.DeepEqual(d.SelectTags, []string{"vendor:dell", "role:storage"}) {
+		t.Errorf("profile storage-dell gave workflow %q script %q tags %v", d.WorkflowName, d.PostInstallScript, d.SelectTags)
+	}
+
+	err = NewDriver(testMachine, "").SetConfigFromFlags(testFlags{"rackhd-config-file": path, "rackhd-profile": "gpu"})
+	if err == nil || !strings.Contains(err.Error(), "Specify one of: edge-supermicro, storage-dell") {
+		t.Errorf("SetConfigFromFlags() with an unknown profile = %v", err)
+	}
+	if err := NewDriver(testMachine, "").SetConfigFromFlags(testFlags{"rackhd-profile": "gpu"}); err == nil {
+		t.Error("SetConfigFromFlags() accepted --rackhd-profile without --rackhd-config-file")
+	}
+}
+
+func TestWorkflowRetries(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.graphStatus["Graph.InstallCentOS"] = "failed"
+	d := env.driver
+	d.WorkflowName, d.WorkflowRetries = "Graph.InstallCentOS", 2
+
+	if err := d.installOS(); ErrorClass(err) != ErrWorkflowFailed {
+		t.Fatalf("installOS() = %v, want %v", err, ErrWorkflowFailed)
+	}
+	if want := []string{"Graph.InstallCentOS", "Graph.InstallCentOS", "Graph.InstallCentOS"}; !reflect.DeepEqual(env.rackhd.started, want) {
+		t.Errorf("started %v, want %v", env.rackhd.started, want)
+	}
+
+	env.rackhd.started = nil
+	env.rackhd.graphStatus["Graph.InstallCentOS"] = "succeeded"
+	if err := d.installOS(); err != nil || len(env.rackhd.started) != 1 {
+		t.Errorf("installOS() = %v, started %v", err, env.rackhd.started)
+	}
+}
+
+func TestKeyGraph(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	d := env.driver
+	d.BootstrapMethod, d.SSHUser = bootstrapGraph, "docker"
+
+	// an installed node gets the key from the installer's options
+	d.WorkflowName = "Graph.InstallCentOS"
+	if err := d.installOS(); err != nil {
+		t.Fatalf("installOS() = %v", err)
+	}
+	want := map[string]interface{}{"defaults": map[string]interface{}{
+		"hostname": testMachine,
+		"users":    []interface{}{map[string]interface{}{"name": "docker", "sshKey": d.SSHKey}},
+	}}
+	if d.SSHKey == "" || !reflect.DeepEqual(env.rackhd.options["Graph.InstallCentOS"], want) {
+		t.Errorf("install options = %v, want %v", env.rackhd.options["Graph.InstallCentOS"], want)
+	}
+	if err := d.installKey(); err != nil || len(env.rackhd.started) != 1 {
+		t.Errorf("installKey() = %v, started %v", err, env.rackhd.started)
+	}
+
+	// any other node is booted into the microkernel by the driver's graph
+	d.WorkflowName, d.candidateIPs = "", []string{"127.0.0.1"}
+	if err := d.installKey(); err != nil {
+		t.Fatalf("installKey() = %v", err)
+	}
+	if _, ok := env.rackhd.definitions[keyGraph]; !ok {
+		t.Errorf("%s was not registered, have %v", keyGraph, env.rackhd.definitions)
+	}
+	if n := len(env.rackhd.started); n != 2 || env.rackhd.started[1] != keyGraph {
+		t.Errorf("started %v, want %s last", env.rackhd.started, keyGraph)
+	}
+	b, _ := json.Marshal(env.rackhd.options[keyGraph])
+	if !strings.Contains(string(b), "user='docker'") || !strings.Contains(string(b), d.SSHKey) {
+		t.Errorf("%s options %s lack the user and key", keyGraph, b)
+	}
+	// the keys of the image are kept
+	if !strings.Contains(string(b), `grep -qxF \"$key\"`) || strings.Contains(string(b), `\"$key\" \u003e \"`) {
+		t.Errorf("%s options %s do not append the key", keyGraph, b)
+	}
+	// only the key is used to log in
+	if ran := env.sshd.ran(); !reflect.DeepEqual(ran, []string{"exit 0"}) {
+		t.Errorf("ran %q, want only the key check", ran)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	path := filepath.Join(env.store, "ks.cfg")
+	if err := ioutil.WriteFile(path, []byte("install\nreboot\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := env.driver
+	d.WorkflowName, d.Templates = "Graph.InstallCentOS", []string{"installScript=" + path}
+
+	installScript := func() string {
+		if err := d.installOS(); err != nil {
+			t.Fatalf("installOS() = %v", err)
+		}
+		options, _ := env.rackhd.options["Graph.InstallCentOS"].(map[string]interface{})
+		defaults, _ := options["defaults"].(map[string]interface{})
+		name, _ := defaults["installScript"].(string)
+		return name
+	}
+	first := installScript()
+	if !strings.HasPrefix(first, "ks-") || !strings.HasSuffix(first, ".cfg") || len(first) != len("ks-.cfg")+12 || env.rackhd.templates[first] != "install\nreboot\n" {
+		t.Fatalf("installScript = %q, library %v", first, env.rackhd.templates)
+	}
+
+	// unchanged files are not uploaded again
+	if name := installScript(); name != first || len(env.rackhd.uploads) != 1 {
+		t.Errorf("installScript = %q, uploads %v, want %s uploaded once", name, env.rackhd.uploads, first)
+	}
+
+	// a changed file gets a new name, leaving the old template to its users
+	if err := ioutil.WriteFile(path, []byte("install\npoweroff\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	second := installScript()
+	if second == first || env.rackhd.templates[first] != "install\nreboot\n" || env.rackhd.templates[second] != "install\npoweroff\n" {
+		t.Errorf("installScript = %q after the change, library %v", second, env.rackhd.templates)
+	}
+
+	// a library copy that does not match its checksum is replaced
+	env.rackhd.templates[second] = "tampered"
+	if installScript(); env.rackhd.templates[second] != "install\npoweroff\n" || len(env.rackhd.uploads) != 3 {
+		t.Errorf("library %v, uploads %v", env.rackhd.templates, env.rackhd.uploads)
+	}
+}
+
+func TestSetupOBM(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	d := env.driver
+
+	if err := d.setupOBM(); err != errPhaseSkipped {
+		t.Errorf("setupOBM() without credentials = %v, want it skipped", err)
+	}
+
+	// a bare node gets the settings of the given BMC, proven by a power on
+	d.BMCHost, d.BMCUser, d.BMCPassword = "10.1.0.16", "admin", "secret"
+	if err := d.setupOBM(); err != nil {
+		t.Fatalf("setupOBM() = %v", err)
+	}
+	b, _ := json.Marshal(env.rackhd.obms[testNodeID])
+	if want := `[{"config":{"host":"10.1.0.16","password":"secret","user":"admin"},"service":"ipmi-obm-service"}]`; string(b) != want {
+		t.Errorf("OBM settings %s, want %s", b, want)
+	}
+	if want := []string{powerOnGraph}; !reflect.DeepEqual(env.rackhd.started, want) {
+		t.Errorf("started %v, want %v", env.rackhd.started, want)
+	}
+	if d.SOLHost != "10.1.0.16" || d.SOLUser != "admin" {
+		t.Errorf("SOL %s@%s, want the new BMC", d.SOLUser, d.SOLHost)
+	}
+
+	// existing settings are left alone
+	if err := d.setupOBM(); err != errPhaseSkipped || len(env.rackhd.started) != 1 {
+		t.Errorf("setupOBM() = %v, started %v", err, env.rackhd.started)
+	}
+
+	// without an address RackHD's graph reads it from the catalog; power
+	// control that does not work fails the create
+	env.rackhd.obms[testNodeID], env.rackhd.started = nil, nil
+	env.rackhd.graphStatus[powerOnGraph] = "failed"
+	d.BMCHost = ""
+	err := d.setupOBM()
+	if err == nil || !strings.Contains(err.Error(), "power control through its BMC does not work") {
+		t.Errorf("setupOBM() = %v, want a power control error", err)
+	}
+	if want := []string{obmSetupGraph, powerOnGraph}; !reflect.DeepEqual(env.rackhd.started, want) {
+		t.Errorf("started %v, want %v", env.rackhd.started, want)
+	}
+	options, _ := json.Marshal(env.rackhd.options[obmSetupGraph])
+	if want := `{"defaults":{"password":"secret","user":"admin"}}`; string(options) != want {
+		t.Errorf("%s options %s, want %s", obmSetupGraph, options, want)
+	}
+
+	// the password stays out of the machine store
+	saved, _ := filepath.Glob(filepath.Join(d.storeDir(), "workflow-"+obmSetupGraph+"-*.json"))
+	if len(saved) != 1 {
+		t.Fatalf("saved %s documents %v", obmSetupGraph, saved)
+	}
+	doc, err := ioutil.ReadFile(saved[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := json.Marshal(d)
+	for name, b := range map[string][]byte{saved[0]: doc, "config": config} {
+		if bytes.Contains(b, []byte("secret")) {
+			t.Errorf("%s contains the BMC password: %s", name, b)
+		}
+	}
+}
+
+func TestBMCPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bmc-password")
+	if err := ioutil.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDriver(testMachine, "")
+	if err := d.SetConfigFromFlags(testFlags{"rackhd-node-id": testNodeID, "rackhd-bmc-user": "admin", "rackhd-bmc-password-file": path}); err != nil {
+		t.Fatalf("SetConfigFromFlags() = %v", err)
+	}
+	if d.BMCPassword != "secret" || d.BMCPasswordFile != path {
+		t.Errorf("BMC password %q from %q, want secret from %s", d.BMCPassword, d.BMCPasswordFile, path)
+	}
+	err := NewDriver(testMachine, "").SetConfigFromFlags(testFlags{"rackhd-bmc-password-stdin": true, "rackhd-bmc-password-file": path})
+	if err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("SetConfigFromFlags() with stdin and a file = %v", err)
+	}
+}
+
+func TestEventWaits(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	env.rackhd.addNode(testNodeID, nil, "127.0.0.1")
+	env.rackhd.graphStatus["Graph.InstallCentOS"] = "running"
+	d := env.driver
+	// as watchEvents sets up while a subscription runs
+	d.events = make(chan rackhdEvent, eventBuffer)
+
+	if got := d.pollInterval(workflowPollInterval); got != eventFallbackInterval {
+		t.Errorf("pollInterval() = %s with events, want %s", got, eventFallbackInterval)
+	}
+	instanceID, err := d.startWorkflow("Graph.InstallCentOS", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		// progress of the graph does not end the wait, its end does
+		d.events <- rackhdEvent{Type: "graph", Action: "progress", TypeID: instanceID}
+		env.rackhd.mu.Lock()
+		env.rackhd.graphs[instanceID]["_status"] = "succeeded"
+		env.rackhd.mu.Unlock()
+		d.events <- rackhdEvent{RoutingKey: "graph.finished.information." + instanceID + "." + testNodeID, Type: "graph", Action: "finished", TypeID: instanceID}
+	}()
+	start := time.Now()
+	if err := d.waitForWorkflow("Graph.InstallCentOS", instanceID, time.Hour); err != nil {
+		t.Fatalf("waitForWorkflow() = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > workflowPollInterval/2 {
+		t.Errorf("waitForWorkflow() took %s, want it ended by the event", elapsed)
+	}
+
+	if nodeChanged(rackhdEvent{Type: "graph", Action: "finished"}) || !nodeChanged(rackhdEvent{Type: "node", Action: "discovered"}) {
+		t.Error("nodeChanged() should wake network waits for node events only")
+	}
+}
+
+func TestPowerVerifiesIdentity(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	d := env.created()
+	d.NodeSerial, d.NodeUUID = "ABC1234", "4c4c4544-0031"
+	env.rackhd.catalogs[testNodeID] = map[string]interface{}{
+		"dmi": map[string]interface{}{"System Information": map[string]interface{}{"Serial Number": "XYZ9876", "UUID": "4c4c4544-0099"}},
+	}
+
+	for name, power := range map[string]func() error{"Start": d.Start, "Stop": d.Stop, "Restart": d.Restart, "Kill": d.Kill} {
+		if err := power(); ErrorClass(err) != ErrIdentityMismatch {
+			t.Errorf("%s() on re-discovered hardware = %v, want %v", name, err, ErrIdentityMismatch)
+		}
+	}
+
+	env.rackhd.catalogs[testNodeID]["dmi"] = map[string]interface{}{"System Information": map[string]interface{}{"Serial Number": "ABC1234", "UUID": "4C4C4544-0031"}}
+	if err := d.Restart(); err != nil {
+		t.Errorf("Restart() = %v", err)
+	}
+}
+
+func TestVerifyEngine(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+	d := env.created()
+	d.RestrictedBootstrap = true
+
+	// docker-machine reads the URL before the engine listens on the port
+	url, err := d.GetURL()
+	if want := "tcp://127.0.0.1:2376"; err != nil || url != want {
+		t.Fatalf("GetURL() = %q, %v, want %q", url, err, want)
+	}
+	if d.EngineVerified {
+		t.Errorf("GetURL() verified the engine")
+	}
+
+	err = d.Start()
+	if err == nil || !strings.Contains(err.Error(), "The Docker API of test is not reachable on 127.0.0.1:2376") {
+		t.Errorf("Start() without an engine = %v", err)
+	}
+	if d.EngineVerified {
+		t.Errorf("Start() without an engine verified it")
+	}
+}
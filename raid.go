@@ -0,0 +1,225 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRAIDWorkflow = "Graph.Raid.Create.MegaRAID"
+	raidWorkflowTimeout = 30 * time.Minute
+
+	raidDrivesCatalog       = "megaraid-physical-drives"
+	raidVirtualDisksCatalog = "megaraid-virtual-disks"
+)
+
+// raidConfig is the declarative layout of --rackhd-raid-config: virtual
+// disks built from the controller's drives in slot order, and optionally the
+// drives left over exposed as JBOD.
+type raidConfig struct {
+	VirtualDisks []raidVirtualDisk `json:"virtualDisks"`
+	JBODRest     bool              `json:"jbodRest"`
+}
+
+type raidVirtualDisk struct {
+	Name   string `json:"name"`
+	Level  string `json:"level"`
+	Drives int    `json:"drives"`
+}
+
+// raidMinDrives is the number of drives each supported level needs.
+var raidMinDrives = map[string]int{"raid0": 1, "raid1": 2, "raid5": 3, "raid6": 4, "raid10": 4}
+
+// readRAIDConfig reads and checks --rackhd-raid-config, e.g.
+// {"virtualDisks": [{"name": "os", "level": "raid1", "drives": 2}], "jbodRest": true}
+// for a mirrored OS disk on the first two drives and the rest as JBOD.
+func readRAIDConfig(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read --rackhd-raid-config %s. Error: %s", path, err)
+	}
+	var config raidConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return "", fmt.Errorf("--rackhd-raid-config %s is not valid JSON. Error: %s", path, err)
+	}
+	if len(config.VirtualDisks) == 0 {
+		return "", fmt.Errorf("--rackhd-raid-config %s declares no virtual disks", path)
+	}
+	for i, vd := range config.VirtualDisks {
+		config.VirtualDisks[i].Level = strings.ToLower(vd.Level)
+		min, ok := raidMinDrives[config.VirtualDisks[i].Level]
+		if !ok {
+			return "", fmt.Errorf("Unsupported RAID level %q in --rackhd-raid-config. Specify raid0, raid1, raid5, raid6 or raid10", vd.Level)
+		}
+		if vd.Name == "" || vd.Drives < min {
+			return "", fmt.Errorf("Virtual disk %q in --rackhd-raid-config needs a name and at least %d drives for %s", vd.Name, min, vd.Level)
+		}
+	}
+	compact, err := json.Marshal(config)
+	return string(compact), err
+}
+
+// raidDrive is a physical drive behind the controller.
+type raidDrive struct {
+	Enclosure int
+	Slot      int
+}
+
+// storcliResponse is the storcli JSON output RackHD stores in its megaraid
+// catalogs.
+type storcliResponse struct {
+	Controllers []struct {
+		ResponseData struct {
+			Drives []struct {
+				EIDSlot string `json:"EID:Slt"`
+			} `json:"Drive Information"`
+			VirtualDrives []struct {
+				Name string `json:"Name"`
+				Type string `json:"TYPE"`
+			} `json:"Virtual Drives"`
+		} `json:"Response Data"`
+	} `json:"Controllers"`
+}
+
+// raidDrives lists the drives of the first controller in slot order.
+func (d *Driver) raidDrives() ([]raidDrive, error) {
+	var catalog storcliResponse
+	if err := d.getCatalog(raidDrivesCatalog, &catalog); err != nil {
+		return nil, err
+	}
+	if len(catalog.Controllers) == 0 {
+		return nil, fmt.Errorf("The %s catalog of node %s lists no controller", raidDrivesCatalog, d.NodeID)
+	}
+	var drives []raidDrive
+	for _, drive := range catalog.Controllers[0].ResponseData.Drives {
+		parts := strings.SplitN(drive.EIDSlot, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		enclosure, err1 := strconv.Atoi(parts[0])
+		slot, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		drives = append(drives, raidDrive{Enclosure: enclosure, Slot: slot})
+	}
+	sort.Slice(drives, func(i, j int) bool {
+		if drives[i].Enclosure != drives[j].Enclosure {
+			return drives[i].Enclosure < drives[j].Enclosure
+		}
+		return drives[i].Slot < drives[j].Slot
+	})
+	return drives, nil
+}
+
+// raidOptions assigns the drives to the declared virtual disks and builds
+// the options of the RAID graph: raidList as the MegaRAID graph takes it, and
+// jbodList with the leftover drives when jbodRest is set.
+func (d *Driver) raidOptions(config *raidConfig, drives []raidDrive) (interface{}, error) {
+	var raidList []map[string]interface{}
+	next := 0
+	for _, vd := range config.VirtualDisks {
+		if next+vd.Drives > len(drives) {
+			return nil, fmt.Errorf("Node %s has %d drives, too few for the virtual disks of --rackhd-raid-config", d.NodeID, len(drives))
+		}
+		assigned := drives[next : next+vd.Drives]
+		next += vd.Drives
+		slots := make([]int, 0, len(assigned))
+		for _, drive := range assigned {
+			if drive.Enclosure != assigned[0].Enclosure {
+				return nil, fmt.Errorf("Virtual disk %s of --rackhd-raid-config would span enclosures %d and %d", vd.Name, assigned[0].Enclosure, drive.Enclosure)
+			}
+			slots = append(slots, drive.Slot)
+		}
+		raidList = append(raidList, map[string]interface{}{
+			"enclosure": assigned[0].Enclosure,
+			"type":      vd.Level,
+			"drives":    slots,
+			"name":      vd.Name,
+		})
+	}
+	createRAID := map[string]interface{}{"createDefault": false, "raidList": raidList}
+	if config.JBODRest && next < len(drives) {
+		var jbod []map[string]interface{}
+		for _, drive := range drives[next:] {
+			jbod = append(jbod, map[string]interface{}{"enclosure": drive.Enclosure, "drive": drive.Slot})
+		}
+		createRAID["jbodList"] = jbod
+	}
+	return map[string]interface{}{"create-raid": createRAID}, nil
+}
+
+func (d *Driver) raidWorkflow() string {
+	if d.RAIDWorkflow == "" {
+		return defaultRAIDWorkflow
+	}
+	return d.RAIDWorkflow
+}
+
+// raidPlan decodes --rackhd-raid-config and lays it out on the node's drives.
+func (d *Driver) raidPlan() (*raidConfig, interface{}, error) {
+	config := &raidConfig{}
+	if err := json.Unmarshal([]byte(d.RAIDConfig), config); err != nil {
+		return nil, nil, err
+	}
+	drives, err := d.raidDrives()
+	if err != nil {
+		return nil, nil, err
+	}
+	options, err := d.raidOptions(config, drives)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, options, nil
+}
+
+// configureRAID lays out the node's drives as --rackhd-raid-config declares
+// before the OS is installed on them, then checks the virtual disks in the
+// catalog the RAID graph refreshed.
+func (d *Driver) configureRAID() error {
+	if d.RAIDConfig == "" {
+		return errPhaseSkipped
+	}
+	config, options, err := d.raidPlan()
+	if err != nil {
+		return err
+	}
+	log.Infof("Configuring RAID on node %s with %s", d.NodeID, d.raidWorkflow())
+	if _, err := d.runWorkflow(d.raidWorkflow(), options, raidWorkflowTimeout); err != nil {
+		return err
+	}
+	return d.verifyRAID(config)
+}
+
+// verifyRAID checks that every declared virtual disk exists with its level.
+func (d *Driver) verifyRAID(config *raidConfig) error {
+	var catalog storcliResponse
+	if err := d.getCatalog(raidVirtualDisksCatalog, &catalog); err != nil {
+		return fmt.Errorf("Unable to verify the RAID configuration of node %s. Error: %w", d.NodeID, err)
+	}
+	levels := make(map[string]string)
+	for _, controller := range catalog.Controllers {
+		for _, vd := range controller.ResponseData.VirtualDrives {
+			levels[vd.Name] = strings.ToLower(vd.Type)
+		}
+	}
+	var wrong []string
+	for _, vd := range config.VirtualDisks {
+		switch level, ok := levels[vd.Name]; {
+		case !ok:
+			wrong = append(wrong, fmt.Sprintf("%s is missing", vd.Name))
+		case level != vd.Level:
+			wrong = append(wrong, fmt.Sprintf("%s is %s, not %s", vd.Name, level, vd.Level))
+		}
+	}
+	if len(wrong) > 0 {
+		return fmt.Errorf("The RAID configuration of node %s does not match --rackhd-raid-config after %s: %s", d.NodeID, d.raidWorkflow(), strings.Join(wrong, "; "))
+	}
+	log.Infof("Node %s has the %d virtual disk(s) of --rackhd-raid-config", d.NodeID, len(config.VirtualDisks))
+	return nil
+}
@@ -0,0 +1,90 @@
+package rackhd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Rebinder is implemented by drivers that can point a machine at its
+// hardware again after the hardware was re-discovered under a new node ID.
+type Rebinder interface {
+	Rebind() error
+}
+
+var _ Rebinder = (*Driver)(nil)
+
+// Rebind finds the node that now holds the machine's hardware, matching the
+// MAC addresses and then the serial number and UUID recorded at create, and
+// updates the machine's node ID to it.
+func (d *Driver) Rebind() error {
+	if d.NodeSerial == "" && d.NodeUUID == "" {
+		return fmt.Errorf("No serial number or UUID was recorded for %s at create time, so its node cannot be found again", d.MachineName)
+	}
+	// nodes sharing a MAC address with the machine are checked first, the
+	// rest only if none of those matches
+	var likely, others []string
+	err := d.eachNode(url.Values{"type": {"compute"}}, func(node *nodeInfo) error {
+		if node.ID == d.NodeID || node.Type != "compute" {
+			return nil
+		}
+		if sharesMAC(node.Identifiers, d.NodeMACs) {
+			likely = append(likely, node.ID)
+		} else {
+			others = append(others, node.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	oldID := d.NodeID
+	for _, id := range append(likely, others...) {
+		d.NodeID = id
+		if d.sameHardware() {
+			log.Infof("Machine %s moved from node %s to node %s", d.MachineName, oldID, id)
+			d.setNodeCheck(nil)
+			if err := d.tagNode(); err != nil {
+				log.Warnf("Unable to tag node %s: %s", d.NodeID, err)
+			}
+			return nil
+		}
+	}
+	d.NodeID = oldID
+	return classError(ErrNodeNotFound, "No node on %s has the serial number %q and UUID %q of machine %s", d.Endpoint, d.NodeSerial, d.NodeUUID, d.MachineName)
+}
+
+// rebindIfEnabled runs Rebind when --rackhd-auto-rebind is set, logging
+// failures, and reports whether the machine was rebound.
+func (d *Driver) rebindIfEnabled() bool {
+	if !d.AutoRebind {
+		return false
+	}
+	if err := d.Rebind(); err != nil {
+		log.Warnf("Unable to rebind %s: %s", d.MachineName, err)
+		return false
+	}
+	return true
+}
+
+// sameHardware reports whether d.NodeID has the recorded serial number and UUID.
+func (d *Driver) sameHardware() bool {
+	info, err := d.systemInfo()
+	if err != nil {
+		log.Debugf("Not matching node %s: %s", d.NodeID, err)
+		return false
+	}
+	return strings.EqualFold(info.SerialNumber, d.NodeSerial) && strings.EqualFold(info.UUID, d.NodeUUID)
+}
+
+func sharesMAC(identifiers, macs []string) bool {
+	for _, mac := range macs {
+		for _, id := range identifiers {
+			if strings.EqualFold(id, mac) {
+				return true
+			}
+		}
+	}
+	return false
+}
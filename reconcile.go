@@ -0,0 +1,196 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers"
+)
+
+// ReconcileOptions select what Reconcile looks at and whether it fixes what
+// it finds.
+type ReconcileOptions struct {
+	// StorePath is the docker-machine store, e.g. ~/.docker/machine.
+	StorePath string
+	// Owner limits the unclaimed node check to nodes tagged with this owner.
+	Owner string
+	// Project limits the unclaimed node check to nodes tagged with this
+	// project.
+	Project string
+	// Fix rebinds machines whose node vanished, where their recorded identity
+	// allows it, and removes the machine tags from unclaimed nodes. Only fix
+	// unclaimed nodes when StorePath is the only store using the endpoints.
+	Fix bool
+}
+
+// Orphan is a machine without a node, or a node claimed by no machine.
+type Orphan struct {
+	Endpoint string
+	Machine  string
+	NodeID   string
+	Problem  string
+	Fixed    bool
+}
+
+// Reconcile compares the RackHD machines in a docker-machine store with the
+// nodes on their endpoints. It reports machines whose node no longer exists
+// and nodes tagged as used by a machine that is not in the store.
+func Reconcile(opts ReconcileOptions) ([]Orphan, error) {
+	machines, err := storeMachines(opts.StorePath)
+	if err != nil {
+		return nil, err
+	}
+	byEndpoint := make(map[string][]*Driver)
+	for _, d := range machines {
+		byEndpoint[d.Endpoint] = append(byEndpoint[d.Endpoint], d)
+	}
+	endpoints := make([]string, 0, len(byEndpoint))
+	for endpoint := range byEndpoint {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	var orphans []Orphan
+	for _, endpoint := range endpoints {
+		found, err := reconcileEndpoint(byEndpoint[endpoint], opts)
+		if err != nil {
+			return orphans, err
+		}
+		orphans = append(orphans, found...)
+	}
+	return orphans, nil
+}
+
+func reconcileEndpoint(machines []*Driver, opts ReconcileOptions) ([]Orphan, error) {
+	endpoint := machines[0].Endpoint
+	// only the IDs of all nodes are kept, and the nodes with machine tags
+	existing := make(map[string]bool)
+	var tagged []*nodeInfo
+	err := machines[0].eachNode(nil, func(node *nodeInfo) error {
+		existing[node.ID] = true
+		for _, tag := range node.Tags {
+			if strings.HasPrefix(tag, machineTagPrefix) {
+				tagged = append(tagged, node)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	names := make(map[string]bool)
+	for _, d := range machines {
+		names[d.MachineName] = true
+		if existing[d.NodeID] {
+			continue
+		}
+		orphan := Orphan{Endpoint: endpoint, Machine: d.MachineName, NodeID: d.NodeID, Problem: "node no longer exists"}
+		if opts.Fix {
+			if err := d.Rebind(); err != nil {
+				log.Debugf("Unable to rebind %s: %s", d.MachineName, err)
+			} else if err := saveStoreMachine(opts.StorePath, d); err != nil {
+				log.Warnf("Machine %s moved to node %s but its config could not be saved: %s", d.MachineName, d.NodeID, err)
+			} else {
+				orphan.Fixed = true
+				orphan.Problem += fmt.Sprintf("; machine now uses node %s", d.NodeID)
+			}
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	for _, node := range tagged {
+		for _, tag := range node.Tags {
+			if !strings.HasPrefix(tag, machineTagPrefix) || names[strings.TrimPrefix(tag, machineTagPrefix)] {
+				continue
+			}
+			if opts.Owner != "" && !containsString(node.Tags, ownerTagPrefix+opts.Owner) {
+				continue
+			}
+			if opts.Project != "" && !containsString(node.Tags, projectTagPrefix+opts.Project) {
+				continue
+			}
+			orphan := Orphan{Endpoint: endpoint, Machine: strings.TrimPrefix(tag, machineTagPrefix), NodeID: node.ID, Problem: "node is tagged for a machine that does not exist"}
+			if opts.Fix {
+				d := &Driver{Config: Config{Endpoint: endpoint, Transport: machines[0].Transport, NodeID: node.ID},
+					BaseDriver: &drivers.BaseDriver{MachineName: orphan.Machine}}
+				if err := d.setNodeTags(withoutMachineTags(node.Tags, orphan.Machine)); err != nil {
+					log.Warnf("Unable to untag node %s: %s", node.ID, err)
+				} else {
+					orphan.Fixed = true
+				}
+			}
+			orphans = append(orphans, orphan)
+		}
+	}
+	return orphans, nil
+}
+
+// withoutMachineTags drops the tags a machine's create added to a node.
+func withoutMachineTags(tags []string, machine string) []string {
+	kept := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag == machineTagPrefix+machine || tag == reclaimTag ||
+			strings.HasPrefix(tag, ownerTagPrefix) || strings.HasPrefix(tag, projectTagPrefix) || strings.HasPrefix(tag, groupTagPrefix) {
+			continue
+		}
+		kept = append(kept, tag)
+	}
+	return kept
+}
+
+// saveStoreMachine writes the driver configuration of d back into its
+// machine config, leaving the rest of the file as docker-machine wrote it.
+func saveStoreMachine(storePath string, d *Driver) error {
+	path := filepath.Join(storePath, "machines", d.MachineName, "config.json")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var host map[string]json.RawMessage
+	if err := json.Unmarshal(b, &host); err != nil {
+		return err
+	}
+	if host["Driver"], err = json.Marshal(d); err != nil {
+		return err
+	}
+	if b, err = json.MarshalIndent(host, "", "    "); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// storeMachines loads the driver configuration of every RackHD machine in a
+// docker-machine store.
+func storeMachines(storePath string) ([]*Driver, error) {
+	paths, err := filepath.Glob(filepath.Join(storePath, "machines", "*", "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	var machines []*Driver
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var host struct {
+			DriverName string
+			Driver     *Driver
+		}
+		if err := json.Unmarshal(b, &host); err != nil {
+			log.Warnf("Skipping unreadable machine config %s: %s", path, err)
+			continue
+		}
+		if host.DriverName != "rackhd" || host.Driver == nil {
+			continue
+		}
+		machines = append(machines, host.Driver)
+	}
+	return machines, nil
+}
@@ -0,0 +1,111 @@
+package rackhd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Hardware policies --rackhd-hardware-policy accepts.
+const (
+	policyDualPSU      = "dual-psu"
+	policyMaxECCErrors = "max-ecc-errors"
+)
+
+// hardwarePolicy is a parsed --rackhd-hardware-policy entry.
+type hardwarePolicy struct {
+	name  string
+	limit int
+}
+
+// parseHardwarePolicy parses dual-psu or max-ecc-errors=<n>.
+func parseHardwarePolicy(value string) (*hardwarePolicy, error) {
+	switch {
+	case value == policyDualPSU:
+		return &hardwarePolicy{name: policyDualPSU}, nil
+	case strings.HasPrefix(value, policyMaxECCErrors+"="):
+		n, err := strconv.Atoi(strings.TrimPrefix(value, policyMaxECCErrors+"="))
+		if err == nil && n >= 0 {
+			return &hardwarePolicy{name: policyMaxECCErrors, limit: n}, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid --rackhd-hardware-policy %q. Specify %s or %s=<n>", value, policyDualPSU, policyMaxECCErrors)
+}
+
+// powerSupplies counts the power supplies the dmi catalog lists as present.
+func (d *Driver) powerSupplies() (int, error) {
+	var dmi struct {
+		PSUs dmiList `json:"System Power Supply"`
+	}
+	if err := d.getCatalog("dmi", &dmi); err != nil {
+		return 0, err
+	}
+	present := 0
+	for _, psu := range dmi.PSUs {
+		// e.g. "Present, OK"; slots without a supply are "Not Present"
+		if strings.HasPrefix(psu["Status"], "Present") {
+			present++
+		}
+	}
+	return present, nil
+}
+
+// selEntry is one record of the sel poller's current data.
+type selEntry struct {
+	ID         string `json:"logId,omitempty"`
+	Date       string `json:"date,omitempty"`
+	Time       string `json:"time,omitempty"`
+	SensorType string `json:"sensorType"`
+	Sensor     string `json:"sensorNumber,omitempty"`
+	Event      string `json:"event"`
+	Value      string `json:"value,omitempty"`
+}
+
+// eccErrors counts the ECC memory events in the node's SEL.
+func (d *Driver) eccErrors() (int, error) {
+	entries, err := d.systemEventLog()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, entry := range entries {
+		if strings.EqualFold(entry.SensorType, "Memory") && strings.Contains(strings.ToUpper(entry.Event), "ECC") {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// checkRedundancy refuses a node that violates a --rackhd-hardware-policy
+// during selection, listing every policy it violates.
+func (d *Driver) checkRedundancy() error {
+	var violations []string
+	for _, value := range d.HardwarePolicies {
+		policy, err := parseHardwarePolicy(value)
+		if err != nil {
+			return err
+		}
+		switch policy.name {
+		case policyDualPSU:
+			n, err := d.powerSupplies()
+			if err != nil {
+				return err
+			}
+			if n < 2 {
+				violations = append(violations, fmt.Sprintf("%s: %d of 2 power supplies present", policyDualPSU, n))
+			}
+		case policyMaxECCErrors:
+			n, err := d.eccErrors()
+			if err != nil {
+				return err
+			}
+			if n > policy.limit {
+				violations = append(violations, fmt.Sprintf("%s: %d ECC events in the SEL, at most %d allowed", policyMaxECCErrors, n, policy.limit))
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("Node %s violates the hardware policies: %s", d.NodeID, strings.Join(violations, "; "))
+	}
+	return nil
+}
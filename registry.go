@@ -0,0 +1,44 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// siteConfig is the --rackhd-site-config document: settings shared by every
+// machine of a site, so air-gapped sites can keep them in one file.
+type siteConfig struct {
+	RegistryMirrors    []string `json:"registryMirrors"`
+	InsecureRegistries []string `json:"insecureRegistries"`
+}
+
+// applySiteConfig fills the registry settings not given on the command line
+// from the site config file.
+func (d *Driver) applySiteConfig(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read --rackhd-site-config %s. Error: %s", path, err)
+	}
+	var site siteConfig
+	if err := json.Unmarshal(b, &site); err != nil {
+		return fmt.Errorf("--rackhd-site-config %s is not valid JSON. Error: %s", path, err)
+	}
+	if len(d.RegistryMirrors) == 0 {
+		d.RegistryMirrors = site.RegistryMirrors
+	}
+	if len(d.InsecureRegistries) == 0 {
+		d.InsecureRegistries = site.InsecureRegistries
+	}
+	return nil
+}
+
+// registryConfig adds the registry settings to the engine's daemon.json.
+func (d *Driver) registryConfig(config map[string]interface{}) {
+	if len(d.RegistryMirrors) > 0 {
+		config["registry-mirrors"] = d.RegistryMirrors
+	}
+	if len(d.InsecureRegistries) > 0 {
+		config["insecure-registries"] = d.InsecureRegistries
+	}
+}
@@ -0,0 +1,80 @@
+package rackhd
+
+import (
+	"fmt"
+)
+
+// Remove strategies, chosen at create time with --rackhd-remove-strategy.
+const (
+	removeNone       = "none"
+	removePowerOff   = "poweroff"
+	removeWipe       = "wipe"
+	removeRediscover = "rediscover"
+
+	defaultWipeWorkflow = "Graph.Bootstrap.Decommission.Node"
+	rediscoverGraph     = "Graph.Refresh.Immediate.Discovery"
+)
+
+func validRemoveStrategy(strategy string) bool {
+	switch strategy {
+	case removeNone, removePowerOff, removeWipe, removeRediscover:
+		return true
+	}
+	return false
+}
+
+// removeMachineKey deletes the machine key from the node's authorized_keys.
+// The node may already be gone or reinstalled, so this is best effort.
+func (d *Driver) removeMachineKey() {
+	if d.IPAddress == "" || d.SSHKey == "" || d.BootstrapMethod == bootstrapWinRM {
+		return
+	}
+	if err := executeSSHKeyCommand(d.keyRemoveCommand(), d); err != nil {
+		log.Warnf("Unable to remove the machine key from %s: %s", d.IPAddress, err)
+	}
+}
+
+func (d *Driver) keyRemoveCommand() string {
+	authorizedKeys := fmt.Sprintf("~%s/.ssh/authorized_keys", d.SSHUser)
+	return fmt.Sprintf("grep -vxF %s %s > %s.rackhd; cat %s.rackhd > %s; rm -f %s.rackhd",
+		shellQuote(d.SSHKey), authorizedKeys, authorizedKeys, authorizedKeys, authorizedKeys, authorizedKeys)
+}
+
+// teardown cancels whatever RackHD is doing to the node and applies the
+// machine's remove strategy.
+func (d *Driver) teardown() error {
+	if d.RemoveStrategy == "" || d.RemoveStrategy == removeNone {
+		log.Infof("Leaving node %s as it is (remove strategy %s)", d.NodeID, removeNone)
+		return nil
+	}
+	// the node will not be left as the checkpoint describes it
+	d.clearCheckpoint()
+
+	if err := d.cancelActiveWorkflow(); err != nil {
+		return err
+	}
+
+	switch d.RemoveStrategy {
+	case removePowerOff:
+		log.Infof("Powering off node %s", d.NodeID)
+		_, err := d.runWorkflow(powerOffGraph, nil, powerWorkflowTimeout)
+		return err
+	case removeWipe:
+		// wiping disks takes far longer than docker-machine rm should block for
+		log.Infof("Starting %s on node %s", d.wipeWorkflow(), d.NodeID)
+		_, err := d.startWorkflow(d.wipeWorkflow(), nil)
+		return err
+	case removeRediscover:
+		log.Infof("Starting %s on node %s", rediscoverGraph, d.NodeID)
+		_, err := d.startWorkflow(rediscoverGraph, nil)
+		return err
+	}
+	return fmt.Errorf("Unsupported remove strategy %q", d.RemoveStrategy)
+}
+
+func (d *Driver) wipeWorkflow() string {
+	if d.WipeWorkflow == "" {
+		return defaultWipeWorkflow
+	}
+	return d.WipeWorkflow
+}
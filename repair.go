@@ -0,0 +1,76 @@
+package rackhd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Repairer is implemented by drivers that can restore access to a machine
+// without recreating it.
+type Repairer interface {
+	Repair() error
+}
+
+var _ Repairer = (*Driver)(nil)
+
+// Repair re-runs the key bootstrap against the node with the stored password,
+// for machines whose key authentication broke, e.g. after authorized_keys was
+// overwritten. The existing machine key is reinstalled; a new one is only
+// generated if the key files are missing from the store.
+func (d *Driver) Repair() error {
+	if d.DisablePasswordAuth && d.BootstrapMethod != bootstrapWinRM {
+		return fmt.Errorf("Password authentication was disabled on %s at create time, so the machine key cannot be reinstalled over SSH", d.MachineName)
+	}
+	if d.SSHPassword == "" {
+		return fmt.Errorf("No password is stored for %s; the machine key cannot be reinstalled", d.MachineName)
+	}
+	if d.IPAddress == "" {
+		return fmt.Errorf("IP address is not set")
+	}
+	unlock, err := d.lockNode("repair")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := d.checkNodeExists(); err != nil {
+		return err
+	}
+	if err := d.verifyIdentity(); err != nil {
+		return err
+	}
+
+	key, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if os.IsNotExist(err) {
+		log.Infof("Machine key of %s is missing, creating a new one", d.MachineName)
+		var created string
+		created, err = d.createSSHKey()
+		key = []byte(created)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read the machine key of %s. Error: %s", d.MachineName, err)
+	}
+	d.SSHKey = strings.TrimSpace(string(key))
+
+	log.Infof("Reinstalling public SSH key on %s [%s]", d.MachineName, d.IPAddress)
+	if err := d.installMachineKey(); err != nil {
+		return err
+	}
+	return d.verifyKeyAuth()
+}
+
+// repairIfNeeded runs Repair when --rackhd-auto-repair is set and key
+// authentication to the node fails. It runs at most once per process.
+func (d *Driver) repairIfNeeded() {
+	if !d.AutoRepair || d.IPAddress == "" || !d.firstTime(&d.repairChecked) {
+		return
+	}
+	if err := executeSSHKeyCommand("exit 0", d); err == nil || ErrorClass(err) != ErrAuth {
+		return
+	}
+	log.Warnf("Key authentication to %s [%s] failed, repairing", d.MachineName, d.IPAddress)
+	if err := d.Repair(); err != nil {
+		log.Warnf("Unable to repair %s: %s", d.MachineName, err)
+	}
+}
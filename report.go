@@ -0,0 +1,62 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// createReport is written to --rackhd-report-file after a successful create.
+type createReport struct {
+	Machine   string             `json:"machine"`
+	NodeID    string             `json:"nodeId"`
+	Serial    string             `json:"serial,omitempty"`
+	SKU       string             `json:"sku,omitempty"`
+	IPAddress string             `json:"ipAddress"`
+	Workflows []workflowRun      `json:"workflows,omitempty"`
+	Durations map[string]float64 `json:"durationsSeconds"`
+	Completed time.Time          `json:"completed"`
+}
+
+// workflowRun records a graph the driver ran for the machine.
+type workflowRun struct {
+	Name       string `json:"name"`
+	InstanceID string `json:"instanceId"`
+}
+
+// writeReport writes the create report. The machine already exists at this
+// point, so a report that cannot be written is only a warning.
+func (d *Driver) writeReport() {
+	if d.ReportFile == "" {
+		return
+	}
+	report := createReport{
+		Machine:   d.MachineName,
+		NodeID:    d.NodeID,
+		IPAddress: d.IPAddress,
+		Workflows: d.workflowRuns,
+		Durations: make(map[string]float64),
+		Completed: time.Now().UTC(),
+	}
+	if node, err := d.getNode(); err == nil {
+		report.SKU = node.SKU
+	}
+	if system, err := d.systemInfo(); err == nil {
+		report.Serial = system.SerialNumber
+	}
+
+	t := d.timings()
+	t.mu.Lock()
+	for _, phase := range t.phases {
+		report.Durations[phase] = t.phaseTimes[phase].Seconds()
+	}
+	t.mu.Unlock()
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(d.ReportFile, b, 0644)
+	}
+	if err != nil {
+		log.Warnf("Unable to write create report %s: %s", d.ReportFile, err)
+	}
+}
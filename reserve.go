@@ -0,0 +1,67 @@
+package rackhd
+
+import (
+	"fmt"
+	"time"
+)
+
+// reservedByOther reports whether the node carries the reserved marker of a
+// RackHD version supporting one, set by another consumer of the pool such as
+// a bare-metal Kubernetes provisioner. A node this machine reserved, or holds
+// the claim or machine tag of, is not reserved by another.
+func (d *Driver) reservedByOther(node *nodeInfo) bool {
+	if node.Reserved == nil || !*node.Reserved {
+		return false
+	}
+	if containsString(node.Tags, machineTagPrefix+d.MachineName) {
+		return false
+	}
+	machine, claimed := liveClaim(node.Tags, time.Now())
+	return !claimed || machine != d.MachineName
+}
+
+// checkReserved refuses a node another consumer reserved.
+func (d *Driver) checkReserved() error {
+	node, err := d.getNode()
+	if err != nil {
+		return err
+	}
+	if d.reservedByOther(node) {
+		return fmt.Errorf("Node %s is reserved in RackHD by another consumer", d.NodeID)
+	}
+	return nil
+}
+
+// setReserved sets the reserved marker of the node, where the RackHD version
+// has one; on others nodes carry no reserved field and nothing is done.
+func (d *Driver) setReserved(reserved bool) error {
+	d.nodeMu.Lock()
+	defer d.nodeMu.Unlock()
+	node, err := d.getNode()
+	if err != nil {
+		return err
+	}
+	if node.Reserved == nil {
+		return nil
+	}
+	if *node.Reserved != reserved {
+		if err := d.getClient().SetNodeReserved(d.context(), d.NodeID, reserved); err != nil {
+			return fmt.Errorf("Unable to update the reserved field of node %s. Error: %s", d.NodeID, apiError(err))
+		}
+		listings.invalidate(d.Endpoint)
+		log.Debugf("Set node %s reserved to %v", d.NodeID, reserved)
+	}
+	d.Reserved = reserved
+	return nil
+}
+
+// unreserveNode clears the reserved marker the machine set, after a failed
+// create or when the machine is removed.
+func (d *Driver) unreserveNode() {
+	if !d.Reserved {
+		return
+	}
+	if err := d.setReserved(false); err != nil {
+		log.Warnf("%s; clear it in RackHD to return the node to the pool", err)
+	}
+}
@@ -0,0 +1,62 @@
+package rackhd
+
+import "fmt"
+
+// restrictedCommands are the only remote commands run with
+// --rackhd-restricted-bootstrap: those installing the machine key, the
+// empty session checking that the bootstrap credentials and the machine key
+// work, and the one removing the key when the machine is removed.
+func (d *Driver) restrictedCommands() []string {
+	commands := append(d.keyInstallCommands(), "exit 0")
+	if d.SSHKey != "" {
+		commands = append(commands, d.keyRemoveCommand())
+	}
+	return commands
+}
+
+// checkRestricted refuses a command that is not one of restrictedCommands.
+func (d *Driver) checkRestricted(command string) error {
+	if containsString(d.restrictedCommands(), command) {
+		return nil
+	}
+	sshLog.Warnf("Refusing to run on %s: %s", d.IPAddress, command)
+	return fmt.Errorf("Remote command %q is not one of the key install commands allowed by --rackhd-restricted-bootstrap", command)
+}
+
+// restrictedConflicts returns the options that run remote commands of their
+// own, which --rackhd-restricted-bootstrap cannot be combined with.
+func (c *Config) restrictedConflicts() []string {
+	options := []struct {
+		set  bool
+		flag string
+	}{
+		{c.BootstrapMethod == bootstrapWinRM, "--rackhd-bootstrap-method=winrm"},
+		{c.DisablePasswordAuth, "--rackhd-disable-password-auth"},
+		{c.NopasswdSudo, "--rackhd-nopasswd-sudo"},
+		{c.SSHCAKey != "", "--rackhd-ssh-ca-key"},
+		{c.SSHCAPublicKey != "", "--rackhd-ssh-ca-public-key"},
+		{c.NetworkConfig != "", "--rackhd-network-config"},
+		{c.HardwareLabels, "--rackhd-hardware-labels"},
+		{c.DockerDataDisk != "", "--rackhd-docker-data-disk"},
+		{c.GPULabels, "--rackhd-gpu-labels"},
+		{c.GPURuntime, "--rackhd-gpu-runtime"},
+		{c.ConfigureFirewall, "--rackhd-configure-firewall"},
+		{c.HTTPProxy != "" || c.HTTPSProxy != "" || c.NoProxy != "", "--rackhd-http-proxy, --rackhd-https-proxy or --rackhd-no-proxy"},
+		{len(c.RegistryMirrors) > 0, "--rackhd-registry-mirror"},
+		{len(c.InsecureRegistries) > 0, "--rackhd-insecure-registry"},
+		{len(c.Sysctls) > 0, "--rackhd-sysctl"},
+		{c.KernelArgs != "", "--rackhd-kernel-args"},
+		{c.Hugepages != "", "--rackhd-hugepages"},
+		{c.NUMABalancing != "", "--rackhd-numa-balancing"},
+		{c.PostInstallScript != "", "--rackhd-post-install-script"},
+		{c.PreUpgradeScript != "", "--rackhd-pre-upgrade-script"},
+		{c.PostUpgradeScript != "", "--rackhd-post-upgrade-script"},
+	}
+	var conflicts []string
+	for _, option := range options {
+		if option.set {
+			conflicts = append(conflicts, option.flag)
+		}
+	}
+	return conflicts
+}
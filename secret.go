@@ -0,0 +1,50 @@
+package rackhd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// readSecret reads a credential piped in on stdin or, when nothing was piped,
+// prompts for it on the controlling terminal without echo. docker-machine does
+// not forward its own stdin to driver plugins, so the prompt is the usual path.
+func readSecret(prompt string) (string, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			return line, nil
+		}
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("Unable to read password from stdin. Error: %s", err)
+		}
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("No password was piped in and no terminal is available to prompt for one. Error: %s", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	secret, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read password from terminal. Error: %s", err)
+	}
+	return string(secret), nil
+}
+
+// readSecretFile returns the first line of a file holding a credential.
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read password file %s. Error: %s", path, err)
+	}
+	return strings.TrimRight(strings.SplitN(string(b), "\n", 2)[0], "\r"), nil
+}
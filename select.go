@@ -0,0 +1,176 @@
+package rackhd
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Selection strategies of --rackhd-select, which picks a free node instead
+// of --rackhd-node-id.
+const (
+	selectFirst  = "first"
+	selectRandom = "random"
+)
+
+// groupTagPrefix records the --rackhd-anti-affinity-group of a machine on
+// its node.
+const groupTagPrefix = "docker-machine-group:"
+
+func validSelectStrategy(strategy string) bool {
+	return strategy == selectFirst || strategy == selectRandom
+}
+
+// freeNode reports whether a node may be selected: it is not used or claimed
+// by a machine, not reserved by another consumer, not under maintenance,
+// carries the --rackhd-select-tag tags and belongs to no other owner.
+func (d *Driver) freeNode(node *nodeInfo) bool {
+	if node.Type != "compute" || inUse(node.Tags) || containsString(node.Tags, maintenanceTag) || d.reservedByOther(node) {
+		return false
+	}
+	for _, tag := range d.SelectTags {
+		if !containsString(node.Tags, tag) {
+			return false
+		}
+	}
+	for _, tag := range node.Tags {
+		if strings.HasPrefix(tag, ownerTagPrefix) && tag != ownerTagPrefix+d.Owner {
+			return false
+		}
+	}
+	return true
+}
+
+// selectCandidates returns the free nodes in the order of the selection
+// strategy and their priority, those in the failure domains least used by the
+// anti-affinity group first. The failure domains are returned by node ID, each
+// looked up once, when they decided the order.
+func (d *Driver) selectCandidates() ([]*nodeInfo, map[string]string, error) {
+	var pool *poolDefinition
+	if d.Pool != "" {
+		pools, err := d.readPools()
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range pools {
+			if pools[i].Name == d.Pool {
+				pool = &pools[i]
+			}
+		}
+		if pool == nil {
+			return nil, nil, fmt.Errorf("Pool %s is not defined in --rackhd-pools-file %s", d.Pool, d.PoolsFile)
+		}
+	}
+
+	var candidates, members []*nodeInfo
+	err := d.eachNode(url.Values{"type": {"compute"}}, func(node *nodeInfo) error {
+		if d.AntiAffinityGroup != "" && containsString(node.Tags, groupTagPrefix+d.AntiAffinityGroup) {
+			members = append(members, node)
+		}
+		if d.freeNode(node) && (pool == nil || pool.contains(node.Tags)) {
+			candidates = append(candidates, node)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.SelectStrategy == selectRandom {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		random.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	if candidates, err = d.prioritize(candidates); err != nil {
+		return nil, nil, err
+	}
+	if len(members) == 0 || len(candidates) < 2 {
+		return candidates, nil, nil
+	}
+
+	domains := make(map[string]string, len(members)+len(candidates))
+	for _, nodes := range [][]*nodeInfo{members, candidates} {
+		for _, node := range nodes {
+			if _, ok := domains[node.ID]; !ok {
+				domains[node.ID] = d.failureDomain(node)
+			}
+		}
+	}
+	used := make(map[string]int)
+	for _, member := range members {
+		used[domains[member.ID]]++
+	}
+	log.Debugf("Machines of anti-affinity group %s per failure domain: %v", d.AntiAffinityGroup, used)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return used[domains[candidates[i].ID]] < used[domains[candidates[j].ID]]
+	})
+	return candidates, domains, nil
+}
+
+// failureDomain returns the rack of a node from its rack tag, or else its
+// chassis from the dmi catalog, so blades of one enclosure share a domain.
+// A node with neither is a domain of its own.
+func (d *Driver) failureDomain(node *nodeInfo) string {
+	for _, tag := range node.Tags {
+		if strings.HasPrefix(tag, rackTagPrefix) {
+			return tag
+		}
+	}
+	var dmi struct {
+		Chassis struct {
+			SerialNumber string `json:"Serial Number"`
+		} `json:"Chassis Information"`
+	}
+	if err := d.getNodeCatalog(node.ID, "dmi", &dmi); err != nil || strings.TrimSpace(dmi.Chassis.SerialNumber) == "" {
+		return "node:" + node.ID
+	}
+	return "chassis:" + strings.TrimSpace(dmi.Chassis.SerialNumber)
+}
+
+// resolveSelection sets the node ID to the first candidate of --rackhd-select.
+// The create claims the node once it passes the selection checks and reads it
+// again to confirm the claim, so of creates racing for the same node one goes
+// on and the others fail there rather than sharing it.
+func (d *Driver) resolveSelection() error {
+	if d.SelectStrategy == "" || d.NodeID != "" {
+		return nil
+	}
+	candidates, domains, err := d.selectCandidates()
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return classError(ErrNodeNotFound, "No free compute node on %s matches the selection", d.Endpoint)
+	}
+	if d.PoolHealth {
+		if candidates, err = d.checkPoolHealth(candidates); err != nil {
+			return err
+		}
+	}
+	// a discovery or another consumer's install may be running on a node
+	// that is not tagged yet, so each is checked before it is taken, unless
+	// the pool health check cleared it of workflows already
+	for _, candidate := range candidates {
+		if !d.PoolHealth {
+			active, err := d.nodeActiveWorkflow(candidate.ID)
+			if err != nil {
+				return err
+			}
+			if active != nil {
+				log.Debugf("Not selecting node %s, which is running workflow %s (%s)", candidate.ID, active.Name, active.InstanceID)
+				continue
+			}
+		}
+		d.NodeID = candidate.ID
+		if domain, ok := domains[candidate.ID]; ok {
+			log.Infof("Selected node %s in %s for anti-affinity group %s", d.NodeID, domain, d.AntiAffinityGroup)
+		} else {
+			log.Infof("Selected node %s", d.NodeID)
+		}
+		return nil
+	}
+	return classError(ErrNodeNotFound, "All %d free compute node(s) on %s matching the selection are running workflows", len(candidates), d.Endpoint)
+}
@@ -0,0 +1,154 @@
+package rackhd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pollerInfo is a poller RackHD runs against a node; sensor readings come
+// from the IPMI pollers running the sdr command. The failure count is that of
+// the polls failing in a row.
+type pollerInfo struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	Paused       bool   `json:"paused"`
+	FailureCount int    `json:"failureCount"`
+	Config       struct {
+		Command string `json:"command"`
+	} `json:"config"`
+}
+
+// sdrSensor is one sensor of the sdr poller's current data.
+type sdrSensor struct {
+	ID      string `json:"sensorId"`
+	Type    string `json:"sensorType"`
+	Reading string `json:"sensorReading"`
+	Units   string `json:"sensorReadingUnits"`
+	Status  string `json:"status"`
+}
+
+// alertSensorTypes are the sensors an alert on stops a create: a node that
+// overheats or loses a fan or power supply fails under load.
+var alertSensorTypes = []string{"temperature", "fan", "power supply"}
+
+// critical reports whether the sensor is in a critical or non-recoverable
+// state, as ipmitool's cr and nr, or RackHD's spelled-out states.
+func (s *sdrSensor) critical() bool {
+	status := strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(s.Status))
+	switch {
+	case status == "cr" || status == "nr":
+		return true
+	case strings.Contains(status, "noncritical"):
+		return false
+	}
+	return strings.Contains(status, "critical") || strings.Contains(status, "nonrecoverable") || strings.Contains(status, "failure")
+}
+
+func (s *sdrSensor) alerting() bool {
+	kind := strings.ToLower(s.Type)
+	for _, t := range alertSensorTypes {
+		if strings.Contains(kind, t) {
+			return s.critical()
+		}
+	}
+	return false
+}
+
+// pollerSamples returns the current data of the node's IPMI pollers running
+// command, such as sdr or sel. It returns false when the node has no such
+// poller with data yet.
+func (d *Driver) pollerSamples(command string) ([]interface{}, bool, error) {
+	pollers, err := d.nodePollers(d.NodeID)
+	if err != nil {
+		return nil, false, err
+	}
+	samples, found := d.samplesOf(pollers, command)
+	return samples, found, nil
+}
+
+// nodePollers returns the pollers RackHD runs against any node.
+func (d *Driver) nodePollers(nodeID string) ([]pollerInfo, error) {
+	payload, err := d.getClient().GetNodePollers(d.context(), nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get the pollers of node %s. Error: %s", nodeID, apiError(err))
+	}
+	return d.adapter().pollers(payload)
+}
+
+// samplesOf is pollerSamples for pollers already fetched.
+func (d *Driver) samplesOf(pollers []pollerInfo, command string) ([]interface{}, bool) {
+	var samples []interface{}
+	found := false
+	for _, poller := range pollers {
+		if poller.Config.Command != command {
+			continue
+		}
+		payload, err := d.getClient().GetPollerData(d.context(), poller.ID)
+		if err != nil {
+			apiLog.Debugf("No current data for poller %s: %s", poller.ID, apiError(err))
+			continue
+		}
+		// the current data is one sample, or a list of them on some releases
+		if list, ok := payload.([]interface{}); ok {
+			samples = append(samples, list...)
+		} else {
+			samples = append(samples, payload)
+		}
+		found = true
+	}
+	return samples, found
+}
+
+// sdrSensors reads the sensors of the node's sdr pollers.
+func (d *Driver) sdrSensors() ([]sdrSensor, bool, error) {
+	pollers, err := d.nodePollers(d.NodeID)
+	if err != nil {
+		return nil, false, err
+	}
+	return d.pollerSensors(pollers)
+}
+
+// pollerSensors returns the readings of the sdr pollers among pollers.
+func (d *Driver) pollerSensors(pollers []pollerInfo) ([]sdrSensor, bool, error) {
+	samples, found := d.samplesOf(pollers, "sdr")
+	if !found {
+		return nil, false, nil
+	}
+	var data []struct {
+		SDR []sdrSensor `json:"sdr"`
+	}
+	if err := decodePayload(samples, &data); err != nil {
+		return nil, false, err
+	}
+	var sensors []sdrSensor
+	for _, sample := range data {
+		sensors = append(sensors, sample.SDR...)
+	}
+	return sensors, true, nil
+}
+
+// checkSensors refuses a node with a critical temperature, fan or power
+// supply reading from its IPMI sensor pollers.
+func (d *Driver) checkSensors() (string, error) {
+	if d.IgnoreSensorAlerts {
+		return "--rackhd-ignore-sensor-alerts is set", errCheckSkipped
+	}
+	sensors, found, err := d.sdrSensors()
+	if err != nil {
+		return "", checkWarning{fmt.Sprintf("sensor state unknown: %s", err)}
+	}
+	if !found {
+		return "", checkWarning{fmt.Sprintf("node %s has no IPMI sensor poller data; sensor alerts cannot be checked", d.NodeID)}
+	}
+	var alerts []string
+	for _, s := range sensors {
+		if s.alerting() {
+			alerts = append(alerts, strings.TrimSpace(fmt.Sprintf("%s %s %s %s", s.ID, s.Status, s.Reading, s.Units)))
+		}
+	}
+	if len(alerts) > 0 {
+		return "", fmt.Errorf("Node %s has critical sensor alerts (%s). Fix the hardware, or set --rackhd-ignore-sensor-alerts to provision anyway",
+			d.NodeID, strings.Join(alerts, "; "))
+	}
+	return fmt.Sprintf("%d sensor(s), no critical alerts", len(sensors)), nil
+}
@@ -0,0 +1,419 @@
+package rackhd
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-swagger/go-swagger/httpkit"
+)
+
+// Values of --rackhd-simulate. In chaos mode a tenth of the API calls fail
+// with a 503 and a tenth of the workflows fail.
+const (
+	simulateOn    = "on"
+	simulateChaos = "chaos"
+)
+
+const (
+	simulatorStateFile = "rackhd-simulator.json"
+	simulatedIP        = "127.0.0.1"
+	chaosRate          = 0.1
+)
+
+// normalizeSimulate maps the usual spellings of a boolean environment
+// variable onto the --rackhd-simulate modes.
+func normalizeSimulate(value string) string {
+	switch strings.ToLower(value) {
+	case "", "0", "false", "off", "no":
+		return ""
+	case "1", "true", "on", "yes":
+		return simulateOn
+	}
+	return strings.ToLower(value)
+}
+
+func (d *Driver) simulating() bool {
+	return d.Simulate != ""
+}
+
+// dial connects to addr, or pretends to when simulating, so the address
+// probes and reachability checks pass without a node behind them.
+func (d *Driver) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if d.simulating() {
+		conn, peer := net.Pipe()
+		peer.Close()
+		return conn, nil
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return dialer.DialContext(d.context(), "tcp", addr)
+}
+
+// simulatorState is the simulated rack. It is kept in the store, next to the
+// machines, because docker-machine runs the driver in a new process for every
+// command and rm has to find the node as create left it.
+type simulatorState struct {
+	Nodes  map[string]map[string]interface{} `json:"nodes"`
+	Graphs map[string]map[string]interface{} `json:"graphs"`
+}
+
+// simulator is the RackHDClient used with --rackhd-simulate. Any node ID is
+// answered with a canned compute node at 127.0.0.1 that has an OBM setting,
+// dmi, bmc and ohai catalogs (8 CPUs with VT-x, 32GB, a 500GB disk) and no
+// pollers; workflows finish as soon as they are started.
+type simulator struct {
+	path  string
+	chaos bool
+	mu    sync.Mutex
+}
+
+func newSimulator(d *Driver) *simulator {
+	return &simulator{
+		path:  filepath.Join(d.StorePath, simulatorStateFile),
+		chaos: d.Simulate == simulateChaos,
+	}
+}
+
+// update runs fn on the simulated rack and saves it when fn succeeds.
+func (s *simulator) update(operation string, fn func(state *simulatorState) (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chaos && rand.Float64() < chaosRate {
+		return nil, &httpkit.APIError{OperationName: operation, Code: http.StatusServiceUnavailable}
+	}
+
+	state := &simulatorState{
+		Nodes:  make(map[string]map[string]interface{}),
+		Graphs: make(map[string]map[string]interface{}),
+	}
+	if b, err := ioutil.ReadFile(s.path); err == nil {
+		if err := json.Unmarshal(b, state); err != nil {
+			log.Warnf("Discarding unreadable simulator state %s: %s", s.path, err)
+		}
+	}
+	result, err := fn(state)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return nil, err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return nil, err
+	}
+	return result, os.Rename(tmp, s.path)
+}
+
+func notFoundError(operation string) error {
+	return &httpkit.APIError{OperationName: operation, Code: http.StatusNotFound}
+}
+
+// simulatedMAC derives a stable, locally administered MAC from the node ID.
+func simulatedMAC(nodeID string) string {
+	sum := sha1.Sum([]byte(nodeID))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", sum[0], sum[1], sum[2])
+}
+
+// node returns the node, adding it to the rack on first use.
+func (state *simulatorState) node(nodeID string) map[string]interface{} {
+	node, ok := state.Nodes[nodeID]
+	if !ok {
+		node = map[string]interface{}{
+			"id":          nodeID,
+			"name":        "sim-" + nodeID,
+			"type":        "compute",
+			"sku":         "simulated",
+			"tags":        []interface{}{},
+			"identifiers": []interface{}{simulatedMAC(nodeID)},
+		}
+		state.Nodes[nodeID] = node
+	}
+	return node
+}
+
+// activeGraph returns the graph running on the node, if any.
+func (state *simulatorState) activeGraph(nodeID string) map[string]interface{} {
+	for _, graph := range state.Graphs {
+		if graph["node"] == nodeID && graph["_status"] == "running" {
+			return graph
+		}
+	}
+	return nil
+}
+
+// simulatedPage applies the $skip and $top parameters of a listing.
+func simulatedPage(query url.Values, records []interface{}) []interface{} {
+	skip, _ := strconv.Atoi(query.Get("$skip"))
+	if skip > len(records) {
+		skip = len(records)
+	}
+	records = records[skip:]
+	if top, err := strconv.Atoi(query.Get("$top")); err == nil && top < len(records) {
+		records = records[:top]
+	}
+	return records
+}
+
+func (s *simulator) GetConfig(ctx context.Context) (interface{}, error) {
+	return s.update("getConfig", func(state *simulatorState) (interface{}, error) {
+		return map[string]interface{}{"simulated": true}, nil
+	})
+}
+
+func (s *simulator) Lookup(ctx context.Context, query url.Values) (interface{}, error) {
+	return s.update("getLookups", func(state *simulatorState) (interface{}, error) {
+		q := query.Get("q")
+		if q != "" && net.ParseIP(q) == nil {
+			if _, err := net.ParseMAC(q); err != nil {
+				state.node(q)
+			}
+		}
+		var records []interface{}
+		for _, id := range sortedNodeIDs(state) {
+			mac := simulatedMAC(id)
+			if q == "" || q == id || q == mac || q == simulatedIP {
+				records = append(records, map[string]interface{}{"node": id, "macAddress": mac, "ipAddress": simulatedIP})
+			}
+		}
+		return simulatedPage(query, records), nil
+	})
+}
+
+func sortedNodeIDs(state *simulatorState) []string {
+	ids := make([]string, 0, len(state.Nodes))
+	for id := range state.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *simulator) GetNodes(ctx context.Context, query url.Values) (interface{}, error) {
+	return s.update("getNodes", func(state *simulatorState) (interface{}, error) {
+		var records []interface{}
+	nodes:
+		for _, id := range sortedNodeIDs(state) {
+			for field, values := range query {
+				if !strings.HasPrefix(field, "$") && fmt.Sprint(state.Nodes[id][field]) != values[0] {
+					continue nodes
+				}
+			}
+			records = append(records, state.Nodes[id])
+		}
+		return simulatedPage(query, records), nil
+	})
+}
+
+func (s *simulator) GetNode(ctx context.Context, nodeID string) (interface{}, error) {
+	return s.update("getNodesIdentifier", func(state *simulatorState) (interface{}, error) {
+		return state.node(nodeID), nil
+	})
+}
+
+func (s *simulator) SetNodeTags(ctx context.Context, nodeID string, tags []string) error {
+	_, err := s.update("patchNodesIdentifier", func(state *simulatorState) (interface{}, error) {
+		state.node(nodeID)["tags"] = tags
+		return nil, nil
+	})
+	return err
+}
+
+func (s *simulator) SetNodeReserved(ctx context.Context, nodeID string, reserved bool) error {
+	_, err := s.update("patchNodesIdentifier", func(state *simulatorState) (interface{}, error) {
+		state.node(nodeID)["reserved"] = reserved
+		return nil, nil
+	})
+	return err
+}
+
+func (s *simulator) GetNodeCatalog(ctx context.Context, nodeID, source string) (interface{}, error) {
+	return s.update("getNodesIdentifierCatalogsSource", func(state *simulatorState) (interface{}, error) {
+		state.node(nodeID)
+		var data interface{}
+		switch source {
+		case "dmi":
+			sum := sha1.Sum([]byte(nodeID))
+			data = map[string]interface{}{
+				"System Information": map[string]interface{}{
+					"Manufacturer":  "RackHD Simulator",
+					"Product Name":  "Simulated Node",
+					"Serial Number": fmt.Sprintf("SIM%X", sum[:4]),
+					"UUID":          fmt.Sprintf("%X-%X-%X-%X-%X", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16]),
+				},
+				"BIOS Information": map[string]interface{}{"Version": "2.4.3"},
+				"TPM Device":       map[string]interface{}{"Vendor ID": "SIM", "Specification Version": "2.0"},
+			}
+		case "smart":
+			data = []interface{}{map[string]interface{}{
+				"OS Device Name": "/dev/sda",
+				"SMART":          map[string]interface{}{"Self-Assessment": "PASSED"},
+			}}
+		case "bmc":
+			data = map[string]interface{}{"Firmware Revision": "2.41"}
+		case "ohai":
+			data = map[string]interface{}{
+				"kernel": map[string]interface{}{"machine": "x86_64"},
+				"cpu": map[string]interface{}{
+					"total": 8,
+					"0":     map[string]interface{}{"flags": []string{"fpu", "sse2", "vmx"}},
+				},
+				"memory":       map[string]interface{}{"total": "33554432kB"},
+				"block_device": map[string]interface{}{"sda": map[string]interface{}{"size": "976773168", "removable": "0"}},
+			}
+		default:
+			return nil, notFoundError("getNodesIdentifierCatalogsSource")
+		}
+		return map[string]interface{}{"node": nodeID, "source": source, "data": data}, nil
+	})
+}
+
+func (s *simulator) GetNodeOBM(ctx context.Context, nodeID string) (interface{}, error) {
+	return s.update("getNodesIdentifierObm", func(state *simulatorState) (interface{}, error) {
+		state.node(nodeID)
+		return []interface{}{map[string]interface{}{"service": "simulated-obm-service"}}, nil
+	})
+}
+
+func (s *simulator) AddNodeOBM(ctx context.Context, nodeID string, setting interface{}) error {
+	_, err := s.update("postNodesIdentifierObm", func(state *simulatorState) (interface{}, error) {
+		state.node(nodeID)
+		return nil, nil
+	})
+	return err
+}
+
+func (s *simulator) GetNodePollers(ctx context.Context, nodeID string) (interface{}, error) {
+	return s.update("getNodesIdentifierPollers", func(state *simulatorState) (interface{}, error) {
+		state.node(nodeID)
+		return []interface{}{}, nil
+	})
+}
+
+func (s *simulator) SetPollerPaused(ctx context.Context, pollerID string, paused bool) error {
+	return nil
+}
+
+func (s *simulator) GetPollerData(ctx context.Context, pollerID string) (interface{}, error) {
+	return s.update("getPollersIdentifierDataCurrent", func(state *simulatorState) (interface{}, error) {
+		return nil, notFoundError("getPollersIdentifierDataCurrent")
+	})
+}
+
+func (s *simulator) GetSKU(ctx context.Context, skuID string) (interface{}, error) {
+	return s.update("getSkusIdentifier", func(state *simulatorState) (interface{}, error) {
+		return map[string]interface{}{"id": skuID, "name": "Simulated"}, nil
+	})
+}
+
+func (s *simulator) StartWorkflow(ctx context.Context, nodeID, name string, body interface{}) (interface{}, error) {
+	return s.update("postNodesIdentifierWorkflows", func(state *simulatorState) (interface{}, error) {
+		state.node(nodeID)
+		if state.activeGraph(nodeID) != nil {
+			return nil, &httpkit.APIError{OperationName: "postNodesIdentifierWorkflows", Code: http.StatusBadRequest}
+		}
+		status := "succeeded"
+		if s.chaos && rand.Float64() < chaosRate {
+			status = "failed"
+		}
+		id := fmt.Sprintf("sim-graph-%d", len(state.Graphs)+1)
+		graph := map[string]interface{}{
+			"instanceId":     id,
+			"injectableName": name,
+			"node":           nodeID,
+			"_status":        status,
+		}
+		state.Graphs[id] = graph
+		return graph, nil
+	})
+}
+
+func (s *simulator) GetActiveWorkflow(ctx context.Context, nodeID string) (interface{}, error) {
+	return s.update("getNodesIdentifierWorkflowsActive", func(state *simulatorState) (interface{}, error) {
+		if graph := state.activeGraph(nodeID); graph != nil {
+			return graph, nil
+		}
+		return nil, notFoundError("getNodesIdentifierWorkflowsActive")
+	})
+}
+
+func (s *simulator) CancelActiveWorkflow(ctx context.Context, nodeID string) error {
+	_, err := s.update("deleteNodesIdentifierWorkflowsActive", func(state *simulatorState) (interface{}, error) {
+		graph := state.activeGraph(nodeID)
+		if graph == nil {
+			return nil, notFoundError("deleteNodesIdentifierWorkflowsActive")
+		}
+		graph["_status"] = "cancelled"
+		return nil, nil
+	})
+	return err
+}
+
+func (s *simulator) GetWorkflow(ctx context.Context, instanceID string) (interface{}, error) {
+	return s.update("getWorkflowsInstanceID", func(state *simulatorState) (interface{}, error) {
+		if graph, ok := state.Graphs[instanceID]; ok {
+			return graph, nil
+		}
+		return nil, notFoundError("getWorkflowsInstanceID")
+	})
+}
+
+func (s *simulator) GetWorkflowDefinition(ctx context.Context, name string) (interface{}, error) {
+	return s.update("getWorkflowsLibraryInjectableName", func(state *simulatorState) (interface{}, error) {
+		return map[string]interface{}{"injectableName": name}, nil
+	})
+}
+
+func (s *simulator) PutWorkflowDefinition(ctx context.Context, definition interface{}) error {
+	_, err := s.update("putWorkflows", func(state *simulatorState) (interface{}, error) {
+		return definition, nil
+	})
+	return err
+}
+
+func (s *simulator) GetTemplate(ctx context.Context, name string) (interface{}, error) {
+	return s.update("getTemplatesLibraryIdentifier", func(state *simulatorState) (interface{}, error) {
+		return nil, notFoundError("getTemplatesLibraryIdentifier")
+	})
+}
+
+func (s *simulator) PutTemplate(ctx context.Context, name, contents string) error {
+	_, err := s.update("putTemplatesLibraryIdentifier", func(state *simulatorState) (interface{}, error) {
+		return nil, nil
+	})
+	return err
+}
+
+// simulatedRunner is the SSHRunner used with --rackhd-simulate. Commands
+// succeed without output, except for the few whose output the driver reads.
+type simulatedRunner struct{}
+
+func (simulatedRunner) Run(ctx context.Context, target SSHTarget, command string) (string, error) {
+	switch {
+	case strings.Contains(command, "/proc/sys/kernel/random/boot_id"):
+		// a new boot every time, so waits for a reboot end at once
+		return fmt.Sprintf("sim-boot-%d\n", time.Now().UnixNano()), nil
+	case strings.Contains(command, "/proc/cmdline"):
+		return "BOOT_IMAGE=/vmlinuz root=/dev/sda1\n", nil
+	case strings.HasPrefix(command, "ip -o addr show"):
+		return "eth0\n", nil
+	}
+	return "", nil
+}
@@ -0,0 +1,54 @@
+package rackhd
+
+import "encoding/json"
+
+// skuDefaults are the docker-machine defaults a SKU pack sets for its nodes,
+// under "docker-machine" in the skuConfig of the SKU, e.g.
+// {"workflow-name": "Graph.InstallCentOS", "workflow-options": {...}}.
+// workflow-options may be an object or a JSON string.
+type skuDefaults struct {
+	WorkflowName    string      `json:"workflow-name"`
+	WorkflowOptions interface{} `json:"workflow-options"`
+}
+
+// applySKUDefaults installs the node with the install graph and options of
+// its SKU pack when --rackhd-workflow-name is not given. Defaults taken from
+// the SKU of an earlier candidate, when the selection is resolved again, are
+// replaced. Nodes without an SKU or defaults are left as they are.
+func (d *Driver) applySKUDefaults() {
+	if d.IgnoreSKUDefaults || d.Adopt {
+		return
+	}
+	if d.skuWorkflow {
+		d.WorkflowName, d.skuWorkflow = "", false
+		if d.skuWorkflowOptions {
+			d.WorkflowOptions, d.skuWorkflowOptions = "", false
+		}
+	}
+	if d.WorkflowName != "" {
+		return
+	}
+	node, err := d.getNode()
+	if err != nil || node.SKU == "" {
+		return
+	}
+	payload, err := d.getClient().GetSKU(d.context(), node.SKU)
+	if err != nil {
+		log.Debugf("Unable to get SKU %s of node %s: %s", node.SKU, d.NodeID, apiError(err))
+		return
+	}
+	defaults, err := d.adapter().skuDefaults(payload)
+	if err != nil || defaults == nil || defaults.WorkflowName == "" {
+		return
+	}
+	d.WorkflowName, d.skuWorkflow = defaults.WorkflowName, true
+	if d.WorkflowOptions == "" && defaults.WorkflowOptions != nil {
+		if options, ok := defaults.WorkflowOptions.(string); ok {
+			d.WorkflowOptions = options
+		} else if b, err := json.Marshal(defaults.WorkflowOptions); err == nil {
+			d.WorkflowOptions = string(b)
+		}
+		d.skuWorkflowOptions = d.WorkflowOptions != ""
+	}
+	log.Infof("Installing node %s with %s, the default of its SKU %s", d.NodeID, d.WorkflowName, node.SKU)
+}
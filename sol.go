@@ -0,0 +1,106 @@
+package rackhd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// obmSetting is an entry of the OBM settings of a node.
+type obmSetting struct {
+	Service string `json:"service"`
+	Config  struct {
+		Host string `json:"host"`
+		User string `json:"user"`
+	} `json:"config"`
+}
+
+// Consoler is implemented by drivers that can attach to the serial console
+// of a machine out of band, for hosts whose network is broken.
+type Consoler interface {
+	Console(stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+var _ Consoler = (*Driver)(nil)
+
+// recordSOL keeps the BMC address and user of the node's IPMI OBM setting, so
+// the console can be reached from the machine alone, even once RackHD is
+// unavailable. RackHD does not hand out the BMC password; it is read from the
+// file of --rackhd-sol-password-file or --rackhd-bmc-password-file, or taken
+// from the IPMI_PASSWORD environment variable.
+func (d *Driver) recordSOL() {
+	payload, err := d.getClient().GetNodeOBM(d.context(), d.NodeID)
+	if err != nil {
+		log.Debugf("Unable to get the OBM settings of node %s, the serial console will not be available: %s", d.NodeID, apiError(err))
+		return
+	}
+	obms, err := d.adapter().obmSettings(payload)
+	if err != nil {
+		log.Debugf("Unable to read the OBM settings of node %s: %s", d.NodeID, err)
+		return
+	}
+	for _, obm := range obms {
+		if strings.HasPrefix(obm.Service, "ipmi") && obm.Config.Host != "" {
+			d.SOLHost, d.SOLUser = obm.Config.Host, obm.Config.User
+			log.Debugf("Node %s has its serial console on %s as %q", d.NodeID, d.SOLHost, d.SOLUser)
+			return
+		}
+	}
+	log.Debugf("Node %s has no IPMI OBM setting, the serial console will not be available", d.NodeID)
+}
+
+// solArgs are the ipmitool arguments activating the serial-over-LAN console.
+// The password is passed in IPMI_PASSWORD (-E) to keep it out of the process
+// list.
+func (d *Driver) solArgs() []string {
+	args := []string{"-I", "lanplus", "-H", d.SOLHost}
+	if d.SOLUser != "" {
+		args = append(args, "-U", d.SOLUser)
+	}
+	return append(args, "-E", "sol", "activate")
+}
+
+// Console attaches stdin, stdout and stderr to the node's serial-over-LAN
+// console with ipmitool, which must be on the PATH, until the session ends
+// with ~. on the console. Machines created before the BMC was recorded look
+// it up in RackHD first.
+func (d *Driver) Console(stdin io.Reader, stdout, stderr io.Writer) error {
+	if d.SOLHost == "" {
+		if err := d.checkNodeExists(); err != nil {
+			return err
+		}
+		d.recordSOL()
+		if d.SOLHost == "" {
+			return fmt.Errorf("Node %s of machine %s has no IPMI OBM setting with a BMC address; no serial console is available", d.NodeID, d.MachineName)
+		}
+	}
+	// the password is not stored with the machine, only the file holding it
+	password := os.Getenv("IPMI_PASSWORD")
+	file := d.SOLPasswordFile
+	if file == "" {
+		file = d.BMCPasswordFile
+	}
+	if file != "" {
+		var err error
+		if password, err = readSecretFile(file); err != nil {
+			return err
+		}
+	}
+	if password == "" {
+		return fmt.Errorf("No BMC password for the serial console of %s. Set --rackhd-sol-password-file at create, or IPMI_PASSWORD", d.MachineName)
+	}
+	ipmitool, err := exec.LookPath("ipmitool")
+	if err != nil {
+		return fmt.Errorf("The serial console requires ipmitool on the PATH. Error: %s", err)
+	}
+	log.Infof("Attaching to the serial console of %s on %s; type ~. to detach", d.MachineName, d.SOLHost)
+	cmd := exec.CommandContext(d.context(), ipmitool, d.solArgs()...)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+password)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Serial console session of %s on %s failed. Error: %s", d.MachineName, d.SOLHost, err)
+	}
+	return nil
+}
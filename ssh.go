@@ -0,0 +1,340 @@
+package rackhd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+const defaultSSHCommandTimeout = 60
+
+// SSHTarget is where and as whom an SSHRunner runs a command. Exactly one of
+// Password and KeyPath is set.
+type SSHTarget struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	KeyPath  string
+	// Timeout bounds the connection and the command
+	Timeout time.Duration
+}
+
+// SSHRunner runs bootstrap commands on the node and returns their stdout. A
+// failing command's error carries its exit status and stderr, and refused
+// logins are classed ErrAuth. The default runner uses golang.org/x/crypto/ssh.
+type SSHRunner interface {
+	Run(ctx context.Context, target SSHTarget, command string) (string, error)
+}
+
+// SetSSHRunner replaces the runner the driver executes remote commands with,
+// e.g. with libmachine's native SSH client or a fake in tests.
+func (d *Driver) SetSSHRunner(runner SSHRunner) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.runner = runner
+}
+
+func (d *Driver) sshRunner() SSHRunner {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.runner == nil && d.simulating() {
+		d.runner = simulatedRunner{}
+	}
+	if d.runner == nil {
+		d.runner = cryptoSSHRunner{}
+	}
+	return d.runner
+}
+
+// execute command over SSH with user / password authentication
+func executeSSHCommand(command string, d *Driver) error {
+	_, err := runSSHCommandOutput(command, d, SSHTarget{User: d.bootstrapUser(), Password: d.SSHPassword})
+	return err
+}
+
+// execute command over SSH authenticating with the generated machine key
+func executeSSHKeyCommand(command string, d *Driver) error {
+	_, err := executeSSHKeyCommandOutput(command, d)
+	return err
+}
+
+// executeSSHKeyCommandOutput is executeSSHKeyCommand returning the command's stdout.
+func executeSSHKeyCommandOutput(command string, d *Driver) (string, error) {
+	return runSSHCommandOutput(command, d, SSHTarget{User: d.SSHUser, KeyPath: d.GetSSHKeyPath()})
+}
+
+func runSSHCommandOutput(command string, d *Driver, target SSHTarget) (string, error) {
+	sshLog.Debugf("Execute executeSSHCommand: %s", command)
+	defer d.track(timingSSH, time.Now())
+
+	if d.RestrictedBootstrap {
+		if err := d.checkRestricted(command); err != nil {
+			return "", err
+		}
+		sshLog.Infof("Running on %s as %s: %s", d.IPAddress, target.User, command)
+	}
+	target.Host = d.IPAddress
+	target.Port = d.SSHPort
+	target.Timeout = d.sshCommandTimeout()
+	out, err := d.sshRunner().Run(d.context(), target, command)
+	if err != nil {
+		return "", err
+	}
+	sshLog.Debugf("Stdout from executeSSHCommand: %s", out)
+	return out, nil
+}
+
+// cryptoSSHRunner is the default SSHRunner.
+type cryptoSSHRunner struct{}
+
+func (cryptoSSHRunner) Run(ctx context.Context, target SSHTarget, command string) (string, error) {
+	auth := cryptossh.Password(target.Password)
+	if target.KeyPath != "" {
+		privateKey, err := ioutil.ReadFile(target.KeyPath)
+		if err != nil {
+			return "", err
+		}
+		signer, err := cryptossh.ParsePrivateKey(privateKey)
+		if err != nil {
+			return "", fmt.Errorf("Unable to parse machine key %s. Error: %s", target.KeyPath, err)
+		}
+		// a key signed by --rackhd-ssh-ca-key logs in with its certificate
+		if b, err := ioutil.ReadFile(target.KeyPath + "-cert.pub"); err == nil {
+			if pub, _, _, _, err := cryptossh.ParseAuthorizedKey(b); err == nil {
+				if cert, ok := pub.(*cryptossh.Certificate); ok {
+					if certSigner, err := cryptossh.NewCertSigner(cert, signer); err == nil {
+						signer = certSigner
+					}
+				}
+			}
+		}
+		auth = cryptossh.PublicKeys(signer)
+	}
+	config := &cryptossh.ClientConfig{
+		User:    target.User,
+		Auth:    []cryptossh.AuthMethod{auth},
+		Timeout: target.Timeout,
+		// the host key changes with every OS install; like the tunnel,
+		// this does not check it
+		HostKeyCallback: cryptossh.InsecureIgnoreHostKey(),
+	}
+
+	addr := fmt.Sprintf("%s:%d", target.Host, target.Port)
+	dialer := &net.Dialer{Timeout: target.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		sshLog.Debugf("Failed to dial: %s", err)
+		return "", err
+	}
+	// the handshake has no context of its own; closing the connection ends it
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	defer close(stop)
+
+	sshConn, channels, requests, err := cryptossh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		sshLog.Debugf("Failed to dial: %s", err)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if isSSHAuthError(err) {
+			return "", classError(ErrAuth, "SSH login to %s as %s was refused. Error: %s", target.Host, target.User, err)
+		}
+		return "", err
+	}
+	client := cryptossh.NewClient(sshConn, channels, requests)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		sshLog.Debugf("Failed to create session: " + err.Error())
+		return "", err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			sshLog.Debugf("Failed to run: " + err.Error())
+			return "", sshCommandError(command, err, stderr.String())
+		}
+	case <-time.After(target.Timeout):
+		// closing the client unblocks Run; the remote shell is torn down with it
+		session.Signal(cryptossh.SIGKILL)
+		client.Close()
+		return "", fmt.Errorf("Remote command %q did not complete within %s on %s. The node may be hung (e.g. full disk); raise --rackhd-ssh-command-timeout if it is just slow", command, target.Timeout, target.Host)
+	case <-ctx.Done():
+		session.Signal(cryptossh.SIGKILL)
+		client.Close()
+		return "", fmt.Errorf("Remote command %q on %s was stopped. Error: %s", command, target.Host, ctx.Err())
+	}
+
+	return stdout.String(), nil
+}
+
+// bootstrapUser is the account used for password authenticated bootstrap commands.
+func (d *Driver) bootstrapUser() string {
+	if d.BootstrapUser == "" {
+		return d.SSHUser
+	}
+	return d.BootstrapUser
+}
+
+// installSSHKey writes the machine public key into SSHUser's authorized_keys
+// over the password session and makes sure sshd will accept the result.
+func (d *Driver) installSSHKey() error {
+	for _, command := range d.keyInstallCommands() {
+		if err := executeSSHCommand(command, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyInstallCommands are the commands installSSHKey runs over the bootstrap
+// session, as sent to the node.
+func (d *Driver) keyInstallCommands() []string {
+	// let the remote shell resolve the home directory; it is not /home/<user> for root
+	sshDir := fmt.Sprintf("~%s/.ssh", d.SSHUser)
+
+	// add public ssh key to authorized_keys
+	key := shellQuote(d.SSHKey)
+	addKey := fmt.Sprintf("echo %s > %s/authorized_keys", key, sshDir)
+	if d.Adopt {
+		// an adopted node is already in use; keep the keys it has
+		addKey = fmt.Sprintf("grep -qxF %s %s/authorized_keys 2>/dev/null || echo %s >> %s/authorized_keys", key, sshDir, key, sshDir)
+	}
+
+	//TAKEN FROM THE FUSION DRIVER TO USE SSH [THANKS!]
+	commands := []string{
+		// create .ssh folder in users home
+		fmt.Sprintf("mkdir -p %s", sshDir),
+		addKey,
+		// make it secure
+		fmt.Sprintf("chmod 700 %s", sshDir),
+		fmt.Sprintf("chmod 600 %s/authorized_keys", sshDir),
+		// sshd rejects keys in a directory owned by someone else, which is what
+		// a root bootstrap on behalf of another user would otherwise leave behind
+		fmt.Sprintf("chown -R %s:$(id -gn %s) %s", d.SSHUser, d.SSHUser, sshDir),
+	}
+	if d.bootstrapUser() != d.SSHUser {
+		for i, command := range commands {
+			commands[i] = d.asRoot(command)
+		}
+	}
+	return commands
+}
+
+// configureSudo gives SSHUser passwordless sudo with a sudoers.d drop-in, so
+// docker-machine's engine provisioning, which runs sudo non-interactively,
+// works on images where the user has no sudo rights of its own. A drop-in
+// visudo rejects is removed again rather than left to break sudo.
+func (d *Driver) configureSudo() error {
+	if d.SSHUser == "root" {
+		log.Debugf("Not configuring sudo; the SSH user is root")
+		return nil
+	}
+	dropIn := "/etc/sudoers.d/docker-machine-" + d.SSHUser
+	log.Infof("Configuring passwordless sudo for %s on %s [%s]", d.SSHUser, d.MachineName, d.IPAddress)
+	commands := []string{
+		fmt.Sprintf("echo %s > %s", shellQuote(d.SSHUser+" ALL=(ALL) NOPASSWD:ALL"), dropIn),
+		fmt.Sprintf("chmod 0440 %s", dropIn),
+		fmt.Sprintf("visudo -cf %s || { rm -f %s; exit 1; }", dropIn, dropIn),
+	}
+	for _, command := range commands {
+		if err := executeSSHCommand(d.asRoot(command), d); err != nil {
+			return fmt.Errorf("Unable to configure passwordless sudo for %s. Error: %w", d.SSHUser, err)
+		}
+	}
+	return nil
+}
+
+// verifyKeyAuth opens a fresh session with the machine key only, so a key that
+// sshd silently refuses is reported here rather than during provisioning.
+func (d *Driver) verifyKeyAuth() error {
+	if err := executeSSHKeyCommand("exit 0", d); err != nil {
+		return fmt.Errorf("The machine key was installed on %s but key authentication as %s does not work. "+
+			"Check the permissions and ownership of the user's home directory and ~/.ssh, and the SELinux "+
+			"context of authorized_keys (restorecon -R ~/.ssh). Error: %w", d.IPAddress, d.SSHUser, err)
+	}
+	return nil
+}
+
+// sshCommandTimeout bounds each bootstrap command, falling back to the default
+// for machines created before the option existed.
+func (d *Driver) sshCommandTimeout() time.Duration {
+	if d.SSHCommandTimeout <= 0 {
+		return defaultSSHCommandTimeout * time.Second
+	}
+	return time.Duration(d.SSHCommandTimeout) * time.Second
+}
+
+// sshCommandError builds an error for a failed remote command that carries the
+// remote exit status and stderr, so failures on the target can be diagnosed.
+func sshCommandError(command string, err error, stderr string) error {
+	stderr = strings.TrimSpace(stderr)
+	if exitErr, ok := err.(*cryptossh.ExitError); ok {
+		if stderr == "" {
+			return fmt.Errorf("Remote command %q failed with exit status %d", command, exitErr.ExitStatus())
+		}
+		return fmt.Errorf("Remote command %q failed with exit status %d: %s", command, exitErr.ExitStatus(), stderr)
+	}
+	if stderr == "" {
+		return fmt.Errorf("Remote command %q failed. Error: %w", command, err)
+	}
+	return fmt.Errorf("Remote command %q failed. Error: %s: %s", command, err, stderr)
+}
+
+// disablePasswordAuth turns off password logins in sshd_config and reloads
+// sshd so the bootstrap credentials can no longer be used against the node.
+func (d *Driver) disablePasswordAuth() error {
+	commands := []string{
+		// rewrite any existing (or commented out) directive, then append one if none was present
+		`sed -i -e 's/^#\?[[:space:]]*PasswordAuthentication[[:space:]].*/PasswordAuthentication no/' /etc/ssh/sshd_config`,
+		`grep -q '^PasswordAuthentication no' /etc/ssh/sshd_config || echo 'PasswordAuthentication no' >> /etc/ssh/sshd_config`,
+		// reload via whichever service manager and unit name the image uses
+		`systemctl reload sshd || systemctl reload ssh || service sshd reload || service ssh reload`,
+	}
+	for _, command := range commands {
+		if err := executeSSHCommand(d.asRoot(command), d); err != nil {
+			return fmt.Errorf("Unable to disable password authentication. Error: %w", err)
+		}
+	}
+	return nil
+}
+
+// asRoot wraps a command in non-interactive sudo when the bootstrap user is not root.
+func (d *Driver) asRoot(command string) string {
+	if d.bootstrapUser() == "root" {
+		return command
+	}
+	return fmt.Sprintf("sudo -n sh -c %s", shellQuote(command))
+}
+
+// shellQuote single-quotes s for safe use as one POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
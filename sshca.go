@@ -0,0 +1,128 @@
+package rackhd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshCAPath is where the CA public key is installed on the node.
+	sshCAPath = "/etc/ssh/docker-machine-ca.pub"
+	// sshPrincipalsDir holds the principals each user accepts certificates
+	// for, as sshd's AuthorizedPrincipalsFile /etc/ssh/auth_principals/%u.
+	sshPrincipalsDir = "/etc/ssh/auth_principals"
+)
+
+func (d *Driver) sshCertPath() string {
+	return d.GetSSHKeyPath() + "-cert.pub"
+}
+
+// sshPrincipals are the principals the node accepts certificates of the CA
+// for as SSHUser, and those of the machine key's certificate.
+func (d *Driver) sshPrincipals() []string {
+	if len(d.SSHCAPrincipals) > 0 {
+		return d.SSHCAPrincipals
+	}
+	return []string{d.SSHUser}
+}
+
+func (d *Driver) sshCASigner() (cryptossh.Signer, error) {
+	b, err := ioutil.ReadFile(d.SSHCAKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read --rackhd-ssh-ca-key %s. Error: %s", d.SSHCAKey, err)
+	}
+	signer, err := cryptossh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse --rackhd-ssh-ca-key %s; it must be an unencrypted private key. Error: %s", d.SSHCAKey, err)
+	}
+	return signer, nil
+}
+
+// sshCAPublicKey returns the CA public key in authorized_keys format, from
+// --rackhd-ssh-ca-public-key or derived from --rackhd-ssh-ca-key.
+func (d *Driver) sshCAPublicKey() (string, error) {
+	if d.SSHCAPublicKey != "" {
+		b, err := ioutil.ReadFile(d.SSHCAPublicKey)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read --rackhd-ssh-ca-public-key %s. Error: %s", d.SSHCAPublicKey, err)
+		}
+		if _, _, _, _, err := cryptossh.ParseAuthorizedKey(b); err != nil {
+			return "", fmt.Errorf("--rackhd-ssh-ca-public-key %s is not an SSH public key. Error: %s", d.SSHCAPublicKey, err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	signer, err := d.sshCASigner()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// signMachineKey signs the machine public key with the CA and writes the
+// certificate next to the key, where ssh -i picks it up. It does not expire,
+// like the raw key it replaces.
+func (d *Driver) signMachineKey() error {
+	signer, err := d.sshCASigner()
+	if err != nil {
+		return err
+	}
+	publicKey, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(d.SSHKey))
+	if err != nil {
+		return fmt.Errorf("Unable to parse the machine key. Error: %s", err)
+	}
+	cert := &cryptossh.Certificate{
+		Key:             publicKey,
+		Serial:          uint64(time.Now().UnixNano()),
+		CertType:        cryptossh.UserCert,
+		KeyId:           "docker-machine:" + d.MachineName,
+		ValidPrincipals: d.sshPrincipals(),
+		// allow for clocks running behind on the node
+		ValidAfter:  uint64(time.Now().Add(-5 * time.Minute).Unix()),
+		ValidBefore: cryptossh.CertTimeInfinity,
+		Permissions: cryptossh.Permissions{Extensions: map[string]string{
+			"permit-pty":             "",
+			"permit-port-forwarding": "",
+			"permit-user-rc":         "",
+		}},
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return fmt.Errorf("Unable to sign the machine key with --rackhd-ssh-ca-key. Error: %s", err)
+	}
+	if err := ioutil.WriteFile(d.sshCertPath(), cryptossh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		return fmt.Errorf("Unable to write the machine certificate %s. Error: %s", d.sshCertPath(), err)
+	}
+	return nil
+}
+
+// installSSHCA makes sshd on the node trust certificates of the CA for
+// SSHUser's principals and reloads it.
+func (d *Driver) installSSHCA() error {
+	caKey, err := d.sshCAPublicKey()
+	if err != nil {
+		return err
+	}
+	principals := make([]string, 0, len(d.sshPrincipals()))
+	for _, principal := range d.sshPrincipals() {
+		principals = append(principals, shellQuote(principal))
+	}
+	log.Infof("Installing the SSH CA for %s on %s [%s]", d.SSHUser, d.MachineName, d.IPAddress)
+	commands := []string{
+		fmt.Sprintf("echo %s > %s", shellQuote(caKey), sshCAPath),
+		fmt.Sprintf("mkdir -p %s", sshPrincipalsDir),
+		fmt.Sprintf("printf '%%s\\n' %s > %s/%s", strings.Join(principals, " "), sshPrincipalsDir, d.SSHUser),
+		fmt.Sprintf("grep -q '^TrustedUserCAKeys' /etc/ssh/sshd_config || echo 'TrustedUserCAKeys %s' >> /etc/ssh/sshd_config", sshCAPath),
+		fmt.Sprintf("grep -q '^AuthorizedPrincipalsFile' /etc/ssh/sshd_config || echo 'AuthorizedPrincipalsFile %s/%%u' >> /etc/ssh/sshd_config", sshPrincipalsDir),
+		`systemctl reload sshd || systemctl reload ssh || service sshd reload || service ssh reload`,
+	}
+	for _, command := range commands {
+		if err := executeSSHCommand(d.asRoot(command), d); err != nil {
+			return fmt.Errorf("Unable to install the SSH CA. Error: %w", err)
+		}
+	}
+	return nil
+}
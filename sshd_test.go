@@ -0,0 +1,140 @@
+package rackhd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// fakeSSHD accepts the bootstrap password and any key, records the commands
+// it is asked to run and succeeds every one of them without output.
+type fakeSSHD struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeSSHD(password string) (*fakeSSHD, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := cryptossh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fakeSSHD{listener: listener, password: password}
+	config := &cryptossh.ServerConfig{
+		PasswordCallback: func(conn cryptossh.ConnMetadata, password []byte) (*cryptossh.Permissions, error) {
+			if string(password) != s.password {
+				return nil, cryptossh.ErrNoAuth
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(conn cryptossh.ConnMetadata, key cryptossh.PublicKey) (*cryptossh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s, nil
+}
+
+func (s *fakeSSHD) port() int {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+func (s *fakeSSHD) Close() error {
+	return s.listener.Close()
+}
+
+func (s *fakeSSHD) ran() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *fakeSSHD) serve(conn net.Conn, config *cryptossh.ServerConfig) {
+	_, channels, requests, err := cryptossh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go cryptossh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(cryptossh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				cryptossh.Unmarshal(req.Payload, &exec)
+				s.mu.Lock()
+				s.commands = append(s.commands, exec.Command)
+				s.mu.Unlock()
+				req.Reply(true, nil)
+				channel.SendRequest("exit-status", false, cryptossh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+// fakeRunner is an SSHRunner recording the commands and the users they run
+// as, for tests that need no connection at all. Commands containing fail
+// return an error.
+type fakeRunner struct {
+	fail string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func (r *fakeRunner) Run(ctx context.Context, target SSHTarget, command string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	auth := "password"
+	if target.KeyPath != "" {
+		auth = "key"
+	}
+	r.commands = append(r.commands, target.User+" ("+auth+"): "+command)
+	if r.fail != "" && strings.Contains(command, r.fail) {
+		return "", fmt.Errorf("Remote command %q failed with exit status 1", command)
+	}
+	return "", nil
+}
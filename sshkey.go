@@ -0,0 +1,81 @@
+package rackhd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultMachineKeyBits = 2048
+	maxMachineKeyBits     = 16384
+)
+
+// setMachineKeyPath points the machine key at --rackhd-reuse-machine-key or
+// --rackhd-machine-key-path instead of id_rsa in the machine directory. The
+// path is persisted with the machine, as SSHKeyPath of the base driver.
+func (d *Driver) setMachineKeyPath(path string) error {
+	if path == "" {
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("Invalid machine key path %s. Error: %s", path, err)
+	}
+	d.SSHKeyPath = abs
+	return nil
+}
+
+// generateMachineKey writes an RSA key pair of the given size to path and
+// path.pub, with comment at the end of the public key. An existing key is
+// kept, as ssh.GenerateSSHKey does.
+func generateMachineKey(path string, bits int, comment string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Unable to create the directory of machine key %s. Error: %s", path, err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return fmt.Errorf("Unable to generate a %d bit machine key. Error: %s", bits, err)
+	}
+	private := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(path, private, 0600); err != nil {
+		return err
+	}
+	public, err := cryptossh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	line := strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(public)))
+	if comment != "" {
+		line += " " + comment
+	}
+	return ioutil.WriteFile(path+".pub", []byte(line+"\n"), 0600)
+}
+
+// reusedPublicKey returns the public key of --rackhd-reuse-machine-key, from
+// its .pub file or derived from the private key, which is never written to.
+func (d *Driver) reusedPublicKey() (string, error) {
+	if b, err := ioutil.ReadFile(d.publicSSHKeyPath()); err == nil {
+		return string(b), nil
+	}
+	b, err := ioutil.ReadFile(d.GetSSHKeyPath())
+	if err != nil {
+		return "", fmt.Errorf("Unable to read --rackhd-reuse-machine-key %s. Error: %s", d.GetSSHKeyPath(), err)
+	}
+	signer, err := cryptossh.ParsePrivateKey(b)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse --rackhd-reuse-machine-key %s; it must be an unencrypted private key. Error: %s", d.GetSSHKeyPath(), err)
+	}
+	return string(cryptossh.MarshalAuthorizedKey(signer.PublicKey())), nil
+}
@@ -0,0 +1,87 @@
+package rackhd
+
+import (
+	"fmt"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+// nodeStatus holds the node document fields that describe whether RackHD
+// still considers the node usable. Each is optional; older RackHD releases
+// omit them and are treated as healthy.
+type nodeStatus struct {
+	Discovered   *bool    `json:"discovered"`
+	Accessible   *bool    `json:"accessible"`
+	Unmanageable *bool    `json:"unmanageable"`
+	Tags         []string `json:"tags"`
+}
+
+// GetState maps the RackHD view of the node onto a docker-machine state. Power
+// state is not available through the 1.1 API, so a healthy node with no
+// workflow running is reported as Running.
+func (d *Driver) GetState() (state.State, error) {
+	/*
+		TODO: THIS REQUIRES THE REDFISH API WHICH IS STILL IN DEVELOPMENT
+		switch instance.State {
+		case "online":
+			return state.Running, nil
+		case "offline":
+			return state.Stopped, nil
+		}
+	*/
+	payload, err := d.getClient().GetNode(d.context(), d.NodeID)
+	if err != nil {
+		if isNotFound(err) {
+			checked, _ := d.nodeCheck()
+			if checked {
+				return state.Error, d.nodeGoneError()
+			}
+			// checkNodeExists rebinds the machine if that is enabled. The state
+			// is fetched again only for the new node, once: the check is then
+			// recorded. A transient failure of the check is reported as is.
+			nodeID := d.NodeID
+			if err := d.checkNodeExists(); err != nil {
+				return state.Error, err
+			}
+			if d.NodeID != nodeID {
+				return d.GetState()
+			}
+		}
+		return state.None, fmt.Errorf("Unable to get node %s. Error: %s", d.NodeID, apiError(err))
+	}
+	status, err := d.adapter().nodeStatus(payload)
+	if err != nil {
+		return state.None, err
+	}
+	switch {
+	case containsString(status.Tags, maintenanceTag):
+		log.Debugf("Node %s is under maintenance", d.NodeID)
+		return state.Paused, nil
+	case status.Unmanageable != nil && *status.Unmanageable:
+		log.Debugf("Node %s is marked unmanageable", d.NodeID)
+		return state.Error, nil
+	case status.Accessible != nil && !*status.Accessible:
+		log.Debugf("Node %s is not accessible", d.NodeID)
+		return state.Error, nil
+	case status.Discovered != nil && !*status.Discovered:
+		log.Debugf("Node %s has not finished discovery", d.NodeID)
+		return state.Starting, nil
+	}
+
+	d.checkLease()
+
+	active, err := d.activeWorkflow()
+	if err != nil {
+		return state.None, err
+	}
+	if active != nil {
+		log.Debugf("Node %s is running workflow %s (%s)", d.NodeID, active.Name, active.InstanceID)
+		switch {
+		case active.Name == powerOffGraph:
+			return state.Stopping, nil
+		case active.Name == powerOnGraph, d.WorkflowName != "" && active.Name == d.WorkflowName:
+			return state.Starting, nil
+		}
+	}
+	return state.Running, nil
+}
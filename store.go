@@ -0,0 +1,27 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// storeDir is where the driver keeps its own artifacts for a machine,
+// <store>/machines/<name>/rackhd.
+func (d *Driver) storeDir() string {
+	return d.ResolveStorePath("rackhd")
+}
+
+// writeStoreJSON saves v as indented JSON under storeDir and returns the path.
+func (d *Driver) writeStoreJSON(name string, v interface{}) (string, error) {
+	if err := os.MkdirAll(d.storeDir(), 0700); err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(d.storeDir(), name)
+	return path, ioutil.WriteFile(path, b, 0600)
+}
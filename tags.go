@@ -0,0 +1,93 @@
+package rackhd
+
+import (
+	"fmt"
+)
+
+// Tag prefixes applied to the nodes consumed by docker-machine.
+const (
+	machineTagPrefix = "docker-machine:"
+	ownerTagPrefix   = "docker-machine-owner:"
+	projectTagPrefix = "docker-machine-project:"
+)
+
+// machineTags returns the tags marking the node as used by this machine.
+func (d *Driver) machineTags() []string {
+	tags := []string{machineTagPrefix + d.MachineName}
+	if d.Owner != "" {
+		tags = append(tags, ownerTagPrefix+d.Owner)
+	}
+	if d.Project != "" {
+		tags = append(tags, projectTagPrefix+d.Project)
+	}
+	if d.AntiAffinityGroup != "" {
+		tags = append(tags, groupTagPrefix+d.AntiAffinityGroup)
+	}
+	return tags
+}
+
+// tagNode adds the machine tags to the node, keeping any tags it already has.
+func (d *Driver) tagNode() error {
+	log.Debugf("Tagging node %s with %v", d.NodeID, d.machineTags())
+	return d.updateNodeTags(func(tags []string) ([]string, error) {
+		for _, tag := range d.machineTags() {
+			if !containsString(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		return tags, nil
+	})
+}
+
+// untagNode removes the machine tags from the node.
+func (d *Driver) untagNode() error {
+	machineTags := append(d.machineTags(), reclaimTag)
+	return d.updateNodeTags(func(current []string) ([]string, error) {
+		tags := make([]string, 0, len(current))
+		for _, tag := range current {
+			if !containsString(machineTags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == len(current) {
+			return nil, nil
+		}
+		log.Debugf("Removing tags %v from node %s", machineTags, d.NodeID)
+		return tags, nil
+	})
+}
+
+// updateNodeTags replaces the tags of the node with what update makes of the
+// current ones, or leaves them when it returns none. RackHD only replaces the
+// whole list, and the claim refresher writes it while the create does, so the
+// updates of a driver are serialized and neither drops the tags of the other.
+func (d *Driver) updateNodeTags(update func(tags []string) ([]string, error)) error {
+	d.nodeMu.Lock()
+	defer d.nodeMu.Unlock()
+	node, err := d.getNode()
+	if err != nil {
+		return err
+	}
+	tags, err := update(node.Tags)
+	if err != nil || tags == nil {
+		return err
+	}
+	return d.setNodeTags(tags)
+}
+
+func (d *Driver) setNodeTags(tags []string) error {
+	if err := d.getClient().SetNodeTags(d.context(), d.NodeID, tags); err != nil {
+		return fmt.Errorf("Unable to update the tags of node %s. Error: %s", d.NodeID, apiError(err))
+	}
+	listings.invalidate(d.Endpoint)
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package rackhd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// templateFile is a --rackhd-template entry: a local template for the install
+// workflow, such as a kickstart or cloud-config.
+type templateFile struct {
+	option   string
+	path     string
+	contents string
+	checksum string
+}
+
+// name is the name of the template in the RackHD library. It carries the
+// start of the checksum, e.g. ks-1a2b3c4d5e6f.cfg, so machines created from
+// different versions of a file do not overwrite each other's template.
+func (t templateFile) name() string {
+	base := filepath.Base(t.path)
+	ext := filepath.Ext(base)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(base, ext), t.checksum[:12], ext)
+}
+
+// templateFiles reads the --rackhd-template files.
+func (d *Driver) templateFiles() ([]templateFile, error) {
+	files := make([]templateFile, 0, len(d.Templates))
+	for _, entry := range d.Templates {
+		parts := strings.SplitN(entry, "=", 2)
+		b, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read --rackhd-template %s. Error: %s", parts[1], err)
+		}
+		sum := sha256.Sum256(b)
+		files = append(files, templateFile{option: parts[0], path: parts[1], contents: string(b), checksum: hex.EncodeToString(sum[:])})
+	}
+	return files, nil
+}
+
+// uploadTemplates puts the --rackhd-template files into the RackHD template
+// library. A template RackHD already has with the same checksum, typically
+// from an earlier machine, is left as it is.
+func (d *Driver) uploadTemplates() error {
+	files, err := d.templateFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.name()
+		if payload, err := d.getClient().GetTemplate(d.context(), name); err == nil {
+			contents, err := d.adapter().templateContents(payload)
+			if sum := sha256.Sum256([]byte(contents)); err == nil && hex.EncodeToString(sum[:]) == file.checksum {
+				log.Debugf("Template %s of %s is up to date", name, file.path)
+				continue
+			}
+		} else if !isNotFound(err) {
+			return fmt.Errorf("Unable to get template %s. Error: %s", name, apiError(err))
+		}
+		log.Infof("Uploading %s as template %s", file.path, name)
+		if err := d.getClient().PutTemplate(d.context(), name, file.contents); err != nil {
+			return fmt.Errorf("Unable to upload template %s. Error: %s", name, apiError(err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package rackhd
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Categories of work timed across a create, independently of phases.
+const (
+	timingAPI      = "RackHD API calls"
+	timingProbe    = "IP probing"
+	timingWorkflow = "workflows"
+	timingSSH      = "remote bootstrap commands"
+)
+
+// timings accumulates how long each phase and each category of work took.
+type timings struct {
+	mu         sync.Mutex
+	phases     []string
+	phaseTimes map[string]time.Duration
+	categories map[string]time.Duration
+	counts     map[string]int
+}
+
+func newTimings() *timings {
+	return &timings{
+		phaseTimes: make(map[string]time.Duration),
+		categories: make(map[string]time.Duration),
+		counts:     make(map[string]int),
+	}
+}
+
+func (t *timings) addPhase(name string, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases = append(t.phases, name)
+	t.phaseTimes[name] = elapsed
+}
+
+func (t *timings) add(category string, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.categories[category] += elapsed
+	t.counts[category]++
+}
+
+// track records the time since start under category; use with defer.
+func (d *Driver) track(category string, start time.Time) {
+	d.timings().add(category, time.Since(start))
+}
+
+func (d *Driver) timings() *timings {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timing == nil {
+		d.timing = newTimings()
+	}
+	return d.timing
+}
+
+// logTimings writes the per-phase and per-category summary of a create.
+func (d *Driver) logTimings() {
+	t := d.timings()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var total time.Duration
+	log.Infof("Create timing summary for %s:", d.MachineName)
+	for _, phase := range t.phases {
+		total += t.phaseTimes[phase]
+		log.Infof("  phase %-18s %s", phase, roundSeconds(t.phaseTimes[phase]))
+	}
+	for _, category := range []string{timingAPI, timingProbe, timingWorkflow, timingSSH} {
+		if t.counts[category] > 0 {
+			log.Infof("  %-24s %s (%d)", category, roundSeconds(t.categories[category]), t.counts[category])
+		}
+	}
+	log.Infof("  total                    %s", roundSeconds(total))
+}
+
+func roundSeconds(elapsed time.Duration) time.Duration {
+	return elapsed / time.Second * time.Second
+}
+
+// timedTransport records the duration of every RackHD API request.
+type timedTransport struct {
+	next   http.RoundTripper
+	driver *Driver
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	t.driver.track(timingAPI, start)
+	metrics.observeAPI(req.Method, time.Since(start))
+	return resp, err
+}
@@ -0,0 +1,95 @@
+package rackhd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// nodeTopology is the CPU and NVMe topology of a node, for schedulers that
+// place work by NUMA node.
+type nodeTopology struct {
+	Sockets        int          `json:"sockets"`
+	NUMANodes      int          `json:"numaNodes"`
+	CoresPerSocket int          `json:"coresPerSocket,omitempty"`
+	NVMe           []nvmeDevice `json:"nvme"`
+}
+
+// nvmeDevice is an NVMe controller and the NUMA node its PCIe slot is local
+// to, -1 where the catalog does not say.
+type nvmeDevice struct {
+	Slot     string `json:"slot"`
+	NUMANode int    `json:"numaNode"`
+}
+
+// lspciDevice is an entry of the lspci catalog, from lspci -vmm, which lists
+// NUMANode where the kernel knows the device's locality.
+type lspciDevice struct {
+	Slot     string `json:"Slot"`
+	Class    string `json:"Class"`
+	NUMANode string `json:"NUMANode"`
+}
+
+// topology reads the node's topology: sockets and cores from the ohai
+// catalog, NVMe placement from the lspci catalog. The NUMA node count is the
+// one lspci reports, or one per socket where it reports none.
+func (d *Driver) topology() (*nodeTopology, error) {
+	var ohai memoryTopology
+	if err := d.getCatalog("ohai", &ohai); err != nil {
+		return nil, err
+	}
+	topo := &nodeTopology{Sockets: ohai.CPU.Real, NVMe: []nvmeDevice{}}
+	if topo.Sockets > 0 && ohai.CPU.Cores > 0 {
+		topo.CoresPerSocket = ohai.CPU.Cores / topo.Sockets
+	}
+
+	maxNode := -1
+	var devices []lspciDevice
+	if err := d.getCatalog("lspci", &devices); err != nil {
+		log.Debugf("Not reading NVMe placement: %s", err)
+	}
+	for _, dev := range devices {
+		node := -1
+		if n, err := strconv.Atoi(dev.NUMANode); err == nil {
+			node = n
+		}
+		if node > maxNode {
+			maxNode = node
+		}
+		if strings.Contains(strings.ToLower(dev.Class), "non-volatile memory") {
+			topo.NVMe = append(topo.NVMe, nvmeDevice{Slot: dev.Slot, NUMANode: node})
+		}
+	}
+	sort.Slice(topo.NVMe, func(i, j int) bool { return topo.NVMe[i].Slot < topo.NVMe[j].Slot })
+
+	topo.NUMANodes = maxNode + 1
+	if topo.NUMANodes < 1 {
+		topo.NUMANodes = topo.Sockets
+	}
+	return topo, nil
+}
+
+// labels returns the topology as engine labels: rackhd.numa-nodes,
+// rackhd.sockets, rackhd.cores-per-socket, rackhd.nvme and, per NUMA node
+// with local NVMe devices, rackhd.nvme.numa<n>.
+func (t *nodeTopology) labels() map[string]string {
+	labels := map[string]string{
+		"rackhd.numa-nodes": strconv.Itoa(t.NUMANodes),
+		"rackhd.sockets":    strconv.Itoa(t.Sockets),
+		"rackhd.nvme":       strconv.Itoa(len(t.NVMe)),
+	}
+	if t.CoresPerSocket > 0 {
+		labels["rackhd.cores-per-socket"] = strconv.Itoa(t.CoresPerSocket)
+	}
+	perNode := make(map[int]int)
+	for _, dev := range t.NVMe {
+		if dev.NUMANode >= 0 {
+			perNode[dev.NUMANode]++
+		}
+	}
+	for node, count := range perNode {
+		labels[fmt.Sprintf("rackhd.nvme.numa%d", node)] = strconv.Itoa(count)
+	}
+	return labels
+}
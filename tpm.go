@@ -0,0 +1,56 @@
+package rackhd
+
+import (
+	"fmt"
+	"time"
+)
+
+const tpmWorkflowTimeout = 15 * time.Minute
+
+// tpmDevice is the "TPM Device" section (SMBIOS type 43) of the dmi catalog.
+type tpmDevice struct {
+	Vendor               string `json:"Vendor ID"`
+	SpecificationVersion string `json:"Specification Version"`
+}
+
+// tpm returns the node's TPM from its dmi catalog, or nil when it lists none.
+func (d *Driver) tpm() (*tpmDevice, error) {
+	var dmi struct {
+		TPM *tpmDevice `json:"TPM Device"`
+	}
+	if err := d.getCatalog("dmi", &dmi); err != nil {
+		return nil, err
+	}
+	return dmi.TPM, nil
+}
+
+// checkTPM refuses a node without a TPM during selection when
+// --rackhd-require-tpm is set.
+func (d *Driver) checkTPM() error {
+	if !d.RequireTPM {
+		return nil
+	}
+	tpm, err := d.tpm()
+	if err != nil {
+		return err
+	}
+	if tpm == nil {
+		return fmt.Errorf("Node %s has no TPM, which --rackhd-require-tpm requires. Enable it in the BIOS, re-catalog the node, or choose another node", d.NodeID)
+	}
+	log.Infof("Node %s has a TPM %s from %s", d.NodeID, tpm.SpecificationVersion, tpm.Vendor)
+	return nil
+}
+
+// attestTPM runs --rackhd-tpm-attestation-workflow once the firmware, BIOS
+// and RAID stages are done, so the measurements attested are the ones the OS
+// will boot with. A failed attestation fails the create.
+func (d *Driver) attestTPM() error {
+	if d.TPMAttestationWorkflow == "" {
+		return errPhaseSkipped
+	}
+	log.Infof("Attesting the TPM of node %s with %s", d.NodeID, d.TPMAttestationWorkflow)
+	if _, err := d.runWorkflow(d.TPMAttestationWorkflow, nil, tpmWorkflowTimeout); err != nil {
+		return fmt.Errorf("TPM attestation of node %s failed. Error: %w", d.NodeID, err)
+	}
+	return nil
+}
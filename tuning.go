@@ -0,0 +1,114 @@
+package rackhd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	sysctlConfigPath = "/etc/sysctl.d/99-docker-machine.conf"
+	rebootTimeout    = 15 * time.Minute
+)
+
+// tuneKernel applies the --rackhd-sysctl settings and adds the
+// --rackhd-kernel-args to the boot loader, together with the settings of the
+// hugepages and NUMA options, rebooting the node if any kernel argument is
+// missing from the running kernel so the engine is provisioned under the
+// final settings.
+func (d *Driver) tuneKernel() error {
+	sysctls, kernelArgs, err := d.memoryTuning()
+	if err != nil {
+		return err
+	}
+	sysctls = append(append([]string{}, d.Sysctls...), sysctls...)
+	kernelArgs = strings.TrimSpace(d.KernelArgs + " " + kernelArgs)
+	if len(sysctls) == 0 && kernelArgs == "" {
+		return errPhaseSkipped
+	}
+
+	if len(sysctls) > 0 {
+		log.Infof("Applying %d sysctl settings on %s", len(sysctls), d.MachineName)
+		err := d.runKeyCommands([]string{
+			fmt.Sprintf("echo %s > %s", shellQuote(strings.Join(sysctls, "\n")), sysctlConfigPath),
+			"sysctl --system >/dev/null",
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to apply sysctl settings. Error: %w", err)
+		}
+	}
+
+	missing, err := d.missingKernelArgs(kernelArgs)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+	args := strings.Join(missing, " ")
+	log.Infof("Adding kernel arguments %q on %s", args, d.MachineName)
+	err = d.runKeyCommands([]string{fmt.Sprintf(`if command -v grubby >/dev/null; then
+	grubby --update-kernel=ALL --args=%s
+else
+	sed -i 's|^GRUB_CMDLINE_LINUX="\(.*\)"|GRUB_CMDLINE_LINUX="\1 %s"|' /etc/default/grub
+	update-grub 2>/dev/null || grub2-mkconfig -o /boot/grub2/grub.cfg 2>/dev/null || grub-mkconfig -o /boot/grub/grub.cfg
+fi`, shellQuote(args), args)})
+	if err != nil {
+		return fmt.Errorf("Unable to update the kernel arguments. Error: %w", err)
+	}
+
+	if err := d.rebootNode(); err != nil {
+		return err
+	}
+	if missing, err = d.missingKernelArgs(kernelArgs); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s rebooted without the kernel arguments %q", d.MachineName, strings.Join(missing, " "))
+	}
+	return nil
+}
+
+// missingKernelArgs returns the kernel arguments the running kernel was not
+// booted with.
+func (d *Driver) missingKernelArgs(kernelArgs string) ([]string, error) {
+	if kernelArgs == "" {
+		return nil, nil
+	}
+	out, err := executeSSHKeyCommandOutput("cat /proc/cmdline", d)
+	if err != nil {
+		return nil, err
+	}
+	running := strings.Fields(out)
+	var missing []string
+	for _, arg := range strings.Fields(kernelArgs) {
+		if !containsString(running, arg) {
+			missing = append(missing, arg)
+		}
+	}
+	return missing, nil
+}
+
+// rebootNode reboots the node and waits until it is back with a new boot ID.
+func (d *Driver) rebootNode() error {
+	bootID, err := executeSSHKeyCommandOutput("cat /proc/sys/kernel/random/boot_id", d)
+	if err != nil {
+		return err
+	}
+	log.Infof("Rebooting %s [%s]", d.MachineName, d.IPAddress)
+	// delay the reboot so the command returns before sshd goes away
+	if err := d.runKeyCommands([]string{"nohup sh -c 'sleep 2; reboot' >/dev/null 2>&1 &"}); err != nil {
+		return fmt.Errorf("Unable to reboot %s. Error: %w", d.MachineName, err)
+	}
+
+	deadline := time.Now().Add(rebootTimeout)
+	for time.Now().Before(deadline) {
+		if err := d.sleep(networkPollInterval); err != nil {
+			return err
+		}
+		out, err := executeSSHKeyCommandOutput("cat /proc/sys/kernel/random/boot_id", d)
+		if err == nil && strings.TrimSpace(out) != strings.TrimSpace(bootID) {
+			log.Infof("%s is back after the reboot", d.MachineName)
+			return nil
+		}
+		log.Debugf("Waiting for %s to come back: %v", d.MachineName, err)
+	}
+	return classError(ErrNoReachableIP, "%s did not come back within %s of rebooting", d.MachineName, rebootTimeout)
+}
@@ -0,0 +1,77 @@
+package rackhd
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	dockerPort       = 2376
+	tunnelSocketName = "rackhd-tunnel.sock"
+)
+
+// tunnelAddr is the local address docker clients use in tunnel mode. The
+// engine certificate generated by docker-machine always carries "localhost".
+func (d *Driver) tunnelAddr() string {
+	return fmt.Sprintf("localhost:%d", d.SSHTunnelPort)
+}
+
+// pickTunnelPort reserves a free local port for the tunnel when none was given.
+func (d *Driver) pickTunnelPort() error {
+	if d.SSHTunnelPort != 0 {
+		return nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("Unable to allocate a local port for the SSH tunnel. Error: %s", err)
+	}
+	defer l.Close()
+	d.SSHTunnelPort = l.Addr().(*net.TCPAddr).Port
+	return nil
+}
+
+// ensureTunnel starts the background SSH port forward to the engine port unless
+// one is already listening. The forward is owned by an ssh control master so
+// it survives this plugin process and can be torn down again on Remove.
+func (d *Driver) ensureTunnel() error {
+	if conn, err := net.DialTimeout("tcp", d.tunnelAddr(), time.Second); err == nil {
+		conn.Close()
+		return nil
+	}
+
+	sshLog.Debugf("Starting SSH tunnel %s -> %s:%d", d.tunnelAddr(), d.IPAddress, dockerPort)
+	args := append(d.tunnelSSHArgs(),
+		"-f", "-N", "-M",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=30",
+		"-L", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", d.SSHTunnelPort, dockerPort),
+		fmt.Sprintf("%s@%s", d.GetSSHUsername(), d.IPAddress),
+	)
+	if out, err := exec.Command("ssh", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to start SSH tunnel to %s. Error: %s: %s", d.IPAddress, err, out)
+	}
+	return nil
+}
+
+// closeTunnel asks the control master to exit, if it is running.
+func (d *Driver) closeTunnel() {
+	args := append(d.tunnelSSHArgs(), "-O", "exit", fmt.Sprintf("%s@%s", d.GetSSHUsername(), d.IPAddress))
+	if out, err := exec.Command("ssh", args...).CombinedOutput(); err != nil {
+		sshLog.Debugf("SSH tunnel was not running: %s: %s", err, out)
+	}
+}
+
+func (d *Driver) tunnelSSHArgs() []string {
+	return []string{
+		"-i", d.GetSSHKeyPath(),
+		"-p", strconv.Itoa(d.SSHPort),
+		"-S", d.ResolveStorePath(tunnelSocketName),
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=quiet",
+	}
+}
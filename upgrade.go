@@ -0,0 +1,73 @@
+package rackhd
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// UpgradeHooker is implemented by drivers that want to run work around a
+// Docker engine upgrade. libmachine's Host.Upgrade does not call driver code,
+// so tooling that upgrades machines calls these around it.
+type UpgradeHooker interface {
+	PreUpgrade() error
+	PostUpgrade() error
+}
+
+var _ UpgradeHooker = (*Driver)(nil)
+
+// PreUpgrade runs the configured pre-upgrade workflow and script, e.g. to
+// drain the node or snapshot its configuration.
+func (d *Driver) PreUpgrade() error {
+	return d.runUpgradeHook("pre-upgrade", d.PreUpgradeWorkflow, d.PreUpgradeScript)
+}
+
+// PostUpgrade runs the configured post-upgrade workflow and script.
+func (d *Driver) PostUpgrade() error {
+	return d.runUpgradeHook("post-upgrade", d.PostUpgradeWorkflow, d.PostUpgradeScript)
+}
+
+func (d *Driver) runUpgradeHook(hook, workflow, script string) error {
+	if workflow == "" && script == "" {
+		return nil
+	}
+	unlock, err := d.lockNode(hook)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if workflow != "" {
+		log.Infof("Running %s workflow %s on node %s", hook, workflow, d.NodeID)
+		if _, err := d.runWorkflow(workflow, nil, d.workflowTimeout()); err != nil {
+			return fmt.Errorf("The %s workflow failed. Error: %w", hook, err)
+		}
+	}
+	if script != "" {
+		b, err := ioutil.ReadFile(script)
+		if err != nil {
+			return fmt.Errorf("Unable to read %s script %s. Error: %s", hook, script, err)
+		}
+		log.Infof("Running %s script %s on %s", hook, script, d.IPAddress)
+		if err := executeSSHKeyCommand("sh -c "+shellQuote(string(b)), d); err != nil {
+			return fmt.Errorf("The %s script failed. Error: %w", hook, err)
+		}
+	}
+	return nil
+}
+
+// postInstall runs --rackhd-post-install-script on the node as the SSH user,
+// as the last create phase once the node is configured.
+func (d *Driver) postInstall() error {
+	if d.PostInstallScript == "" {
+		return errPhaseSkipped
+	}
+	b, err := ioutil.ReadFile(d.PostInstallScript)
+	if err != nil {
+		return fmt.Errorf("Unable to read post-install script %s. Error: %s", d.PostInstallScript, err)
+	}
+	log.Infof("Running post-install script %s on %s", d.PostInstallScript, d.IPAddress)
+	if err := executeSSHKeyCommand("sh -c "+shellQuote(string(b)), d); err != nil {
+		return fmt.Errorf("The post-install script failed. Error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package rackhd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Lifecycle events POSTed to --rackhd-webhook-url.
+const (
+	eventCreateStarted   = "create.started"
+	eventCreateSucceeded = "create.succeeded"
+	eventCreateFailed    = "create.failed"
+	eventRemoved         = "machine.removed"
+	eventStart           = "machine.start"
+
+	webhookTimeout = 10 * time.Second
+)
+
+type webhookPayload struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Machine   string    `json:"machine"`
+	NodeID    string    `json:"nodeId"`
+	IPAddress string    `json:"ipAddress,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// notify POSTs a lifecycle event to the configured webhook. Delivery is best
+// effort: an unreachable webhook is logged and never fails the operation.
+func (d *Driver) notify(event string, opErr error) {
+	if d.WebhookURL == "" {
+		return
+	}
+	payload := webhookPayload{
+		Event:     event,
+		Time:      time.Now().UTC(),
+		Machine:   d.MachineName,
+		NodeID:    d.NodeID,
+		IPAddress: d.IPAddress,
+	}
+	if opErr != nil {
+		payload.Error = opErr.Error()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Warnf("Unable to encode webhook event %s: %s", event, err)
+		return
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(d.WebhookURL, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Warnf("Unable to deliver webhook event %s to %s: %s", event, redactURI(d.WebhookURL), err)
+	}
+}
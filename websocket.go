@@ -0,0 +1,104 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketMessage is a message of the on-http websocket protocol. The client
+// sends watch requests; the server answers with initial, created, updated and
+// removed messages for the watched resource.
+type websocketMessage struct {
+	Handler  string          `json:"handler"`
+	Resource string          `json:"resource,omitempty"`
+	Params   interface{}     `json:"params,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// websocketResources are the resources watched for a node, with the filter
+// that selects the node's documents.
+var websocketResources = map[string]func(nodeID string) interface{}{
+	"nodes":        func(nodeID string) interface{} { return map[string]string{"id": nodeID} },
+	"graphobjects": func(nodeID string) interface{} { return map[string]string{"node": nodeID} },
+}
+
+// websocketSubscription consumes the node's events from the on-http
+// websocket endpoint.
+type websocketSubscription struct {
+	conn *websocket.Conn
+}
+
+func (s *websocketSubscription) Close() error {
+	return s.conn.Close()
+}
+
+// subscribeWebsocket watches the node and its graphs over the on-http
+// websocket endpoint at uri and hands each change to handler as a rackhdEvent,
+// like subscribeAMQP does for the event exchange.
+func subscribeWebsocket(d *Driver, uri, nodeID string, handler func(rackhdEvent)) (*websocketSubscription, error) {
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.DialContext(d.context(), uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to the RackHD websocket at %s. Error: %s", redactURI(uri), err)
+	}
+	for resource, params := range websocketResources {
+		watch := websocketMessage{Handler: "watch", Resource: resource, Params: params(nodeID)}
+		if err := conn.WriteJSON(watch); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to watch %s over the RackHD websocket. Error: %s", resource, err)
+		}
+	}
+
+	go func() {
+		for {
+			var message websocketMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				// also how the loop ends once Close is called
+				log.Debugf("Stopped reading the RackHD websocket: %s", err)
+				return
+			}
+			if message.Resource == "" || message.Handler == "initial" {
+				continue
+			}
+			handler(websocketEvent(message, nodeID))
+		}
+	}()
+
+	return &websocketSubscription{conn: conn}, nil
+}
+
+// websocketEvent turns a websocket change message into the event the AMQP
+// exchange would have published for it.
+func websocketEvent(message websocketMessage, nodeID string) rackhdEvent {
+	event := rackhdEvent{
+		RoutingKey: message.Resource + "." + message.Handler,
+		Type:       message.Resource,
+		Action:     message.Handler,
+		NodeID:     nodeID,
+		Data:       message.Data,
+	}
+	var doc struct {
+		ID             string `json:"id"`
+		InstanceID     string `json:"instanceId"`
+		InjectableName string `json:"injectableName"`
+		Status         string `json:"_status"`
+	}
+	if err := json.Unmarshal(message.Data, &doc); err != nil {
+		return event
+	}
+	switch message.Resource {
+	case "graphobjects":
+		event.Type = "graph"
+		event.TypeID = doc.InjectableName
+		if doc.Status != "" {
+			event.Action = doc.Status
+		}
+	case "nodes":
+		event.Type = "node"
+		event.TypeID = doc.ID
+	}
+	return event
+}
@@ -0,0 +1,116 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// priorityTagPrefix sets the selection priority of a node, e.g.
+// dm-priority:10. It takes precedence over --rackhd-weights-file.
+const priorityTagPrefix = "dm-priority:"
+
+// weightRule is an entry of --rackhd-weights-file: the priority of the nodes
+// carrying all of Tags and, when set, of SKU.
+type weightRule struct {
+	Tags     []string `json:"tags"`
+	SKU      string   `json:"sku"`
+	Priority int      `json:"priority"`
+}
+
+type weightsFile struct {
+	Weights []weightRule `json:"weights"`
+}
+
+func (d *Driver) readWeights() ([]weightRule, error) {
+	if d.WeightsFile == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(d.WeightsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read --rackhd-weights-file %s. Error: %s", d.WeightsFile, err)
+	}
+	var file weightsFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("--rackhd-weights-file %s is not valid JSON. Error: %s", d.WeightsFile, err)
+	}
+	for _, rule := range file.Weights {
+		if len(rule.Tags) == 0 && rule.SKU == "" {
+			return nil, fmt.Errorf("Every weight of --rackhd-weights-file %s needs tags or a sku", d.WeightsFile)
+		}
+	}
+	return file.Weights, nil
+}
+
+// nodePriority returns the priority of a node: its dm-priority tag, or else
+// the highest priority of the weight rules it matches, or else 0. skus
+// caches the SKU names looked up.
+func (d *Driver) nodePriority(node *nodeInfo, rules []weightRule, skus map[string]string) int {
+	for _, tag := range node.Tags {
+		if strings.HasPrefix(tag, priorityTagPrefix) {
+			if priority, err := strconv.Atoi(strings.TrimPrefix(tag, priorityTagPrefix)); err == nil {
+				return priority
+			}
+			log.Debugf("Ignoring tag %s of node %s; the priority is not a number", tag, node.ID)
+		}
+	}
+	priority, matched := 0, false
+	for _, rule := range rules {
+		if !containsAll(node.Tags, rule.Tags) {
+			continue
+		}
+		if rule.SKU != "" {
+			if node.SKU == "" {
+				continue
+			}
+			if _, ok := skus[node.SKU]; !ok {
+				skus[node.SKU] = d.skuName(node.SKU)
+			}
+			if skus[node.SKU] != rule.SKU && node.SKU != rule.SKU {
+				continue
+			}
+		}
+		if !matched || rule.Priority > priority {
+			priority, matched = rule.Priority, true
+		}
+	}
+	return priority
+}
+
+// prioritize orders the candidates by priority, highest first, keeping the
+// order of equal ones. Nodes with a negative priority are left out: they are
+// kept for creates that name them with --rackhd-node-id.
+func (d *Driver) prioritize(candidates []*nodeInfo) ([]*nodeInfo, error) {
+	rules, err := d.readWeights()
+	if err != nil {
+		return nil, err
+	}
+	skus := make(map[string]string)
+	priorities := make(map[string]int, len(candidates))
+	kept := candidates[:0]
+	for _, candidate := range candidates {
+		priority := d.nodePriority(candidate, rules, skus)
+		if priority < 0 {
+			log.Debugf("Not selecting node %s, whose priority is %d", candidate.ID, priority)
+			continue
+		}
+		priorities[candidate.ID] = priority
+		kept = append(kept, candidate)
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return priorities[kept[i].ID] > priorities[kept[j].ID]
+	})
+	return kept, nil
+}
+
+func containsAll(list, values []string) bool {
+	for _, value := range values {
+		if !containsString(list, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package rackhd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/masterzen/winrm"
+)
+
+const (
+	bootstrapSSH   = "ssh"
+	bootstrapWinRM = "winrm"
+	bootstrapGraph = "graph"
+
+	defaultWinRMPort      = 5985
+	defaultWinRMHTTPSPort = 5986
+)
+
+// installSSHKeyScript makes sure the Win32-OpenSSH server is installed and
+// running, then installs the machine key where sshd looks for it: members of
+// Administrators use the shared administrators_authorized_keys file. $write
+// is Set-Content, or Add-Content to keep the keys already on the node.
+const installSSHKeyScript = `$ErrorActionPreference = 'Stop'
+$user = '%s'
+$key = '%s'
+$write = '%s'
+if (-not (Get-Service sshd -ErrorAction SilentlyContinue)) {
+	Add-WindowsCapability -Online -Name OpenSSH.Server~~~~0.0.1.0 | Out-Null
+}
+Set-Service -Name sshd -StartupType Automatic
+Start-Service sshd
+if (-not (Get-NetFirewallRule -Name 'OpenSSH-Server-In-TCP' -ErrorAction SilentlyContinue)) {
+	New-NetFirewallRule -Name 'OpenSSH-Server-In-TCP' -DisplayName 'OpenSSH Server (sshd)' -Enabled True -Direction Inbound -Protocol TCP -Action Allow -LocalPort %d | Out-Null
+}
+$admins = Get-LocalGroupMember -SID S-1-5-32-544 | ForEach-Object { $_.Name.Split('\')[-1] }
+if ($admins -contains $user) {
+	$file = Join-Path $env:ProgramData 'ssh\administrators_authorized_keys'
+	& $write -Path $file -Value $key -Encoding ascii
+	icacls $file /inheritance:r /grant 'Administrators:F' /grant 'SYSTEM:F' | Out-Null
+} else {
+	$dir = Join-Path (Join-Path $env:SystemDrive 'Users') (Join-Path $user '.ssh')
+	New-Item -ItemType Directory -Force -Path $dir | Out-Null
+	$file = Join-Path $dir 'authorized_keys'
+	& $write -Path $file -Value $key -Encoding ascii
+	icacls $file /inheritance:r /grant "${user}:F" /grant 'SYSTEM:F' | Out-Null
+}
+`
+
+// bootstrapPort is the port probed when choosing which of the node's
+// addresses to bootstrap through.
+func (d *Driver) bootstrapPort() int {
+	if d.BootstrapMethod == bootstrapWinRM {
+		return d.WinRMPort
+	}
+	return d.SSHPort
+}
+
+// installSSHKeyWinRM is the Windows Server counterpart of installSSHKey. It
+// uses WinRM with the bootstrap credentials so docker-machine can manage the
+// host over OpenSSH afterwards.
+func (d *Driver) installSSHKeyWinRM() error {
+	write := "Set-Content"
+	if d.Adopt {
+		write = "Add-Content"
+	}
+	script := fmt.Sprintf(installSSHKeyScript, psEscape(d.SSHUser), psEscape(d.SSHKey), write, d.SSHPort)
+	return executeWinRMCommand(winrm.Powershell(script), d)
+}
+
+// execute command over WinRM with user / password authentication
+func executeWinRMCommand(command string, d *Driver) error {
+	sshLog.Debugf("Execute executeWinRMCommand on %s:%d", d.IPAddress, d.WinRMPort)
+	defer d.track(timingSSH, time.Now())
+
+	endpoint := winrm.NewEndpoint(d.IPAddress, d.WinRMPort, d.WinRMHTTPS, d.WinRMInsecure, nil, nil, nil, d.sshCommandTimeout())
+	client, err := winrm.NewClient(endpoint, d.bootstrapUser(), d.SSHPassword)
+	if err != nil {
+		return fmt.Errorf("Unable to create WinRM client for %s. Error: %s", d.IPAddress, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	done := make(chan struct{})
+	var exitCode int
+	go func() {
+		exitCode, err = client.Run(command, &stdout, &stderr)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(d.sshCommandTimeout()):
+		return fmt.Errorf("WinRM command did not complete within %s on %s", d.sshCommandTimeout(), d.IPAddress)
+	case <-d.context().Done():
+		return fmt.Errorf("WinRM command on %s was stopped. Error: %s", d.IPAddress, d.context().Err())
+	}
+	if err != nil {
+		return fmt.Errorf("WinRM command failed on %s. Error: %s", d.IPAddress, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("WinRM command failed on %s with exit status %d: %s", d.IPAddress, exitCode, strings.TrimSpace(stderr.String()))
+	}
+	sshLog.Debugf("Stdout from executeWinRMCommand: %s", stdout.String())
+	return nil
+}
+
+// psEscape escapes s for use inside a single-quoted PowerShell string.
+func psEscape(s string) string {
+	return strings.Replace(s, "'", "''", -1)
+}
@@ -0,0 +1,192 @@
+package rackhd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWorkflowTimeout = 60
+
+	powerOnGraph         = "Graph.PowerOn.Node"
+	powerOffGraph        = "Graph.PowerOff.Node"
+	powerWorkflowTimeout = 5 * time.Minute
+	workflowPollInterval = 10 * time.Second
+)
+
+// workflowInstance is the subset of a RackHD graph instance the driver reads.
+type workflowInstance struct {
+	InstanceID string `json:"instanceId"`
+	Name       string `json:"injectableName"`
+	Status     string `json:"_status"`
+}
+
+// runWorkflow starts the named graph on the node and waits for it to finish,
+// returning the graph instance ID.
+func (d *Driver) runWorkflow(name string, options interface{}, timeout time.Duration) (string, error) {
+	defer d.track(timingWorkflow, time.Now())
+
+	instanceID, err := d.startWorkflow(name, options)
+	if err != nil {
+		return "", err
+	}
+	return instanceID, d.waitForWorkflow(name, instanceID, timeout)
+}
+
+// startWorkflow starts the named graph on the node without waiting for it.
+func (d *Driver) startWorkflow(name string, options interface{}) (string, error) {
+	body := map[string]interface{}{"name": name}
+	if options != nil {
+		body["options"] = options
+	}
+	workflowLog.Debugf("Starting workflow %s on node %s", name, d.NodeID)
+	payload, err := d.getClient().StartWorkflow(d.context(), d.NodeID, name, body)
+	if err != nil {
+		return "", fmt.Errorf("Unable to start workflow %s on node %s. Error: %s", name, d.NodeID, apiError(err))
+	}
+
+	wf, err := d.adapter().workflow(payload)
+	if err != nil {
+		return "", err
+	}
+	if wf.InstanceID == "" {
+		return "", fmt.Errorf("RackHD did not return an instance ID for workflow %s", name)
+	}
+	workflowLog.Debugf("Workflow %s started with instance ID %s", name, wf.InstanceID)
+	d.workflowRuns = append(d.workflowRuns, workflowRun{Name: name, InstanceID: wf.InstanceID})
+	return wf.InstanceID, nil
+}
+
+// cancelActiveWorkflow cancels the graph currently running on the node, if any.
+func (d *Driver) cancelActiveWorkflow() error {
+	active, err := d.activeWorkflow()
+	if err != nil || active == nil {
+		return err
+	}
+
+	workflowLog.Infof("Cancelling active workflow %s (%s) on node %s", active.Name, active.InstanceID, d.NodeID)
+	if err := d.getClient().CancelActiveWorkflow(d.context(), d.NodeID); err != nil {
+		return fmt.Errorf("Unable to cancel workflow %s on node %s. Error: %s", active.InstanceID, d.NodeID, apiError(err))
+	}
+	return nil
+}
+
+// activeWorkflow returns the graph currently running on the node, or nil.
+func (d *Driver) activeWorkflow() (*workflowInstance, error) {
+	return d.nodeActiveWorkflow(d.NodeID)
+}
+
+// nodeActiveWorkflow is activeWorkflow for any node, such as a selection
+// candidate.
+func (d *Driver) nodeActiveWorkflow(nodeID string) (*workflowInstance, error) {
+	payload, err := d.getClient().GetActiveWorkflow(d.context(), nodeID)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to get the active workflow of node %s. Error: %s", nodeID, apiError(err))
+	}
+	active, err := d.adapter().workflow(payload)
+	if err != nil || active.InstanceID == "" {
+		return nil, nil
+	}
+	return active, nil
+}
+
+// waitForWorkflow polls a graph instance until it reaches a final state. The
+// final graph document, with the state and errors of every task, is kept in
+// the machine store for post-mortem debugging.
+func (d *Driver) waitForWorkflow(name, instanceID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		payload, err := d.getClient().GetWorkflow(d.context(), instanceID)
+		if err != nil {
+			return fmt.Errorf("Unable to get the status of workflow %s (%s). Error: %s", name, instanceID, apiError(err))
+		}
+		wf, err := d.adapter().workflow(payload)
+		if err != nil {
+			return err
+		}
+
+		switch wf.Status {
+		case "succeeded":
+			d.saveWorkflow(name, instanceID, payload)
+			return nil
+		case "failed", "cancelled", "timeout":
+			path := d.saveWorkflow(name, instanceID, payload)
+			return classError(ErrWorkflowFailed, "Workflow %s (%s) on node %s finished with status %s. Task details: %s", name, instanceID, d.NodeID, wf.Status, path)
+		}
+
+		if time.Now().After(deadline) {
+			path := d.saveWorkflow(name, instanceID, payload)
+			return classError(ErrWorkflowFailed, "Workflow %s (%s) on node %s did not finish within %s. Task details: %s", name, instanceID, d.NodeID, timeout, path)
+		}
+		workflowLog.Debugf("Workflow %s (%s) status: %s", name, instanceID, wf.Status)
+		if err := d.awaitEvent(d.pollInterval(workflowPollInterval), graphFinished(name, instanceID)); err != nil {
+			return fmt.Errorf("Stopped waiting for workflow %s (%s) on node %s, it is still running. Error: %w", name, instanceID, d.NodeID, err)
+		}
+	}
+}
+
+// saveWorkflow writes a graph instance document into the machine store and
+// returns its path. Failing to save is logged and otherwise ignored.
+func (d *Driver) saveWorkflow(name, instanceID string, graph interface{}) string {
+	var doc interface{}
+	if err := decodePayload(graph, &doc); err == nil {
+		graph = redactPasswords(doc)
+	}
+	path, err := d.writeStoreJSON(fmt.Sprintf("workflow-%s-%s.json", name, instanceID), graph)
+	if err != nil {
+		workflowLog.Warnf("Unable to save workflow %s (%s) to the machine store: %s", name, instanceID, err)
+		return ""
+	}
+	workflowLog.Debugf("Saved workflow %s (%s) to %s", name, instanceID, path)
+	return path
+}
+
+// redactPasswords returns a copy of a JSON document with the values of its
+// password fields hidden, such as the BMC password in the options of the OBM
+// setup graph.
+func redactPasswords(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if _, ok := value.(string); ok && strings.Contains(strings.ToLower(key), "password") {
+				redacted[key] = "xxxxx"
+			} else {
+				redacted[key] = redactPasswords(value)
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, value := range v {
+			redacted[i] = redactPasswords(value)
+		}
+		return redacted
+	}
+	return v
+}
+
+// workflowOptions parses the --rackhd-workflow-options JSON document.
+func (d *Driver) workflowOptions() (interface{}, error) {
+	if d.WorkflowOptions == "" {
+		return nil, nil
+	}
+	var options interface{}
+	if err := json.Unmarshal([]byte(d.WorkflowOptions), &options); err != nil {
+		return nil, fmt.Errorf("--rackhd-workflow-options is not valid JSON. Error: %s", err)
+	}
+	return options, nil
+}
+
+func (d *Driver) workflowTimeout() time.Duration {
+	if d.WorkflowTimeout <= 0 {
+		return defaultWorkflowTimeout * time.Minute
+	}
+	return time.Duration(d.WorkflowTimeout) * time.Minute
+}